@@ -1,9 +1,12 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
 	"os"
+	"strconv"
 	"syscall"
 )
 
@@ -204,4 +207,75 @@ func (b *BTree) SearchFromDisk(key byte) (*FindResult,error) {
 	tmpResult.Value = node.Value[site]
 	tmpResult.Founded = true
 	return tmpResult,nil
-}
\ No newline at end of file
+}
+
+// DataPage : a data node read back from a file written by FsyncAll,for tools reading the file without the tree.
+type DataPage struct {
+	Offset uint64
+	Pre uint64
+	Next uint64
+	Keys []byte
+	Values []string
+}
+
+// ReadDataPages : read every page of fileName in offset order,the empty pages are skipped.
+func ReadDataPages(fileName string) ([]*DataPage,error) {
+	TmpFile,err := os.Open(fileName)
+	if err != nil {
+		return nil,err
+	}
+	defer TmpFile.Close()
+	var pages []*DataPage
+	data := make([]byte,pageSize)
+	for offset := int64(0) ; ; offset += pageSize {
+		n,err1 := TmpFile.ReadAt(data,offset)
+		if err1 != nil && err1 != io.EOF {
+			return nil,err1
+		}
+		if n == 0 {
+			return pages,nil
+		}
+		//a page is json padded with zero
+		page := bytes.TrimRight(data[:n],"\x00")
+		if len(page) != 0 {
+			node := new(diskNode)
+			if err2 := json.Unmarshal(page,node) ; err2 != nil {
+				return nil,errors.New("read error: broken page at offset "+strconv.FormatInt(offset,10))
+			}
+			tmp := &DataPage{Offset: uint64(offset),Pre: node.Pre,Next: node.Next}
+			for i := 1 ; i <= int(node.KeyNum) && i < len(node.Key) && i < len(node.Value) ; i++ {
+				tmp.Keys = append(tmp.Keys,node.Key[i])
+				tmp.Values = append(tmp.Values,node.Value[i])
+			}
+			pages = append(pages,tmp)
+		}
+		if err1 == io.EOF {
+			return pages,nil
+		}
+	}
+}
+
+// IsDataFile : check the first page of fileName is a node written by FsyncAll,a json object padded with zero.
+func IsDataFile(fileName string) (bool,error) {
+	TmpFile,err := os.Open(fileName)
+	if err != nil {
+		return false,err
+	}
+	defer TmpFile.Close()
+	data := make([]byte,pageSize)
+	n,err1 := TmpFile.ReadAt(data,0)
+	if err1 != nil && err1 != io.EOF {
+		return false,err1
+	}
+	page := bytes.TrimRight(data[:n],"\x00")
+	fields := make(map[string]json.RawMessage)
+	if len(page) == 0 || json.Unmarshal(page,&fields) != nil {
+		return false,nil
+	}
+	for _,name := range []string{"KeyNum","Key","Value","CurrentOffset","ChildrenOffset"} {
+		if _,ok := fields[name] ; !ok {
+			return false,nil
+		}
+	}
+	return true,nil
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// arena hand out the nodes,towers,entries and key value bytes of a skip list
+// from large blocks,so an insert allocate nothing in most cases and the GC
+// track a few big objects instead of several small ones per entry.
+// An arena is used by the single writer of its skip list,readers only read
+// memory published by the writer.
+
+const (
+	arenaBlockSize = 65536 // bytes of a key value block
+	arenaNodeNum   = 1024  // nodes of a node block
+	bigValueSize   = arenaBlockSize / 4
+)
+
+var (
+	nodeSize    = int64(unsafe.Sizeof(listNode{}))
+	entrySize   = int64(unsafe.Sizeof(memEntry{}))
+	pointerSize = int64(unsafe.Sizeof(unsafe.Pointer(nil)))
+)
+
+type arena struct {
+	nodes   []listNode
+	towers  []unsafe.Pointer
+	entries []memEntry
+	buf     []byte
+	size    int64 // atomic,bytes handed out
+}
+
+func (a *arena) newNode(height uint8) *listNode {
+	if len(a.nodes) == 0 {
+		a.nodes = make([]listNode, arenaNodeNum)
+	}
+	node := &a.nodes[0]
+	a.nodes = a.nodes[1:]
+	if len(a.towers) < int(height) {
+		a.towers = make([]unsafe.Pointer, arenaNodeNum*2)
+	}
+	node.height = height
+	node.next = a.towers[:height:height]
+	a.towers = a.towers[height:]
+	atomic.AddInt64(&a.size, nodeSize+int64(height)*pointerSize)
+	return node
+}
+
+func (a *arena) newEntry(key, value []byte, keyType byte, seq uint64) *memEntry {
+	if len(a.entries) == 0 {
+		a.entries = make([]memEntry, arenaNodeNum)
+	}
+	e := &a.entries[0]
+	a.entries = a.entries[1:]
+	e.keyLen = len(key) + 1
+	e.key = key
+	e.keyType = keyType
+	e.seq = seq
+	e.valueLen = len(value)
+	e.value = a.copyBytes(value)
+	atomic.AddInt64(&a.size, entrySize)
+	return e
+}
+
+// copyBytes copy b into the current block,a big slice get its own allocation.
+func (a *arena) copyBytes(b []byte) []byte {
+	atomic.AddInt64(&a.size, int64(len(b)))
+	if len(b) > bigValueSize {
+		return append([]byte(nil), b...)
+	}
+	if cap(a.buf)-len(a.buf) < len(b) {
+		a.buf = make([]byte, 0, arenaBlockSize)
+	}
+	start := len(a.buf)
+	a.buf = append(a.buf, b...)
+	return a.buf[start:len(a.buf):len(a.buf)]
+}
+
+// memoryUsage return the bytes of nodes,towers,entries,keys and values.
+func (a *arena) memoryUsage() int64 {
+	return atomic.LoadInt64(&a.size)
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+// A failed flush,compaction or write ahead log write put the database into the
+// background error state:reads go on but every write and background job return
+// the error,so no write is lost behind a broken flush or a torn log.Resume
+// leave the state once the cause is fixed if the error is an I/O error like a
+// fulled disk,a corrupted file is not recoverable.
+
+// checkWritable return the error a write get,it must be called with lsm.mu held.
+func (lsm *LSMTree) checkWritable() error {
+	if lsm.closed {
+		return ErrClosed
+	}
+	if lsm.dbOpts.ReadOnly {
+		return ErrReadOnly
+	}
+	return lsm.bgErr
+}
+
+// setBackgroundError must be called with lsm.mu held,only the first error is
+// kept until Resume.
+func (lsm *LSMTree) setBackgroundError(err error, reason string) {
+	if lsm.bgErr != nil || err == ErrClosed {
+		return
+	}
+	lsm.bgErr, lsm.bgErrReason = err, reason
+	lsm.bgCond.Broadcast()
+	info := BackgroundErrorInfo{Reason: reason, Err: err}
+	if reason != ReasonWriteAheadLog {
+		info.ColumnFamily = lsm.family.name
+	}
+	lsm.queueEvent(func(listener EventListener) {
+		listener.OnBackgroundError(info)
+	})
+}
+
+// recoverable report whether err is an I/O error,which may be gone once its
+// cause is fixed.
+func recoverable(err error) bool {
+	var pathErr *os.PathError
+	var syscallErr *os.SyscallError
+	return errors.As(err, &pathErr) || errors.As(err, &syscallErr)
+}
+
+// BackgroundError return the error the database stopped writes for,nil if it is writable.
+func (lsm *LSMTree) BackgroundError() error {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	return lsm.bgErr
+}
+
+// Resume clear a recoverable background error and reschedule the flushes and
+// compactions,an unrecoverable one is returned.After a write ahead log error
+// the log is truncated at the last record written whole,so a torn record is not
+// replayed,and the writes go to a new log.
+func (lsm *LSMTree) Resume() error {
+	defer lsm.deliverEvents()
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	if lsm.closed {
+		return ErrClosed
+	}
+	if lsm.bgErr == nil {
+		return nil
+	}
+	if !recoverable(lsm.bgErr) {
+		return lsm.bgErr
+	}
+	if lsm.bgErrReason == ReasonWriteAheadLog {
+		oldLog := lsm.writeAheadLog
+		if err := os.Truncate(lsm.logFileName(oldLog.num), oldLog.size); err != nil {
+			return err
+		}
+		newLog, err := lsm.newLogWriter()
+		if err != nil {
+			return err
+		}
+		oldLog.close()
+		lsm.writeAheadLog = newLog
+	}
+	// a failed flush or compaction may have left the MANIFEST behind the levels
+	if err := lsm.saveManifest(); err != nil {
+		return err
+	}
+	lsm.bgErr, lsm.bgErrReason = nil, ""
+	for _, family := range lsm.families {
+		if family.imm != nil {
+			lsm.scheduler.scheduleFlush(family)
+		}
+	}
+	lsm.maybeScheduleCompaction()
+	lsm.bgCond.Broadcast()
+	return nil
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal(what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBackgroundFlushError(t *testing.T) {
+	listener := new(testEventListener)
+	lsmTree := makeValueLogTestLSMTree(t, t.TempDir(), &Options{EventListener: listener})
+	defer lsmTree.Close()
+	lsmTree.scheduler.start(lsmTree, 1, 1)
+	putKeys(t, lsmTree, 0, 100)
+	// a directory in the way of the SSTable fail the flush
+	lsmTree.mu.Lock()
+	blocked := lsmTree.tableFileName(lsmTree.nextFileNum + 1)
+	if err := os.Mkdir(blocked, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.rotateMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	lsmTree.scheduler.scheduleFlush(lsmTree)
+	lsmTree.mu.Unlock()
+	waitFor(t, "Failed flush does not set the background error.", func() bool {
+		return lsmTree.BackgroundError() != nil
+	})
+	bgErr := lsmTree.BackgroundError()
+	batch := new(WriteBatch)
+	batch.Put(testKey(200), testKey(200))
+	if err := lsmTree.Write(batch); err != bgErr {
+		t.Fatal("Write succeed after the background error.", err)
+	}
+	checkEvents(t, listener.take(), "error flush")
+	checkFound(t, lsmTree, 50, true)
+	// the flush is retried once the directory is gone
+	if err := os.Remove(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "Resume does not flush the immutable table.", func() bool {
+		lsmTree.mu.Lock()
+		defer lsmTree.mu.Unlock()
+		return lsmTree.imm == nil && len(lsmTree.levels[0]) == 1
+	})
+	if err := lsmTree.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	checkFound(t, lsmTree, 200, true)
+	// a corrupted file is not recoverable
+	corrupted := errors.New("sstable: block checksum mismatch")
+	lsmTree.mu.Lock()
+	lsmTree.setBackgroundError(corrupted, ReasonCompaction)
+	lsmTree.mu.Unlock()
+	if err := lsmTree.Resume(); err != corrupted {
+		t.Fatal("Resume clear an unrecoverable error.", err)
+	}
+}
+
+func TestBackgroundWALError(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree := makeValueLogTestLSMTree(t, dir, nil)
+	putKeys(t, lsmTree, 0, 100)
+	lsmTree.mu.Lock()
+	oldLog := lsmTree.writeAheadLog
+	oldLog.file.Close()
+	lsmTree.mu.Unlock()
+	batch := new(WriteBatch)
+	batch.Put(testKey(100), testKey(100))
+	if err := lsmTree.Write(batch); err == nil {
+		t.Fatal("Write to a closed log succeed.")
+	}
+	if err := lsmTree.Write(batch); err == nil || err != lsmTree.BackgroundError() {
+		t.Fatal("Write after the log error does not return it.", err)
+	}
+	// the failed write left a torn record behind
+	file, err := os.OpenFile(lsmTree.logFileName(oldLog.num), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{1, 2, 3, 4, 3, 0, 0, 0, 'b', 'a', 'd'})
+	file.Close()
+	if err := lsmTree.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if lsmTree.writeAheadLog == oldLog {
+		t.Fatal("Resume keep writing the failed log.")
+	}
+	putKeys(t, lsmTree, 100, 200)
+	if err := lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// both logs are replayed
+	lsmTree = makeValueLogTestLSMTree(t, dir, nil)
+	defer lsmTree.Close()
+	for i := 0; i < 200; i += 7 {
+		checkFound(t, lsmTree, i, true)
+	}
+}
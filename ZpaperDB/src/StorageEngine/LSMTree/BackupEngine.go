@@ -0,0 +1,397 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A BackupEngine keep backups of a database in its directory:
+// shared/<file>_<size>_<crc32c>: the SSTables and value logs,shared by the backups
+// private/<id>/: the MANIFEST and write ahead logs of the backup id
+// meta/<id>: the files of the backup id,written last so a backup without it is
+// incomplete and ignored.
+// A backup is a checkpoint of the database in a temp directory of the database
+// directory,so its files are hard linked and stay while they are copied.The
+// checkpoint is removed once the backup end,or by the next open of the
+// database if the backup was interrupted.An
+// SSTable or value log is never rewritten under its number,but a restored
+// database reuse the numbers,so only the files whose name,size and checksum are
+// not in shared/ yet are copied.A restore check the checksum of every file.
+// backup meta layout: timestamp(8 bytes) | file num(4 bytes) | files
+// file layout: shared(1 byte) | size(8 bytes) | checksum(4 bytes) | name(varint len)
+
+const backupCheckpointName = "BACKUP.tmp"
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+type BackupEngine struct {
+	mu  sync.Mutex
+	dir string
+}
+
+type BackupInfo struct {
+	ID        uint32
+	Timestamp time.Time
+	Size      int64
+	NumFiles  int
+}
+
+type backupFile struct {
+	name     string
+	size     int64
+	checksum uint32 // crc32c of the content
+	shared   bool
+}
+
+type backupMeta struct {
+	timestamp time.Time
+	files     []backupFile
+}
+
+// OpenBackupEngine open the backups saved in dir,dir is created if it does not exist.
+func OpenBackupEngine(dir string) (*BackupEngine, error) {
+	for _, sub := range []string{"shared", "private", "meta"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &BackupEngine{dir: dir}, nil
+}
+
+func (be *BackupEngine) sharedFileName(f backupFile) string {
+	return filepath.Join(be.dir, "shared", f.name+"_"+strconv.FormatInt(f.size, 10)+"_"+strconv.FormatUint(uint64(f.checksum), 10))
+}
+
+func (be *BackupEngine) privateDir(id uint32) string {
+	return filepath.Join(be.dir, "private", strconv.FormatUint(uint64(id), 10))
+}
+
+func (be *BackupEngine) metaFileName(id uint32) string {
+	return filepath.Join(be.dir, "meta", strconv.FormatUint(uint64(id), 10))
+}
+
+func (m *backupMeta) encode() []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	data := make([]byte, 12, 12+len(m.files)*32)
+	binary.LittleEndian.PutUint64(data, uint64(m.timestamp.UnixNano()))
+	binary.LittleEndian.PutUint32(data[8:], uint32(len(m.files)))
+	for _, f := range m.files {
+		if f.shared {
+			data = append(data, 1)
+		} else {
+			data = append(data, 0)
+		}
+		binary.LittleEndian.PutUint64(tmp[:], uint64(f.size))
+		data = append(data, tmp[:8]...)
+		binary.LittleEndian.PutUint32(tmp[:], f.checksum)
+		data = append(data, tmp[:4]...)
+		n := binary.PutUvarint(tmp[:], uint64(len(f.name)))
+		data = append(data, tmp[:n]...)
+		data = append(data, f.name...)
+	}
+	return data
+}
+
+func decodeBackupMeta(data []byte) (*backupMeta, error) {
+	if len(data) < 12 {
+		return nil, errors.New("backup: meta too short")
+	}
+	m := &backupMeta{timestamp: time.Unix(0, int64(binary.LittleEndian.Uint64(data)))}
+	fileNum := binary.LittleEndian.Uint32(data[8:])
+	data = data[12:]
+	for i := uint32(0); i < fileNum; i++ {
+		if len(data) < 13 {
+			return nil, errors.New("backup: bad meta file")
+		}
+		f := backupFile{shared: data[0] == 1, size: int64(binary.LittleEndian.Uint64(data[1:]))}
+		f.checksum = binary.LittleEndian.Uint32(data[9:])
+		name, rest, ok := readLengthPrefixed(data[13:])
+		if !ok {
+			return nil, errors.New("backup: bad meta file")
+		}
+		f.name, data = string(name), rest
+		m.files = append(m.files, f)
+	}
+	return m, nil
+}
+
+func (be *BackupEngine) readMeta(id uint32) (*backupMeta, error) {
+	file, err := os.Open(be.metaFileName(id))
+	if os.IsNotExist(err) {
+		return nil, errors.New("backup: no backup " + strconv.FormatUint(uint64(id), 10))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := makeLogReader(file).readRecord()
+	if err == io.EOF {
+		return nil, errors.New("backup: empty meta")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeBackupMeta(data)
+}
+
+// backupIDs return the ids of the complete backups in order.
+func (be *BackupEngine) backupIDs() ([]uint32, error) {
+	entries, err := os.ReadDir(filepath.Join(be.dir, "meta"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for _, e := range entries {
+		id, err := strconv.ParseUint(e.Name(), 10, 32)
+		if err == nil {
+			ids = append(ids, uint32(id))
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// CreateNewBackup back up the database of lsm while it keep taking writes.
+func (be *BackupEngine) CreateNewBackup(lsm *LSMTree) (BackupInfo, error) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	ids, err := be.backupIDs()
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	id := uint32(1)
+	if len(ids) > 0 {
+		id = ids[len(ids)-1] + 1
+	}
+	checkpoint := filepath.Join(lsm.dir, backupCheckpointName)
+	if err = os.RemoveAll(checkpoint); err != nil {
+		return BackupInfo{}, err
+	}
+	if err = lsm.Checkpoint(checkpoint); err != nil {
+		return BackupInfo{}, err
+	}
+	defer os.RemoveAll(checkpoint)
+	private := be.privateDir(id)
+	if err = os.RemoveAll(private); err != nil {
+		return BackupInfo{}, err
+	}
+	if err = os.Mkdir(private, 0755); err != nil {
+		return BackupInfo{}, err
+	}
+	entries, err := os.ReadDir(checkpoint)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	meta := &backupMeta{timestamp: time.Now()}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return BackupInfo{}, err
+		}
+		f := backupFile{name: e.Name(), size: info.Size()}
+		f.shared = f.name != manifestName && !strings.HasPrefix(f.name, "WAL")
+		src := filepath.Join(checkpoint, f.name)
+		if f.checksum, err = fileChecksum(src); err != nil {
+			return BackupInfo{}, err
+		}
+		if f.shared {
+			err = be.copyShared(src, be.sharedFileName(f))
+		} else {
+			err = copyFile(src, filepath.Join(private, f.name))
+		}
+		if err != nil {
+			return BackupInfo{}, err
+		}
+		meta.files = append(meta.files, f)
+	}
+	if err = writeRecordFile(be.metaFileName(id), meta.encode()); err != nil {
+		return BackupInfo{}, err
+	}
+	return meta.info(id), nil
+}
+
+// copyShared copy src into shared/ unless an earlier backup did.
+func (be *BackupEngine) copyShared(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	if err := copyFile(src, dst+".tmp"); err != nil {
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
+
+// fileChecksum return the crc32c of the content of name.
+func fileChecksum(name string) (uint32, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	hash := crc32.New(castagnoliTable)
+	if _, err = io.Copy(hash, file); err != nil {
+		return 0, err
+	}
+	return hash.Sum32(), nil
+}
+
+func (m *backupMeta) info(id uint32) BackupInfo {
+	info := BackupInfo{ID: id, Timestamp: m.timestamp, NumFiles: len(m.files)}
+	for _, f := range m.files {
+		info.Size += f.size
+	}
+	return info
+}
+
+// GetBackupInfo return the backups in creation order.
+func (be *BackupEngine) GetBackupInfo() ([]BackupInfo, error) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	ids, err := be.backupIDs()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]BackupInfo, 0, len(ids))
+	for _, id := range ids {
+		meta, err := be.readMeta(id)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, meta.info(id))
+	}
+	return infos, nil
+}
+
+// RestoreDBFromBackup write the database of the backup id into dir,which must
+// not hold a database.A copied file whose checksum differ from the backup is
+// an error.
+func (be *BackupEngine) RestoreDBFromBackup(id uint32, dir string) error {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	meta, err := be.readMeta(id)
+	if err != nil {
+		return err
+	}
+	if m, err := readManifest(dir); err != nil || m != nil {
+		if err == nil {
+			err = errors.New("backup: " + dir + " holds a database")
+		}
+		return err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, f := range meta.files {
+		src := filepath.Join(be.privateDir(id), f.name)
+		if f.shared {
+			src = be.sharedFileName(f)
+		}
+		dst := filepath.Join(dir, f.name)
+		if err = copyFile(src, dst); err != nil {
+			return err
+		}
+		checksum, err := fileChecksum(dst)
+		if err != nil {
+			return err
+		}
+		if checksum != f.checksum {
+			return errors.New("backup: checksum mismatch of " + f.name)
+		}
+	}
+	return nil
+}
+
+// RestoreDBFromLatestBackup restore the newest backup into dir.
+func (be *BackupEngine) RestoreDBFromLatestBackup(dir string) error {
+	be.mu.Lock()
+	ids, err := be.backupIDs()
+	be.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return errors.New("backup: no backup")
+	}
+	return be.RestoreDBFromBackup(ids[len(ids)-1], dir)
+}
+
+// DeleteBackup remove the backup id and the shared files no other backup use.
+func (be *BackupEngine) DeleteBackup(id uint32) error {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if _, err := be.readMeta(id); err != nil {
+		return err
+	}
+	return be.deleteBackup(id)
+}
+
+// PurgeOldBackups delete the oldest backups until keep are left.
+func (be *BackupEngine) PurgeOldBackups(keep int) error {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	ids, err := be.backupIDs()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(ids)-keep; i++ {
+		if err = be.deleteBackup(ids[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteBackup must be called with be.mu held.
+func (be *BackupEngine) deleteBackup(id uint32) error {
+	if err := os.Remove(be.metaFileName(id)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(be.privateDir(id)); err != nil {
+		return err
+	}
+	return be.removeUnusedShared()
+}
+
+// removeUnusedShared remove the shared files no backup use,and the temp files
+// of a failed backup.
+func (be *BackupEngine) removeUnusedShared() error {
+	ids, err := be.backupIDs()
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, id := range ids {
+		meta, err := be.readMeta(id)
+		if err != nil {
+			return err
+		}
+		for _, f := range meta.files {
+			if f.shared {
+				used[be.sharedFileName(f)] = true
+			}
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(be.dir, "shared"))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := filepath.Join(be.dir, "shared", e.Name())
+		if used[name] {
+			continue
+		}
+		if err = os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
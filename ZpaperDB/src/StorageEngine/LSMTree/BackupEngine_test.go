@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupEngine(t *testing.T) {
+	lsmTree := makeValueLogTestLSMTree(t, t.TempDir(), nil)
+	defer lsmTree.Close()
+	be, err := OpenBackupEngine(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, lsmTree, 0, 100)
+	first, err := be.CreateNewBackup(lsmTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, lsmTree, 100, 200)
+	second, err := be.CreateNewBackup(lsmTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != 1 || second.ID != 2 || second.Size <= first.Size {
+		t.Fatalf("Backups %+v %+v", first, second)
+	}
+	// the second backup copy only the SSTable flushed after the first
+	shared, _ := os.ReadDir(filepath.Join(be.dir, "shared"))
+	if len(shared) != 2 {
+		t.Fatalf("%d shared files,want 2", len(shared))
+	}
+	if _, err = os.Stat(filepath.Join(lsmTree.dir, backupCheckpointName)); !os.IsNotExist(err) {
+		t.Fatal("Backup leave its checkpoint.")
+	}
+	restored := t.TempDir()
+	if err = be.RestoreDBFromBackup(1, restored); err != nil {
+		t.Fatal(err)
+	}
+	if err = be.RestoreDBFromBackup(1, restored); err == nil {
+		t.Fatal("Backup is restored over a database.")
+	}
+	db, err := OpenLSMTree(restored, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFound(t, db, 99, true)
+	checkFound(t, db, 100, false)
+	db.Close()
+	// the files of the second backup stay once the first is deleted
+	if err = be.DeleteBackup(1); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := be.GetBackupInfo()
+	if err != nil || len(infos) != 1 || infos[0].ID != 2 {
+		t.Fatalf("Backups %+v after delete %v", infos, err)
+	}
+	restored = t.TempDir()
+	if err = be.RestoreDBFromLatestBackup(restored); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenLSMTree(restored, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 200; i += 7 {
+		checkFound(t, db, i, true)
+	}
+	if err = be.PurgeOldBackups(0); err != nil {
+		t.Fatal(err)
+	}
+	if shared, _ = os.ReadDir(filepath.Join(be.dir, "shared")); len(shared) != 0 {
+		t.Fatal("Purged backups leave shared files.")
+	}
+}
+
+func TestBackupCheckpointLeftover(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree := makeValueLogTestLSMTree(t, dir, nil)
+	putKeys(t, lsmTree, 0, 10)
+	if err := lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the checkpoint of a backup interrupted by a crash
+	checkpoint := filepath.Join(dir, backupCheckpointName)
+	if err := os.Mkdir(checkpoint, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(checkpoint, manifestName), []byte("torn"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lsmTree = makeValueLogTestLSMTree(t, dir, nil)
+	defer lsmTree.Close()
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Fatal("Open leave the checkpoint of an interrupted backup.", err)
+	}
+	checkFound(t, lsmTree, 5, true)
+}
+
+func TestBackupSameNameAndSize(t *testing.T) {
+	be, err := OpenBackupEngine(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two databases whose SSTable has the same number and size,like a database
+	// restored from a backup and written again
+	for _, value := range []string{"a", "b"} {
+		lsmTree, err := OpenLSMTree(t.TempDir(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = lsmTree.Put(&WriteArgs{Key: []byte("key"), Value: []byte(value)}, new(WriteReply)); err != nil {
+			t.Fatal(err)
+		}
+		if err = lsmTree.minorCompaction(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = be.CreateNewBackup(lsmTree); err != nil {
+			t.Fatal(err)
+		}
+		lsmTree.Close()
+	}
+	restored := t.TempDir()
+	if err = be.RestoreDBFromBackup(2, restored); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenLSMTree(restored, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := db.Get([]byte("key"))
+	db.Close()
+	if err != nil || string(value) != "b" {
+		t.Fatalf("Get = %q,%v,want b", value, err)
+	}
+	// a damaged shared file is not restored
+	shared, _ := os.ReadDir(filepath.Join(be.dir, "shared"))
+	for _, e := range shared {
+		if err = os.WriteFile(filepath.Join(be.dir, "shared", e.Name()), []byte("damaged"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = be.RestoreDBFromBackup(1, t.TempDir()); err == nil {
+		t.Fatal("Damaged backup is restored.")
+	}
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// A checkpoint is a directory which open as a standalone database with the keys
+// written before it.The memory tables are flushed first,then with lsm.mu held
+// the SSTables and value logs of the current version are hard linked,they are
+// never written again,and the write ahead logs the column families have not
+// flushed are copied,as the current one is still written.Holding lsm.mu pin
+// the version:a compaction remove its inputs only after it install its outputs
+// under lsm.mu.The MANIFEST of the checkpoint is written from the same version.
+
+// Checkpoint write a checkpoint of the database into dir,which must not exist.
+func (lsm *LSMTree) Checkpoint(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return errors.New("checkpoint: " + dir + " exists")
+	}
+	lsm.mu.Lock()
+	if lsm.closed {
+		lsm.mu.Unlock()
+		return ErrClosed
+	}
+	readOnly := lsm.dbOpts.ReadOnly
+	families := lsm.columnFamilies()
+	lsm.mu.Unlock()
+	if !readOnly {
+		for _, family := range families {
+			lsm.mu.Lock()
+			flush := !family.dropped && (family.table.entries > 0 || family.imm != nil)
+			lsm.mu.Unlock()
+			if !flush {
+				continue
+			}
+			if err := family.minorCompaction(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	err := lsm.linkLiveFiles(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	return err
+}
+
+func (lsm *LSMTree) linkLiveFiles(dir string) error {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	if lsm.closed {
+		return ErrClosed
+	}
+	for _, family := range lsm.families {
+		for _, files := range family.levels {
+			for _, meta := range files {
+				name := lsm.tableFileName(meta.fileNum)
+				if err := linkOrCopyFile(name, filepath.Join(dir, filepath.Base(name))); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for num := range lsm.liveValueLogs() {
+		name := lsm.values.fileName(num)
+		if err := linkOrCopyFile(name, filepath.Join(dir, filepath.Base(name))); err != nil {
+			return err
+		}
+	}
+	nums, err := logFiles(lsm.dir)
+	if err != nil {
+		return err
+	}
+	logNum := lsm.minLogNum()
+	for _, num := range nums {
+		if num < logNum {
+			continue
+		}
+		name := lsm.logFileName(num)
+		if err = copyFile(name, filepath.Join(dir, filepath.Base(name))); err != nil {
+			return err
+		}
+	}
+	return writeManifest(dir, lsm.currentManifest())
+}
+
+// linkOrCopyFile hard link src to dst,or copy it if they are on different file systems.
+func linkOrCopyFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+// copyFile copy src to dst and sync it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
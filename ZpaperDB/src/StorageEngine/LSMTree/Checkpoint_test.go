@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree := makeValueLogTestLSMTree(t, dir, &Options{ValueLogThreshold: 64})
+	defer lsmTree.Close()
+	cf, err := lsmTree.CreateColumnFamily("other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, lsmTree, 0, 100)
+	if err = lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	putLargeValues(t, lsmTree, 100, 150, "a")
+	putKeysCF(t, lsmTree, cf, 0, 50)
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	if err = lsmTree.Checkpoint(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	if err = lsmTree.Checkpoint(checkpoint); err == nil {
+		t.Fatal("Checkpoint overwrite a directory.")
+	}
+	// the SSTables are linked,not copied
+	flushed := lsmTree.levels[0][0].fileNum
+	src, _ := os.Stat(lsmTree.tableFileName(flushed))
+	dst, err := os.Stat(filepath.Join(checkpoint, filepath.Base(lsmTree.tableFileName(flushed))))
+	if err != nil || !os.SameFile(src, dst) {
+		t.Fatal("SSTable is not linked into the checkpoint.", err)
+	}
+	// the checkpoint do not see the writes after it
+	putKeys(t, lsmTree, 200, 250)
+	opened, err := OpenLSMTree(checkpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer opened.Close()
+	for i := 0; i < 100; i += 7 {
+		checkFound(t, opened, i, true)
+	}
+	for i := 100; i < 150; i += 7 {
+		if value, err := opened.Get(testKey(i)); err != nil || string(value) != string(largeValue(i, "a")) {
+			t.Fatalf("key %d value %q %v", i, value, err)
+		}
+	}
+	checkFoundCF(t, opened, opened.ColumnFamily("other"), 49, true)
+	checkFound(t, opened, 200, false)
+}
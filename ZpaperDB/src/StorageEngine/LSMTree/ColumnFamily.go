@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+)
+
+// Column families split the keys of one database into keyspaces,every family
+// has its own memory tables,levels and options.The families share the write
+// ahead log,the MANIFEST and the sequence,so a WriteBatch spanning families is
+// applied atomically.The default column family is the LSMTree itself,it can not
+// be dropped.Ids are never reused,the operations of a dropped family left in the
+// write ahead log are skipped by the replay.
+
+const DefaultColumnFamilyName = "default"
+
+var ErrColumnFamilyNotFound = errors.New("zpaperdb: column family not found")
+
+// ColumnFamilyHandle name a column family of the database.
+type ColumnFamilyHandle struct {
+	id   uint32
+	name string
+}
+
+func (h *ColumnFamilyHandle) ID() uint32 {
+	return h.id
+}
+
+func (h *ColumnFamilyHandle) Name() string {
+	return h.name
+}
+
+// OpenColumnFamilies open the LSMTree saved in dir like OpenLSMTree,familyOpts
+// give the options of its column families by name.A family missing from
+// familyOpts use opts.
+func OpenColumnFamilies(dir string, opts *Options, familyOpts map[string]*Options) (*LSMTree, error) {
+	var lsmTree *LSMTree
+	lsmTree, err := lsmTree.initLSMTree(opts)
+	if err != nil {
+		return nil, err
+	}
+	lsmTree.familyOpts = familyOpts
+	err = lsmTree.open(dir)
+	if err != nil {
+		lsmTree.closeFiles()
+		return nil, err
+	}
+	lsmTree.deliverEvents()
+	if !lsmTree.opts.ReadOnly {
+		lsmTree.BeginCompaction()
+	}
+	return lsmTree, nil
+}
+
+// CreateColumnFamily create the column family name,a nil opts use the options
+// given to OpenColumnFamilies for name or the options of the database.The
+// options which belong to the whole database,like ReadOnly and the write stall
+// triggers,are always the database's.
+func (lsm *LSMTree) CreateColumnFamily(name string, opts *Options) (*ColumnFamilyHandle, error) {
+	if name == "" {
+		return nil, errors.New("zpaperdb: empty column family name")
+	}
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	if err := lsm.checkWritable(); err != nil {
+		return nil, err
+	}
+	if lsm.findColumnFamily(name) != nil {
+		return nil, errors.New("zpaperdb: column family " + name + " exists")
+	}
+	if opts == nil {
+		opts = lsm.familyOpts[name]
+	}
+	opts, err := opts.columnFamilyOptions(lsm.dbOpts)
+	if err != nil {
+		return nil, err
+	}
+	family, err := lsm.initColumnFamily(lsm.nextFamilyID, name, opts)
+	if err != nil {
+		return nil, err
+	}
+	lsm.nextFamilyID++
+	family.table.logNum = lsm.writeAheadLog.num
+	if err = lsm.saveManifest(); err != nil {
+		delete(lsm.families, family.family.id)
+		return nil, err
+	}
+	return family.family, nil
+}
+
+// DropColumnFamily remove the column family,its SSTables and value logs once the
+// MANIFEST forget it,reads of the family running meanwhile finish on the files
+// they pinned.
+func (lsm *LSMTree) DropColumnFamily(cf *ColumnFamilyHandle) error {
+	if cf.id == 0 {
+		return errors.New("zpaperdb: can not drop the default column family")
+	}
+	defer lsm.deliverEvents()
+	lsm.bgMu.RLock()
+	defer lsm.bgMu.RUnlock()
+	lsm.mu.Lock()
+	family := lsm.families[cf.id]
+	lsm.mu.Unlock()
+	if family != nil {
+		// wait for the running flush and compaction of the family
+		family.compactMu.Lock()
+		defer family.compactMu.Unlock()
+		family.flushMu.Lock()
+		defer family.flushMu.Unlock()
+	}
+	lsm.mu.Lock()
+	if err := lsm.checkWritable(); err != nil {
+		lsm.mu.Unlock()
+		return err
+	}
+	if family == nil || lsm.families[cf.id] != family {
+		lsm.mu.Unlock()
+		return ErrColumnFamilyNotFound
+	}
+	delete(lsm.families, cf.id)
+	if err := lsm.saveManifest(); err != nil {
+		lsm.families[cf.id] = family
+		lsm.mu.Unlock()
+		return err
+	}
+	family.dropped = true
+	lsm.versionChanged()
+	lsm.mu.Unlock()
+	for level, files := range family.levels {
+		family.removeTables(files, level, ReasonDropColumnFamily)
+	}
+	if err := lsm.removeObsoleteLogs(); err != nil {
+		return err
+	}
+	return lsm.removeObsoleteValueLogs()
+}
+
+// ListColumnFamilies return the names of the column families in creation order.
+func (lsm *LSMTree) ListColumnFamilies() []string {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	families := lsm.columnFamilies()
+	names := make([]string, len(families))
+	for i, family := range families {
+		names[i] = family.family.name
+	}
+	return names
+}
+
+// ColumnFamily return the handle of the column family name,nil if there is none.
+func (lsm *LSMTree) ColumnFamily(name string) *ColumnFamilyHandle {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	if family := lsm.findColumnFamily(name); family != nil {
+		return family.family
+	}
+	return nil
+}
+
+func (lsm *LSMTree) DefaultColumnFamily() *ColumnFamilyHandle {
+	return lsm.family
+}
+
+// findColumnFamily must be called with lsm.mu held.
+func (lsm *LSMTree) findColumnFamily(name string) *LSMTree {
+	for _, family := range lsm.families {
+		if family.family.name == name {
+			return family
+		}
+	}
+	return nil
+}
+
+// columnFamilies return the column families ordered by id,it must be called
+// with lsm.mu held.
+func (lsm *LSMTree) columnFamilies() []*LSMTree {
+	families := make([]*LSMTree, 0, len(lsm.families))
+	for _, family := range lsm.families {
+		families = append(families, family)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].family.id < families[j].family.id
+	})
+	return families
+}
+
+func (lsm *LSMTree) columnFamily(cf *ColumnFamilyHandle) (*LSMTree, error) {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	family := lsm.families[cf.id]
+	if family == nil {
+		return nil, ErrColumnFamilyNotFound
+	}
+	return family, nil
+}
+
+func (lsm *LSMTree) PutCF(cf *ColumnFamilyHandle, key, value []byte) error {
+	batch := new(WriteBatch)
+	batch.PutCF(cf, key, value)
+	return lsm.write(batch)
+}
+
+// GetCF return ErrNotFound if key is absent or deleted in the column family.
+func (lsm *LSMTree) GetCF(cf *ColumnFamilyHandle, key []byte) ([]byte, error) {
+	family, err := lsm.columnFamily(cf)
+	if err != nil {
+		return nil, err
+	}
+	return family.Get(key)
+}
+
+func (lsm *LSMTree) DeleteCF(cf *ColumnFamilyHandle, key []byte) error {
+	batch := new(WriteBatch)
+	batch.DeleteCF(cf, key)
+	return lsm.write(batch)
+}
+
+func (lsm *LSMTree) MergeCF(cf *ColumnFamilyHandle, key, operand []byte) error {
+	batch := new(WriteBatch)
+	batch.MergeCF(cf, key, operand)
+	return lsm.write(batch)
+}
+
+// NewIteratorCF iterate the visible keys of the column family like NewIterator.
+func (lsm *LSMTree) NewIteratorCF(cf *ColumnFamilyHandle) *DBIterator {
+	family, err := lsm.columnFamily(cf)
+	if err != nil {
+		return &DBIterator{err: err}
+	}
+	return family.NewIterator()
+}
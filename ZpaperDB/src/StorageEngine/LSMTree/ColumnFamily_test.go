@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func checkFoundCF(t *testing.T, lsmTree *LSMTree, cf *ColumnFamilyHandle, i int, want bool) {
+	value, err := lsmTree.GetCF(cf, testKey(i))
+	if want && (err != nil || !bytes.Equal(value, testKey(i))) {
+		t.Fatalf("%s key %d is not found %v", cf.Name(), i, err)
+	}
+	if !want && err != ErrNotFound {
+		t.Fatalf("%s key %d found,want ErrNotFound %v", cf.Name(), i, err)
+	}
+}
+
+func putKeysCF(t *testing.T, lsmTree *LSMTree, cf *ColumnFamilyHandle, from, to int) {
+	for i := from; i < to; i++ {
+		if err := lsmTree.PutCF(cf, testKey(i), testKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestColumnFamily(t *testing.T) {
+	lsmTree := makeTestLSMTree(t)
+	blobs, err := lsmTree.CreateColumnFamily("blobs", &Options{MemTableType: "vector", SnappyCompression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lsmTree.CreateColumnFamily("blobs", nil); err == nil {
+		t.Fatal("Column family is created twice.")
+	}
+	if names := lsmTree.ListColumnFamilies(); !reflect.DeepEqual(names, []string{"default", "blobs"}) {
+		t.Fatalf("Column families %v,want default and blobs", names)
+	}
+	if lsmTree.ColumnFamily("blobs") != blobs || lsmTree.ColumnFamily("missing") != nil {
+		t.Fatal("ColumnFamily return a wrong handle.")
+	}
+	family, _ := lsmTree.columnFamily(blobs)
+	if family.memType != "vector" || family.snappy != 0x1 || lsmTree.snappy != 0x0 {
+		t.Fatal("Column family does not use its own options.")
+	}
+	putKeys(t, lsmTree, 0, 10)
+	putKeysCF(t, lsmTree, blobs, 5, 15)
+	checkFound(t, lsmTree, 12, false)
+	checkFoundCF(t, lsmTree, blobs, 2, false)
+	checkFoundCF(t, lsmTree, blobs, 12, true)
+	if err = family.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if len(family.levels[0]) != 1 || len(lsmTree.levels[0]) != 0 {
+		t.Fatal("Flush of a column family write the other families.")
+	}
+	if err = lsmTree.DeleteCF(blobs, testKey(12)); err != nil {
+		t.Fatal(err)
+	}
+	checkFoundCF(t, lsmTree, blobs, 12, false)
+	checkFoundCF(t, lsmTree, blobs, 13, true)
+	it := lsmTree.NewIteratorCF(blobs)
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		n++
+	}
+	if n != 9 {
+		t.Fatalf("Column family iterator return %d keys,want 9", n)
+	}
+	if err = lsmTree.DropColumnFamily(lsmTree.DefaultColumnFamily()); err == nil {
+		t.Fatal("Default column family is dropped.")
+	}
+	if err = lsmTree.DropColumnFamily(blobs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lsmTree.GetCF(blobs, testKey(13)); err != ErrColumnFamilyNotFound {
+		t.Fatal("Dropped column family is read.", err)
+	}
+	if err = lsmTree.PutCF(blobs, testKey(1), testKey(1)); err != ErrColumnFamilyNotFound {
+		t.Fatal("Dropped column family is written.", err)
+	}
+	if names := lsmTree.ListColumnFamilies(); len(names) != 1 {
+		t.Fatalf("Column families %v after drop", names)
+	}
+	checkFound(t, lsmTree, 5, true)
+}
+
+// TestColumnFamilyAtomicBatch write a batch spanning families,a batch with a
+// dropped family must be rejected as a whole.
+func TestColumnFamilyAtomicBatch(t *testing.T) {
+	lsmTree := makeTestLSMTree(t)
+	meta, _ := lsmTree.CreateColumnFamily("meta", nil)
+	index, _ := lsmTree.CreateColumnFamily("index", nil)
+	batch := new(WriteBatch)
+	batch.Put(testKey(1), testKey(1))
+	batch.PutCF(meta, testKey(2), testKey(2))
+	batch.PutCF(index, testKey(3), testKey(3))
+	if err := lsmTree.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	checkFound(t, lsmTree, 1, true)
+	checkFoundCF(t, lsmTree, meta, 2, true)
+	checkFoundCF(t, lsmTree, index, 3, true)
+	if err := lsmTree.DropColumnFamily(index); err != nil {
+		t.Fatal(err)
+	}
+	seq := lsmTree.seq
+	batch.Reset()
+	batch.PutCF(meta, testKey(4), testKey(4))
+	batch.PutCF(index, testKey(5), testKey(5))
+	if err := lsmTree.Write(batch); err != ErrColumnFamilyNotFound {
+		t.Fatal("Batch writing a dropped column family is accepted.", err)
+	}
+	checkFoundCF(t, lsmTree, meta, 4, false)
+	if lsmTree.seq != seq {
+		t.Fatal("Rejected batch consume sequence numbers.")
+	}
+}
+
+func TestColumnFamilyReopen(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree, err := OpenLSMTree(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, _ := lsmTree.CreateColumnFamily("blobs", nil)
+	index, _ := lsmTree.CreateColumnFamily("index", nil)
+	putKeysCF(t, lsmTree, blobs, 0, 50)
+	family, _ := lsmTree.columnFamily(blobs)
+	if err = family.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	putKeysCF(t, lsmTree, blobs, 50, 100)
+	putKeysCF(t, lsmTree, index, 0, 10)
+	putKeys(t, lsmTree, 0, 10)
+	if err = lsmTree.DropColumnFamily(index); err != nil {
+		t.Fatal(err)
+	}
+	if err = lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsmTree, err = OpenColumnFamilies(dir, nil, map[string]*Options{"blobs": {MemTableType: "BTree"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmTree.Close()
+	if names := lsmTree.ListColumnFamilies(); !reflect.DeepEqual(names, []string{"default", "blobs"}) {
+		t.Fatalf("Recovered column families %v,want default and blobs", names)
+	}
+	blobs = lsmTree.ColumnFamily("blobs")
+	family, _ = lsmTree.columnFamily(blobs)
+	if family.memType != "BTree" {
+		t.Fatal("Recovered column family does not use the options given to open.")
+	}
+	checkFoundCF(t, lsmTree, blobs, 10, true)
+	checkFoundCF(t, lsmTree, blobs, 70, true)
+	checkFound(t, lsmTree, 5, true)
+	checkFound(t, lsmTree, 70, false)
+	// a new family never take the id of the dropped one
+	index, _ = lsmTree.CreateColumnFamily("index", nil)
+	if index.ID() != 3 {
+		t.Fatalf("Recreated column family id %d,want 3", index.ID())
+	}
+	checkFoundCF(t, lsmTree, index, 5, false)
+}
+
+// TestColumnFamilyLogs check that an idle column family does not keep the
+// write ahead logs flushed by the others.
+func TestColumnFamilyLogs(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree, err := OpenLSMTree(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmTree.Close()
+	idle, _ := lsmTree.CreateColumnFamily("idle", nil)
+	busy, _ := lsmTree.CreateColumnFamily("busy", nil)
+	if err = lsmTree.PutCF(busy, testKey(1), testKey(1)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		putKeys(t, lsmTree, i*10, i*10+10)
+		if err = lsmTree.minorCompaction(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// busy keep its log and the newer ones,idle keep none
+	nums, _ := logFiles(dir)
+	family, _ := lsmTree.columnFamily(busy)
+	if len(nums) != 4 || nums[0] != family.table.logNum {
+		t.Fatalf("Write ahead logs %v,want the ones from the log of busy", nums)
+	}
+	if err = family.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	nums, _ = logFiles(dir)
+	if len(nums) != 1 || nums[0] != lsmTree.writeAheadLog.num {
+		t.Fatalf("Write ahead logs %v,want only the current one", nums)
+	}
+	checkFoundCF(t, lsmTree, busy, 1, true)
+	checkFoundCF(t, lsmTree, idle, 1, false)
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+)
+
+// CompactRange and the compaction filter.A CompactionFilter see every value a
+// compaction write,a merge folded into a value included,and may keep,remove or
+// change it.A removed value become a tombstone unless the compaction is
+// bottommost,so the older versions below it do not come back.Flushes do not
+// run the filter.
+
+// CompactionDecision is what a CompactionFilter decide for a value.
+type CompactionDecision int
+
+const (
+	CompactionKeep CompactionDecision = iota
+	CompactionRemove
+	CompactionChange
+)
+
+// CompactionFilter is called by compaction for every value,level is the first
+// input level of the compaction.newValue replace the value if the decision is
+// CompactionChange.
+type CompactionFilter interface {
+	Name() string
+	Filter(level int, key, value []byte) (decision CompactionDecision, newValue []byte)
+}
+
+// CompactRange flush the memory table and compact every file overlapping
+// [start,end] as the compaction style decide,nil means unbounded.It return once
+// the files are compacted.The last level is rewritten in place only if there is
+// a compaction filter.
+func (lsm *LSMTree) CompactRange(start, end []byte) error {
+	if start != nil && end != nil && bytes.Compare(start, end) > 0 {
+		return errors.New("compact range: start must not be greater than end")
+	}
+	lsm.mu.Lock()
+	if err := lsm.checkWritable(); err != nil {
+		lsm.mu.Unlock()
+		return err
+	}
+	flush := lsm.table.entries > 0 || lsm.imm != nil
+	lsm.mu.Unlock()
+	if flush {
+		if err := lsm.minorCompaction(); err != nil {
+			return err
+		}
+	}
+	lsm.bgMu.RLock()
+	defer lsm.bgMu.RUnlock()
+	lsm.compactMu.Lock()
+	defer lsm.compactMu.Unlock()
+	lsm.mu.Lock()
+	firstNum := lsm.nextFileNum
+	lsm.mu.Unlock()
+	for level := 0; level < maxLevel; level++ {
+		lsm.mu.Lock()
+		if lsm.closed || lsm.dropped {
+			lsm.mu.Unlock()
+			return ErrClosed
+		}
+		if err := lsm.bgErr; err != nil {
+			lsm.mu.Unlock()
+			return err
+		}
+		cp := lsm.picker.compactRange(lsm.currentVersion(), level, start, end)
+		lsm.mu.Unlock()
+		if cp == nil {
+			continue
+		}
+		if cp.inPlace() {
+			// the files written by this CompactRange are filtered already
+			if lsm.opts.CompactionFilter == nil {
+				continue
+			}
+			var files []*fileMeta
+			for _, meta := range cp.inputFile[0] {
+				if meta.fileNum < firstNum {
+					files = append(files, meta)
+				}
+			}
+			if len(files) == 0 {
+				continue
+			}
+			cp.inputFile[0] = files
+		}
+		if err := lsm.majorCompress(cp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompactRangeCF compact [start,end] of the column family like CompactRange.
+func (lsm *LSMTree) CompactRangeCF(cf *ColumnFamilyHandle, start, end []byte) error {
+	family, err := lsm.columnFamily(cf)
+	if err != nil {
+		return err
+	}
+	return family.CompactRange(start, end)
+}
+
+// inPlace report whether cp rewrite the files of one level into the same level.
+func (cp *compaction) inPlace() bool {
+	return !cp.deletion && len(cp.inputLevel) == 1 && cp.inputLevel[0] == cp.outputLevel
+}
+
+// filterEntries run the compaction filter on the values of data.
+func (lsm *LSMTree) filterEntries(cp *compaction, data []pairs) ([]pairs, error) {
+	filter := lsm.opts.CompactionFilter
+	if filter == nil {
+		return data, nil
+	}
+	level := cp.inputLevel[0]
+	filtered := data[:0]
+	for i := range data {
+		entry := data[i]
+		seq, keyType := entry.trailer()
+		userKey := entry.userKey()
+		value := entry.value
+		switch keyType {
+		case typeValue:
+		case typeValueTTL:
+			value = value[expirySize:]
+		case typeValuePointer:
+			var err error
+			if value, err = lsm.values.read(userKey, value); err != nil {
+				return nil, err
+			}
+		default:
+			filtered = append(filtered, entry)
+			continue
+		}
+		decision, newValue := filter.Filter(level, userKey, value)
+		switch decision {
+		case CompactionRemove:
+			if cp.bottommost {
+				continue
+			}
+			entry.setEntry(userKey, nil, seq, typeDeletion)
+		case CompactionChange:
+			if keyType == typeValueTTL {
+				data := make([]byte, expirySize, expirySize+len(newValue))
+				copy(data, entry.value[:expirySize])
+				entry.setEntry(userKey, append(data, newValue...), seq, typeValueTTL)
+			} else {
+				entry.setEntry(userKey, newValue, seq, typeValue)
+			}
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered, nil
+}
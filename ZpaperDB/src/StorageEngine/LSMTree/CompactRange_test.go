@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testCompactionFilter remove the keys under 10 and change the keys under 20.
+type testCompactionFilter struct {
+	levels map[int]bool
+}
+
+func (f *testCompactionFilter) Name() string {
+	return "test"
+}
+
+func (f *testCompactionFilter) Filter(level int, key, value []byte) (CompactionDecision, []byte) {
+	f.levels[level] = true
+	switch {
+	case bytes.Compare(key, testKey(10)) < 0:
+		return CompactionRemove, nil
+	case bytes.Compare(key, testKey(20)) < 0:
+		return CompactionChange, append([]byte("changed/"), value...)
+	}
+	return CompactionKeep, nil
+}
+
+func countKeyTypes(t *testing.T, files []*fileMeta) map[byte]int {
+	count := make(map[byte]int)
+	for _, meta := range files {
+		data, err := meta.table.readAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range data {
+			_, keyType := data[i].trailer()
+			count[keyType]++
+		}
+	}
+	return count
+}
+
+func TestCompactRange(t *testing.T) {
+	lsmTree := makeValueLogTestLSMTree(t, t.TempDir(), &Options{MaxFileOfOneLevel: 10})
+	defer lsmTree.Close()
+	putKeys(t, lsmTree, 0, 100)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	batch := new(WriteBatch)
+	for i := 0; i < 10; i++ {
+		batch.Delete(testKey(i))
+	}
+	if err := lsmTree.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	// the deletions in the memory table are flushed and compacted with the keys
+	if err := lsmTree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(lsmTree.levels[0]) != 0 || lsmTree.table.entries != 0 || len(lsmTree.levels[1]) == 0 {
+		t.Fatal("CompactRange leave files in level0 or the memory table.")
+	}
+	if count := countKeyTypes(t, lsmTree.levels[1]); count[typeDeletion] != 0 || count[typeValue] != 90 {
+		t.Fatalf("Bottommost level hold %v,want 90 values and no deletion", count)
+	}
+	checkFound(t, lsmTree, 5, false)
+	checkFound(t, lsmTree, 50, true)
+	// a range outside every file compact nothing
+	files := lsmTree.levels[1]
+	if err := lsmTree.CompactRange([]byte("zzz"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(lsmTree.levels[1]) != len(files) || lsmTree.levels[1][0] != files[0] {
+		t.Fatal("CompactRange rewrite files outside the range.")
+	}
+	if err := lsmTree.CompactRange(testKey(5), testKey(1)); err == nil {
+		t.Fatal("Reversed range is accepted.")
+	}
+}
+
+func TestCompactionFilter(t *testing.T) {
+	filter := &testCompactionFilter{levels: make(map[int]bool)}
+	dir := t.TempDir()
+	lsmTree := makeValueLogTestLSMTree(t, dir, &Options{MaxFileOfOneLevel: 10, CompactionFilter: filter})
+	putKeys(t, lsmTree, 0, 50)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	// flushes do not filter
+	checkFound(t, lsmTree, 5, true)
+	if err := lsmTree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFound(t, lsmTree, 5, false)
+	checkString(t, lsmTree, testKey(15), "changed/"+string(testKey(15)))
+	checkFound(t, lsmTree, 30, true)
+	// the last level is rewritten in place,only the keys of the range are filtered again
+	filter.levels = make(map[int]bool)
+	if err := lsmTree.CompactRange(testKey(15), testKey(16)); err != nil {
+		t.Fatal(err)
+	}
+	if !filter.levels[1] || len(lsmTree.levels[0]) != 0 {
+		t.Fatal("The last level is not rewritten by the filter.")
+	}
+	checkString(t, lsmTree, testKey(15), "changed/changed/"+string(testKey(15)))
+	if err := lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsmTree = makeValueLogTestLSMTree(t, dir, nil)
+	defer lsmTree.Close()
+	checkFound(t, lsmTree, 5, false)
+	checkFound(t, lsmTree, 49, true)
+}
+
+func TestFilterEntries(t *testing.T) {
+	filter := &testCompactionFilter{levels: make(map[int]bool)}
+	lsmTree := makeValueLogTestLSMTree(t, t.TempDir(), &Options{CompactionFilter: filter})
+	defer lsmTree.Close()
+	expiry := make([]byte, expirySize)
+	expiry[0] = 7
+	data := make([]pairs, 4)
+	data[0].setEntry(testKey(1), []byte("v"), 10, typeValue)
+	data[1].setEntry(testKey(11), append(expiry, 'v'), 11, typeValueTTL)
+	data[2].setEntry(testKey(12), nil, 12, typeDeletion)
+	data[3].setEntry(testKey(30), []byte("v"), 13, typeValue)
+	// the removed key hide the older versions of the levels below
+	cp := &compaction{inputLevel: []int{2}, outputLevel: 3}
+	filtered, err := lsmTree.filterEntries(cp, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filtered) != 4 || !filter.levels[2] {
+		t.Fatalf("%d entries are left,want 4", len(filtered))
+	}
+	if seq, keyType := filtered[0].trailer(); seq != 10 || keyType != typeDeletion {
+		t.Fatal("Removed key is not a deletion of the same sequence.")
+	}
+	if _, keyType := filtered[1].trailer(); keyType != typeValueTTL || !bytes.Equal(filtered[1].value, append(expiry, "changed/v"...)) {
+		t.Fatalf("Changed TTL value %q lose its expiry", filtered[1].value)
+	}
+	if _, keyType := filtered[2].trailer(); keyType != typeDeletion {
+		t.Fatal("Deletion is filtered.")
+	}
+	data = data[:1]
+	data[0].setEntry(testKey(1), []byte("v"), 10, typeValue)
+	cp.bottommost = true
+	if filtered, err = lsmTree.filterEntries(cp, data); err != nil || len(filtered) != 0 {
+		t.Fatal("Removed key is kept by a bottommost compaction.", err)
+	}
+}
+
+func TestUniversalCompactRange(t *testing.T) {
+	filter := &testCompactionFilter{levels: make(map[int]bool)}
+	lsmTree := makeValueLogTestLSMTree(t, t.TempDir(), &Options{
+		CompactionStyle:   "universal",
+		ValueLogThreshold: 64,
+		CompactionFilter:  filter,
+	})
+	defer lsmTree.Close()
+	for _, gen := range []string{"a", "b", "c"} {
+		putLargeValues(t, lsmTree, 0, 30, gen)
+		if err := lsmTree.minorCompaction(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsmTree.CompactRange(nil, testKey(0)); err != nil {
+		t.Fatal(err)
+	}
+	if runs := len(sortedRuns(lsmTree.currentVersion())); runs != 1 {
+		t.Fatalf("Universal CompactRange leave %d sorted runs,want 1", runs)
+	}
+	checkFound(t, lsmTree, 5, false)
+	// the filter see the values saved in the value log
+	checkString(t, lsmTree, testKey(15), "changed/"+string(largeValue(15, "c")))
+	checkLargeValues(t, lsmTree, 20, 30, "c")
+}
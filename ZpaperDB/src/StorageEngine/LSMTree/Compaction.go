@@ -0,0 +1,393 @@
+package storage
+
+import (
+	"bytes"
+	"time"
+)
+
+// A CompactionPicker choose the compactions of a column family,Options.CompactionStyle
+// select one of them:
+// leveled: level0 is compacted into level1 once it has MaxFileOfOneLevel files,
+// a level larger than MaxBytesForLevelBase*LevelSizeMultiplier^(level-1) compact
+// one file after its compact pointer into the next level.
+// universal: every level0 file and every non empty level is a sorted run,newer
+// runs are in level0 or smaller levels.Once there are MaxFileOfOneLevel runs,
+// all of them are merged if the newer runs reach UniversalMaxSizeAmplificationPercent
+// of the oldest one,otherwise the newest runs whose size is within UniversalSizeRatio
+// percent of the runs before them,or at last the newest runs which bring the run
+// number under MaxFileOfOneLevel.The output take the place of the oldest input run.
+// fifo: the files stay in level0 and nothing is rewritten,the oldest files are
+// dropped while level0 is larger than FIFOMaxTableFilesSize or older than FIFOTTL.
+
+const universalMinMergeWidth = 2
+
+type CompactionPicker interface {
+	Name() string
+	// pickCompaction return nil if the column family need no compaction.
+	pickCompaction(v *version) *compaction
+	// pendingCompactionBytes estimate the bytes compaction must rewrite to catch up.
+	pendingCompactionBytes(v *version) int64
+	// stallFileNum return the number the level0 write stall triggers compare.
+	stallFileNum(v *version) int
+	// compactRange return the compaction of level for CompactRange,nil if
+	// nothing of [start,end] at level need to be rewritten.
+	compactRange(v *version, level int, start, end []byte) *compaction
+}
+
+// version is what a CompactionPicker see of a column family,its levels must
+// not be modified.
+type version struct {
+	levels         [][]*fileMeta
+	compactPointer [][]byte
+	maxFileNum     int
+	now            int64
+}
+
+type leveledPicker struct {
+	baseBytes  int64
+	multiplier int
+}
+
+type universalPicker struct {
+	sizeRatio            int
+	maxSizeAmplification int
+}
+
+type fifoPicker struct {
+	maxTableFilesSize int64
+	ttl               time.Duration
+}
+
+// sortedRun is a level0 file or a whole level of the universal style.
+type sortedRun struct {
+	level int
+	files []*fileMeta
+	size  int64
+}
+
+func makeCompactionPicker(opts *Options) CompactionPicker {
+	switch opts.CompactionStyle {
+	case "universal":
+		return universalPicker{
+			sizeRatio:            opts.UniversalSizeRatio,
+			maxSizeAmplification: opts.UniversalMaxSizeAmplificationPercent,
+		}
+	case "fifo":
+		return fifoPicker{maxTableFilesSize: opts.FIFOMaxTableFilesSize, ttl: opts.FIFOTTL}
+	}
+	return leveledPicker{baseBytes: opts.MaxBytesForLevelBase, multiplier: opts.LevelSizeMultiplier}
+}
+
+// currentVersion must be called with lsm.mu held.
+func (lsm *LSMTree) currentVersion() *version {
+	return &version{
+		levels:         lsm.levels,
+		compactPointer: lsm.compactPointer,
+		maxFileNum:     lsm.maxFileNum,
+		now:            lsm.now(),
+	}
+}
+
+func (p leveledPicker) Name() string {
+	return "leveled"
+}
+
+func (p leveledPicker) maxBytesForLevel(level int) int64 {
+	size := p.baseBytes
+	for i := 1; i < level; i++ {
+		size *= int64(p.multiplier)
+	}
+	return size
+}
+
+// pickCompaction choose level0 if it has maxFileNum files,otherwise the first
+// level larger than maxBytesForLevel.Level0 files may overlap,so all of them are
+// compacted together,other levels compact one file after the compact pointer.
+func (p leveledPicker) pickCompaction(v *version) *compaction {
+	if len(v.levels[0]) > 0 && len(v.levels[0]) >= v.maxFileNum {
+		return setupCompaction(v, 0, v.levels[0])
+	}
+	for level := 1; level < maxLevel-1; level++ {
+		if totalFileSize(v.levels[level]) <= p.maxBytesForLevel(level) {
+			continue
+		}
+		input := v.levels[level][0]
+		for _, meta := range v.levels[level] {
+			if bytes.Compare(meta.smallest, v.compactPointer[level]) > 0 {
+				input = meta
+				break
+			}
+		}
+		return setupCompaction(v, level, []*fileMeta{input})
+	}
+	return nil
+}
+
+func (p leveledPicker) pendingCompactionBytes(v *version) int64 {
+	var pending int64
+	if len(v.levels[0]) >= v.maxFileNum {
+		pending += totalFileSize(v.levels[0]) + totalFileSize(v.levels[1])
+	}
+	for level := 1; level < maxLevel-1; level++ {
+		excess := totalFileSize(v.levels[level]) - p.maxBytesForLevel(level)
+		if excess > 0 {
+			pending += excess * int64(p.multiplier+1)
+		}
+	}
+	return pending
+}
+
+func (p leveledPicker) stallFileNum(v *version) int {
+	return len(v.levels[0])
+}
+
+// compactRange move the files overlapping [start,end] down to the last non
+// empty level,whose files are rewritten in place.Every level0 file is moved
+// if one of them overlap,so no older level0 file is left above.
+func (p leveledPicker) compactRange(v *version, level int, start, end []byte) *compaction {
+	last := 0
+	for i := range v.levels {
+		if len(v.levels[i]) > 0 {
+			last = i
+		}
+	}
+	if level > last {
+		return nil
+	}
+	inputs := filesInRange(v.levels[level], start, end)
+	if len(inputs) == 0 {
+		return nil
+	}
+	if level == 0 {
+		inputs = v.levels[0]
+	}
+	if level < last || level == 0 {
+		return setupCompaction(v, level, inputs)
+	}
+	cp := new(compaction)
+	cp.curLevel = -1
+	cp.outputLevel = level
+	cp.maxFileNum = v.maxFileNum
+	cp.inputLevel = []int{level}
+	cp.inputFile = [][]*fileMeta{append([]*fileMeta(nil), inputs...)}
+	cp.bottommost = bottommost(v, cp)
+	return cp
+}
+
+// filesInRange return the files overlapping [start,end],nil means unbounded.
+func filesInRange(files []*fileMeta, start, end []byte) []*fileMeta {
+	result := make([]*fileMeta, 0, len(files))
+	for _, meta := range files {
+		if start != nil && bytes.Compare(meta.largest, start) < 0 {
+			continue
+		}
+		if end != nil && bytes.Compare(meta.smallest, end) > 0 {
+			continue
+		}
+		result = append(result, meta)
+	}
+	return result
+}
+
+// setupCompaction compact inputs of level with the overlapping files of the next level.
+func setupCompaction(v *version, level int, inputs []*fileMeta) *compaction {
+	cp := new(compaction)
+	cp.curLevel = level
+	cp.outputLevel = level + 1
+	cp.maxFileNum = v.maxFileNum
+	cp.inputLevel = []int{level, level + 1}
+	cp.inputFile = make([][]*fileMeta, 2)
+	cp.inputFile[0] = append([]*fileMeta(nil), inputs...)
+	smallest, largest := keyRangeOf(inputs)
+	cp.inputFile[1] = overlappingFiles(v.levels[level+1], smallest, largest)
+	cp.bottommost = bottommost(v, cp)
+	return cp
+}
+
+// bottommost report whether no file older than the inputs of cp overlap them,
+// the older files are the older level0 files and the levels below the inputs.
+func bottommost(v *version, cp *compaction) bool {
+	var inputs []*fileMeta
+	deepest := 0
+	oldestLevel0 := ^uint64(0)
+	for i, files := range cp.inputFile {
+		inputs = append(inputs, files...)
+		if cp.inputLevel[i] > deepest {
+			deepest = cp.inputLevel[i]
+		}
+		if cp.inputLevel[i] != 0 {
+			continue
+		}
+		for _, meta := range files {
+			if meta.fileNum < oldestLevel0 {
+				oldestLevel0 = meta.fileNum
+			}
+		}
+	}
+	older := make([]*fileMeta, 0)
+	if deepest == 0 {
+		for _, meta := range v.levels[0] {
+			if meta.fileNum < oldestLevel0 {
+				older = append(older, meta)
+			}
+		}
+	}
+	for level := deepest + 1; level < len(v.levels); level++ {
+		older = append(older, v.levels[level]...)
+	}
+	smallest, largest := keyRangeOf(inputs)
+	return len(overlappingFiles(older, smallest, largest)) == 0
+}
+
+func (p universalPicker) Name() string {
+	return "universal"
+}
+
+// sortedRuns return the sorted runs newest first.
+func sortedRuns(v *version) []sortedRun {
+	runs := make([]sortedRun, 0, len(v.levels[0])+len(v.levels))
+	for i := len(v.levels[0]) - 1; i >= 0; i-- {
+		meta := v.levels[0][i]
+		runs = append(runs, sortedRun{level: 0, files: []*fileMeta{meta}, size: meta.size})
+	}
+	for level := 1; level < len(v.levels); level++ {
+		if len(v.levels[level]) > 0 {
+			runs = append(runs, sortedRun{level: level, files: v.levels[level], size: totalFileSize(v.levels[level])})
+		}
+	}
+	return runs
+}
+
+func (p universalPicker) pickCompaction(v *version) *compaction {
+	runs := sortedRuns(v)
+	if len(runs) < universalMinMergeWidth || len(runs) < v.maxFileNum {
+		return nil
+	}
+	last := len(runs) - 1
+	var newer int64
+	for _, run := range runs[:last] {
+		newer += run.size
+	}
+	if newer*100 >= runs[last].size*int64(p.maxSizeAmplification) {
+		return setupUniversalCompaction(v, runs)
+	}
+	n, candidate := 1, runs[0].size
+	for n < len(runs) && runs[n].size*100 <= candidate*int64(100+p.sizeRatio) {
+		candidate += runs[n].size
+		n++
+	}
+	if n < universalMinMergeWidth {
+		n = len(runs) - v.maxFileNum + 1
+		if n < universalMinMergeWidth {
+			n = universalMinMergeWidth
+		}
+	}
+	return setupUniversalCompaction(v, runs[:n])
+}
+
+// setupUniversalCompaction merge the newest runs.The output replace the oldest
+// input run,the output of level0 runs go to the level above the next non empty
+// level,or stay in level0 if older level0 files remain.
+func setupUniversalCompaction(v *version, runs []sortedRun) *compaction {
+	cp := new(compaction)
+	cp.curLevel = -1
+	cp.maxFileNum = v.maxFileNum
+	var level0 []*fileMeta
+	for _, run := range runs {
+		if run.level == 0 {
+			level0 = append(level0, run.files...)
+			continue
+		}
+		cp.inputLevel = append(cp.inputLevel, run.level)
+		cp.inputFile = append(cp.inputFile, run.files)
+	}
+	if len(level0) > 0 {
+		cp.inputLevel = append([]int{0}, cp.inputLevel...)
+		cp.inputFile = append([][]*fileMeta{level0}, cp.inputFile...)
+	}
+	cp.outputLevel = runs[len(runs)-1].level
+	if cp.outputLevel == 0 && len(level0) == len(v.levels[0]) {
+		cp.outputLevel = len(v.levels) - 1
+		for level := 1; level < len(v.levels); level++ {
+			if len(v.levels[level]) > 0 {
+				cp.outputLevel = level - 1
+				break
+			}
+		}
+	}
+	cp.bottommost = bottommost(v, cp)
+	return cp
+}
+
+func (p universalPicker) pendingCompactionBytes(v *version) int64 {
+	runs := sortedRuns(v)
+	if len(runs) < universalMinMergeWidth || len(runs) < v.maxFileNum {
+		return 0
+	}
+	var pending int64
+	for _, run := range runs[:len(runs)-1] {
+		pending += run.size
+	}
+	return pending
+}
+
+func (p universalPicker) stallFileNum(v *version) int {
+	return len(sortedRuns(v))
+}
+
+// compactRange merge every sorted run into one if a run overlap [start,end].
+func (p universalPicker) compactRange(v *version, level int, start, end []byte) *compaction {
+	if level != 0 {
+		return nil
+	}
+	runs := sortedRuns(v)
+	for _, run := range runs {
+		if len(filesInRange(run.files, start, end)) > 0 {
+			return setupUniversalCompaction(v, runs)
+		}
+	}
+	return nil
+}
+
+func (p fifoPicker) Name() string {
+	return "fifo"
+}
+
+// pickCompaction drop the oldest level0 files while level0 is too large or they
+// are expired.
+func (p fifoPicker) pickCompaction(v *version) *compaction {
+	total := totalFileSize(v.levels[0])
+	var dropped []*fileMeta
+	for _, meta := range v.levels[0] {
+		expired := p.ttl > 0 && meta.createdAt+int64(p.ttl) <= v.now
+		if total <= p.maxTableFilesSize && !expired {
+			break
+		}
+		dropped = append(dropped, meta)
+		total -= meta.size
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	return &compaction{
+		curLevel:   -1,
+		maxFileNum: v.maxFileNum,
+		inputLevel: []int{0},
+		inputFile:  [][]*fileMeta{dropped},
+		deletion:   true,
+	}
+}
+
+func (p fifoPicker) pendingCompactionBytes(v *version) int64 {
+	return 0
+}
+
+// stallFileNum is 0,level0 of the fifo style only shrink by dropping files.
+func (p fifoPicker) stallFileNum(v *version) int {
+	return 0
+}
+
+// compactRange is nil,the fifo style never rewrite files.
+func (p fifoPicker) compactRange(v *version, level int, start, end []byte) *compaction {
+	return nil
+}
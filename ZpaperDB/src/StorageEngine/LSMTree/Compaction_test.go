@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func testFile(num uint64, size int64, smallest, largest string) *fileMeta {
+	return &fileMeta{fileNum: num, size: size, smallest: []byte(smallest), largest: []byte(largest)}
+}
+
+func makeTestVersion(maxFileNum int) *version {
+	return &version{
+		levels:         make([][]*fileMeta, maxLevel),
+		compactPointer: make([][]byte, maxLevel),
+		maxFileNum:     maxFileNum,
+	}
+}
+
+func checkInputs(t *testing.T, cp *compaction, levels []int, files [][]uint64) {
+	if cp == nil {
+		t.Fatal("No compaction is picked.")
+	}
+	if len(cp.inputLevel) != len(levels) {
+		t.Fatalf("Input levels %v,want %v", cp.inputLevel, levels)
+	}
+	for i := range levels {
+		if cp.inputLevel[i] != levels[i] || len(cp.inputFile[i]) != len(files[i]) {
+			t.Fatalf("Input %d is level %d with %d files,want level %d with %v", i, cp.inputLevel[i], len(cp.inputFile[i]), levels[i], files[i])
+		}
+		for j, meta := range cp.inputFile[i] {
+			if meta.fileNum != files[i][j] {
+				t.Fatalf("Input %d file %d is %d,want %d", i, j, meta.fileNum, files[i][j])
+			}
+		}
+	}
+}
+
+func TestLeveledPicker(t *testing.T) {
+	picker := leveledPicker{baseBytes: 100, multiplier: 10}
+	v := makeTestVersion(2)
+	v.levels[0] = []*fileMeta{testFile(5, 10, "b", "d"), testFile(6, 10, "c", "f")}
+	v.levels[1] = []*fileMeta{testFile(1, 10, "a", "a"), testFile(2, 10, "c", "e"), testFile(3, 10, "g", "h")}
+	v.levels[2] = []*fileMeta{testFile(4, 10, "f", "z")}
+	cp := picker.pickCompaction(v)
+	checkInputs(t, cp, []int{0, 1}, [][]uint64{{5, 6}, {2}})
+	if cp.outputLevel != 1 || cp.bottommost {
+		t.Fatal("Level0 compaction overlapping level2 is bottommost.")
+	}
+	v.levels[0] = nil
+	if cp = picker.pickCompaction(v); cp != nil {
+		t.Fatal("Compaction is picked under the level limits.")
+	}
+	// level1 is over its 100 bytes,the file after the compact pointer is picked
+	v.levels[1] = append(v.levels[1], testFile(7, 100, "i", "j"))
+	v.compactPointer[1] = []byte("e")
+	cp = picker.pickCompaction(v)
+	checkInputs(t, cp, []int{1, 2}, [][]uint64{{3}, {4}})
+	if !cp.bottommost || cp.curLevel != 1 {
+		t.Fatal("Compaction of the two last levels is not bottommost.")
+	}
+	if pending := picker.pendingCompactionBytes(v); pending != 30*11 {
+		t.Fatalf("Pending compaction bytes %d,want %d", pending, 30*11)
+	}
+}
+
+func TestUniversalPicker(t *testing.T) {
+	picker := universalPicker{sizeRatio: 1, maxSizeAmplification: 200}
+	v := makeTestVersion(3)
+	v.levels[0] = []*fileMeta{testFile(3, 10, "a", "z"), testFile(4, 10, "a", "z")}
+	if picker.pickCompaction(v) != nil {
+		t.Fatal("Compaction is picked under the sorted run trigger.")
+	}
+	// the two level0 runs of similar size are merged above level6
+	v.levels[6] = []*fileMeta{testFile(1, 50, "a", "m"), testFile(2, 50, "n", "z")}
+	cp := picker.pickCompaction(v)
+	checkInputs(t, cp, []int{0}, [][]uint64{{4, 3}})
+	if cp.outputLevel != 5 || cp.bottommost || cp.curLevel != -1 {
+		t.Fatalf("Level0 runs are merged into level %d,want 5", cp.outputLevel)
+	}
+	if picker.stallFileNum(v) != 3 || picker.pendingCompactionBytes(v) != 20 {
+		t.Fatal("Sorted runs are not counted.")
+	}
+	// runs of different size:the newest ones are merged to bring the number under the trigger
+	v.levels[0] = []*fileMeta{testFile(3, 50, "a", "z"), testFile(4, 10, "a", "z")}
+	v.levels[5] = []*fileMeta{testFile(5, 30, "a", "z")}
+	cp = picker.pickCompaction(v)
+	checkInputs(t, cp, []int{0}, [][]uint64{{4, 3}})
+	if cp.outputLevel != 4 {
+		t.Fatalf("Level0 runs are merged into level %d,want 4", cp.outputLevel)
+	}
+	// the newer runs reach 200% of the oldest one,all runs are merged
+	v.levels[6] = []*fileMeta{testFile(1, 20, "a", "z")}
+	cp = picker.pickCompaction(v)
+	checkInputs(t, cp, []int{0, 5, 6}, [][]uint64{{4, 3}, {5}, {1}})
+	if cp.outputLevel != 6 || !cp.bottommost {
+		t.Fatal("Full universal compaction is not bottommost into level6.")
+	}
+}
+
+func TestFIFOPicker(t *testing.T) {
+	picker := fifoPicker{maxTableFilesSize: 250}
+	v := makeTestVersion(2)
+	for i := 1; i <= 4; i++ {
+		v.levels[0] = append(v.levels[0], testFile(uint64(i), 100, "a", "z"))
+	}
+	cp := picker.pickCompaction(v)
+	checkInputs(t, cp, []int{0}, [][]uint64{{1, 2}})
+	if !cp.deletion {
+		t.Fatal("FIFO compaction rewrite files.")
+	}
+	if picker.stallFileNum(v) != 0 {
+		t.Fatal("FIFO level0 stall writes.")
+	}
+	picker = fifoPicker{maxTableFilesSize: 1000, ttl: time.Hour}
+	now := time.Now()
+	v.now = now.UnixNano()
+	for i, meta := range v.levels[0] {
+		meta.createdAt = now.Add(-time.Duration(4-i) * 25 * time.Minute).UnixNano()
+	}
+	cp = picker.pickCompaction(v)
+	checkInputs(t, cp, []int{0}, [][]uint64{{1, 2}})
+	v.levels[0] = v.levels[0][2:]
+	if picker.pickCompaction(v) != nil {
+		t.Fatal("Files younger than the FIFO TTL are dropped.")
+	}
+}
+
+func TestCompactionStyles(t *testing.T) {
+	for _, style := range []string{"leveled", "universal", "fifo"} {
+		dir := t.TempDir()
+		opts := &Options{CompactionStyle: style, MaxFileOfOneLevel: 3, FIFOMaxTableFilesSize: 8192}
+		lsmTree := makeValueLogTestLSMTree(t, dir, opts)
+		if lsmTree.picker.Name() != style {
+			t.Fatalf("Picker %s,want %s", lsmTree.picker.Name(), style)
+		}
+		for round := 0; round < 10; round++ {
+			putKeys(t, lsmTree, round*50, round*50+50)
+			// overwrite older keys,reads must find the newest run first
+			putKeys(t, lsmTree, 0, 5)
+			flushAndCompact(t, lsmTree)
+		}
+		switch style {
+		case "fifo":
+			if size := totalFileSize(lsmTree.levels[0]); size > 8192 {
+				t.Fatalf("FIFO level0 is %d bytes,over 8192", size)
+			}
+			checkFound(t, lsmTree, 100, false)
+			checkFound(t, lsmTree, 499, true)
+		default:
+			if runs := len(sortedRuns(lsmTree.currentVersion())); style == "universal" && runs >= 3 {
+				t.Fatalf("Universal compaction leave %d sorted runs", runs)
+			}
+			for i := 0; i < 500; i += 7 {
+				checkFound(t, lsmTree, i, true)
+			}
+		}
+		if err := lsmTree.Close(); err != nil {
+			t.Fatal(err)
+		}
+		lsmTree = makeValueLogTestLSMTree(t, dir, opts)
+		checkFound(t, lsmTree, 2, true)
+		checkFound(t, lsmTree, 499, true)
+		lsmTree.Close()
+	}
+	if _, err := (&Options{CompactionStyle: "tiered"}).resolve(); err == nil {
+		t.Fatal("Unknown compaction style is accepted.")
+	}
+}
@@ -0,0 +1,501 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+)
+
+// DBIterator iterate the visible keys of the LSMTree in order.It works on a
+// snapshot taken by NewIterator,later writes are not seen:the memory tables are
+// copied,they are bounded by MaxMemTableSize,and the SSTables are pinned until
+// Close and read one data block at a time.The versions of a key in every source
+// are resolved like get once the iterator stop on it.
+type DBIterator struct {
+	lsm       *LSMTree
+	sources   []internalIterator // newest first
+	files     []*fileMeta        // pinned until Close
+	rangeDels []rangeTombstone
+	now       int64
+	forward   bool
+	valid     bool
+	key       []byte
+	value     []byte
+	err       error
+}
+
+// internalIterator iterate the entries of a source in order,a source hold at
+// most one entry for every user key.
+type internalIterator interface {
+	valid() bool
+	seekToFirst()
+	seekToLast()
+	seek(key []byte)        // move to the first user key >= key
+	seekForPrev(key []byte) // move to the last user key <= key
+	next()
+	prev()
+	userKey() []byte
+	entry() *pairs
+	error() error
+}
+
+// sliceIterator iterate the sorted entries copied from a memory table.
+type sliceIterator struct {
+	data []pairs
+	pos  int
+}
+
+// tableIterator iterate the non-overlapping files of a level,or one file of
+// level 0,it hold the data block it is in only.
+type tableIterator struct {
+	files  []*fileMeta
+	file   int
+	block  int
+	keys   [][]byte
+	values [][]byte
+	pos    int
+	err    error
+}
+
+// NewIterator pin the SSTables and copy the memory tables into a snapshot.
+// The iterator is not positioned,call SeekToFirst,SeekToLast or Seek first.
+// Close release the files it pinned.
+func (lsm *LSMTree) NewIterator() *DBIterator {
+	it := &DBIterator{lsm: lsm}
+	lsm.mu.Lock()
+	if lsm.closed {
+		lsm.mu.Unlock()
+		it.err = ErrClosed
+		return it
+	}
+	if lsm.dropped {
+		lsm.mu.Unlock()
+		it.err = ErrColumnFamilyNotFound
+		return it
+	}
+	memTables := []*memTable{lsm.table}
+	if lsm.imm != nil {
+		memTables = append(memTables, lsm.imm)
+	}
+	it.files = lsm.pinFiles()
+	var tables []internalIterator
+	for i := len(lsm.levels[0]) - 1; i >= 0; i-- {
+		tables = append(tables, &tableIterator{files: []*fileMeta{lsm.levels[0][i]}})
+	}
+	for level := 1; level < len(lsm.levels); level++ {
+		if len(lsm.levels[level]) > 0 {
+			tables = append(tables, &tableIterator{files: append([]*fileMeta(nil), lsm.levels[level]...)})
+		}
+	}
+	lsm.mu.Unlock()
+	it.now = lsm.now()
+	for _, mt := range memTables {
+		it.sources = append(it.sources, &sliceIterator{data: *mt.str.export(), pos: -1})
+		mt.rwMu.RLock()
+		it.rangeDels = append(it.rangeDels, mt.rangeDels...)
+		mt.rwMu.RUnlock()
+	}
+	for _, meta := range it.files {
+		it.rangeDels = append(it.rangeDels, meta.table.rangeDels...)
+	}
+	it.sources = append(it.sources, tables...)
+	return it
+}
+
+func (it *DBIterator) Valid() bool {
+	return it.err == nil && it.valid
+}
+
+func (it *DBIterator) SeekToFirst() {
+	for _, src := range it.sources {
+		src.seekToFirst()
+	}
+	it.forward = true
+	it.findNext()
+}
+
+func (it *DBIterator) SeekToLast() {
+	for _, src := range it.sources {
+		src.seekToLast()
+	}
+	it.forward = false
+	it.findPrev()
+}
+
+// Seek move to the first key >= target.
+func (it *DBIterator) Seek(target []byte) {
+	for _, src := range it.sources {
+		src.seek(target)
+	}
+	it.forward = true
+	it.findNext()
+}
+
+// SeekForPrev move to the last key <= target.
+func (it *DBIterator) SeekForPrev(target []byte) {
+	for _, src := range it.sources {
+		src.seekForPrev(target)
+	}
+	it.forward = false
+	it.findPrev()
+}
+
+// Next move every source past the current key,the sources behind it are
+// positioned again after a Prev.
+func (it *DBIterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	key := it.key
+	for _, src := range it.sources {
+		if !it.forward {
+			src.seek(key)
+		}
+		if src.valid() && bytes.Equal(src.userKey(), key) {
+			src.next()
+		}
+	}
+	it.forward = true
+	it.findNext()
+}
+
+func (it *DBIterator) Prev() {
+	if !it.Valid() {
+		return
+	}
+	key := it.key
+	for _, src := range it.sources {
+		if it.forward {
+			src.seekForPrev(key)
+		}
+		if src.valid() && bytes.Equal(src.userKey(), key) {
+			src.prev()
+		}
+	}
+	it.forward = false
+	it.findPrev()
+}
+
+func (it *DBIterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.key
+}
+
+func (it *DBIterator) Value() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.value
+}
+
+func (it *DBIterator) Error() error {
+	return it.err
+}
+
+func (it *DBIterator) Close() error {
+	unpinFiles(it.files)
+	it.files = nil
+	it.sources = nil
+	it.valid = false
+	return it.err
+}
+
+// findNext stop on the smallest visible key of the sources,the sources at an
+// invisible key are moved past it.
+func (it *DBIterator) findNext() {
+	for it.sourceError() == nil {
+		key, ok := it.edgeKey(-1)
+		if !ok || it.resolve(key) {
+			return
+		}
+		for _, src := range it.sources {
+			if src.valid() && bytes.Equal(src.userKey(), key) {
+				src.next()
+			}
+		}
+	}
+}
+
+// findPrev stop on the largest visible key of the sources.
+func (it *DBIterator) findPrev() {
+	for it.sourceError() == nil {
+		key, ok := it.edgeKey(1)
+		if !ok || it.resolve(key) {
+			return
+		}
+		for _, src := range it.sources {
+			if src.valid() && bytes.Equal(src.userKey(), key) {
+				src.prev()
+			}
+		}
+	}
+}
+
+func (it *DBIterator) sourceError() error {
+	it.valid = false
+	for _, src := range it.sources {
+		if err := src.error(); err != nil && it.err == nil {
+			it.err = err
+		}
+	}
+	return it.err
+}
+
+// edgeKey return the smallest user key of the sources if dir is -1,the largest
+// if dir is 1.
+func (it *DBIterator) edgeKey(dir int) ([]byte, bool) {
+	var key []byte
+	found := false
+	for _, src := range it.sources {
+		if !src.valid() {
+			continue
+		}
+		if k := src.userKey(); !found || bytes.Compare(k, key) == dir {
+			key, found = k, true
+		}
+	}
+	return key, found
+}
+
+// resolve collect the versions of key newest first,it report whether key is
+// visible or an error stopped the iterator.
+func (it *DBIterator) resolve(key []byte) bool {
+	versions := make([]pairs, 0, len(it.sources))
+	for _, src := range it.sources {
+		if src.valid() && bytes.Equal(src.userKey(), key) {
+			versions = append(versions, *src.entry())
+		}
+	}
+	var rangeDelSeq uint64
+	for i := range it.rangeDels {
+		if it.rangeDels[i].seq > rangeDelSeq && it.rangeDels[i].covers(key) {
+			rangeDelSeq = it.rangeDels[i].seq
+		}
+	}
+	value, ok, err := it.lsm.resolveVersions(key, versions, rangeDelSeq, it.now)
+	if err != nil {
+		it.err = err
+		return true
+	}
+	if ok {
+		it.key, it.value, it.valid = key, value, true
+	}
+	return ok
+}
+
+// resolveVersions return the value of key from its versions newest first,like
+// get does with the versions it find.
+func (lsm *LSMTree) resolveVersions(key []byte, versions []pairs, rangeDelSeq uint64, now int64) ([]byte, bool, error) {
+	var lists [][]byte
+	for i := range versions {
+		seq, keyType := versions[i].trailer()
+		if keyType == typeMerge && seq >= rangeDelSeq {
+			lists = append(lists, versions[i].value)
+			continue
+		}
+		value := versions[i].value
+		if keyType == typeValuePointer && seq >= rangeDelSeq {
+			var err error
+			if value, err = lsm.values.read(key, value); err != nil {
+				return nil, false, err
+			}
+			keyType = typeValue
+		}
+		return lsm.resolveValue(key, value, keyType, seq, rangeDelSeq, now, lists)
+	}
+	if lists != nil {
+		return lsm.resolveValue(key, nil, typeDeletion, 0, rangeDelSeq, now, lists)
+	}
+	return nil, false, nil
+}
+
+func (s *sliceIterator) valid() bool {
+	return s.pos >= 0 && s.pos < len(s.data)
+}
+
+func (s *sliceIterator) seekToFirst() {
+	s.pos = 0
+}
+
+func (s *sliceIterator) seekToLast() {
+	s.pos = len(s.data) - 1
+}
+
+func (s *sliceIterator) seek(key []byte) {
+	s.pos = sort.Search(len(s.data), func(i int) bool {
+		return bytes.Compare(s.data[i].userKey(), key) >= 0
+	})
+}
+
+func (s *sliceIterator) seekForPrev(key []byte) {
+	s.pos = sort.Search(len(s.data), func(i int) bool {
+		return bytes.Compare(s.data[i].userKey(), key) > 0
+	}) - 1
+}
+
+func (s *sliceIterator) next() {
+	if s.pos < len(s.data) {
+		s.pos++
+	}
+}
+
+func (s *sliceIterator) prev() {
+	if s.pos >= 0 {
+		s.pos--
+	}
+}
+
+func (s *sliceIterator) userKey() []byte {
+	return s.data[s.pos].userKey()
+}
+
+func (s *sliceIterator) entry() *pairs {
+	return &s.data[s.pos]
+}
+
+func (s *sliceIterator) error() error {
+	return nil
+}
+
+func (t *tableIterator) valid() bool {
+	return t.err == nil && t.pos >= 0 && t.pos < len(t.keys)
+}
+
+func (t *tableIterator) table() *tableReader {
+	return t.files[t.file].table
+}
+
+// load read the data block of the current file,the position is invalid on an
+// error.
+func (t *tableIterator) load(file, block int) bool {
+	t.file, t.block, t.pos = file, block, -1
+	t.keys, t.values, t.err = t.table().readBlock(t.table().index[block].value)
+	return t.err == nil
+}
+
+// skipForward move to the first entry of the next blocks if the block is passed.
+func (t *tableIterator) skipForward() {
+	for t.err == nil && t.pos >= len(t.keys) {
+		switch {
+		case t.block+1 < len(t.table().index):
+			t.load(t.file, t.block+1)
+		case t.file+1 < len(t.files):
+			t.file++
+			t.block = -1
+			t.keys = nil
+			continue
+		default:
+			return
+		}
+		t.pos = 0
+	}
+}
+
+// skipBackward move to the last entry of the previous blocks if the block is passed.
+func (t *tableIterator) skipBackward() {
+	for t.err == nil && t.pos < 0 {
+		switch {
+		case t.block > 0:
+			t.load(t.file, t.block-1)
+		case t.file > 0:
+			t.file--
+			t.block = len(t.table().index)
+			t.keys = nil
+			continue
+		default:
+			return
+		}
+		t.pos = len(t.keys) - 1
+	}
+}
+
+func (t *tableIterator) seekToFirst() {
+	t.file, t.block, t.keys, t.pos, t.err = 0, -1, nil, 0, nil
+	t.skipForward()
+}
+
+func (t *tableIterator) seekToLast() {
+	t.file, t.keys, t.pos, t.err = len(t.files)-1, nil, -1, nil
+	t.block = len(t.table().index)
+	t.skipBackward()
+}
+
+func (t *tableIterator) seek(key []byte) {
+	t.err = nil
+	file := sort.Search(len(t.files), func(i int) bool {
+		return bytes.Compare(t.files[i].largest, key) >= 0
+	})
+	if file == len(t.files) {
+		t.file, t.keys, t.pos = len(t.files)-1, nil, 0
+		return
+	}
+	index := t.files[file].table.index
+	// the key can only be in the last block whose first key <= key
+	block := sort.Search(len(index), func(i int) bool {
+		return bytes.Compare(userKeyOf(index[i].key), key) > 0
+	}) - 1
+	if block < 0 {
+		block = 0
+	}
+	if !t.load(file, block) {
+		return
+	}
+	t.pos = sort.Search(len(t.keys), func(j int) bool {
+		return bytes.Compare(userKeyOf(t.keys[j]), key) >= 0
+	})
+	t.skipForward()
+}
+
+func (t *tableIterator) seekForPrev(key []byte) {
+	t.err = nil
+	file := sort.Search(len(t.files), func(i int) bool {
+		return bytes.Compare(t.files[i].smallest, key) > 0
+	}) - 1
+	if file < 0 {
+		t.file, t.keys, t.pos = 0, nil, -1
+		return
+	}
+	index := t.files[file].table.index
+	block := sort.Search(len(index), func(i int) bool {
+		return bytes.Compare(userKeyOf(index[i].key), key) > 0
+	}) - 1
+	if block < 0 {
+		block = 0
+	}
+	if !t.load(file, block) {
+		return
+	}
+	t.pos = sort.Search(len(t.keys), func(j int) bool {
+		return bytes.Compare(userKeyOf(t.keys[j]), key) > 0
+	}) - 1
+	t.skipBackward()
+}
+
+func (t *tableIterator) next() {
+	if t.valid() {
+		t.pos++
+		t.skipForward()
+	}
+}
+
+func (t *tableIterator) prev() {
+	if t.valid() {
+		t.pos--
+		t.skipBackward()
+	}
+}
+
+func (t *tableIterator) userKey() []byte {
+	return userKeyOf(t.keys[t.pos])
+}
+
+func (t *tableIterator) entry() *pairs {
+	p := new(pairs)
+	p.set(t.table().internalKey(t.keys[t.pos]), t.values[t.pos])
+	return p
+}
+
+func (t *tableIterator) error() error {
+	return t.err
+}
@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// The dump functions read the files of a database without opening it,for the
+// zpaperdb command.An entry read from a SSTable has the sequence saved in the
+// table,the global sequence of an ingested table is only in the MANIFEST.
+
+// DumpBlock is a block of a SSTable,a data block is named by its first user key.
+type DumpBlock struct {
+	Name   string
+	Offset uint32
+	Size   uint32
+}
+
+// TableDump is the layout of a SSTable,MetaBlocks hold the filters,the range
+// tombstones and the value logs the table point to.
+type TableDump struct {
+	Size       int64
+	MetaIndex  DumpBlock
+	Index      DumpBlock
+	DataBlocks []DumpBlock
+	MetaBlocks []DumpBlock
+}
+
+// DumpEntry is an entry of a SSTable or a write ahead log,the Value of a range
+// deletion is the end of its range.ColumnFamily is only set for a log.
+type DumpEntry struct {
+	ColumnFamily uint32
+	Key          []byte
+	Seq          uint64
+	Type         string
+	Value        []byte
+}
+
+type ManifestDump struct {
+	NextFileNum    uint64
+	LastSeq        uint64
+	NextFamilyID   uint32
+	ColumnFamilies []FamilyDump
+}
+
+// FamilyDump is a column family of the MANIFEST,it has flushed the write ahead
+// logs older than LogNum.
+type FamilyDump struct {
+	ID     uint32
+	Name   string
+	LogNum uint64
+	Files  []FileDump
+}
+
+// FileDump is a SSTable of a level,GlobalSeq is set if it is ingested.
+type FileDump struct {
+	Level     int
+	FileNum   uint64
+	Size      int64
+	Smallest  []byte
+	Largest   []byte
+	GlobalSeq uint64
+}
+
+func keyTypeName(keyType byte) string {
+	switch keyType {
+	case typeDeletion:
+		return "deletion"
+	case typeValue:
+		return "value"
+	case typeRangeDeletion:
+		return "range deletion"
+	case typeValueTTL:
+		return "value ttl"
+	case typeMerge:
+		return "merge"
+	case typeValuePointer:
+		return "value pointer"
+	}
+	return "unknown"
+}
+
+func openTableFile(path string) (*tableReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := openTable(file, nil, nil)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// DumpTable return the layout of the SSTable path.
+func DumpTable(path string) (*TableDump, error) {
+	t, err := openTableFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer t.close()
+	dump := &TableDump{
+		Size:      t.size,
+		MetaIndex: DumpBlock{Name: "meta index", Offset: t.footer.metaIndexHandle.offset, Size: t.footer.metaIndexHandle.size},
+		Index:     DumpBlock{Name: "index", Offset: t.footer.indexHandle.offset, Size: t.footer.indexHandle.size},
+	}
+	for _, index := range t.index {
+		dump.DataBlocks = append(dump.DataBlocks, DumpBlock{
+			Name:   string(userKeyOf(index.key)),
+			Offset: index.value.offset,
+			Size:   index.value.size,
+		})
+	}
+	keys, values, err := t.readBlock(t.footer.metaIndexHandle)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		handle, err := decodeBlockHandler(values[i])
+		if err != nil {
+			return nil, err
+		}
+		dump.MetaBlocks = append(dump.MetaBlocks, DumpBlock{Name: string(keys[i]), Offset: handle.offset, Size: handle.size})
+	}
+	return dump, nil
+}
+
+// ScanTable call fn with every entry of the SSTable path in order,then with its
+// range tombstones.
+func ScanTable(path string, fn func(DumpEntry) error) error {
+	t, err := openTableFile(path)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	for _, index := range t.index {
+		keys, values, err := t.readBlock(index.value)
+		if err != nil {
+			return err
+		}
+		for i := range keys {
+			p := pairs{key: keys[i]}
+			seq, keyType := p.trailer()
+			if err = fn(DumpEntry{Key: p.userKey(), Seq: seq, Type: keyTypeName(keyType), Value: values[i]}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, rangeDel := range t.rangeDels {
+		entry := DumpEntry{Key: rangeDel.start, Seq: rangeDel.seq, Type: keyTypeName(typeRangeDeletion), Value: rangeDel.end}
+		if err = fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanLog call fn with every operation of the write ahead log path in order,the
+// value of a merge is its operand.A record torn at the tail end the log.
+func ScanLog(path string, fn func(DumpEntry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := makeLogReader(file)
+	for {
+		record, err := reader.readRecord()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		batch, err := decodeWriteBatch(record)
+		if err != nil {
+			return err
+		}
+		err = batch.iterate(func(family uint32, keyType byte, key, value []byte, seq uint64) error {
+			return fn(DumpEntry{ColumnFamily: family, Key: key, Seq: seq, Type: keyTypeName(keyType), Value: value})
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DumpManifest return the MANIFEST of dir,the default column family is first.
+func DumpManifest(dir string) (*ManifestDump, error) {
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, errors.New("manifest: " + dir + " has no MANIFEST")
+	}
+	dump := &ManifestDump{NextFileNum: m.nextFileNum, LastSeq: m.lastSeq, NextFamilyID: m.nextFamilyID}
+	families := append([]manifestFamily{{id: 0, name: DefaultColumnFamilyName, logNum: m.logNum, files: m.files}}, m.families...)
+	for _, f := range families {
+		family := FamilyDump{ID: f.id, Name: f.name, LogNum: f.logNum}
+		for _, file := range f.files {
+			family.Files = append(family.Files, FileDump{
+				Level:     file.level,
+				FileNum:   file.fileNum,
+				Size:      file.size,
+				Smallest:  file.smallest,
+				Largest:   file.largest,
+				GlobalSeq: file.globalSeq,
+			})
+		}
+		dump.ColumnFamilies = append(dump.ColumnFamilies, family)
+	}
+	return dump, nil
+}
+
+// VerifyResult is a file checked by VerifyDB,Err is nil if the file is intact.
+type VerifyResult struct {
+	File string
+	Err  error
+}
+
+// VerifyTable read every block of the SSTable path and check its checksum,the
+// values it point to are read from the value logs beside it.
+func VerifyTable(path string) error {
+	// the footer,index,meta index and meta blocks are checked by openTable
+	t, err := openTableFile(path)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	vl := makeValueLog(filepath.Dir(path))
+	defer vl.close()
+	for _, index := range t.index {
+		keys, values, err := t.readBlock(index.value)
+		if err != nil {
+			return err
+		}
+		for i := range keys {
+			p := pairs{key: keys[i]}
+			if _, keyType := p.trailer(); keyType != typeValuePointer {
+				continue
+			}
+			if _, err = vl.read(p.userKey(), values[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// VerifyDB check the MANIFEST of dir,the SSTables it list and the write ahead
+// logs.A file failing the check does not stop the others.
+func VerifyDB(dir string) ([]VerifyResult, error) {
+	if err := VerifyLog(filepath.Join(dir, manifestName)); err != nil {
+		return nil, err
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, errors.New("manifest: " + dir + " has no MANIFEST")
+	}
+	var results []VerifyResult
+	files := m.files
+	for _, f := range m.families {
+		files = append(files, f.files...)
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, "ssTable"+strconv.FormatUint(f.fileNum, 10))
+		results = append(results, VerifyResult{File: filepath.Base(path), Err: VerifyTable(path)})
+	}
+	nums, err := logFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, num := range nums {
+		path := filepath.Join(dir, "WAL"+strconv.FormatUint(num, 10))
+		results = append(results, VerifyResult{File: filepath.Base(path), Err: VerifyLog(path)})
+	}
+	return results, nil
+}
+
+// VerifyLog read every record of the write ahead log or MANIFEST path and check
+// its checksum.
+func VerifyLog(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := makeLogReader(file)
+	for {
+		if _, err = reader.readRecord(); err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDumpAndVerify(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree := makeValueLogTestLSMTree(t, dir, nil)
+	putKeys(t, lsmTree, 0, 1000)
+	if err := lsmTree.DeleteRange(testKey(10), testKey(20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	table := lsmTree.tableFileName(lsmTree.levels[0][0].fileNum)
+	putKeys(t, lsmTree, 1000, 1010)
+	if err := lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := DumpManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.ColumnFamilies) != 1 || len(m.ColumnFamilies[0].Files) != 1 || m.ColumnFamilies[0].Name != DefaultColumnFamilyName {
+		t.Fatalf("MANIFEST %+v,want the default column family with 1 file", m)
+	}
+	if f := m.ColumnFamilies[0].Files[0]; string(f.Smallest) != string(testKey(0)) || string(f.Largest) != string(testKey(999)) {
+		t.Fatalf("File range [%s,%s],want [%s,%s]", f.Smallest, f.Largest, testKey(0), testKey(999))
+	}
+	dump, err := DumpTable(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dump.DataBlocks) < 2 || dump.DataBlocks[0].Name != string(testKey(0)) || len(dump.MetaBlocks) == 0 {
+		t.Fatalf("Table layout %+v,want several data blocks from %s and the meta blocks", dump, testKey(0))
+	}
+	values, rangeDels := 0, 0
+	err = ScanTable(table, func(e DumpEntry) error {
+		switch e.Type {
+		case "value":
+			values++
+		case "range deletion":
+			rangeDels++
+		}
+		return nil
+	})
+	if err != nil || values != 1000 || rangeDels != 1 {
+		t.Fatalf("Table hold %d values and %d range deletions %v,want 1000 and 1", values, rangeDels, err)
+	}
+	logged := 0
+	logs, err := logFiles(dir)
+	if err != nil || len(logs) == 0 {
+		t.Fatal("No write ahead log is left.", err)
+	}
+	for _, num := range logs {
+		err = ScanLog(lsmTree.logFileName(num), func(e DumpEntry) error {
+			logged++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if logged != 10 {
+		t.Fatalf("Logs hold %d operations,want 10", logged)
+	}
+	results, err := VerifyDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("Intact file %s fail the check: %v", r.File, r.Err)
+		}
+	}
+	// break a data block of the table
+	file, err := os.OpenFile(table, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.WriteAt([]byte("broken"), 16); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if _, err = DumpTable(table); err != nil {
+		t.Fatal("Layout of a table with a damaged data block is not read.", err)
+	}
+	if err = VerifyTable(table); err == nil {
+		t.Fatal("Damaged table pass the check.")
+	}
+	results, err = VerifyDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := 0
+	for _, r := range results {
+		if r.Err != nil {
+			broken++
+		}
+	}
+	if broken != 1 || len(results) != 1+len(logs) {
+		t.Fatalf("%d of %d files fail the check,want 1 of %d", broken, len(results), 1+len(logs))
+	}
+}
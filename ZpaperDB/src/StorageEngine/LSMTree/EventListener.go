@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"os"
+	"time"
+)
+
+// Options.EventListener is called by the goroutine which run the job,the flush
+// and compaction workers mostly,so a slow listener hold the job back.It is
+// never called with lsm.mu held and may call the tree.A write stall change or a write ahead log created under
+// lsm.mu is queued and delivered in order once lsm.mu is released.
+
+// Reasons of the table file events and the background errors.
+const (
+	ReasonFlush            = "flush"
+	ReasonCompaction       = "compaction"
+	ReasonValueLogGC       = "value log gc"
+	ReasonDropColumnFamily = "drop column family"
+	ReasonWriteAheadLog    = "write ahead log"
+	ReasonIngest           = "ingest external file"
+)
+
+type EventListener interface {
+	OnFlushBegin(info FlushInfo)
+	OnFlushEnd(info FlushInfo)
+	OnCompactionBegin(info CompactionInfo)
+	OnCompactionEnd(info CompactionInfo)
+	OnTableFileCreated(info TableFileInfo)
+	OnTableFileDeleted(info TableFileInfo)
+	OnWALCreated(info WALInfo)
+	OnWALDeleted(info WALInfo)
+	OnWriteStallChange(info WriteStallInfo)
+	OnBackgroundError(info BackgroundErrorInfo)
+}
+
+// NopEventListener ignore every event,embed it to implement only some callbacks.
+type NopEventListener struct{}
+
+func (NopEventListener) OnFlushBegin(FlushInfo)                {}
+func (NopEventListener) OnFlushEnd(FlushInfo)                  {}
+func (NopEventListener) OnCompactionBegin(CompactionInfo)      {}
+func (NopEventListener) OnCompactionEnd(CompactionInfo)        {}
+func (NopEventListener) OnTableFileCreated(TableFileInfo)      {}
+func (NopEventListener) OnTableFileDeleted(TableFileInfo)      {}
+func (NopEventListener) OnWALCreated(WALInfo)                  {}
+func (NopEventListener) OnWALDeleted(WALInfo)                  {}
+func (NopEventListener) OnWriteStallChange(WriteStallInfo)     {}
+func (NopEventListener) OnBackgroundError(BackgroundErrorInfo) {}
+
+// FlushInfo describe the flush of an immutable table into FileNum,FileNum is 0
+// at OnFlushEnd if the table was empty.Err is the error the flush failed with.
+type FlushInfo struct {
+	ColumnFamily string
+	FileNum      uint64
+	Size         int64
+	Duration     time.Duration
+	Err          error
+}
+
+// CompactionInfo describe a compaction of InputFiles of InputLevels into
+// OutputFiles of OutputLevel,the outputs and bytes are known at OnCompactionEnd.
+type CompactionInfo struct {
+	ColumnFamily string
+	InputLevels  []int
+	OutputLevel  int
+	InputFiles   []uint64
+	OutputFiles  []uint64
+	BytesRead    int64
+	BytesWritten int64
+	Duration     time.Duration
+	Err          error
+}
+
+type TableFileInfo struct {
+	ColumnFamily string
+	FileNum      uint64
+	Path         string
+	Level        int
+	Size         int64
+	Reason       string
+}
+
+type WALInfo struct {
+	FileNum uint64
+	Path    string
+}
+
+// WriteStallInfo is the database wide stall state,normal,delayed or stopped.
+type WriteStallInfo struct {
+	Previous string
+	Current  string
+}
+
+// BackgroundErrorInfo is the error which stopped the writes,Reason is flush,
+// compaction or write ahead log.ColumnFamily is empty for a write ahead log error.
+type BackgroundErrorInfo struct {
+	ColumnFamily string
+	Reason       string
+	Err          error
+}
+
+func (lsm *LSMTree) notify(event func(listener EventListener)) {
+	if lsm.dbOpts.EventListener != nil {
+		event(lsm.dbOpts.EventListener)
+	}
+}
+
+// queueEvent must be called with lsm.mu held,the event is delivered by deliverEvents.
+func (lsm *LSMTree) queueEvent(event func(listener EventListener)) {
+	if lsm.dbOpts.EventListener != nil {
+		lsm.events = append(lsm.events, event)
+	}
+}
+
+// deliverEvents call the listeners with the queued events,it must be called
+// without lsm.mu held.eventMu keep the events in order between goroutines.
+func (lsm *LSMTree) deliverEvents() {
+	if lsm.dbOpts.EventListener == nil {
+		return
+	}
+	lsm.eventMu.Lock()
+	defer lsm.eventMu.Unlock()
+	lsm.mu.Lock()
+	events := lsm.events
+	lsm.events = nil
+	lsm.mu.Unlock()
+	for _, event := range events {
+		lsm.notify(event)
+	}
+}
+
+// setStallState must be called with lsm.mu held.
+func (lsm *LSMTree) setStallState(state int) {
+	if state == lsm.stall.state {
+		return
+	}
+	info := WriteStallInfo{Previous: stallStateName(lsm.stall.state), Current: stallStateName(state)}
+	lsm.stall.state = state
+	lsm.queueEvent(func(listener EventListener) {
+		listener.OnWriteStallChange(info)
+	})
+}
+
+func (lsm *LSMTree) tableFileInfo(meta *fileMeta, level int, reason string) TableFileInfo {
+	return TableFileInfo{
+		ColumnFamily: lsm.family.name,
+		FileNum:      meta.fileNum,
+		Path:         lsm.tableFileName(meta.fileNum),
+		Level:        level,
+		Size:         meta.size,
+		Reason:       reason,
+	}
+}
+
+func (lsm *LSMTree) notifyTablesCreated(files []*fileMeta, level int, reason string) {
+	for _, meta := range files {
+		info := lsm.tableFileInfo(meta, level, reason)
+		lsm.notify(func(listener EventListener) {
+			listener.OnTableFileCreated(info)
+		})
+	}
+}
+
+// removeTables close and remove files of level once the reads which pinned
+// them release them,the files must be out of the levels already.Their value
+// logs are kept meanwhile.
+func (lsm *LSMTree) removeTables(files []*fileMeta, level int, reason string) {
+	lsm.mu.Lock()
+	for _, meta := range files {
+		lsm.removedTables[meta] = true
+	}
+	lsm.mu.Unlock()
+	for _, meta := range files {
+		meta := meta
+		info := lsm.tableFileInfo(meta, level, reason)
+		meta.obsolete = func() {
+			meta.table.close()
+			os.Remove(lsm.tableFileName(meta.fileNum))
+			lsm.mu.Lock()
+			delete(lsm.removedTables, meta)
+			lsm.mu.Unlock()
+			lsm.notify(func(listener EventListener) {
+				listener.OnTableFileDeleted(info)
+			})
+		}
+		meta.unref()
+	}
+}
+
+func (lsm *LSMTree) compactionInfo(cp *compaction) CompactionInfo {
+	info := CompactionInfo{
+		ColumnFamily: lsm.family.name,
+		InputLevels:  cp.inputLevel,
+		OutputLevel:  cp.outputLevel,
+	}
+	for _, files := range cp.inputFile {
+		for _, meta := range files {
+			info.InputFiles = append(info.InputFiles, meta.fileNum)
+			info.BytesRead += meta.size
+		}
+	}
+	return info
+}
+
+func (lsm *LSMTree) walInfo(num uint64) WALInfo {
+	return WALInfo{FileNum: num, Path: lsm.logFileName(num)}
+}
+
+// removeLog remove the write ahead log num.
+func (lsm *LSMTree) removeLog(num uint64) error {
+	if err := os.Remove(lsm.logFileName(num)); err != nil {
+		return err
+	}
+	info := lsm.walInfo(num)
+	lsm.notify(func(listener EventListener) {
+		listener.OnWALDeleted(info)
+	})
+	return nil
+}
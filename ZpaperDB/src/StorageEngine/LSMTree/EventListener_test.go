@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type testEventListener struct {
+	mu          sync.Mutex
+	events      []string
+	flushes     []FlushInfo
+	compactions []CompactionInfo
+}
+
+func (l *testEventListener) add(event string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *testEventListener) OnFlushBegin(info FlushInfo) {
+	l.add(fmt.Sprintf("flush begin %d", info.FileNum))
+}
+
+func (l *testEventListener) OnFlushEnd(info FlushInfo) {
+	l.add(fmt.Sprintf("flush end %d", info.FileNum))
+	l.mu.Lock()
+	l.flushes = append(l.flushes, info)
+	l.mu.Unlock()
+}
+
+func (l *testEventListener) OnCompactionBegin(info CompactionInfo) {
+	l.add(fmt.Sprintf("compaction begin %v", info.InputFiles))
+}
+
+func (l *testEventListener) OnCompactionEnd(info CompactionInfo) {
+	l.add(fmt.Sprintf("compaction end %v", info.OutputFiles))
+	l.mu.Lock()
+	l.compactions = append(l.compactions, info)
+	l.mu.Unlock()
+}
+
+func (l *testEventListener) OnTableFileCreated(info TableFileInfo) {
+	l.add(fmt.Sprintf("table created %d level%d %s", info.FileNum, info.Level, info.Reason))
+}
+
+func (l *testEventListener) OnTableFileDeleted(info TableFileInfo) {
+	l.add(fmt.Sprintf("table deleted %d level%d %s", info.FileNum, info.Level, info.Reason))
+}
+
+func (l *testEventListener) OnWALCreated(info WALInfo) {
+	l.add(fmt.Sprintf("wal created %d", info.FileNum))
+}
+
+func (l *testEventListener) OnWALDeleted(info WALInfo) {
+	l.add(fmt.Sprintf("wal deleted %d", info.FileNum))
+}
+
+func (l *testEventListener) OnWriteStallChange(info WriteStallInfo) {
+	l.add("stall " + info.Previous + " " + info.Current)
+}
+
+func (l *testEventListener) OnBackgroundError(info BackgroundErrorInfo) {
+	l.add("error " + info.Reason)
+}
+
+// take return the events since the last take.
+func (l *testEventListener) take() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := l.events
+	l.events = nil
+	return events
+}
+
+func checkEvents(t *testing.T, events []string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		found := false
+		for _, event := range events {
+			found = found || event == w
+		}
+		if !found {
+			t.Fatalf("Event %q is missing in %q", w, events)
+		}
+	}
+}
+
+func TestEventListener(t *testing.T) {
+	listener := new(testEventListener)
+	lsmTree := makeValueLogTestLSMTree(t, t.TempDir(), &Options{
+		MaxFileOfOneLevel:           2,
+		Level0SlowdownWritesTrigger: 2,
+		EventListener:               listener,
+	})
+	defer lsmTree.Close()
+	putKeys(t, lsmTree, 0, 100)
+	// the first write deliver the log created by open
+	firstLog := lsmTree.writeAheadLog.num
+	checkEvents(t, listener.take(), fmt.Sprintf("wal created %d", firstLog))
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	flushed := lsmTree.levels[0][0]
+	checkEvents(t, listener.take(),
+		fmt.Sprintf("flush begin %d", flushed.fileNum),
+		fmt.Sprintf("flush end %d", flushed.fileNum),
+		fmt.Sprintf("table created %d level0 flush", flushed.fileNum),
+		fmt.Sprintf("wal created %d", lsmTree.writeAheadLog.num),
+		fmt.Sprintf("wal deleted %d", firstLog))
+	if info := listener.flushes[0]; info.Size != flushed.size || info.ColumnFamily != DefaultColumnFamilyName || info.Err != nil {
+		t.Fatalf("Flush info %+v", info)
+	}
+	// the second level0 file delay the writes
+	putKeys(t, lsmTree, 50, 150)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	checkEvents(t, listener.take(), "stall normal delayed")
+	inputs := []uint64{lsmTree.levels[0][0].fileNum, lsmTree.levels[0][1].fileNum}
+	cp := lsmTree.pickCompaction()
+	if cp == nil {
+		t.Fatal("No compaction is picked.")
+	}
+	if err := lsmTree.majorCompress(cp); err != nil {
+		t.Fatal(err)
+	}
+	output := lsmTree.levels[1][0].fileNum
+	checkEvents(t, listener.take(),
+		fmt.Sprintf("compaction begin %v", inputs),
+		fmt.Sprintf("compaction end [%d]", output),
+		fmt.Sprintf("table created %d level1 compaction", output),
+		fmt.Sprintf("table deleted %d level0 compaction", inputs[0]),
+		fmt.Sprintf("table deleted %d level0 compaction", inputs[1]),
+		"stall delayed normal")
+	info := listener.compactions[0]
+	if info.OutputLevel != 1 || info.BytesRead == 0 || info.BytesWritten != lsmTree.levels[1][0].size || info.Duration <= 0 {
+		t.Fatalf("Compaction info %+v", info)
+	}
+}
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sort"
+)
+
+// IngestExternalFile add the SSTables written by SSTWriter to the column family
+// without writing their keys again.The files must not overlap each other,their
+// entries get one global sequence newer than every write before,it is saved in
+// the MANIFEST and applied by the table reader.A memory table overlapping the
+// files is flushed first,as it is read before the SSTables.With the leveled
+// compaction style each file is placed at the deepest level which has no
+// overlapping file in it or above it,otherwise at level0.The files are copied,
+// the flushes and compactions of the family wait until they are installed.
+
+type externalFile struct {
+	path     string
+	size     int64
+	smallest []byte
+	largest  []byte
+}
+
+// readExternalFile check that path is a SSTable of SSTWriter and return its key range.
+func (lsm *LSMTree) readExternalFile(path string) (*externalFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	t, err := openTable(file, lsm.filterPolicy, lsm.prefixExtractor)
+	if err != nil {
+		return nil, err
+	}
+	data, err := t.readAll()
+	if err != nil {
+		return nil, err
+	}
+	for i := range data {
+		seq, keyType := data[i].trailer()
+		if seq != 0 || keyType == typeValuePointer {
+			return nil, errors.New("ingest: " + path + " is not written by SSTWriter")
+		}
+		if i > 0 && bytes.Compare(data[i-1].userKey(), data[i].userKey()) >= 0 {
+			return nil, errors.New("ingest: keys of " + path + " are not in order")
+		}
+	}
+	for _, rangeDel := range t.rangeDels {
+		if rangeDel.seq != 0 {
+			return nil, errors.New("ingest: " + path + " is not written by SSTWriter")
+		}
+	}
+	tb := &TableBuilder{data: &data, rangeDels: t.rangeDels}
+	f := &externalFile{path: path, size: t.size}
+	f.smallest, f.largest = tb.keyRange()
+	if f.smallest == nil && f.largest == nil {
+		return nil, errors.New("ingest: " + path + " is empty")
+	}
+	return f, nil
+}
+
+func (lsm *LSMTree) IngestExternalFile(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	files := make([]*externalFile, len(paths))
+	for i, path := range paths {
+		f, err := lsm.readExternalFile(path)
+		if err != nil {
+			return err
+		}
+		files[i] = f
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return bytes.Compare(files[i].smallest, files[j].smallest) < 0
+	})
+	for i := 1; i < len(files); i++ {
+		if bytes.Compare(files[i-1].largest, files[i].smallest) >= 0 {
+			return errors.New("ingest: " + files[i-1].path + " and " + files[i].path + " overlap")
+		}
+	}
+	defer lsm.deliverEvents()
+	for {
+		lsm.mu.Lock()
+		err := lsm.checkWritable()
+		flush := err == nil && lsm.memTablesOverlap(files)
+		lsm.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if flush {
+			if err = lsm.minorCompaction(); err != nil {
+				return err
+			}
+		}
+		// a write may fill the memory table again before the files are installed
+		if installed, err := lsm.installExternalFiles(files); installed || err != nil {
+			return err
+		}
+	}
+}
+
+func (lsm *LSMTree) IngestExternalFileCF(cf *ColumnFamilyHandle, paths []string) error {
+	family, err := lsm.columnFamily(cf)
+	if err != nil {
+		return err
+	}
+	return family.IngestExternalFile(paths)
+}
+
+// memTablesOverlap must be called with lsm.mu held.
+func (lsm *LSMTree) memTablesOverlap(files []*externalFile) bool {
+	for _, mt := range []*memTable{lsm.table, lsm.imm} {
+		if mt == nil {
+			continue
+		}
+		for _, f := range files {
+			if key := mt.str.seek(f.smallest); key != nil && bytes.Compare(key, f.largest) <= 0 {
+				return true
+			}
+			for _, rangeDel := range mt.rangeDels {
+				if bytes.Compare(rangeDel.start, f.largest) <= 0 && bytes.Compare(rangeDel.end, f.smallest) > 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// installExternalFiles copy the files into the directory and install them,it
+// return false if a memory table overlap them again.
+func (lsm *LSMTree) installExternalFiles(files []*externalFile) (bool, error) {
+	lsm.bgMu.RLock()
+	defer lsm.bgMu.RUnlock()
+	lsm.compactMu.Lock()
+	defer lsm.compactMu.Unlock()
+	lsm.flushMu.Lock()
+	defer lsm.flushMu.Unlock()
+	lsm.mu.Lock()
+	if err := lsm.checkWritable(); err != nil {
+		lsm.mu.Unlock()
+		return false, err
+	}
+	if lsm.dropped {
+		lsm.mu.Unlock()
+		return false, ErrColumnFamilyNotFound
+	}
+	if lsm.memTablesOverlap(files) {
+		lsm.mu.Unlock()
+		return false, nil
+	}
+	fileNums := make([]uint64, len(files))
+	for i := range files {
+		fileNums[i] = lsm.newFileNum()
+	}
+	lsm.mu.Unlock()
+	// the flushes and compactions of the family wait,so the levels do not change
+	metas := make([]*fileMeta, 0, len(files))
+	for i, f := range files {
+		meta, err := lsm.openExternalFile(f, fileNums[i])
+		if err != nil {
+			lsm.removeOutputs(metas)
+			return false, err
+		}
+		metas = append(metas, meta)
+	}
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	if err := lsm.checkWritable(); err != nil {
+		lsm.removeOutputs(metas)
+		return false, err
+	}
+	if lsm.memTablesOverlap(files) {
+		lsm.removeOutputs(metas)
+		return false, nil
+	}
+	// the levels and the sequence are restored if the MANIFEST is not saved
+	oldLevels := append([][]*fileMeta(nil), lsm.levels...)
+	oldSeq := lsm.seq
+	lsm.seq++
+	levels := make([]int, len(metas))
+	for i, meta := range metas {
+		meta.table.setGlobalSeq(lsm.seq)
+		levels[i] = lsm.ingestLevel(meta)
+		files := append([]*fileMeta(nil), lsm.levels[levels[i]]...)
+		files = append(files, meta)
+		if levels[i] > 0 {
+			sort.Slice(files, func(i, j int) bool {
+				return bytes.Compare(files[i].smallest, files[j].smallest) < 0
+			})
+		}
+		lsm.levels[levels[i]] = files
+	}
+	if err := lsm.saveManifest(); err != nil {
+		copy(lsm.levels, oldLevels)
+		lsm.seq = oldSeq
+		lsm.removeOutputs(metas)
+		return false, err
+	}
+	lsm.versionChanged()
+	lsm.scheduler.scheduleCompaction(lsm)
+	for i, meta := range metas {
+		info := lsm.tableFileInfo(meta, levels[i], ReasonIngest)
+		lsm.queueEvent(func(listener EventListener) {
+			listener.OnTableFileCreated(info)
+		})
+	}
+	return true, nil
+}
+
+// openExternalFile copy f into the SSTable fileNum and open it.
+func (lsm *LSMTree) openExternalFile(f *externalFile, fileNum uint64) (*fileMeta, error) {
+	name := lsm.tableFileName(fileNum)
+	if err := copyFile(f.path, name); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	meta := &fileMeta{fileNum: fileNum, size: f.size, smallest: f.smallest, largest: f.largest, createdAt: lsm.now()}
+	if meta.table, err = openTable(file, lsm.filterPolicy, lsm.prefixExtractor); err != nil {
+		file.Close()
+		os.Remove(name)
+		return nil, err
+	}
+	return meta, nil
+}
+
+// ingestLevel return the level of an ingested file,it must be called with
+// lsm.mu held.A file overlapping level0 go to level0 as its newest file.
+func (lsm *LSMTree) ingestLevel(meta *fileMeta) int {
+	if lsm.opts.CompactionStyle != "leveled" {
+		return 0
+	}
+	level := 0
+	for ; level+1 < maxLevel; level++ {
+		if len(filesInRange(lsm.levels[level], meta.smallest, meta.largest)) > 0 {
+			return level
+		}
+		if len(filesInRange(lsm.levels[level+1], meta.smallest, meta.largest)) > 0 {
+			return level
+		}
+	}
+	return level
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// writeExternalFile write the keys [from,to) with value gen into a new SSTable.
+func writeExternalFile(t *testing.T, from, to int, gen string) string {
+	path := filepath.Join(t.TempDir(), "external"+strconv.Itoa(from)+".sst")
+	w, err := MakeSSTWriter(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := from; i < to; i++ {
+		if err = w.Put(testKey(i), append([]byte(gen), testKey(i)...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func checkValue(t *testing.T, lsmTree *LSMTree, i int, gen string) {
+	value, err := lsmTree.Get(testKey(i))
+	if err != nil || string(value) != gen+string(testKey(i)) {
+		t.Fatalf("key %d value %q %v,want generation %q", i, value, err, gen)
+	}
+}
+
+func TestIngestExternalFile(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree := makeValueLogTestLSMTree(t, dir, nil)
+	putKeys(t, lsmTree, 0, 100)
+	if err := lsmTree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// no file overlap the keys,the file go to the deepest level
+	if err := lsmTree.IngestExternalFile([]string{writeExternalFile(t, 200, 300, "a")}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(lsmTree.levels[maxLevel-1]); n != 1 {
+		t.Fatalf("Bottommost level hold %d files,want 1", n)
+	}
+	checkValue(t, lsmTree, 250, "a")
+	// the file overlap level1,it stay above it and hide the older values
+	seq := lsmTree.seq
+	if err := lsmTree.IngestExternalFile([]string{writeExternalFile(t, 50, 60, "b")}); err != nil {
+		t.Fatal(err)
+	}
+	if lsmTree.seq != seq+1 || len(lsmTree.levels[0]) != 1 {
+		t.Fatalf("Ingestion end with sequence %d and %d level0 files,want %d and 1", lsmTree.seq, len(lsmTree.levels[0]), seq+1)
+	}
+	checkValue(t, lsmTree, 55, "b")
+	checkFound(t, lsmTree, 45, true)
+	// the memory table overlapping the file is flushed before it
+	putKeys(t, lsmTree, 300, 310)
+	if err := lsmTree.IngestExternalFile([]string{writeExternalFile(t, 305, 320, "c")}); err != nil {
+		t.Fatal(err)
+	}
+	if lsmTree.table.entries != 0 {
+		t.Fatal("Overlapping memory table is not flushed.")
+	}
+	checkValue(t, lsmTree, 305, "c")
+	checkFound(t, lsmTree, 300, true)
+	// a write after the ingestion is newer
+	putKeys(t, lsmTree, 56, 57)
+	checkFound(t, lsmTree, 56, true)
+	if err := lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the global sequences are saved in the MANIFEST
+	lsmTree = makeValueLogTestLSMTree(t, dir, nil)
+	defer lsmTree.Close()
+	checkValue(t, lsmTree, 55, "b")
+	checkValue(t, lsmTree, 250, "a")
+	checkFound(t, lsmTree, 56, true)
+	// a compaction keep the ingested values
+	if err := lsmTree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, lsmTree, 55, "b")
+	checkValue(t, lsmTree, 305, "c")
+	checkFound(t, lsmTree, 56, true)
+	checkFound(t, lsmTree, 45, true)
+}
+
+func TestIngestExternalFileErrors(t *testing.T) {
+	lsmTree := makeValueLogTestLSMTree(t, t.TempDir(), nil)
+	defer lsmTree.Close()
+	overlapping := []string{writeExternalFile(t, 0, 10, "a"), writeExternalFile(t, 5, 15, "b")}
+	if err := lsmTree.IngestExternalFile(overlapping); err == nil {
+		t.Fatal("Overlapping files are ingested.")
+	}
+	if err := lsmTree.IngestExternalFile([]string{filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Fatal("Missing file is ingested.")
+	}
+	// a table of the database hold sequences,it is not an external file
+	putKeys(t, lsmTree, 0, 10)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.IngestExternalFile([]string{lsmTree.tableFileName(lsmTree.levels[0][0].fileNum)}); err == nil {
+		t.Fatal("SSTable of the database is ingested.")
+	}
+	for i := 0; i < 15; i++ {
+		checkFound(t, lsmTree, i, i < 10)
+	}
+	// files out of order are sorted
+	files := []string{writeExternalFile(t, 30, 40, "c"), writeExternalFile(t, 20, 30, "d")}
+	if err := lsmTree.IngestExternalFile(files); err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, lsmTree, 25, "d")
+	checkValue(t, lsmTree, 35, "c")
+}
+
+func TestIngestManifestError(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree := makeValueLogTestLSMTree(t, dir, nil)
+	defer lsmTree.Close()
+	putKeys(t, lsmTree, 0, 10)
+	seq := lsmTree.seq
+	tables, _ := filepath.Glob(filepath.Join(dir, "ssTable*"))
+	// the MANIFEST can not be written while a directory take its temp name
+	tmpName := filepath.Join(dir, manifestName+".tmp")
+	if err := os.Mkdir(tmpName, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.IngestExternalFile([]string{writeExternalFile(t, 100, 200, "a")}); err == nil {
+		t.Fatal("Ingestion succeed without saving the MANIFEST.")
+	}
+	for level := range lsmTree.levels {
+		if len(lsmTree.levels[level]) != 0 {
+			t.Fatalf("Level %d keep the file whose ingestion failed.", level)
+		}
+	}
+	if after, _ := filepath.Glob(filepath.Join(dir, "ssTable*")); lsmTree.seq != seq || len(after) != len(tables) {
+		t.Fatalf("Failed ingestion leave sequence %d and %d tables,want %d and %d", lsmTree.seq, len(after), seq, len(tables))
+	}
+	checkFound(t, lsmTree, 150, false)
+	os.Remove(tmpName)
+	if err := lsmTree.IngestExternalFile([]string{writeExternalFile(t, 100, 200, "a")}); err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, lsmTree, 150, "a")
+}
@@ -3,26 +3,20 @@ package storage
 // including :
 // 1.sort interface of some data type.
 // 2.Iterator interface.
-// 2.bloom filter.
-// 3.some typical hash func.
+// 2.bloom filter and filter policy.
+// 3.xxHash64 for bloom filter.
 // 4.disk block cache to improve the efficiency of read.
 // 5.RBTree.
 
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"math"
-	"os"
-	"sort"
+	"math/bits"
 	"strconv"
 	"sync"
-	"time"
-)
-
-const (
-	bitNum = 32 << (^uint(0) >> 63)
+	"unsafe"
 )
 
 type keySet [][]byte
@@ -46,59 +40,24 @@ func (k keySet) Swap(i, j int) {
 }
 
 type IContainer interface {
-	Iterator() IIterator
+	NewIterator() IIterator
 }
 
+// IIterator iterate sorted keys in both directions.The Seek methods position
+// the iterator,Key and Value are nil and Next and Prev do nothing unless Valid.
 type IIterator interface {
 	Valid() bool
-	SeedToFirst()
+	SeekToFirst()
 	SeekToLast()
-	Seek(target []byte) bool
+	// Seek move to the first key >= target.
+	Seek(target []byte)
+	// SeekForPrev move to the last key <= target.
+	SeekForPrev(target []byte)
 	Next()
 	Prev()
-	key() []byte
-	value() []byte
-}
-
-type Iterator struct {
-	curIndex  int
-	container *Container
-}
-
-func (i *Iterator) Valid() bool {
-	if i.curIndex == len(i.container.container)-1 {
-		return false
-	}
-	return true
-}
-func (i *Iterator) SeedToFirst() {
-	i.curIndex = 0
-}
-func (i *Iterator) SeekToLast() {
-	i.curIndex = len(i.container.container) - 1
-}
-func (i *Iterator) Seek(target []byte) bool {
-	for bytes.Compare(i.container.container[i.curIndex].entry.key, target) != 0 {
-		i.curIndex++
-		if i.curIndex == len(i.container.container) {
-			return false
-		}
-	}
-	return true
-}
-func (i *Iterator) Next() {
-	if i.curIndex < len(i.container.container)-1 {
-		i.curIndex++
-	}
-}
-func (i *Iterator) Prev() {
-	i.curIndex--
-}
-func (i *Iterator) key() []byte {
-	return i.container.container[i.curIndex].entry.key
-}
-func (i *Iterator) value() []byte {
-	return i.container.container[i.curIndex].entry.value
+	Key() []byte
+	Value() []byte
+	Error() error
 }
 
 type bloomFilter struct {
@@ -107,7 +66,6 @@ type bloomFilter struct {
 	ByteArray   []byte
 	BitArrayLen int64
 	HashNum     int
-	HashFunc    []func([]byte) uint64
 }
 
 type filter struct {
@@ -117,78 +75,107 @@ type filter struct {
 	hashNum   int32
 }
 
-func RSHash(key []byte) uint64 {
-	var a uint64 = 63689
-	var b uint64 = 378551
-	var hash uint64
-	for i := 0; i < len(key); i++ {
-		hash = hash*a + uint64(key[i])
-		a *= b
-	}
-	if bitNum == 32 {
-		return hash & 0x7FFFFFFF
-	}
-	return hash & 0x7FFFFFFFFFFFFFFF
+// FilterPolicy build the filter of a SSTable and answer whether a key may be in it.
+// Name is recorded in the meta index block, so a reader only decode the filter
+// which is built by the same policy.
+type FilterPolicy interface {
+	Name() string
+	CreateFilter(keys [][]byte) []byte
+	KeyMayMatch(key []byte, filterData []byte) bool
 }
 
-func BKDRHash(key []byte) uint64 {
-	var hash uint64
-	var seed uint64 = 131313
-	for i := 0; i < len(key); i++ {
-		hash = hash*seed + uint64(key[i])
-	}
-	if bitNum == 32 {
-		return hash & 0x7FFFFFFF
-	}
-	return hash & 0x7FFFFFFFFFFFFFFF
+// PrefixExtractor map a key to its prefix,the prefix filter is built on
+// these prefixes.Keys out of the domain are not added to the prefix filter.
+type PrefixExtractor interface {
+	Name() string
+	Transform(key []byte) []byte
+	InDomain(key []byte) bool
 }
 
-func DJBHash(key []byte) uint64 {
-	var hash uint64 = 5381
-	for i := 0; i < len(key); i++ {
-		hash = (hash << 5) + hash + uint64(key[i])
-	}
-	if bitNum == 32 {
-		return hash & 0x7FFFFFFF
-	}
-	return hash & 0x7FFFFFFFFFFFFFFF
+type bloomFilterPolicy struct {
+	fpp float64
 }
 
-func JSHash(key []byte) uint64 {
-	var hash uint64 = 1315423911
-	for i := 0; i < len(key); i++ {
-		hash ^= (hash << 5) + uint64(key[i]) + (hash >> 2)
-	}
-	if bitNum == 32 {
-		return hash & 0x7FFFFFFF
-	}
-	return hash & 0x7FFFFFFFFFFFFFFF
+type fixedPrefixExtractor struct {
+	prefixLen int
 }
 
-func SDBMHash(key []byte) uint64 {
-	var hash uint64
-	for i := 0; i < len(key); i++ {
-		hash = hash*65599 + uint64(key[i])
-		// hash = uint64(key[i])+(hash<<6)+(hash<<16)-hash
+const (
+	prime64v1 uint64 = 11400714785074694791
+	prime64v2 uint64 = 14029467366897019727
+	prime64v3 uint64 = 1609587929392839161
+	prime64v4 uint64 = 9650029242287828579
+	prime64v5 uint64 = 2870177450012600261
+)
+
+// xxHash64 is the 64-bit xxHash of data,all bloom probes are derived from it.
+func xxHash64(data []byte, seed uint64) uint64 {
+	var h uint64
+	n := len(data)
+	p := 0
+	if n >= 32 {
+		v1 := seed + prime64v1 + prime64v2
+		v2 := seed + prime64v2
+		v3 := seed
+		v4 := seed - prime64v1
+		for ; p+32 <= n; p += 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(data[p:]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(data[p+8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(data[p+16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(data[p+24:]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = seed + prime64v5
 	}
-	if bitNum == 32 {
-		return hash & 0x7FFFFFFF
+	h += uint64(n)
+	for ; p+8 <= n; p += 8 {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(data[p:]))
+		h = bits.RotateLeft64(h, 27)*prime64v1 + prime64v4
 	}
-	return hash & 0x7FFFFFFFFFFFFFFF
+	if p+4 <= n {
+		h ^= uint64(binary.LittleEndian.Uint32(data[p:])) * prime64v1
+		h = bits.RotateLeft64(h, 23)*prime64v2 + prime64v3
+		p += 4
+	}
+	for ; p < n; p++ {
+		h ^= uint64(data[p]) * prime64v5
+		h = bits.RotateLeft64(h, 11) * prime64v1
+	}
+	h ^= h >> 33
+	h *= prime64v2
+	h ^= h >> 29
+	h *= prime64v3
+	h ^= h >> 32
+	return h
 }
 
-func AdlerHash(key []byte) uint64 {
-	var s1 uint64 = 1
-	var s2 uint64
-	for i := 0; i < len(key); i++ {
-		s1 += uint64(key[i])
-		s2 += s1
-	}
-	hash := s2*65536 + s1
-	if bitNum == 32 {
-		return hash & 0x7FFFFFFF
+func xxRound(acc, input uint64) uint64 {
+	acc += input * prime64v2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * prime64v1
+}
+
+func xxMergeRound(acc, value uint64) uint64 {
+	acc ^= xxRound(0, value)
+	return acc*prime64v1 + prime64v4
+}
+
+// bloomSites use double hashing g(i) = h1 + i*h2 on one 64-bit hash,
+// so the number of probes is not limited by the number of hash functions.
+func bloomSites(key []byte, hashNum int, bitArrayLen uint64) []uint64 {
+	hash := xxHash64(key, 0)
+	h1 := hash & 0xFFFFFFFF
+	h2 := hash >> 32
+	result := make([]uint64, hashNum)
+	for i := 0; i < hashNum; i++ {
+		result[i] = (h1 + uint64(i)*h2) % bitArrayLen
 	}
-	return hash & 0x7FFFFFFFFFFFFFFF
+	return result
 }
 
 func (bf *bloomFilter) optimalHashFuncNum(expectedInsertions int64) int {
@@ -201,23 +188,18 @@ func (bf *bloomFilter) optimalBitArrayLen(fpp float64, expectedInsertions int64)
 	negN := -expectedInsertions
 	up := float64(negN) * math.Log(fpp)
 	down := math.Ln2 * math.Ln2
-	return uint64(up / down)
+	return uint64(math.Max(8, up/down))
 }
 
 func (bf *bloomFilter) mappingByHash(key []byte) []uint64 {
-	result := make([]uint64, bf.HashNum)
-	for i := 0; i < bf.HashNum; i++ {
-		tmpResult := bf.HashFunc[i](key)
-		result[i] = tmpResult % uint64(bf.BitArrayLen)
-	}
-	return result
+	return bloomSites(key, bf.HashNum, uint64(bf.BitArrayLen))
 }
 
 func MakeBloomFilter(fpp float64, expectedInsertions int64) (*bloomFilter, error) {
 	switch {
-	case fpp < 0.0:
+	case fpp <= 0.0:
 		return nil, errors.New("false positive probability must be > 0.0")
-	case fpp > 1.0:
+	case fpp >= 1.0:
 		return nil, errors.New("false positive probability must be < 1.0")
 	case expectedInsertions <= 0:
 		return nil, errors.New("excepted insertions must be >= 0")
@@ -226,54 +208,25 @@ func MakeBloomFilter(fpp float64, expectedInsertions int64) (*bloomFilter, error
 	bf.BitArrayLen = int64(bf.optimalBitArrayLen(fpp, expectedInsertions))
 	bf.ByteArray = make([]byte, (bf.BitArrayLen>>3)+1)
 	bf.HashNum = bf.optimalHashFuncNum(expectedInsertions)
-	bf.HashFunc = []func([]byte) uint64{
-		RSHash,
-		BKDRHash,
-		DJBHash,
-		JSHash,
-		SDBMHash,
-		AdlerHash}
 	return bf, nil
 }
 
 func (bf *bloomFilter) changeBit(site uint64) {
-	if site == 0 {
-		return
-	}
-	byteSite := site >> 3
-	bitSite := site & 0x07
-	if bitSite == 0 {
-		byteSite -= 1
-		bitSite = 8
-	}
-	bf.ByteArray[byteSite] |= 128 >> (bitSite - 1)
-	return
+	bf.ByteArray[site>>3] |= 128 >> (site & 0x07)
 }
 
 func (bf *bloomFilter) checkBitSite(site uint64) bool {
-	byteSite := site >> 3
-	bitSite := site & 0x07
-	if bitSite == 0 {
-		byteSite -= 1
-		bitSite = 8
-	}
-	if bf.ByteArray[byteSite]&(128>>(bitSite-1)) == 128>>(bitSite-1) {
-		return true
-	}
-	return false
+	return checkBit(bf.ByteArray, site)
 }
 
-func (f *filter) getSize() uint32 {
-	return uint32(len(f.bitMap) + 12)
+func checkBit(bitMap []byte, site uint64) bool {
+	return bitMap[site>>3]&(128>>(site&0x07)) != 0
 }
 
 func (bf *bloomFilter) Add(key []byte) {
 	bf.mu.Lock()
 	defer bf.mu.Unlock()
 	bf.ElementNum++
-	if bf.HashNum > 6 {
-		bf.HashNum = 6
-	}
 	site := bf.mappingByHash(key)
 	for i := 0; i < len(site); i++ {
 		bf.changeBit(site[i])
@@ -293,6 +246,104 @@ func (bf *bloomFilter) Query(key []byte) bool {
 	return true
 }
 
+func (bf *bloomFilter) toFilter() *filter {
+	return &filter{
+		keyNum:    uint32(bf.ElementNum),
+		bitMap:    bf.ByteArray,
+		bitMapLen: uint32(bf.BitArrayLen),
+		hashNum:   int32(bf.HashNum),
+	}
+}
+
+func (f *filter) getSize() uint32 {
+	return uint32(len(f.bitMap) + 12)
+}
+
+// encode layout: bitMap | keyNum | bitMapLen | hashNum
+func (f *filter) encode() []byte {
+	data := make([]byte, f.getSize())
+	n := copy(data, f.bitMap)
+	binary.LittleEndian.PutUint32(data[n:], f.keyNum)
+	binary.LittleEndian.PutUint32(data[n+4:], f.bitMapLen)
+	binary.LittleEndian.PutUint32(data[n+8:], uint32(f.hashNum))
+	return data
+}
+
+func decodeFilter(data []byte) (*filter, error) {
+	if len(data) < 12 {
+		return nil, errors.New("filter: data too short")
+	}
+	n := len(data) - 12
+	f := new(filter)
+	f.bitMap = data[:n]
+	f.keyNum = binary.LittleEndian.Uint32(data[n:])
+	f.bitMapLen = binary.LittleEndian.Uint32(data[n+4:])
+	f.hashNum = int32(binary.LittleEndian.Uint32(data[n+8:]))
+	if f.bitMapLen == 0 || uint64(f.bitMapLen) > uint64(n)*8 || f.hashNum <= 0 {
+		return nil, errors.New("filter: bad bit map length")
+	}
+	return f, nil
+}
+
+func (f *filter) mayMatch(key []byte) bool {
+	site := bloomSites(key, int(f.hashNum), uint64(f.bitMapLen))
+	for i := 0; i < len(site); i++ {
+		if !checkBit(f.bitMap, site[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func MakeBloomFilterPolicy(fpp float64) (FilterPolicy, error) {
+	if fpp <= 0.0 || fpp >= 1.0 {
+		return nil, errors.New("false positive probability must be in (0.0,1.0)")
+	}
+	return &bloomFilterPolicy{fpp: fpp}, nil
+}
+
+func (p *bloomFilterPolicy) Name() string {
+	return "zpaperdb.BuiltinBloomFilter"
+}
+
+func (p *bloomFilterPolicy) CreateFilter(keys [][]byte) []byte {
+	expectedInsertions := int64(len(keys))
+	if expectedInsertions == 0 {
+		expectedInsertions = 1
+	}
+	bf, _ := MakeBloomFilter(p.fpp, expectedInsertions)
+	for _, key := range keys {
+		bf.Add(key)
+	}
+	return bf.toFilter().encode()
+}
+
+// KeyMayMatch return true if the filter can not be decoded,
+// a broken filter must not hide any key.
+func (p *bloomFilterPolicy) KeyMayMatch(key []byte, filterData []byte) bool {
+	f, err := decodeFilter(filterData)
+	if err != nil {
+		return true
+	}
+	return f.mayMatch(key)
+}
+
+func MakeFixedPrefixExtractor(prefixLen int) PrefixExtractor {
+	return &fixedPrefixExtractor{prefixLen: prefixLen}
+}
+
+func (e *fixedPrefixExtractor) Name() string {
+	return "zpaperdb.FixedPrefix." + strconv.Itoa(e.prefixLen)
+}
+
+func (e *fixedPrefixExtractor) Transform(key []byte) []byte {
+	return key[:e.prefixLen]
+}
+
+func (e *fixedPrefixExtractor) InDomain(key []byte) bool {
+	return len(key) >= e.prefixLen
+}
+
 // RBTree act as a LSMTree memoryTree basic workflow:
 // While writing in, put the data in memory self-balancing tree(Red-Black Tree),
 // this memoryTree called memoryTable,when memoryTable greater than a certain
@@ -306,496 +357,471 @@ func (bf *bloomFilter) Query(key []byte) bool {
 // merge and compress periodically,for perform multi-sectionDiskFile.And discard
 // old data that has been overwritten or deleted.
 
+// RBTree is written by one goroutine at a time and read concurrently,readers
+// and iterators take the read lock.A key is kept in one node,a newer write of
+// the key replace the entry of the node.
 type RBTree struct {
-	mu           *sync.Mutex
-	root         *RBTreeNode
-	pairs        []entry
-	full         bool
-	dataSize     int
-	ssTableIndex int
+	mu       sync.RWMutex
+	root     *RBTreeNode
+	keyNum   int
+	dataSize int64
 }
 
+var rbNodeSize = int64(unsafe.Sizeof(RBTreeNode{}))
+
 type RBTreeNode struct {
-	key    []byte
-	value  []byte
-	color  bool //true is red,false is black.
-	left   *RBTreeNode
-	right  *RBTreeNode
-	parent *RBTreeNode
+	key     []byte
+	value   []byte
+	keyType byte
+	seq     uint64
+	color   bool //true is red,false is black.
+	left    *RBTreeNode
+	right   *RBTreeNode
+	parent  *RBTreeNode
+}
+
+// rbIterator walk the tree in order through the parent links.
+type rbIterator struct {
+	tree *RBTree
+	node *RBTreeNode
 }
 
 func (lsm *LSMTree) initRBTree() *RBTree {
-	lsm.mu.Lock()
-	defer lsm.mu.Unlock()
 	tree := new(RBTree)
-	tree.full = false
-	lsm.ssTableNum++
-	tree.ssTableIndex = lsm.ssTableNum
-	lsm.table.str = tree
 	return tree
 }
 
-func (rb *RBTree) findInsertSite(key []byte, node *RBTreeNode) (*RBTreeNode, *RBTreeNode) {
-	if bytes.Compare(key, node.key) == 1 {
-		if node.right == nil {
-			return node, node.right
-		}
-		rb.findInsertSite(key, node.right)
-	} else {
-		if node.left == nil {
-			return node, node.left
-		}
-		rb.findInsertSite(key, node.left)
+func colorOf(node *RBTreeNode) bool {
+	if node == nil {
+		return black
 	}
-	return nil, nil
+	return node.color
 }
 
-func (rb *RBTree) reAdjustColor(cur *RBTreeNode) {
-	var uncle *RBTreeNode
-	parent := cur.parent
-	pParent := cur.parent.parent
-	if cur == cur.parent.left {
-		uncle = cur.parent.right
-	} else {
-		uncle = cur.parent.left
+// leftSpin turn the right child of cur into the parent of cur.
+func (rb *RBTree) leftSpin(cur *RBTreeNode) {
+	child := cur.right
+	cur.right = child.left
+	if child.left != nil {
+		child.left.parent = cur
 	}
-	if pParent == rb.root {
-		parent.color = black
-		uncle.color = black
-		return
+	rb.replaceChild(cur, child)
+	child.left = cur
+	cur.parent = child
+}
+
+// rightSpin turn the left child of cur into the parent of cur.
+func (rb *RBTree) rightSpin(cur *RBTreeNode) {
+	child := cur.left
+	cur.left = child.right
+	if child.right != nil {
+		child.right.parent = cur
 	}
-	parent.color = black
-	uncle.color = black
-	pParent.color = red
-	rb.reAdjustColor(pParent)
-}
-
-func (rb *RBTree) rightSignSpin(cur *RBTreeNode) {
-	var tmpRoot *RBTreeNode
-	parent := cur
-	pParent := cur.parent
-	if pParent == rb.root {
-		parent.right = pParent
-		pParent.color = red
-		pParent.left = nil
-		pParent.parent = parent
-		rb.root = parent
-		rb.root.color = black
-		return
+	rb.replaceChild(cur, child)
+	child.right = cur
+	cur.parent = child
+}
+
+// replaceChild put node at the place of old under the parent of old.
+func (rb *RBTree) replaceChild(old, node *RBTreeNode) {
+	parent := old.parent
+	if node != nil {
+		node.parent = parent
+	}
+	if parent == nil {
+		rb.root = node
+	} else if parent.left == old {
+		parent.left = node
 	} else {
-		tmpRoot = pParent.parent
-		if tmpRoot.left == pParent {
-			parent.right = pParent
-			pParent.color = red
-			pParent.left = nil
-			pParent.parent = parent
-			tmpRoot.left = parent
-			tmpRoot.left.color = black
-			return
+		parent.right = node
+	}
+}
+
+// findNode return the node of key or nil.
+func (rb *RBTree) findNode(key []byte) *RBTreeNode {
+	cur := rb.root
+	for cur != nil {
+		cmp := bytes.Compare(key, cur.key)
+		if cmp == 0 {
+			return cur
+		} else if cmp > 0 {
+			cur = cur.right
 		} else {
-			parent.right = pParent
-			pParent.color = red
-			pParent.left = nil
-			pParent.parent = parent
-			tmpRoot.right = parent
-			tmpRoot.right.color = black
-			return
+			cur = cur.left
 		}
 	}
+	return nil
 }
 
-func (rb *RBTree) leftSignSpin(cur *RBTreeNode) {
-	var tmpRoot *RBTreeNode
-	parent := cur
-	pParent := cur.parent
-	if pParent == rb.root {
-		parent.left = rb.root
-		pParent.color = red
-		pParent.right = nil
-		pParent.parent = parent
-		rb.root = parent
-		rb.root.color = black
-		return
-	} else {
-		tmpRoot = pParent.parent
-		if tmpRoot.left == pParent {
-			parent.left = pParent
-			pParent.color = red
-			pParent.right = nil
-			pParent.parent = parent
-			tmpRoot.left = parent
-			tmpRoot.left.color = black
-			return
+// seekNode return the first node whose key >= key.
+func (rb *RBTree) seekNode(key []byte) *RBTreeNode {
+	var found *RBTreeNode
+	for cur := rb.root; cur != nil; {
+		if bytes.Compare(cur.key, key) >= 0 {
+			found = cur
+			cur = cur.left
 		} else {
-			parent.left = pParent
-			pParent.color = red
-			pParent.right = nil
-			pParent.parent = parent
-			tmpRoot.right = parent
-			tmpRoot.right.color = black
-			return
+			cur = cur.right
 		}
 	}
+	return found
 }
 
-func (rbn *RBTreeNode) insertData(key []byte, value []byte, parent *RBTreeNode) {
-	rbn.key = key
-	rbn.value = value
-	rbn.parent = parent
-	rbn.color = red
-	return
+// seekPrevNode return the last node whose key <= key.
+func (rb *RBTree) seekPrevNode(key []byte) *RBTreeNode {
+	var found *RBTreeNode
+	for cur := rb.root; cur != nil; {
+		if bytes.Compare(cur.key, key) <= 0 {
+			found = cur
+			cur = cur.right
+		} else {
+			cur = cur.left
+		}
+	}
+	return found
 }
 
-func (rb *RBTree) addDataSize(key []byte, value []byte) {
-	tmpDataPair := new(entry)
-	tmpDataPair.key = key
-	tmpDataPair.value = value
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.BigEndian, tmpDataPair)
-	if err != nil {
-		rb.addDataSize(key, value)
-		return
+func minNode(node *RBTreeNode) *RBTreeNode {
+	for node != nil && node.left != nil {
+		node = node.left
 	}
-	rb.dataSize += buf.Len()
-	if rb.dataSize > tableMaxSize {
-		rb.full = true
-	}
-	return
+	return node
 }
 
-func (rb *RBTree) insert(key []byte, value []byte) {
-	var lsm *LSMTree
-	var parent *RBTreeNode
-	var uncle *RBTreeNode
-	rb.addDataSize(key, value)
-	err := lsm.writeRestoreLog(key, value, "insert")
-	if err != nil {
-		return
+func maxNode(node *RBTreeNode) *RBTreeNode {
+	for node != nil && node.right != nil {
+		node = node.right
 	}
-	if rb.root == nil {
-		rb.root = new(RBTreeNode)
-		rb.root.key = key
-		rb.root.value = value
-		rb.root.color = black
-		return
-	}
-	insertSite := new(RBTreeNode)
-	parent, insertSite = rb.findInsertSite(key, rb.root)
-	if parent.color == black {
-		insertSite.insertData(key, value, parent)
-		return
+	return node
+}
+
+func (rbn *RBTreeNode) next() *RBTreeNode {
+	if rbn.right != nil {
+		return minNode(rbn.right)
 	}
-	insertSite.insertData(key, value, parent)
-	cur := insertSite
-	pParent := parent.parent
-	if parent.left == cur {
-		uncle = parent.right
-	} else {
-		uncle = parent.left
+	cur := rbn
+	for cur.parent != nil && cur == cur.parent.right {
+		cur = cur.parent
 	}
-	if uncle != nil && uncle.color == red {
-		rb.reAdjustColor(cur)
-		return
+	return cur.parent
+}
+
+func (rbn *RBTreeNode) prev() *RBTreeNode {
+	if rbn.left != nil {
+		return maxNode(rbn.left)
 	}
-	if cur == parent.left && parent == pParent.left {
-		rb.rightSignSpin(cur.parent)
-	} else if cur == parent.right && parent == pParent.right {
-		rb.leftSignSpin(cur.parent)
-	} else if cur == parent.right && parent == pParent.left {
-		rb.leftSignSpin(cur)
-		cur.color = red
-		rb.rightSignSpin(cur)
-	} else if cur == parent.left && parent == pParent.right {
-		rb.rightSignSpin(cur)
-		cur.color = red
-		rb.leftSignSpin(cur)
+	cur := rbn
+	for cur.parent != nil && cur == cur.parent.left {
+		cur = cur.parent
 	}
-	return
+	return cur.parent
 }
 
-func (rbn *RBTreeNode) deleteLeafAdjust(parent *RBTreeNode) {
-	if rbn.color == black {
-		if rbn.left == nil && rbn.right == nil {
-			if parent.color == red {
-				parent.left = nil
-				parent.color = black
-				rbn.color = red
-			} else {
-				parent.left = nil
-				rbn.color = red
-				// in order to maintain number of black, have to adjust.
-			}
-		} else if rbn.left.color == red {
-			parent.left = nil
-			newParent := rbn.left
-			if parent == parent.parent.left {
-				parent.parent.left = newParent
-			} else {
-				parent.parent.right = newParent
-			}
-			newParent.parent = parent.parent
-			newParent.color = parent.color
-			newParent.left = parent
-			newParent.right = rbn
-			parent.color = black
-			parent.parent = newParent
-			rbn.parent = newParent
-			rbn.left = nil
-		} else if rbn.right.color == red {
-			parent.left = nil
-			newParent := rbn
-			if parent == parent.parent.left {
-				parent.parent.left = newParent
-			} else {
-				parent.parent.right = newParent
+// addDataSize count the node,key and value of an insert.
+func (rb *RBTree) addDataSize(key []byte, value []byte) {
+	rb.dataSize += rbNodeSize + int64(len(key)) + int64(len(value))
+}
+
+func (rb *RBTree) memoryUsage() int64 {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+	return rb.dataSize
+}
+
+// insert replace the entry of an existing key if seq is newer,otherwise link a
+// red leaf and restore the colors.
+func (rb *RBTree) insert(key []byte, value []byte, keyType byte, seq uint64) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	var parent *RBTreeNode
+	cur := rb.root
+	cmp := 0
+	for cur != nil {
+		parent = cur
+		cmp = bytes.Compare(key, cur.key)
+		if cmp == 0 {
+			if cur.seq < seq {
+				rb.dataSize += int64(len(value)) - int64(len(cur.value))
+				cur.value = append([]byte(nil), value...)
+				cur.keyType = keyType
+				cur.seq = seq
 			}
-			newParent.parent = parent.parent
-			newParent.color = parent.color
-			newParent.left = parent
-			newParent.right.color = black
-			parent.color = black
-			parent.right = rbn.left
-			parent.parent = newParent
-			newParent.right.parent = parent
+			return
+		} else if cmp > 0 {
+			cur = cur.right
+		} else {
+			cur = cur.left
 		}
+	}
+	node := &RBTreeNode{
+		key:     append([]byte(nil), key...),
+		value:   append([]byte(nil), value...),
+		keyType: keyType,
+		seq:     seq,
+		color:   red,
+		parent:  parent,
+	}
+	if parent == nil {
+		rb.root = node
+	} else if cmp > 0 {
+		parent.right = node
 	} else {
-		parent.left = nil
-		if parent == parent.parent.left {
-			parent.parent.left = rbn
+		parent.left = node
+	}
+	rb.addDataSize(key, value)
+	rb.keyNum++
+	rb.insertAdjust(node)
+}
+
+// insertAdjust fix the red node cur whose parent may be red too.
+func (rb *RBTree) insertAdjust(cur *RBTreeNode) {
+	for cur.parent != nil && cur.parent.color == red {
+		parent := cur.parent
+		pParent := parent.parent
+		if parent == pParent.left {
+			uncle := pParent.right
+			if colorOf(uncle) == red {
+				parent.color, uncle.color, pParent.color = black, black, red
+				cur = pParent
+				continue
+			}
+			if cur == parent.right {
+				cur = parent
+				rb.leftSpin(cur)
+				parent = cur.parent
+			}
+			parent.color, pParent.color = black, red
+			rb.rightSpin(pParent)
 		} else {
-			parent.parent.right = rbn
+			uncle := pParent.left
+			if colorOf(uncle) == red {
+				parent.color, uncle.color, pParent.color = black, black, red
+				cur = pParent
+				continue
+			}
+			if cur == parent.left {
+				cur = parent
+				rb.rightSpin(cur)
+				parent = cur.parent
+			}
+			parent.color, pParent.color = black, red
+			rb.leftSpin(pParent)
 		}
-		parent.right = rbn.left
-		rbn.left.parent = parent
-		rbn.left = parent
-		rbn.parent = parent.parent
-		parent.parent = rbn
-		parent.color = red
-		rbn.color = black
 	}
+	rb.root.color = black
 }
 
+// delete unlink the node of key,a node with two children is replaced by its
+// successor.If a black node is removed,the colors are restored from its child.
 func (rb *RBTree) delete(key []byte) bool {
-	result := rb.root.findNode(key)
-	if result.rb == nil {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	node := rb.findNode(key)
+	if node == nil {
 		return false
 	}
-	parent := result.rb.parent
-	if result.rb.left == nil && result.rb.right == nil { // deleted node is a leaf node.
-		if result.rb.color == red {
-			if result.rb == parent.left {
-				parent.left = nil
-			} else {
-				parent.right = nil
-			}
+	rb.dataSize -= rbNodeSize + int64(len(node.key)) + int64(len(node.value))
+	rb.keyNum--
+	removedColor := node.color
+	var child, parent *RBTreeNode
+	if node.left == nil {
+		child, parent = node.right, node.parent
+		rb.replaceChild(node, node.right)
+	} else if node.right == nil {
+		child, parent = node.left, node.parent
+		rb.replaceChild(node, node.left)
+	} else {
+		successor := minNode(node.right)
+		removedColor = successor.color
+		child = successor.right
+		if successor.parent == node {
+			parent = successor
 		} else {
-			if result.rb == parent.left {
-				bro := parent.right
-				bro.deleteLeafAdjust(parent)
-			} else {
-				bro := parent.left
-				bro.deleteLeafAdjust(parent)
-			}
+			parent = successor.parent
+			rb.replaceChild(successor, successor.right)
+			successor.right = node.right
+			successor.right.parent = successor
 		}
+		rb.replaceChild(node, successor)
+		successor.left = node.left
+		successor.left.parent = successor
+		successor.color = node.color
 	}
-	if result.rb.left == nil || result.rb.right != nil {
-		child := result.rb.right
-		if result.rb == result.rb.parent.left {
-			result.rb.parent.left = child
-		} else {
-			result.rb.parent.right = child
-		}
-		child.parent = result.rb.parent
-		child.color = black
-	} else if result.rb.left != nil || result.rb.right == nil {
-		child := result.rb.left
-		if result.rb == result.rb.parent.left {
-			result.rb.parent.left = child
+	if removedColor == black {
+		rb.deleteAdjust(child, parent)
+	}
+	return true
+}
+
+// deleteAdjust give cur,which may be nil,the black lost by the delete.
+func (rb *RBTree) deleteAdjust(cur, parent *RBTreeNode) {
+	for cur != rb.root && colorOf(cur) == black {
+		if cur == parent.left {
+			bro := parent.right
+			if colorOf(bro) == red {
+				bro.color, parent.color = black, red
+				rb.leftSpin(parent)
+				bro = parent.right
+			}
+			if colorOf(bro.left) == black && colorOf(bro.right) == black {
+				bro.color = red
+				cur, parent = parent, parent.parent
+				continue
+			}
+			if colorOf(bro.right) == black {
+				bro.left.color, bro.color = black, red
+				rb.rightSpin(bro)
+				bro = parent.right
+			}
+			bro.color, parent.color = parent.color, black
+			bro.right.color = black
+			rb.leftSpin(parent)
 		} else {
-			result.rb.parent.right = child
+			bro := parent.left
+			if colorOf(bro) == red {
+				bro.color, parent.color = black, red
+				rb.rightSpin(parent)
+				bro = parent.left
+			}
+			if colorOf(bro.left) == black && colorOf(bro.right) == black {
+				bro.color = red
+				cur, parent = parent, parent.parent
+				continue
+			}
+			if colorOf(bro.left) == black {
+				bro.right.color, bro.color = black, red
+				rb.leftSpin(bro)
+				bro = parent.left
+			}
+			bro.color, parent.color = parent.color, black
+			bro.left.color = black
+			rb.rightSpin(parent)
 		}
-		child.parent = result.rb.parent
-		child.color = black
+		cur = rb.root
 	}
-	if result.rb.left != nil && result.rb.right != nil {
-		tmpKey := result.rb.right.key
-		result.rb.right.key = result.rb.key
-		result.rb.key = tmpKey
-		result.rb.value = result.rb.right.value
-		rb.delete(key)
+	if cur != nil {
+		cur.color = black
 	}
-	return true
 }
 
 func (rb *RBTree) changeValue(key []byte, newValue []byte) bool {
-	result := rb.root.findNode(key)
-	if result.rb == nil {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	node := rb.findNode(key)
+	if node == nil {
 		return false
-	} else {
-		result.rb.value = newValue
-		return true
 	}
+	node.value = append([]byte(nil), newValue...)
+	return true
 }
 
+// find copy the entry under the read lock,the node may be replaced by a later write.
 func (rb *RBTree) find(key []byte) *findResult {
-	return rb.root.findNode(key)
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+	node := rb.findNode(key)
+	if node == nil {
+		return nil
+	}
+	return &findResult{e: node.entry()}
 }
 
-func (rbn *RBTreeNode) findNode(key []byte) *findResult {
-	if bytes.Compare(key, rbn.key) == 0 {
-		return &findResult{rbn, nil}
-	} else if bytes.Compare(key, rbn.key) == 1 {
-		if rbn.right == nil {
-			return nil
-		}
-		rbn.right.findNode(key)
-	} else {
-		if rbn.left == nil {
-			return nil
-		}
-		rbn.left.findNode(key)
+func (rb *RBTree) seek(key []byte) []byte {
+	it := rb.NewIterator()
+	it.Seek(key)
+	return it.Key()
+}
+
+func (rbn *RBTreeNode) entry() *memEntry {
+	return &memEntry{
+		keyLen:   len(rbn.key) + 1,
+		key:      rbn.key,
+		keyType:  rbn.keyType,
+		seq:      rbn.seq,
+		valueLen: len(rbn.value),
+		value:    rbn.value,
 	}
-	return nil
 }
 
-func (rb *RBTree) inorder(cur *RBTreeNode, num *int) {
-	if cur == nil {
-		return
+// export return every key of the tree in order,tombstones included.
+func (rb *RBTree) export() *[]pairs {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+	data := make([]pairs, 0, rb.keyNum)
+	for node := minNode(rb.root); node != nil; node = node.next() {
+		tmpEntry := new(pairs)
+		tmpEntry.setEntry(node.key, node.value, node.seq, node.keyType)
+		data = append(data, *tmpEntry)
 	}
-	rb.inorder(cur.left, num)
-	rb.pairs[*num].key = cur.key
-	rb.pairs[*num].value = cur.value
-	*num++
-	rb.inorder(cur.right, num)
+	return &data
 }
 
-func (lsm *LSMTree) setMemoryHash(key []byte, offSet int64, ssTableNum int) {
-	lsm.mu.Lock()
-	defer lsm.mu.Unlock()
-	tmpMap := lsm.memoryHash[ssTableNum]
-	(*tmpMap)[&key] = offSet
-	return
+func (rb *RBTree) NewIterator() IIterator {
+	return &rbIterator{tree: rb}
 }
 
-func (lsm *LSMTree) encodingToBuf(instance *RBTree) (*bytes.Buffer, error) {
-	var num *int
-	var curSize int
-	root := instance.root
-	instance.inorder(root, num)
-	buf := new(bytes.Buffer)
-	for i := 0; i < len(instance.pairs); i++ {
-		err := binary.Write(buf, binary.BigEndian, instance.pairs[i])
-		if err != nil {
-			return nil, err
-		}
-		curSize += buf.Len()
-		if curSize > 4096 {
-			lsm.setMemoryHash(instance.pairs[i+1].key, int64(curSize), instance.ssTableIndex)
-		}
-	}
-	return buf, nil
+func (it *rbIterator) Valid() bool {
+	return it.node != nil
 }
 
-func (lsm *LSMTree) writeToDisk(buf *bytes.Buffer) error {
-	var tmpLen int
-	var err, err1, err2 error
-	lsm.mu.Lock()
-	defer lsm.mu.Unlock()
-	lsm.ssTableFile[lsm.ssTableNum], err = os.Create("SSTable" + strconv.Itoa(lsm.ssTableNum))
-	if err != nil {
-		return err
-	}
-	for i := 0; i < 4194304; i += tmpLen {
-		tmpData := new([]byte)
-		_, err1 = buf.Read(*tmpData)
-		if err1 != nil {
-			return err1
-		}
-		tmpLen, err2 = lsm.ssTableFile[lsm.ssTableNum].Write(*tmpData)
-		if err2 != nil {
-			return err2
-		}
-	}
-	lsm.ssTableNum++
-	return nil
+func (it *rbIterator) SeekToFirst() {
+	it.tree.mu.RLock()
+	it.node = minNode(it.tree.root)
+	it.tree.mu.RUnlock()
 }
 
-/*
-func (lsm *LSMTree) syncToDisk() {
-	var wg sync.WaitGroup
-	for {
-		if lsm.table.fulled == true {
-			wg.Add(1)
-			go func() {
-				buf, err := lsm.encodingToBuf(lsm.table.str)
-				if err != nil {
-					buf, err = lsm.encodingToBuf(lsm.table.str)
-				}
-				err1 := lsm.writeToDisk(buf)
-				if err1 != nil {
-					err1 = lsm.writeToDisk(buf)
-				}
-				wg.Done()
-				lsm.memTable[i] = nil
-			}()
-		}
-		wg.Wait()
-		randTime := 200 + rand.Intn(randTimeSection)
-		time.Sleep(time.Duration(randTime) * time.Millisecond)
+func (it *rbIterator) SeekToLast() {
+	it.tree.mu.RLock()
+	it.node = maxNode(it.tree.root)
+	it.tree.mu.RUnlock()
+}
+
+func (it *rbIterator) Seek(target []byte) {
+	it.tree.mu.RLock()
+	it.node = it.tree.seekNode(target)
+	it.tree.mu.RUnlock()
+}
+
+func (it *rbIterator) SeekForPrev(target []byte) {
+	it.tree.mu.RLock()
+	it.node = it.tree.seekPrevNode(target)
+	it.tree.mu.RUnlock()
+}
+
+func (it *rbIterator) Next() {
+	if it.node == nil {
+		return
 	}
+	it.tree.mu.RLock()
+	it.node = it.node.next()
+	it.tree.mu.RUnlock()
 }
-*/
 
-func (lsm *LSMTree) writeRestoreLog(key []byte, value []byte, preFix string) error {
-	tmpLogEntry := new(logEntry)
-	tmpLogEntry.data.key = key
-	tmpLogEntry.data.value = value
-	tmpLogEntry.nowTime = time.Now()
-	tmpLogEntry.logPrefix = preFix
-	data, err := json.Marshal(tmpLogEntry)
-	if err != nil {
-		return err
+func (it *rbIterator) Prev() {
+	if it.node == nil {
+		return
 	}
-	_, err1 := lsm.writeAheadLog.Write(data)
-	if err1 != nil {
-		return err1
+	it.tree.mu.RLock()
+	it.node = it.node.prev()
+	it.tree.mu.RUnlock()
+}
+
+func (it *rbIterator) Key() []byte {
+	if it.node == nil {
+		return nil
 	}
-	return nil
+	return it.node.key
 }
 
-// return the start-end offset section of the key in memory hash and the segment number.
-func (lsm *LSMTree) searchInSparseHash(key []byte) ([]int64, []int64, []int) {
-	var start, end []int64
-	var segment []int
-	num := 0
-	for i := lsm.ssTableNum; i > 0; i-- {
-		var keys keySet
-		keyNum := 0
-		for hashKey := range *lsm.memoryHash[i] {
-			keys[keyNum] = *hashKey
-			keyNum++
-		}
-		sort.Sort(keys)
-		index := sort.Search(len(keys), func(i int) bool {
-			return bytes.Compare(keys[i], key) == 1
-		})
-		if index == 0 {
-			start[num] = 0
-			end[num] = (*lsm.memoryHash[i])[&keys[index]]
-		} else if index == len(keys) {
-			start[num] = (*lsm.memoryHash[i])[&keys[index-1]]
-			end[num] = -1
-		} else {
-			start[num] = (*lsm.memoryHash[i])[&keys[index-1]]
-			end[num] = (*lsm.memoryHash[i])[&keys[index]]
-		}
-		segment[num] = i
-		num++
+func (it *rbIterator) Value() []byte {
+	if it.node == nil {
+		return nil
 	}
-	return start, end, segment
+	it.tree.mu.RLock()
+	defer it.tree.mu.RUnlock()
+	return it.node.value
 }
 
-func (rb *RBTree) export() *[]pairs {
-	data := make([]pairs, 10000)
-	return &data
+func (it *rbIterator) Error() error {
+	return nil
 }
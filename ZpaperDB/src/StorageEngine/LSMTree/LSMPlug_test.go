@@ -1,14 +1,16 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
+	"sort"
 	"strconv"
 	"testing"
 )
 
 func TestHashFunc(t *testing.T) {
-	expe := []uint64{93, 1440, 780, 1825, 1722, 827}
+	expe := []uint64{1783, 1729, 1675, 1621, 1567, 1513}
 	bf, _ := MakeBloomFilter(0.01, 200)
 	byteSet := []byte{1, 2, 3}
 	hashValueSet := bf.mappingByHash(byteSet)
@@ -19,6 +21,60 @@ func TestHashFunc(t *testing.T) {
 	}
 }
 
+func TestXXHash64(t *testing.T) {
+	if xxHash64(nil, 0) != 0xEF46DB3751D8E999 {
+		t.Error("xxHash64 of empty input error.")
+	}
+	if xxHash64([]byte("abc"), 0) != 0x44BC2CF5AD770999 {
+		t.Error("xxHash64 of short input error.")
+	}
+	if xxHash64([]byte("Nobody inspects the spammish repetition"), 0) != 0xFBCEA83C8A378BF1 {
+		t.Error("xxHash64 of long input error.")
+	}
+}
+
+func TestBloomFilterManyProbes(t *testing.T) {
+	bf, _ := MakeBloomFilter(0.0001, 1000)
+	if bf.HashNum <= 6 {
+		t.Fatal("Bloom filter hash number error,want > 6.")
+	}
+	for i := 0; i < 1000; i++ {
+		bf.Add(binaryData(strconv.Itoa(i)))
+	}
+	falseNum := 0
+	for i := 1000; i < 11000; i++ {
+		if bf.Query(binaryData(strconv.Itoa(i))) {
+			falseNum++
+		}
+	}
+	if falseNum > 10 {
+		t.Error("Bloom filter false positive too much:", falseNum)
+	}
+}
+
+func TestBloomFilterPolicy(t *testing.T) {
+	policy, err := MakeBloomFilterPolicy(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = binaryData(strconv.Itoa(i))
+	}
+	filterData := policy.CreateFilter(keys)
+	for _, key := range keys {
+		if !policy.KeyMayMatch(key, filterData) {
+			t.Fatal("Filter policy lose key", string(key))
+		}
+	}
+	if !policy.KeyMayMatch([]byte("x"), filterData[:3]) {
+		t.Error("Broken filter must match every key.")
+	}
+	if _, err = MakeBloomFilterPolicy(0); err == nil {
+		t.Error("Filter policy accept fpp 0.")
+	}
+}
+
 func TestBloomFilter_Add(t *testing.T) {
 	bf, _ := MakeBloomFilter(0.01, 200)
 	for i := 0; i < 100; i++ {
@@ -67,3 +123,97 @@ func TestPlugMessy(t *testing.T) {
 	}
 	fmt.Println(bf.mappingByHash(byteSet))
 }
+
+// checkRBTree verify the order,the parent links and the colors of the tree,
+// return the black height.
+func checkRBTree(t *testing.T, node *RBTreeNode) int {
+	if node == nil {
+		return 1
+	}
+	if node.left != nil && (node.left.parent != node || bytes.Compare(node.left.key, node.key) >= 0) {
+		t.Fatal("Left child is out of order or lose its parent.")
+	}
+	if node.right != nil && (node.right.parent != node || bytes.Compare(node.right.key, node.key) <= 0) {
+		t.Fatal("Right child is out of order or lose its parent.")
+	}
+	if node.color == red && (colorOf(node.left) == red || colorOf(node.right) == red) {
+		t.Fatal("Red node has a red child.")
+	}
+	height := checkRBTree(t, node.left)
+	if height != checkRBTree(t, node.right) {
+		t.Fatal("Black height of the children differ.")
+	}
+	if node.color == black {
+		height++
+	}
+	return height
+}
+
+// TestRBTreeRandom run random inserts,stale inserts and deletes against a map.
+func TestRBTreeRandom(t *testing.T) {
+	var lsmTree *LSMTree
+	rb := lsmTree.initRBTree()
+	rnd := rand.New(rand.NewSource(1))
+	model := make(map[string]*memEntry)
+	for seq := uint64(1); seq <= 30000; seq++ {
+		key := []byte(strconv.Itoa(rnd.Intn(3000)))
+		switch op := rnd.Intn(10); {
+		case op < 3:
+			_, ok := model[string(key)]
+			if rb.delete(key) != ok {
+				t.Fatalf("Delete key %s return %v,want %v", key, !ok, ok)
+			}
+			delete(model, string(key))
+		case op == 3:
+			rb.insert(key, []byte("stale"), typeValue, 0)
+			if _, ok := model[string(key)]; !ok {
+				model[string(key)] = &memEntry{key: key, value: []byte("stale"), keyType: typeValue}
+			}
+		default:
+			keyType := byte(typeValue)
+			if op == 4 {
+				keyType = typeDeletion
+			}
+			value := []byte(strconv.FormatUint(seq, 10))
+			rb.insert(key, value, keyType, seq)
+			model[string(key)] = &memEntry{key: key, value: value, keyType: keyType, seq: seq}
+		}
+		if seq%1000 == 0 {
+			if colorOf(rb.root) != black {
+				t.Fatal("Root is not black.")
+			}
+			checkRBTree(t, rb.root)
+		}
+	}
+	keys := make([]string, 0, len(model))
+	for key := range model {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data := *rb.export()
+	if len(data) != len(keys) {
+		t.Fatalf("Export %d entries,want %d", len(data), len(keys))
+	}
+	for i := range data {
+		want := model[keys[i]]
+		seq, keyType := data[i].trailer()
+		if string(data[i].userKey()) != keys[i] || seq != want.seq || keyType != want.keyType || !bytes.Equal(data[i].value, want.value) {
+			t.Fatalf("Export entry %d is %s,want %s", i, data[i].userKey(), keys[i])
+		}
+	}
+	for i := 0; i < 3100; i++ {
+		key := strconv.Itoa(i)
+		result := rb.find([]byte(key))
+		want, ok := model[key]
+		if (result != nil) != ok || ok && result.memEntry().seq != want.seq {
+			t.Fatalf("Find key %s error.", key)
+		}
+	}
+	checkIterator(t, rb.NewIterator(), keys, rnd)
+	for _, key := range keys {
+		rb.delete([]byte(key))
+	}
+	if rb.root != nil || len(*rb.export()) != 0 || rb.memoryUsage() != 0 {
+		t.Fatal("Tree is not empty after deleting every key.")
+	}
+}
@@ -2,13 +2,12 @@ package storage
 
 import (
 	"bytes"
-	"encoding/binary"
-	"ini"
-	"io"
-	"log"
+	"errors"
 	"os"
-	"sort"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,6 +30,17 @@ const (
 	//fpp                = 0.05    // for the time false positive probability being as 0.05
 	//exceptedInsertions = 10000   // for the time excepted insertions being as 10000
 	randTimeSection = 200 // ms/second
+	maxLevel        = 7
+)
+
+// keyType of an entry,the tombstone of a key is an entry of typeDeletion.
+const (
+	typeDeletion      byte = 0x0
+	typeValue         byte = 0x1
+	typeRangeDeletion byte = 0x2
+	typeValueTTL      byte = 0x3 // the value is prefixed by its expiry time
+	typeMerge         byte = 0x4 // the value is a list of merge operands
+	typeValuePointer  byte = 0x5 // the value is a pointer into a value log
 )
 
 // Skip list nature:
@@ -47,33 +57,90 @@ const (
 // All of above condition is in order to ensure that
 // the longest path no more than double of the shortest path.
 
+// LSMTree is the default column family of the database,every column family is
+// an LSMTree of its own memory tables,levels and options.The families share the
+// dbState,so a WriteBatch spanning families is one record of the write ahead log.
 type LSMTree struct {
+	*dbState
+	family          *ColumnFamilyHandle
+	dropped         bool
+	opts            *Options
+	memType         string
+	maxMemSize      int
+	table           *memTable
+	imm             *memTable
+	levels          [][]*fileMeta
+	compactPointer  [][]byte
+	maxFileNum      int
+	snappy          byte
+	filterPolicy    FilterPolicy
+	prefixExtractor PrefixExtractor
+	compress        *compaction
+	picker          CompactionPicker
+	stats           familyStats
+	reads           readStats
+	flushMu         sync.Mutex // serialize the flushes of the column family
+	compactMu       sync.Mutex // serialize the compactions of the column family
+}
+
+// dbState is shared by the column families of one database.
+type dbState struct {
 	mu            *sync.Mutex
-	table         *memTable
-	memoryHash    []*map[*[]byte]int64
-	ssTableFile   []*os.File
-	ssTableNum    int
-	levelNum      []uint8
-	compress      *compaction
-	writeAheadLog *os.File
+	bgMu          *sync.RWMutex // held shared by flushes and compactions,Close take it to wait for them
+	bgCond        *sync.Cond    // broadcast when the levels change or the tree is closed
+	closing       chan struct{}
+	closed        bool
+	scheduler     *scheduler
+	rateLimiter   *rateLimiter
+	stall         writeStall
+	lock          *fileLock
+	dir           string
+	seq           uint64
+	nextFileNum   uint64
+	writeAheadLog *logWriter
+	walBytes      int64
+	values        *valueLog
+	dbOpts        *Options
+	familyOpts    map[string]*Options
+	families      map[uint32]*LSMTree
+	nextFamilyID  uint32
+
+	// value logs which are written but no installed SSTable point to yet
+	pendingValueLogs map[uint64]bool
+	// tables out of the levels which reads still use,see fileMeta.refs
+	removedTables map[*fileMeta]bool
+
+	bgErr       error // the writes are stopped until Resume,see BackgroundError.go
+	bgErrReason string
+
+	eventMu sync.Mutex            // serialize deliverEvents
+	events  []func(EventListener) // queued under mu for the listener
 }
 
-type entry struct {
-	key       []byte
-	value     []byte
-	tombstone bool
+var (
+	ErrNotFound = errors.New("zpaperdb: not found")
+	ErrClosed   = errors.New("zpaperdb: closed")
+	ErrLocked   = errors.New("zpaperdb: directory is locked by another handle") // not returned on windows
+	ErrReadOnly = errors.New("zpaperdb: read only")
+)
+
+const lockFileName = "LOCK"
+
+type WriteArgs struct {
+	Key   []byte
+	Value []byte
 }
 
-type logEntry struct {
-	logPrefix string
-	nowTime   time.Time
-	data      *entry
+type WriteReply struct {
 }
 
+// AddArgs with a positive TTL write a key which expire after TTL,its KeyType
+// is typeValueTTL.
 type AddArgs struct {
 	Key     []byte
 	KeyType byte
 	Value   []byte
+	TTL     time.Duration
 }
 
 type AddReply struct {
@@ -100,164 +167,492 @@ type DeleteReply struct {
 	err     error
 }
 
-func (lsm *LSMTree) initLSMTree() *LSMTree {
-	cfg, _ := ini.Load("lsm.ini")
-	memType := cfg.Section("MemTable").Key("memoryTableType").String()
+func (lsm *LSMTree) initLSMTree(opts *Options) (*LSMTree, error) {
+	opts, err := opts.resolve()
+	if err != nil {
+		return nil, err
+	}
+	state := new(dbState)
+	state.mu = new(sync.Mutex)
+	state.bgMu = new(sync.RWMutex)
+	state.bgCond = sync.NewCond(state.mu)
+	state.closing = make(chan struct{})
+	state.scheduler = makeScheduler()
+	state.rateLimiter = makeRateLimiter(opts.RateBytesPerSecond, opts.RateLimiterAutoTune, state.closing)
+	state.pendingValueLogs = make(map[uint64]bool)
+	state.removedTables = make(map[*fileMeta]bool)
+	state.nextFileNum = 1
+	state.families = make(map[uint32]*LSMTree)
+	state.nextFamilyID = 1
+	state.dbOpts = opts
+	return state.initColumnFamily(0, DefaultColumnFamilyName, opts)
+}
+
+// initColumnFamily make the column family id with the resolved opts.
+func (state *dbState) initColumnFamily(id uint32, name string, opts *Options) (*LSMTree, error) {
+	var err error
 	tree := new(LSMTree)
-	tree.ssTableFile = make([]*os.File, 10)
-	tree.levelNum = make([]uint8, 20)
-	tree.writeAheadLog, _ = os.Create("WAL")
-	tree.memoryHash = make([]*map[*[]byte]int64, 100)
-	for i := 0; i < 100; i++ {
-		tmpMap := make(map[*[]byte]int64)
-		tree.memoryHash[i] = &tmpMap
-	}
-	if memType == "skipList" {
-		tree.table.str = tree.initSkipList()
+	tree.dbState = state
+	tree.family = &ColumnFamilyHandle{id: id, name: name}
+	tree.opts = opts
+	tree.memType = opts.MemTableType
+	tree.maxMemSize = opts.MaxMemTableSize
+	tree.maxFileNum = opts.MaxFileOfOneLevel
+	if opts.SnappyCompression == true {
+		tree.snappy = 0x1
 	} else {
-		tree.table.str = tree.initRBTree()
+		tree.snappy = 0x0
+	}
+	tree.filterPolicy = opts.FilterPolicy
+	if tree.filterPolicy == nil {
+		tree.filterPolicy, err = MakeBloomFilterPolicy(opts.FilterFpp)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return tree
+	tree.prefixExtractor = opts.PrefixExtractor
+	tree.picker = makeCompactionPicker(opts)
+	tree.levels = make([][]*fileMeta, maxLevel)
+	tree.compactPointer = make([][]byte, maxLevel)
+	tree.table = tree.makeMemTable()
+	state.families[id] = tree
+	return tree, nil
 }
 
-func MakeLSMTree() (*LSMTree, error) {
-	var lsmTree *LSMTree
+// open lock dir,load its MANIFEST and replay the write ahead logs which are not
+// flushed yet into level0 SSTables,then start the write ahead log of new memory
+// tables.A column family only replay the logs from its own log number.A read
+// only open keep the replayed logs in the memory tables and never write the directory.
+func (lsm *LSMTree) open(dir string) error {
+	lsm.dir = dir
+	lsm.values = makeValueLog(dir)
+	readOnly := lsm.opts.ReadOnly
+	if !readOnly {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
 	var err error
-	lsmTree = lsmTree.initLSMTree()
+	lsm.lock, err = lockFile(filepath.Join(dir, lockFileName), readOnly)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if _, err = lsm.loadManifest(); err != nil {
+		return err
+	}
+	nums, err := logFiles(dir)
+	if err != nil {
+		return err
+	}
+	logNum := lsm.minLogNum()
+	for _, num := range nums {
+		if num >= lsm.nextFileNum {
+			lsm.nextFileNum = num + 1
+		}
+		if num < logNum {
+			continue
+		}
+		lastSeq, err := replayLog(lsm.logFileName(num), lsm.replayTables(num))
+		if err != nil {
+			return err
+		}
+		lsm.seq = maxSeq(lsm.seq, lastSeq)
+	}
+	if readOnly {
+		return nil
+	}
+	lsm.writeAheadLog, err = lsm.newLogWriter()
+	if err != nil {
+		return err
+	}
+	for _, family := range lsm.columnFamilies() {
+		recovered := family.table
+		family.table = family.makeMemTable()
+		family.table.logNum = lsm.writeAheadLog.num
+		meta, err := family.flushTable(lsm.newFileNum(), *recovered.str.export(), recovered.rangeDels)
+		if err != nil {
+			return err
+		}
+		if meta != nil {
+			family.levels[0] = append(family.levels[0], meta)
+			lsm.installValueLogs(meta)
+		}
+	}
+	if err = lsm.saveManifest(); err != nil {
+		return err
+	}
+	for _, num := range nums {
+		if num != lsm.writeAheadLog.num {
+			lsm.removeLog(num)
+		}
 	}
-	go lsmTree.MakeCompaction()
-	return lsmTree, nil
+	// a backup interrupted by a crash leave its checkpoint behind
+	if err = os.RemoveAll(filepath.Join(dir, backupCheckpointName)); err != nil {
+		return err
+	}
+	return lsm.removeObsoleteValueLogs()
 }
 
-func (lsm *LSMTree) RBAdd(args *AddArgs, reply *AddReply) error {
-	memoryStr := lsm.table
-	memoryStr.rwMu.Lock()
-	defer memoryStr.rwMu.Unlock()
-	if memoryStr.fulled != true {
-		memoryStr.str.insert(args.Key, args.Value)
-		reply.err = nil
-	} else {
-		lsm.mu.Lock()
-		lsm.table.str = lsm.initRBTree()
-		lsm.mu.Unlock()
-		err1 := lsm.RBAdd(args, reply)
-		if err1 != nil {
-			return err1
+// replayTables return the memory tables of the column families which replay
+// the log num,an operation of another family is skipped.
+func (lsm *LSMTree) replayTables(num uint64) func(family uint32) *memTable {
+	return func(id uint32) *memTable {
+		family := lsm.families[id]
+		if family == nil || num < family.table.logNum {
+			return nil
 		}
+		return family.table
 	}
-	return nil
 }
 
-func (lsm *LSMTree) RBGet(args *GetArgs, reply *GetReply) error {
-	memoryTree := lsm.table.str
-	tmpNode := memoryTree.find(args.Key)
-	if tmpNode != nil {
-		reply.Value = tmpNode.rb.value
-		reply.Found = true
-		reply.err = nil
-	} else {
-		start, end, segNum := lsm.searchInSparseHash(args.Key)
-		for i := 0; i < len(start); i++ {
-			if end[i] == -1 {
-				section := io.NewSectionReader(lsm.ssTableFile[segNum[i]], start[i], 1024)
-				end[i] = section.Size()
-			}
-			binaryData := make([]byte, end[i]-start[i])
-			_, err := lsm.ssTableFile[segNum[i]].ReadAt(binaryData, start[i])
-			if err != nil {
-				reply.Found = false
-				reply.err = err
-				return err
-			} else {
-				buf := new(bytes.Buffer)
-				buf.Write(binaryData)
-				var decodingData []entry
-				err1 := binary.Read(buf, binary.BigEndian, decodingData)
-				if err1 != nil {
-					reply.Found = false
-					reply.err = err1
-					return err1
-				}
-				var keys keySet
-				for index, pair := range decodingData {
-					keys[index] = pair.key
-				}
-				keyIndex := sort.Search(len(keys), func(i int) bool {
-					return bytes.Compare(keys[i], args.Key) == 0
-				})
-				if bytes.Compare(decodingData[keyIndex].key, args.Key) == 0 {
-					reply.Found = true
-					reply.Value = decodingData[keyIndex].value
-					reply.err = nil
-					return nil
-				} else {
-					continue
-				}
+// OpenLSMTree open the LSMTree saved in dir,a new one is created if dir is empty.
+// A nil opts use DefaultOptions,so do its column families.
+func OpenLSMTree(dir string, opts *Options) (*LSMTree, error) {
+	return OpenColumnFamilies(dir, opts, nil)
+}
+
+// MakeLSMTree open dir with the options of iniFile,like lsm.ini.
+func MakeLSMTree(dir, iniFile string) (*LSMTree, error) {
+	return OpenLSMTree(dir, &Options{IniFile: iniFile})
+}
+
+// Close stop the background work and close the files,the memory table is
+// recovered from its write ahead log by the next open.
+func (lsm *LSMTree) Close() error {
+	lsm.mu.Lock()
+	if lsm.closed {
+		lsm.mu.Unlock()
+		return ErrClosed
+	}
+	lsm.closed = true
+	close(lsm.closing)
+	lsm.bgCond.Broadcast()
+	lsm.mu.Unlock()
+	lsm.scheduler.close()
+	lsm.bgMu.Lock()
+	defer lsm.bgMu.Unlock()
+	return lsm.closeFiles()
+}
+
+func (lsm *LSMTree) closeFiles() error {
+	var err error
+	if lsm.writeAheadLog != nil {
+		err = lsm.writeAheadLog.close()
+	}
+	for _, family := range lsm.families {
+		for _, files := range family.levels {
+			for _, meta := range files {
+				meta.table.close()
 			}
 		}
-		reply.Found = false
+	}
+	if lsm.values != nil {
+		lsm.values.close()
+	}
+	if lsm.lock != nil {
+		lsm.lock.release()
+	}
+	return err
+}
+
+// Put is the rpc form of Write with one key.
+func (lsm *LSMTree) Put(args *WriteArgs, reply *WriteReply) error {
+	batch := new(WriteBatch)
+	batch.Put(args.Key, args.Value)
+	return lsm.Write(batch)
+}
+
+// Write apply the operations of batch atomically.
+func (lsm *LSMTree) Write(batch *WriteBatch) error {
+	if batch.Count() == 0 {
 		return nil
 	}
-	return nil
+	return lsm.write(batch)
+}
+
+// Get return ErrNotFound if key is absent or deleted.
+func (lsm *LSMTree) Get(key []byte) ([]byte, error) {
+	value, found, err := lsm.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (lsm *LSMTree) RBAdd(args *AddArgs, reply *AddReply) error {
+	if args.TTL > 0 {
+		args.KeyType = typeValueTTL
+		reply.err = lsm.PutWithTTL(args.Key, args.Value, args.TTL)
+		return reply.err
+	}
+	args.KeyType = typeValue
+	batch := new(WriteBatch)
+	batch.Put(args.Key, args.Value)
+	reply.err = lsm.write(batch)
+	return reply.err
 }
 
+func (lsm *LSMTree) RBGet(args *GetArgs, reply *GetReply) error {
+	reply.Value, reply.Found, reply.err = lsm.get(args.Key)
+	return reply.err
+}
+
+// RBDelete write a tombstone of the key,the tombstone shadow older values
+// during reads and is purged by compaction.SSTables are never rewritten.
 func (lsm *LSMTree) RBDelete(args *DeleteArgs, reply *DeleteReply) error {
-	result := lsm.table.str.find(args.Key)
-	if result.rb != nil {
-		lsm.table.str.delete(args.Key)
-	} else {
-		start, end, segNum := lsm.searchInSparseHash(args.Key)
-		for i := 0; i < len(start); i++ {
-			if end[i] == -1 {
-				section := io.NewSectionReader(lsm.ssTableFile[segNum[i]], start[i], 1024)
-				end[i] = section.Size()
+	_, reply.Found, reply.err = lsm.get(args.Key)
+	if reply.err != nil {
+		return reply.err
+	}
+	batch := new(WriteBatch)
+	batch.Delete(args.Key)
+	reply.err = lsm.write(batch)
+	if reply.err != nil {
+		return reply.err
+	}
+	reply.Deleted = true
+	return nil
+}
+
+// DeleteRange write a range tombstone which delete every key in [start,end).
+func (lsm *LSMTree) DeleteRange(start, end []byte) error {
+	if bytes.Compare(start, end) >= 0 {
+		return errors.New("delete range: start must be less than end")
+	}
+	batch := new(WriteBatch)
+	batch.DeleteRange(start, end)
+	return lsm.write(batch)
+}
+
+// write give the batch its sequence numbers,append it to the write ahead log,
+// then insert it into the memory tables of its column families.
+func (lsm *LSMTree) write(batch *WriteBatch) error {
+	defer lsm.deliverEvents()
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	if err := lsm.checkWritable(); err != nil {
+		return err
+	}
+	// makeRoomForWrite may release lsm.mu,a family may be dropped meanwhile
+	if err := lsm.makeRoomForWrite(); err != nil {
+		return err
+	}
+	if err := lsm.checkBatch(batch); err != nil {
+		return err
+	}
+	batch.seq = lsm.seq + 1
+	batch.time = lsm.now()
+	record := batch.encode()
+	err := lsm.writeAheadLog.addRecord(record)
+	if err != nil {
+		lsm.setBackgroundError(err, ReasonWriteAheadLog)
+		return err
+	}
+	lsm.walBytes += int64(logHeaderSize + len(record))
+	applied, _ := decodeWriteBatch(record)
+	err = applied.insertInto(func(id uint32) *memTable {
+		return lsm.families[id].table
+	})
+	if err != nil {
+		return err
+	}
+	applied.iterate(func(id uint32, keyType byte, key, value []byte, seq uint64) error {
+		lsm.families[id].stats.userBytes += int64(len(key) + len(value))
+		return nil
+	})
+	lsm.seq += uint64(batch.count)
+	// the write which fill a table rotate it,a failed rotation is retried by the next write
+	for _, family := range lsm.families {
+		if !family.table.fulled && family.table.memoryUsage() >= int64(family.maxMemSize) {
+			family.table.fulled = true
+			family.maybeRotate()
+		}
+	}
+	return nil
+}
+
+// checkBatch reject a batch writing a dropped column family or merging without
+// a merge operator before it reach the write ahead log,it must be called with lsm.mu held.
+func (lsm *LSMTree) checkBatch(batch *WriteBatch) error {
+	return batch.iterate(func(id uint32, keyType byte, key, value []byte, seq uint64) error {
+		family := lsm.families[id]
+		if family == nil {
+			return ErrColumnFamilyNotFound
+		}
+		if keyType == typeMerge && family.opts.MergeOperator == nil {
+			return errNoMergeOperator
+		}
+		return nil
+	})
+}
+
+// get search the memory tables,then level0 from the newest file and the other
+// levels in order.The first version found is the newest one,it is visible only
+// if it is not a tombstone or expired and no newer range tombstone cover it.
+// Merge operands found first are collected until an older version is found.
+// A value separated into a value log is read only if it is visible.
+func (lsm *LSMTree) get(key []byte) ([]byte, bool, error) {
+	lsm.mu.Lock()
+	if lsm.closed {
+		lsm.mu.Unlock()
+		return nil, false, ErrClosed
+	}
+	if lsm.dropped {
+		lsm.mu.Unlock()
+		return nil, false, ErrColumnFamilyNotFound
+	}
+	memTables := []*memTable{lsm.table}
+	if lsm.imm != nil {
+		memTables = append(memTables, lsm.imm)
+	}
+	files := lsm.pinFiles()
+	lsm.mu.Unlock()
+	defer unpinFiles(files)
+	atomic.AddInt64(&lsm.reads.gets, 1)
+	now := lsm.now()
+	var rangeDelSeq uint64
+	for _, mt := range memTables {
+		rangeDelSeq = maxSeq(rangeDelSeq, mt.rangeDelSeq(key))
+	}
+	for _, meta := range files {
+		rangeDelSeq = maxSeq(rangeDelSeq, meta.table.rangeDelSeq(key))
+	}
+	var lists [][]byte
+	for _, mt := range memTables {
+		result := mt.str.find(key)
+		if result != nil {
+			e := result.memEntry()
+			if e.keyType == typeMerge && e.seq >= rangeDelSeq {
+				lists = append(lists, e.value)
+				continue
 			}
-			binaryData := make([]byte, end[i]-start[i])
-			_, err := lsm.ssTableFile[segNum[i]].ReadAt(binaryData, start[i])
-			if err != nil {
-				log.Fatal(err)
-			} else {
-				buf := new(bytes.Buffer)
-				buf.Write(binaryData)
-				var decodingData []entry
-				err1 := binary.Read(buf, binary.BigEndian, decodingData)
-				if err1 != nil {
-					log.Fatal(err1)
-				}
-				var keys keySet
-				for index, pair := range decodingData {
-					keys[index] = pair.key
-				}
-				keyIndex := sort.Search(len(keys), func(i int) bool {
-					return bytes.Compare(keys[i], args.Key) == 0
-				})
-				if bytes.Compare(decodingData[keyIndex].key, args.Key) == 0 {
-					reply.Found = true
-					reply.err = nil
-					decodingData[keyIndex].tombstone = true
-					buf1 := new(bytes.Buffer)
-					err2 := binary.Write(buf1, binary.BigEndian, decodingData)
-					if err2 != nil {
-						log.Fatal(err2)
-					}
-					var tmpData []byte
-					_, err3 := buf.Read(tmpData)
-					if err3 != nil {
-						log.Fatal(err3)
-					}
-					_, err4 := lsm.ssTableFile[segNum[i]].WriteAt(tmpData, start[i])
-					if err4 != nil {
-						log.Fatal(err4)
-					}
-					reply.Deleted = true
-					return nil
-				} else {
-					continue
+			return lsm.resolveValue(key, e.value, e.keyType, e.seq, rangeDelSeq, now, lists)
+		}
+	}
+	for _, meta := range files {
+		if bytes.Compare(key, meta.smallest) < 0 || bytes.Compare(key, meta.largest) > 0 {
+			continue
+		}
+		pair, err := lsm.searchTable(meta.table, key)
+		if err != nil {
+			return nil, false, err
+		}
+		if pair != nil {
+			seq, keyType := pair.trailer()
+			if keyType == typeMerge && seq >= rangeDelSeq {
+				lists = append(lists, pair.value)
+				continue
+			}
+			value := pair.value
+			if keyType == typeValuePointer && seq >= rangeDelSeq {
+				if value, err = lsm.values.read(key, value); err != nil {
+					return nil, false, err
 				}
+				keyType = typeValue
 			}
+			return lsm.resolveValue(key, value, keyType, seq, rangeDelSeq, now, lists)
 		}
 	}
-	return nil
+	if lists != nil {
+		return lsm.resolveValue(key, nil, typeDeletion, 0, rangeDelSeq, now, lists)
+	}
+	return nil, false, nil
+}
+
+// resolveValue apply the merge operands collected by get,newest first,on the
+// version found below them.
+func (lsm *LSMTree) resolveValue(key, value []byte, keyType byte, seq uint64, rangeDelSeq uint64, now int64, lists [][]byte) ([]byte, bool, error) {
+	if lists == nil {
+		return visibleValue(value, keyType, seq, rangeDelSeq, now)
+	}
+	if seq < rangeDelSeq {
+		value, keyType = nil, typeDeletion
+	}
+	merged, keyType, err := mergeOnto(lsm.opts.MergeOperator, key, value, keyType, now, lists)
+	if err != nil {
+		return nil, false, err
+	}
+	return visibleValue(merged, keyType, seq, 0, now)
+}
+
+func visibleValue(value []byte, keyType byte, seq uint64, rangeDelSeq uint64, now int64) ([]byte, bool, error) {
+	if keyType == typeDeletion || seq < rangeDelSeq {
+		return nil, false, nil
+	}
+	if keyType == typeValueTTL {
+		if expired(value, now) {
+			return nil, false, nil
+		}
+		return value[expirySize:], true, nil
+	}
+	return value, true, nil
+}
+
+func maxSeq(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// pinFiles return the files of the levels newest first and pin them until
+// unpinFiles,so a compaction finishing meanwhile does not close them.It must
+// be called with lsm.mu held.
+func (lsm *LSMTree) pinFiles() []*fileMeta {
+	files := make([]*fileMeta, 0, 16)
+	for i := len(lsm.levels[0]) - 1; i >= 0; i-- {
+		files = append(files, lsm.levels[0][i])
+	}
+	for level := 1; level < len(lsm.levels); level++ {
+		files = append(files, lsm.levels[level]...)
+	}
+	for _, meta := range files {
+		meta.ref()
+	}
+	return files
+}
+
+func unpinFiles(files []*fileMeta) {
+	for _, meta := range files {
+		meta.unref()
+	}
+}
+
+func (lsm *LSMTree) makeMemTable() *memTable {
+	mt := new(memTable)
+	mt.rwMu = new(sync.RWMutex)
+	if lsm.opts != nil {
+		mt.mergeOperator = lsm.opts.MergeOperator
+	}
+	switch lsm.memType {
+	case "skipList":
+		mt.str = lsm.initSkipList()
+	case "BTree":
+		mt.str = lsm.initBTree()
+	case "hashLinkList":
+		mt.str = lsm.initHashLinkList()
+	case "vector":
+		mt.str = lsm.initVector()
+	default:
+		mt.str = lsm.initRBTree()
+	}
+	return mt
+}
+
+func (lsm *LSMTree) newFileNum() uint64 {
+	num := lsm.nextFileNum
+	lsm.nextFileNum++
+	return num
+}
+
+func (lsm *LSMTree) tableFileName(num uint64) string {
+	return filepath.Join(lsm.dir, "ssTable"+strconv.FormatUint(num, 10))
+}
+
+func (lsm *LSMTree) logFileName(num uint64) string {
+	return filepath.Join(lsm.dir, "WAL"+strconv.FormatUint(num, 10))
 }
@@ -1,18 +1,170 @@
 package storage
 
-import "testing"
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func makeTestLSMTree(t *testing.T) *LSMTree {
+	var lsmTree *LSMTree
+	lsmTree, err := lsmTree.initLSMTree(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsmTree.open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lsmTree
+}
+
+func testKey(i int) []byte {
+	return []byte("key" + strconv.Itoa(1000+i))
+}
+
+func putKeys(t *testing.T, lsmTree *LSMTree, from, to int) {
+	for i := from; i < to; i++ {
+		err := lsmTree.RBAdd(&AddArgs{Key: testKey(i), Value: testKey(i)}, new(AddReply))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkFound(t *testing.T, lsmTree *LSMTree, i int, want bool) {
+	reply := new(GetReply)
+	err := lsmTree.RBGet(&GetArgs{Key: testKey(i)}, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Found != want {
+		t.Fatalf("key %d found = %v,want %v", i, reply.Found, want)
+	}
+	if want && !bytes.Equal(reply.Value, testKey(i)) {
+		t.Fatalf("key %d value error", i)
+	}
+}
 
 func TestInsert(t *testing.T) {
 	var lsmTree *LSMTree
 	var err error
-	lsmTree, err = lsmTree.initLSMTree()
+	lsmTree, err = lsmTree.initLSMTree(&Options{IniFile: "lsm.ini"})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestDelete(t *testing.T) {
+	lsmTree := makeTestLSMTree(t)
+	putKeys(t, lsmTree, 0, 100)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	tableName := lsmTree.tableFileName(lsmTree.levels[0][0].fileNum)
+	before, _ := os.ReadFile(tableName)
+	for i := 0; i < 50; i++ {
+		reply := new(DeleteReply)
+		err := lsmTree.RBDelete(&DeleteArgs{Key: testKey(i)}, reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reply.Found || !reply.Deleted {
+			t.Fatal("Delete reply error.")
+		}
+	}
+	after, _ := os.ReadFile(tableName)
+	if !bytes.Equal(before, after) {
+		t.Fatal("Delete rewrite the SSTable.")
+	}
+	checkFound(t, lsmTree, 10, false)
+	checkFound(t, lsmTree, 60, true)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	checkFound(t, lsmTree, 10, false)
+	checkFound(t, lsmTree, 60, true)
+	putKeys(t, lsmTree, 10, 11)
+	checkFound(t, lsmTree, 10, true)
+}
 
+func TestDeleteRange(t *testing.T) {
+	lsmTree := makeTestLSMTree(t)
+	putKeys(t, lsmTree, 0, 100)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.DeleteRange(testKey(10), testKey(20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.DeleteRange(testKey(20), testKey(10)); err == nil {
+		t.Fatal("Empty range is accepted.")
+	}
+	checkFound(t, lsmTree, 9, true)
+	checkFound(t, lsmTree, 10, false)
+	checkFound(t, lsmTree, 19, false)
+	checkFound(t, lsmTree, 20, true)
+	putKeys(t, lsmTree, 15, 16)
+	checkFound(t, lsmTree, 15, true)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	checkFound(t, lsmTree, 14, false)
+	checkFound(t, lsmTree, 15, true)
+	checkFound(t, lsmTree, 16, false)
+}
+
+func TestCompactionPurgeTombstone(t *testing.T) {
+	lsmTree := makeTestLSMTree(t)
+	lsmTree.maxFileNum = 2
+	putKeys(t, lsmTree, 0, 1000)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := lsmTree.RBDelete(&DeleteArgs{Key: testKey(i)}, new(DeleteReply)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsmTree.DeleteRange(testKey(500), testKey(600)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.maybeCompact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(lsmTree.levels[0]) != 0 || len(lsmTree.levels[1]) == 0 {
+		t.Fatal("Level0 is not compacted.")
+	}
+	var num int
+	for _, meta := range lsmTree.levels[1] {
+		data, err := meta.table.readAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range data {
+			if _, keyType := data[i].trailer(); keyType != typeValue {
+				t.Fatal("Tombstone is not purged at the bottommost level.")
+			}
+		}
+		if len(meta.table.rangeDels) != 0 {
+			t.Fatal("Range tombstone is not purged at the bottommost level.")
+		}
+		num += len(data)
+	}
+	if num != 800 {
+		t.Fatalf("Compaction keep %d entries,want 800", num)
+	}
+	checkFound(t, lsmTree, 50, false)
+	checkFound(t, lsmTree, 550, false)
+	checkFound(t, lsmTree, 700, true)
 }
 
 func TestSearch(t *testing.T) {
@@ -22,10 +174,11 @@ func TestSearch(t *testing.T) {
 func TestPutGet(t *testing.T) {
 	var lsmTree *LSMTree
 	var err error
-	lsmTree, err = MakeLSMTree()
+	lsmTree, err = OpenLSMTree(t.TempDir(), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer lsmTree.Close()
 	args := new(WriteArgs)
 	args.Key = nil
 	args.Value = nil
@@ -37,6 +190,301 @@ func TestPutGet(t *testing.T) {
 
 }
 
-func TestConcurrentGet(t *testing.T) {
+func TestMakeLSMTree(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree, err := MakeLSMTree(dir, "lsm.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, lsmTree, 0, 10)
+	if err = lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, manifestName)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat("data"); !os.IsNotExist(err) {
+		t.Fatal("MakeLSMTree write ./data.")
+	}
+}
 
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree, err := OpenLSMTree(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, lsmTree, 0, 100)
+	if err = lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, lsmTree, 100, 200)
+	batch := new(WriteBatch)
+	batch.Delete(testKey(5))
+	batch.DeleteRange(testKey(150), testKey(160))
+	if err = lsmTree.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	seq := lsmTree.seq
+	if err = lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = lsmTree.Close(); err != ErrClosed {
+		t.Fatal("Close twice must return ErrClosed.")
+	}
+	lsmTree, err = OpenLSMTree(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmTree.Close()
+	if lsmTree.seq != seq {
+		t.Fatalf("Recovered sequence %d,want %d", lsmTree.seq, seq)
+	}
+	checkFound(t, lsmTree, 4, true)
+	checkFound(t, lsmTree, 5, false)
+	checkFound(t, lsmTree, 120, true)
+	checkFound(t, lsmTree, 155, false)
+	if _, err = lsmTree.Get(testKey(155)); err != ErrNotFound {
+		t.Fatal("Get deleted key must return ErrNotFound.")
+	}
+	nums, _ := logFiles(dir)
+	if len(nums) != 1 || nums[0] != lsmTree.writeAheadLog.num {
+		t.Fatal("Replayed write ahead logs are not removed.", nums)
+	}
+}
+
+func TestIterator(t *testing.T) {
+	lsmTree := makeTestLSMTree(t)
+	putKeys(t, lsmTree, 0, 50)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, lsmTree, 25, 100)
+	lsmTree.DeleteRange(testKey(10), testKey(20))
+	lsmTree.RBDelete(&DeleteArgs{Key: testKey(30)}, new(DeleteReply))
+	it := lsmTree.NewIterator()
+	defer it.Close()
+	want := make([]int, 0, 100)
+	for i := 0; i < 100; i++ {
+		if (i < 10 || i >= 20) && i != 30 {
+			want = append(want, i)
+		}
+	}
+	var n int
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if !bytes.Equal(it.Key(), testKey(want[n])) || !bytes.Equal(it.Value(), testKey(want[n])) {
+			t.Fatalf("Iterator key %s,want %s", it.Key(), testKey(want[n]))
+		}
+		n++
+	}
+	if n != len(want) || it.Error() != nil {
+		t.Fatalf("Iterator return %d keys,want %d", n, len(want))
+	}
+	it.Seek(testKey(15))
+	if !it.Valid() || !bytes.Equal(it.Key(), testKey(20)) {
+		t.Fatal("Seek must move to the first key >= target.")
+	}
+	it.Prev()
+	if !bytes.Equal(it.Key(), testKey(9)) {
+		t.Fatal("Prev error.")
+	}
+	it.SeekForPrev(testKey(15))
+	if !it.Valid() || !bytes.Equal(it.Key(), testKey(9)) {
+		t.Fatal("SeekForPrev must move to the last key <= target.")
+	}
+	var _ IIterator = it
+	it.SeekToLast()
+	if !bytes.Equal(it.Key(), testKey(99)) {
+		t.Fatal("SeekToLast error.")
+	}
+	it.Next()
+	if it.Valid() {
+		t.Fatal("Iterator is valid after the last key.")
+	}
+}
+
+func TestIteratorDuringCompaction(t *testing.T) {
+	lsmTree, err := OpenLSMTree(t.TempDir(), &Options{MaxMemTableSize: 8192, MaxFileOfOneLevel: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmTree.Close()
+	putKeys(t, lsmTree, 0, 1000)
+	for i := 0; i < 1000; i += 3 {
+		if err = lsmTree.RBDelete(&DeleteArgs{Key: testKey(i)}, new(DeleteReply)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	it := lsmTree.NewIterator()
+	defer it.Close()
+	want := make([]int, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		if i%3 != 0 {
+			want = append(want, i)
+		}
+	}
+	// rewrite every key so the tables the iterator pinned are compacted away
+	deadline := time.Now().Add(10 * time.Second)
+	for start := lsmTree.Stats().Compactions; lsmTree.Stats().Compactions < start+20 && time.Now().Before(deadline); {
+		for i := 0; i < 1000; i++ {
+			if err = lsmTree.RBAdd(&AddArgs{Key: testKey(i), Value: []byte("new")}, new(AddReply)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if n == len(want) || !bytes.Equal(it.Key(), testKey(want[n])) || !bytes.Equal(it.Value(), testKey(want[n])) {
+			t.Fatalf("Iterator stop on %s=%s,want %s of the snapshot", it.Key(), it.Value(), testKey(want[n]))
+		}
+		n++
+	}
+	if n != len(want) || it.Error() != nil {
+		t.Fatalf("Iterator return %d keys %v,want %d", n, it.Error(), len(want))
+	}
+	n = len(want) - 1
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		if !bytes.Equal(it.Key(), testKey(want[n])) {
+			t.Fatalf("Backward iterator stop on %s,want %s", it.Key(), testKey(want[n]))
+		}
+		n--
+	}
+	if n != -1 || it.Error() != nil {
+		t.Fatalf("Backward iterator miss %d keys %v", n+1, it.Error())
+	}
+	// change the direction in the middle
+	it.Seek(testKey(500))
+	it.Prev()
+	it.Prev()
+	it.Next()
+	if !it.Valid() || !bytes.Equal(it.Key(), testKey(499)) {
+		t.Fatalf("Iterator stop on %s after changing direction,want %s", it.Key(), testKey(499))
+	}
+}
+
+func TestMemTableRotation(t *testing.T) {
+	var lsmTree *LSMTree
+	lsmTree, err := lsmTree.initLSMTree(&Options{MaxMemTableSize: 8192})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lsmTree.open(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	for lsmTree.imm == nil {
+		before := lsmTree.table.memoryUsage()
+		if before >= 8192 {
+			t.Fatal("Memory table is not rotated at maxMemoryTableSize.")
+		}
+		putKeys(t, lsmTree, i, i+1)
+		i++
+	}
+	if lsmTree.imm.memoryUsage() < 8192 || lsmTree.table.memoryUsage() != lsmTree.makeMemTable().memoryUsage() {
+		t.Fatal("Rotation must happen in the write which fill the table.")
+	}
+	for !lsmTree.table.fulled {
+		putKeys(t, lsmTree, i, i+1)
+		i++
+	}
+	if lsmTree.imm == nil || lsmTree.scheduler.pendingFlushes() != 1 {
+		t.Fatal("Fulled table must wait for the flush of the immutable table.")
+	}
+	done := make(chan error)
+	go func() {
+		done <- lsmTree.RBAdd(&AddArgs{Key: testKey(i), Value: testKey(i)}, new(AddReply))
+	}()
+	select {
+	case <-done:
+		t.Fatal("Write is not stopped by the unflushed immutable table.")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err = lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(lsmTree.levels[0]) != 1 || lsmTree.imm == nil || lsmTree.table.fulled {
+		t.Fatal("Blocked write must rotate the fulled table after the flush.")
+	}
+	for j := 0; j <= i; j++ {
+		checkFound(t, lsmTree, j, true)
+	}
+}
+
+func TestFlushInBackground(t *testing.T) {
+	lsmTree, err := OpenLSMTree(t.TempDir(), &Options{MaxMemTableSize: 8192})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmTree.Close()
+	putKeys(t, lsmTree, 0, 2000)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lsmTree.mu.Lock()
+		// the flushed files may be compacted out of level0 already
+		var flushed bool
+		for level := range lsmTree.levels {
+			flushed = flushed || len(lsmTree.levels[level]) > 0
+		}
+		imm := lsmTree.imm
+		lsmTree.mu.Unlock()
+		if flushed && imm == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Fulled memory table is not flushed in background.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 2000; i += 100 {
+		checkFound(t, lsmTree, i, true)
+	}
+}
+
+// TestConcurrentGet read while background compactions replace the files the
+// reads found,a read must finish on the files it started with.
+func TestConcurrentGet(t *testing.T) {
+	lsmTree, err := OpenLSMTree(t.TempDir(), &Options{MaxMemTableSize: 8192, MaxFileOfOneLevel: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmTree.Close()
+	putKeys(t, lsmTree, 0, 1000)
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for ; ; i = (i + 7) % 1000 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				value, err := lsmTree.Get(testKey(i))
+				if err != nil || !bytes.Equal(value, testKey(i)) {
+					errs <- fmt.Errorf("key %d value %q %v during compaction", i, value, err)
+					return
+				}
+			}
+		}(r)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for lsmTree.Stats().Compactions < 50 && time.Now().Before(deadline) {
+		putKeys(t, lsmTree, 0, 1000)
+	}
+	close(done)
+	wg.Wait()
+	select {
+	case err = <-errs:
+		t.Fatal(err)
+	default:
+	}
+	if n := lsmTree.Stats().Compactions; n < 50 {
+		t.Fatalf("%d compactions ran during the reads,want 50", n)
+	}
 }
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree, err := OpenLSMTree(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, lsmTree, 0, 10)
+	if _, err = OpenLSMTree(dir, nil); err != ErrLocked {
+		t.Fatal("Second open must return ErrLocked.", err)
+	}
+	if _, err = OpenLSMTree(dir, &Options{ReadOnly: true}); err != ErrLocked {
+		t.Fatal("Read only open of a locked directory must return ErrLocked.", err)
+	}
+	if err = lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := OpenLSMTree(dir, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	other, err := OpenLSMTree(dir, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal("Read only opens must share the lock.", err)
+	}
+	defer other.Close()
+	if _, err = OpenLSMTree(dir, nil); err != ErrLocked {
+		t.Fatal("Open while read only handles exist must return ErrLocked.", err)
+	}
+	checkFound(t, reader, 5, true)
+	if err = reader.RBAdd(&AddArgs{Key: testKey(20), Value: testKey(20)}, new(AddReply)); err != ErrReadOnly {
+		t.Fatal("Write of a read only handle must return ErrReadOnly.", err)
+	}
+	nums, _ := logFiles(dir)
+	if len(nums) != 1 {
+		t.Fatal("Read only open must not touch the write ahead logs.", nums)
+	}
+}
+
+func TestReadOnlyMissingDir(t *testing.T) {
+	if _, err := OpenLSMTree(t.TempDir()+"/missing", &Options{ReadOnly: true}); err == nil {
+		t.Fatal("Read only open of a missing directory must fail.")
+	}
+}
+
+func TestReadOnlyCheckpoint(t *testing.T) {
+	lsmTree := makeTestLSMTree(t)
+	defer lsmTree.Close()
+	putKeys(t, lsmTree, 0, 10)
+	dir := t.TempDir() + "/cp"
+	if err := lsmTree.Checkpoint(dir); err != nil {
+		t.Fatal(err)
+	}
+	// a checkpoint has no LOCK file
+	reader, err := OpenLSMTree(dir, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal("Read only open of a checkpoint fail.", err)
+	}
+	defer reader.Close()
+	checkFound(t, reader, 5, true)
+	if _, err = OpenLSMTree(dir, nil); err != ErrLocked {
+		t.Fatal("Open while a read only handle exist must return ErrLocked.", err)
+	}
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileLock hold a flock on the LOCK file of a data directory,the lock is
+// released by the kernel if the process exit.
+type fileLock struct {
+	file *os.File
+}
+
+// lockFile take a shared lock for read only opens and an exclusive lock otherwise,
+// it return ErrLocked at once if the lock is held by another handle.A read only
+// open create the LOCK file missing in a checkpoint or a restored backup,if the
+// directory can not be written and has none it is opened without a lock.
+func lockFile(name string, shared bool) (*fileLock, error) {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil && shared && !os.IsNotExist(err) {
+		file, err = os.Open(name)
+		if os.IsNotExist(err) {
+			return &fileLock{}, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return nil, ErrLocked
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &fileLock{file: file}, nil
+}
+
+func (l *fileLock) release() error {
+	if l.file == nil {
+		return nil
+	}
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	return l.file.Close()
+}
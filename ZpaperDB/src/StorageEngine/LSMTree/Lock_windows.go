@@ -0,0 +1,33 @@
+package storage
+
+import "os"
+
+// fileLock on windows open the LOCK file without a share mode lock,so it does
+// not protect a directory from a second process:lockFile never return ErrLocked
+// and two handles may write the same directory.
+type fileLock struct {
+	file *os.File
+}
+
+// lockFile create the LOCK file like on unix,a read only open of a directory
+// which can not be written and has none go on without it.
+func lockFile(name string, shared bool) (*fileLock, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil && shared && !os.IsNotExist(err) {
+		file, err = os.Open(name)
+		if os.IsNotExist(err) {
+			return &fileLock{}, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fileLock{file: file}, nil
+}
+
+func (l *fileLock) release() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,437 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MANIFEST save the current version of the LSMTree as one log record:
+// next file number(8 bytes) | last sequence(8 bytes) | log number(8 bytes) | file num(4 bytes) | files |
+// next family id(4 bytes) | family num(4 bytes) | families
+// file layout: level(1 byte) | file number(8 bytes) | size(8 bytes) | smallest(varint len) | largest(varint len) |
+// global sequence(8 bytes),only if the level has globalSeqFlag
+// family layout: id(4 bytes) | name(varint len) | log number(8 bytes) | file num(4 bytes) | files
+// The header files and log number are the default column family's,the other
+// families follow them.A family has flushed the write ahead logs older than its
+// log number.The MANIFEST is rewritten into a temp file and renamed,so it is
+// always complete.
+
+const (
+	manifestName  = "MANIFEST"
+	globalSeqFlag = 0x80 // the file is ingested,see IngestExternalFile
+)
+
+type manifest struct {
+	nextFileNum  uint64
+	lastSeq      uint64
+	logNum       uint64
+	files        []manifestFile
+	nextFamilyID uint32
+	families     []manifestFamily
+}
+
+type manifestFile struct {
+	level     int
+	fileNum   uint64
+	size      int64
+	smallest  []byte
+	largest   []byte
+	globalSeq uint64
+}
+
+type manifestFamily struct {
+	id     uint32
+	name   string
+	logNum uint64
+	files  []manifestFile
+}
+
+func (m *manifest) encode() []byte {
+	data := make([]byte, 24, 28+len(m.files)*64)
+	binary.LittleEndian.PutUint64(data, m.nextFileNum)
+	binary.LittleEndian.PutUint64(data[8:], m.lastSeq)
+	binary.LittleEndian.PutUint64(data[16:], m.logNum)
+	data = encodeManifestFiles(data, m.files)
+	var tmp [binary.MaxVarintLen64]byte
+	binary.LittleEndian.PutUint32(tmp[:], m.nextFamilyID)
+	binary.LittleEndian.PutUint32(tmp[4:], uint32(len(m.families)))
+	data = append(data, tmp[:8]...)
+	for _, family := range m.families {
+		binary.LittleEndian.PutUint32(tmp[:], family.id)
+		data = append(data, tmp[:4]...)
+		n := binary.PutUvarint(tmp[:], uint64(len(family.name)))
+		data = append(data, tmp[:n]...)
+		data = append(data, family.name...)
+		binary.LittleEndian.PutUint64(tmp[:], family.logNum)
+		data = append(data, tmp[:8]...)
+		data = encodeManifestFiles(data, family.files)
+	}
+	return data
+}
+
+func encodeManifestFiles(data []byte, files []manifestFile) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	binary.LittleEndian.PutUint32(tmp[:], uint32(len(files)))
+	data = append(data, tmp[:4]...)
+	for _, f := range files {
+		if f.globalSeq != 0 {
+			data = append(data, byte(f.level)|globalSeqFlag)
+		} else {
+			data = append(data, byte(f.level))
+		}
+		binary.LittleEndian.PutUint64(tmp[:], f.fileNum)
+		data = append(data, tmp[:8]...)
+		binary.LittleEndian.PutUint64(tmp[:], uint64(f.size))
+		data = append(data, tmp[:8]...)
+		for _, key := range [][]byte{f.smallest, f.largest} {
+			n := binary.PutUvarint(tmp[:], uint64(len(key)))
+			data = append(data, tmp[:n]...)
+			data = append(data, key...)
+		}
+		if f.globalSeq != 0 {
+			binary.LittleEndian.PutUint64(tmp[:], f.globalSeq)
+			data = append(data, tmp[:8]...)
+		}
+	}
+	return data
+}
+
+// decodeManifest accept a MANIFEST without the family section,it has only the
+// default column family.
+func decodeManifest(data []byte) (*manifest, error) {
+	if len(data) < 28 {
+		return nil, errors.New("manifest: too short")
+	}
+	m := new(manifest)
+	m.nextFileNum = binary.LittleEndian.Uint64(data)
+	m.lastSeq = binary.LittleEndian.Uint64(data[8:])
+	m.logNum = binary.LittleEndian.Uint64(data[16:])
+	var err error
+	if m.files, data, err = decodeManifestFiles(data[24:]); err != nil {
+		return nil, err
+	}
+	m.nextFamilyID = 1
+	if len(data) == 0 {
+		return m, nil
+	}
+	if len(data) < 8 {
+		return nil, errors.New("manifest: bad family")
+	}
+	m.nextFamilyID = binary.LittleEndian.Uint32(data)
+	familyNum := binary.LittleEndian.Uint32(data[4:])
+	data = data[8:]
+	for i := uint32(0); i < familyNum; i++ {
+		if len(data) < 4 {
+			return nil, errors.New("manifest: bad family")
+		}
+		family := manifestFamily{id: binary.LittleEndian.Uint32(data)}
+		name, rest, ok := readLengthPrefixed(data[4:])
+		if !ok || len(rest) < 8 {
+			return nil, errors.New("manifest: bad family")
+		}
+		family.name = string(name)
+		family.logNum = binary.LittleEndian.Uint64(rest)
+		if family.files, data, err = decodeManifestFiles(rest[8:]); err != nil {
+			return nil, err
+		}
+		m.families = append(m.families, family)
+	}
+	return m, nil
+}
+
+func decodeManifestFiles(data []byte) ([]manifestFile, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, errors.New("manifest: too short")
+	}
+	fileNum := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	var files []manifestFile
+	for i := uint32(0); i < fileNum; i++ {
+		if len(data) < 17 {
+			return nil, nil, errors.New("manifest: bad file")
+		}
+		f := manifestFile{level: int(data[0] &^ globalSeqFlag)}
+		ingested := data[0]&globalSeqFlag != 0
+		f.fileNum = binary.LittleEndian.Uint64(data[1:])
+		f.size = int64(binary.LittleEndian.Uint64(data[9:]))
+		var ok bool
+		if f.smallest, data, ok = readLengthPrefixed(data[17:]); !ok {
+			return nil, nil, errors.New("manifest: bad file")
+		}
+		if f.largest, data, ok = readLengthPrefixed(data); !ok {
+			return nil, nil, errors.New("manifest: bad file")
+		}
+		if ingested {
+			if len(data) < 8 {
+				return nil, nil, errors.New("manifest: bad file")
+			}
+			f.globalSeq = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		}
+		if f.level >= maxLevel {
+			return nil, nil, errors.New("manifest: bad level")
+		}
+		files = append(files, f)
+	}
+	return files, data, nil
+}
+
+// readManifest return nil if dir has no MANIFEST.
+func readManifest(dir string) (*manifest, error) {
+	file, err := os.Open(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := makeLogReader(file).readRecord()
+	if err == io.EOF {
+		return nil, errors.New("manifest: empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeManifest(data)
+}
+
+func writeManifest(dir string, m *manifest) error {
+	return writeRecordFile(filepath.Join(dir, manifestName), m.encode())
+}
+
+// writeRecordFile write data as one log record into a temp file and rename it
+// to name,so name is always complete.
+func writeRecordFile(name string, data []byte) error {
+	tmpName := name + ".tmp"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	w := &logWriter{file: file}
+	err = w.addRecord(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, name)
+}
+
+// currentManifest must be called with lsm.mu held.Logs of the memory tables
+// which are not flushed yet must be kept.
+func (lsm *LSMTree) currentManifest() *manifest {
+	m := new(manifest)
+	m.nextFileNum = lsm.nextFileNum
+	m.lastSeq = lsm.seq
+	m.nextFamilyID = lsm.nextFamilyID
+	for _, family := range lsm.columnFamilies() {
+		if family.family.id == 0 {
+			m.logNum = family.logNum()
+			m.files = family.manifestFiles()
+			continue
+		}
+		m.families = append(m.families, manifestFamily{
+			id:     family.family.id,
+			name:   family.family.name,
+			logNum: family.logNum(),
+			files:  family.manifestFiles(),
+		})
+	}
+	return m
+}
+
+// logNum return the oldest write ahead log the column family has not flushed.
+func (lsm *LSMTree) logNum() uint64 {
+	if lsm.imm != nil {
+		return lsm.imm.logNum
+	}
+	return lsm.table.logNum
+}
+
+func (lsm *LSMTree) manifestFiles() []manifestFile {
+	var files []manifestFile
+	for level := range lsm.levels {
+		for _, meta := range lsm.levels[level] {
+			files = append(files, manifestFile{
+				level:     level,
+				fileNum:   meta.fileNum,
+				size:      meta.size,
+				smallest:  meta.smallest,
+				largest:   meta.largest,
+				globalSeq: meta.table.globalSeq,
+			})
+		}
+	}
+	return files
+}
+
+// saveManifest must be called with lsm.mu held.
+func (lsm *LSMTree) saveManifest() error {
+	return writeManifest(lsm.dir, lsm.currentManifest())
+}
+
+// loadManifest make the column families recorded in the MANIFEST of lsm.dir and
+// open their tables,the memory table of a family start at its log number.A
+// family missing from Options.ColumnFamilies use the options of the database.
+func (lsm *LSMTree) loadManifest() (*manifest, error) {
+	m, err := readManifest(lsm.dir)
+	if err != nil || m == nil {
+		return m, err
+	}
+	lsm.nextFileNum = m.nextFileNum
+	lsm.seq = m.lastSeq
+	lsm.nextFamilyID = m.nextFamilyID
+	lsm.table.logNum = m.logNum
+	if err = lsm.loadFiles(m.files); err != nil {
+		return nil, err
+	}
+	for _, f := range m.families {
+		opts, err := lsm.familyOpts[f.name].columnFamilyOptions(lsm.dbOpts)
+		if err != nil {
+			return nil, err
+		}
+		family, err := lsm.initColumnFamily(f.id, f.name, opts)
+		if err != nil {
+			return nil, err
+		}
+		family.table.logNum = f.logNum
+		if err = family.loadFiles(f.files); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// loadFiles open the tables of the column family,the creation time of a table
+// is its modification time.
+func (lsm *LSMTree) loadFiles(files []manifestFile) error {
+	for _, f := range files {
+		file, err := os.Open(lsm.tableFileName(f.fileNum))
+		if err != nil {
+			return err
+		}
+		meta := &fileMeta{fileNum: f.fileNum, size: f.size, smallest: f.smallest, largest: f.largest}
+		if info, err := file.Stat(); err == nil {
+			meta.createdAt = info.ModTime().UnixNano()
+		}
+		meta.table, err = openTable(file, lsm.filterPolicy, lsm.prefixExtractor)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		meta.table.setGlobalSeq(f.globalSeq)
+		lsm.levels[f.level] = append(lsm.levels[f.level], meta)
+	}
+	for level := 1; level < len(lsm.levels); level++ {
+		files := lsm.levels[level]
+		sort.Slice(files, func(i, j int) bool {
+			return bytes.Compare(files[i].smallest, files[j].smallest) < 0
+		})
+	}
+	sort.Slice(lsm.levels[0], func(i, j int) bool {
+		return lsm.levels[0][i].fileNum < lsm.levels[0][j].fileNum
+	})
+	return nil
+}
+
+// minLogNum return the oldest write ahead log a column family has not flushed,
+// it must be called with lsm.mu held.
+func (lsm *LSMTree) minLogNum() uint64 {
+	logNum := ^uint64(0)
+	for _, family := range lsm.families {
+		if num := family.logNum(); num < logNum {
+			logNum = num
+		}
+	}
+	return logNum
+}
+
+// removeObsoleteLogs remove the write ahead logs every column family has flushed.
+func (lsm *LSMTree) removeObsoleteLogs() error {
+	lsm.mu.Lock()
+	logNum := lsm.minLogNum()
+	lsm.mu.Unlock()
+	nums, err := logFiles(lsm.dir)
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		if num >= logNum {
+			break
+		}
+		if err = lsm.removeLog(num); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logFiles return the numbers of the write ahead logs in dir in order.
+func logFiles(dir string) ([]uint64, error) {
+	return numberedFiles(dir, "WAL")
+}
+
+// numberedFiles return the numbers of the files named prefix and a number in dir in order.
+func numberedFiles(dir string, prefix string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	nums := make([]uint64, 0, len(entries))
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		num, err := strconv.ParseUint(strings.TrimPrefix(e.Name(), prefix), 10, 64)
+		if err == nil {
+			nums = append(nums, num)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums, nil
+}
+
+// replayLog insert every batch of the log into the memory tables of its column
+// families and return the last sequence.
+func replayLog(name string, tables func(family uint32) *memTable) (uint64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := makeLogReader(file)
+	var lastSeq uint64
+	for {
+		record, err := reader.readRecord()
+		// a damaged last record was torn by a crash while it was written
+		if err == io.EOF || err == errRecordChecksum && reader.remaining == 0 {
+			return lastSeq, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		batch, err := decodeWriteBatch(record)
+		if err != nil {
+			return 0, err
+		}
+		if err = batch.insertInto(tables); err != nil {
+			return 0, err
+		}
+		if batch.count > 0 {
+			lastSeq = batch.seq + uint64(batch.count) - 1
+		}
+	}
+}
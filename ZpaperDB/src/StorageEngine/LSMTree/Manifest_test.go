@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	m, err := readManifest(dir)
+	if m != nil || err != nil {
+		t.Fatal("Empty directory must have no manifest.")
+	}
+	m = &manifest{nextFileNum: 9, lastSeq: 1000, logNum: 7}
+	m.files = []manifestFile{
+		{level: 0, fileNum: 3, size: 100, smallest: []byte("a"), largest: []byte("m")},
+		{level: 2, fileNum: 5, size: 200, smallest: []byte(""), largest: []byte("z")},
+	}
+	if err = writeManifest(dir, m); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.nextFileNum != 9 || loaded.lastSeq != 1000 || loaded.logNum != 7 || len(loaded.files) != 2 {
+		t.Fatal("Manifest header error.")
+	}
+	f := loaded.files[1]
+	if f.level != 2 || f.fileNum != 5 || f.size != 200 || len(f.smallest) != 0 || !bytes.Equal(f.largest, []byte("z")) {
+		t.Fatal("Manifest file error.")
+	}
+	if _, err = decodeManifest(m.encode()[:40]); err == nil {
+		t.Fatal("Truncated manifest is accepted.")
+	}
+	// a MANIFEST written before column families end after the files
+	data := m.encode()
+	loaded, err = decodeManifest(data[:len(data)-8])
+	if err != nil || loaded.nextFamilyID != 1 || len(loaded.families) != 0 || len(loaded.files) != 2 {
+		t.Fatal("Manifest without column families error.", err)
+	}
+	m.nextFamilyID = 4
+	m.families = []manifestFamily{
+		{id: 1, name: "blobs", logNum: 6, files: m.files[:1]},
+		{id: 3, name: "index", logNum: 7},
+	}
+	loaded, err = decodeManifest(m.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.nextFamilyID != 4 || len(loaded.families) != 2 || len(loaded.files) != 2 {
+		t.Fatal("Manifest column families error.")
+	}
+	family := loaded.families[0]
+	if family.id != 1 || family.name != "blobs" || family.logNum != 6 || len(family.files) != 1 || family.files[0].fileNum != 3 {
+		t.Fatal("Manifest column family error.")
+	}
+	if _, err = decodeManifest(m.encode()[:len(m.encode())-3]); err == nil {
+		t.Fatal("Truncated column family is accepted.")
+	}
+}
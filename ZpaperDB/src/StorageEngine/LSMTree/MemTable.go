@@ -4,198 +4,322 @@ import (
 	"bytes"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
+// memTable is fulled once its memory usage reach maxMemoryTableSize,then it is
+// turned into the immutable table and flushed.
 type memTable struct {
-	str    underStr
-	rwMu   *sync.RWMutex
-	fulled bool
+	str           underStr
+	rwMu          *sync.RWMutex
+	fulled        bool
+	rangeDels     []rangeTombstone
+	logNum        uint64
+	entries       int // operations added,written with lsm.mu held
+	mergeOperator MergeOperator
 }
 
 type underStr interface {
-	insert(key, value []byte)
-	delete(key []byte) bool
+	insert(key, value []byte, keyType byte, seq uint64)
 	find(key []byte) *findResult
+	seek(key []byte) []byte // the first key >= key,nil if there is none
 	export() *[]pairs
+	memoryUsage() int64
+}
+
+// rangeTombstone delete every key in [start,end) whose sequence is less than seq.
+type rangeTombstone struct {
+	start []byte
+	end   []byte
+	seq   uint64
 }
 
 type findResult struct {
-	rb *RBTreeNode
 	sl *listNode
+	e  *memEntry // entry of the other structures
 }
 
+const skipListMaxHeight = 12
+
+var rangeDelSize = int64(unsafe.Sizeof(rangeTombstone{}))
+
+// skipList support one writer and many concurrent readers without locks.
+// A node is linked into the list from level 0 up with atomic stores,so a reader
+// see either the old or the new next pointer of a level.The entry of a node is
+// replaced atomically when its key is written again.The writer must be
+// serialized by the caller,LSMTree hold lsm.mu while inserting.
 type skipList struct {
-	mu        *sync.RWMutex
-	head      *listNode
-	keyNum    int
-	maxHeight uint8
-	iter      *Container
+	head   *listNode
+	height int32 // atomic
+	keyNum int64 // atomic
+	rnd    *rand.Rand
+	arena  *arena
 }
 
 type listNode struct {
+	key    []byte
+	entry  unsafe.Pointer // *memEntry
 	height uint8
-	entry  *memEntry
-	next   []*listNode
+	next   []unsafe.Pointer // *listNode
 }
 
 type memEntry struct {
 	keyLen   int
 	key      []byte
 	keyType  byte // del(0x0) or add(0x1)
+	seq      uint64
 	valueLen int
 	value    []byte
 }
 
-type Container struct {
-	container []*listNode
+// skipListIterator position with a search from the head,so Prev cost a search
+// too.Nodes are never removed,an iterator stay valid during inserts.
+type skipListIterator struct {
+	list *skipList
+	node *listNode
+}
+
+func (r *rangeTombstone) covers(key []byte) bool {
+	return bytes.Compare(key, r.start) >= 0 && bytes.Compare(key, r.end) < 0
 }
 
-func (c *Container) NewIterator() IIterator {
-	i := new(Iterator)
-	i.container = c
-	return i
+// add insert an operation,now decide whether the base of a merge is expired.
+func (mt *memTable) add(keyType byte, key, value []byte, seq uint64, now int64) error {
+	mt.entries++
+	switch keyType {
+	case typeRangeDeletion:
+		mt.rwMu.Lock()
+		mt.rangeDels = append(mt.rangeDels, rangeTombstone{start: key, end: value, seq: seq})
+		mt.rwMu.Unlock()
+		return nil
+	case typeMerge:
+		return mt.addMerge(key, value, seq, now)
+	}
+	mt.str.insert(key, value, keyType, seq)
+	return nil
+}
+
+// memoryUsage count keys,values and node overhead of the table and its range tombstones.
+func (mt *memTable) memoryUsage() int64 {
+	size := mt.str.memoryUsage()
+	mt.rwMu.RLock()
+	for i := range mt.rangeDels {
+		size += rangeDelSize + int64(len(mt.rangeDels[i].start)+len(mt.rangeDels[i].end))
+	}
+	mt.rwMu.RUnlock()
+	return size
+}
+
+// rangeDelSeq return the sequence of the newest range tombstone which cover key.
+func (mt *memTable) rangeDelSeq(key []byte) uint64 {
+	var seq uint64
+	mt.rwMu.RLock()
+	defer mt.rwMu.RUnlock()
+	for i := range mt.rangeDels {
+		if mt.rangeDels[i].seq > seq && mt.rangeDels[i].covers(key) {
+			seq = mt.rangeDels[i].seq
+		}
+	}
+	return seq
+}
+
+func (r *findResult) memEntry() *memEntry {
+	if r.sl != nil {
+		return r.sl.loadEntry()
+	}
+	return r.e
 }
 
 func (lsm *LSMTree) initSkipList() *skipList {
 	list := new(skipList)
-	list.head = new(listNode)
-	list.head.entry = nil
-	list.head.next = make([]*listNode, 12)
-	list.iter = new(Container)
+	list.arena = new(arena)
+	list.head = list.arena.newNode(skipListMaxHeight)
+	list.height = 1
+	list.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
 	return list
 }
 
-func (s *skipList) initSkipListNode(key []byte, value []byte) *listNode {
-	node := new(listNode)
-	node.entry = new(memEntry)
-	node.entry.keyLen = len(key) + 1
-	node.entry.valueLen = len(value)
-	node.entry.key = key
-	node.entry.value = value
-	node.height = RandomHeight()
-	node.next = make([]*listNode, node.height)
-	return node
+func (n *listNode) getNext(level int) *listNode {
+	return (*listNode)(atomic.LoadPointer(&n.next[level]))
 }
 
-func RandomHeight() uint8 {
-	source := rand.NewSource(time.Now().Unix())
-	kBranching := 4
+func (n *listNode) setNext(level int, next *listNode) {
+	atomic.StorePointer(&n.next[level], unsafe.Pointer(next))
+}
+
+func (n *listNode) loadEntry() *memEntry {
+	return (*memEntry)(atomic.LoadPointer(&n.entry))
+}
+
+// randomHeight increase the height with probability 1/4 each level.
+func (s *skipList) randomHeight() uint8 {
 	height := 1
-	for height < 12 && (int(source.Int63())&(kBranching-1) == 0) {
+	for height < skipListMaxHeight && s.rnd.Intn(4) == 0 {
 		height++
 	}
 	return uint8(height)
 }
 
-func (s *skipList) insert(key []byte, value []byte) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	var i, k uint8
-	insertNode := s.initSkipListNode(key, value)
-	tmpHeight := s.maxHeight - 1
-	s.mu.Lock()
-	s.keyNum++
-	if insertNode.height > s.maxHeight {
-		s.maxHeight = insertNode.height
-	}
-	s.mu.Unlock()
-	start := s.head
-	changePoints := make([]*listNode, insertNode.height+tmpHeight)
-	for j := insertNode.height - 1; j > 0; j-- {
-		if s.head.next[j] == nil {
-			changePoints[j] = insertNode
-			continue
+// findPrev fill prev with the last node before key of every level,
+// return the first node whose key >= key.
+func (s *skipList) findPrev(key []byte, prev []*listNode) *listNode {
+	cur := s.head
+	var next *listNode
+	for level := int(atomic.LoadInt32(&s.height)) - 1; level >= 0; level-- {
+		for next = cur.getNext(level); next != nil && bytes.Compare(next.key, key) < 0; next = cur.getNext(level) {
+			cur = next
 		}
-		if bytes.Compare(s.head.next[j].entry.key, key) == 1 {
-			changePoints[j] = insertNode
-			changePoints[j+insertNode.height] = s.head.next[j]
-		} else {
-			for next := start.next[j]; next != nil; start = next {
-				if bytes.Compare(next.next[j].entry.key, key) == 1 {
-					changePoints[j] = next
-					changePoints[j+insertNode.height] = next.next[j]
-				}
-			}
+		if prev != nil {
+			prev[level] = cur
 		}
 	}
-	for i = 0; i < insertNode.height-1; i++ {
-		changePoints[i].next[i] = insertNode
+	return next
+}
+
+// insert replace the entry of an existing key,a newer write always has a larger sequence.
+func (s *skipList) insert(key []byte, value []byte, keyType byte, seq uint64) {
+	var prev [skipListMaxHeight]*listNode
+	next := s.findPrev(key, prev[:])
+	if next != nil && bytes.Equal(next.key, key) {
+		if next.loadEntry().seq < seq {
+			atomic.StorePointer(&next.entry, unsafe.Pointer(s.arena.newEntry(next.key, value, keyType, seq)))
+		}
+		return
+	}
+	height := s.randomHeight()
+	node := s.arena.newNode(height)
+	node.key = s.arena.copyBytes(key)
+	node.entry = unsafe.Pointer(s.arena.newEntry(node.key, value, keyType, seq))
+	listHeight := uint8(atomic.LoadInt32(&s.height))
+	for i := listHeight; i < height; i++ {
+		prev[i] = s.head
+	}
+	for i := 0; i < int(height); i++ {
+		node.next[i] = unsafe.Pointer(prev[i].getNext(i))
+		prev[i].setNext(i, node)
 	}
-	for k = 0; k < tmpHeight; k++ {
-		insertNode.next[k] = changePoints[k+insertNode.height]
+	if height > listHeight {
+		atomic.StoreInt32(&s.height, int32(height))
 	}
+	atomic.AddInt64(&s.keyNum, 1)
 }
 
 func (s *skipList) find(key []byte) *findResult {
-	level := s.maxHeight - 1
-	start := s.head.next[level]
-	for {
-		next := start.next[level]
-		if next == nil {
-			level--
-			next = start.next[level]
-		}
-		if bytes.Compare(next.entry.key, key) == -1 {
-			start = next
-		} else {
-			if level == 0 {
-				return &findResult{nil, next}
-			} else {
-				level--
-			}
-		}
+	next := s.findPrev(key, nil)
+	if next != nil && bytes.Equal(next.key, key) {
+		return &findResult{sl: next}
 	}
+	return nil
+}
+
+// seek return the first key >= key,nil if there is none.
+func (s *skipList) seek(key []byte) []byte {
+	it := s.NewIterator()
+	it.Seek(key)
+	return it.Key()
+}
 
+// export return the sorted entries of the list,the keys are internal keys.
+func (s *skipList) export() *[]pairs {
+	pairData := make([]pairs, 0, atomic.LoadInt64(&s.keyNum))
+	for next := s.head.getNext(0); next != nil; next = next.getNext(0) {
+		e := next.loadEntry()
+		tmpEntry := new(pairs)
+		tmpEntry.setEntry(next.key, e.value, e.seq, e.keyType)
+		pairData = append(pairData, *tmpEntry)
+	}
+	return &pairData
 }
 
-func (s *skipList) delete(key []byte) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	updatePoint := make([]*listNode, s.maxHeight-1)
+func (s *skipList) memoryUsage() int64 {
+	return s.arena.memoryUsage()
+}
+
+// findLessThan return the last node whose key < key,or the head.
+func (s *skipList) findLessThan(key []byte) *listNode {
 	cur := s.head
-	for i := cur.height - 1; i > 0; i-- {
-		for bytes.Compare(cur.next[i].entry.key, key) == -1 {
-			cur = cur.next[i]
+	for level := int(atomic.LoadInt32(&s.height)) - 1; level >= 0; level-- {
+		for next := cur.getNext(level); next != nil && bytes.Compare(next.key, key) < 0; next = cur.getNext(level) {
+			cur = next
 		}
-		updatePoint[i] = cur
-	}
-	cur = cur.next[0]
-	if bytes.Compare(cur.entry.key, key) != 0 {
-		return false
-	} else {
-		for j := 0; uint8(j) <= s.maxHeight-1; j++ {
-			if updatePoint[j].next[j] != cur {
-				break
-			}
-			updatePoint[j].next[j] = cur.next[j]
+	}
+	return cur
+}
+
+// findLast return the last node,or the head of an empty list.
+func (s *skipList) findLast() *listNode {
+	cur := s.head
+	for level := int(atomic.LoadInt32(&s.height)) - 1; level >= 0; level-- {
+		for next := cur.getNext(level); next != nil; next = cur.getNext(level) {
+			cur = next
 		}
 	}
-	for s.maxHeight-1 > 0 && s.head.next[s.maxHeight-1] == nil {
-		s.maxHeight--
+	return cur
+}
+
+func (s *skipList) NewIterator() IIterator {
+	return &skipListIterator{list: s}
+}
+
+// orNil turn the head into nil,the head is before the first key.
+func (it *skipListIterator) orNil(node *listNode) *listNode {
+	if node == it.list.head {
+		return nil
 	}
-	s.keyNum--
-	return true
+	return node
 }
 
-func (s *skipList) export() *[]pairs {
-	i := 0
-	pairData := make([]pairs, 200)
-	start := s.head
-	s.iter.container = make([]*listNode, s.keyNum)
-	for next := start.next[0]; next != nil; start = next {
-		s.iter.container[i] = next
-	}
-	i = 0
-	iter := s.iter.NewIterator()
-	for ; iter.Valid(); iter.Next() {
-		tmpEntry := new(pairs)
-		tmpEntry.key = iter.key()
-		tmpEntry.value = iter.value()
-		tmpEntry.keyLen = uint(len(iter.key()))
-		tmpEntry.valueLen = uint(len(iter.value()))
-		pairData[i] = *tmpEntry
-		i++
+func (it *skipListIterator) Valid() bool {
+	return it.node != nil
+}
+
+func (it *skipListIterator) SeekToFirst() {
+	it.node = it.list.head.getNext(0)
+}
+
+func (it *skipListIterator) SeekToLast() {
+	it.node = it.orNil(it.list.findLast())
+}
+
+func (it *skipListIterator) Seek(target []byte) {
+	it.node = it.list.findPrev(target, nil)
+}
+
+func (it *skipListIterator) SeekForPrev(target []byte) {
+	it.node = it.list.findPrev(target, nil)
+	if it.node == nil || !bytes.Equal(it.node.key, target) {
+		it.node = it.orNil(it.list.findLessThan(target))
 	}
-	return &pairData
+}
+
+func (it *skipListIterator) Next() {
+	if it.node != nil {
+		it.node = it.node.getNext(0)
+	}
+}
+
+func (it *skipListIterator) Prev() {
+	if it.node != nil {
+		it.node = it.orNil(it.list.findLessThan(it.node.key))
+	}
+}
+
+func (it *skipListIterator) Key() []byte {
+	if it.node == nil {
+		return nil
+	}
+	return it.node.key
+}
+
+func (it *skipListIterator) Value() []byte {
+	if it.node == nil {
+		return nil
+	}
+	return it.node.loadEntry().value
+}
+
+func (it *skipListIterator) Error() error {
+	return nil
 }
@@ -0,0 +1,432 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+// Other memory table structures behind underStr,chosen by memoryTableType:
+// BTree: a B-tree of high fanout,a node hold many keys in one slice so a search
+// touch few cache lines.
+// hashLinkList: keys are hashed by their prefix into buckets of sorted linked
+// lists,a point lookup only walk one short list.The prefix is given by the
+// prefix extractor,the whole key is used if there is none.
+// vector: inserts are appended without any ordering,the vector is sorted on the
+// first read or on flush.It suit bulk loading where reads are rare.
+// Unlike the skip list,readers of them take a read lock of the structure.
+
+const (
+	btreeDegree   = 32
+	btreeMaxItems = 2*btreeDegree - 1
+	hashBucketNum = 16384
+)
+
+var (
+	btreeNodeSize = int64(unsafe.Sizeof(btreeNode{}))
+	hashNodeSize  = int64(unsafe.Sizeof(hashNode{}))
+)
+
+// newMemEntry copy key and value,the caller may reuse its buffers.
+func newMemEntry(key, value []byte, keyType byte, seq uint64) *memEntry {
+	e := new(memEntry)
+	e.key = append([]byte(nil), key...)
+	e.keyLen = len(key) + 1
+	e.keyType = keyType
+	e.seq = seq
+	e.valueLen = len(value)
+	e.value = append([]byte(nil), value...)
+	return e
+}
+
+func memEntrySize(key, value []byte) int64 {
+	return entrySize + int64(len(key)+len(value))
+}
+
+type bTree struct {
+	mu     sync.RWMutex
+	root   *btreeNode
+	keyNum int
+	size   int64
+}
+
+// btreeNode hold at most btreeMaxItems sorted entries,an internal node has one
+// more child than entries.
+type btreeNode struct {
+	items    []*memEntry
+	children []*btreeNode
+}
+
+func (lsm *LSMTree) initBTree() *bTree {
+	tree := new(bTree)
+	tree.root = tree.newNode(true)
+	return tree
+}
+
+func (t *bTree) newNode(leaf bool) *btreeNode {
+	n := new(btreeNode)
+	n.items = make([]*memEntry, 0, btreeMaxItems)
+	t.size += btreeNodeSize + btreeMaxItems*pointerSize
+	if !leaf {
+		n.children = make([]*btreeNode, 0, btreeMaxItems+1)
+		t.size += (btreeMaxItems + 1) * pointerSize
+	}
+	return n
+}
+
+func (n *btreeNode) leaf() bool {
+	return n.children == nil
+}
+
+// search return the index of the first entry whose key >= key.
+func (n *btreeNode) search(key []byte) int {
+	return sort.Search(len(n.items), func(i int) bool {
+		return bytes.Compare(n.items[i].key, key) >= 0
+	})
+}
+
+// split move the upper half of the fulled child i into a new right sibling,
+// the median entry go up into n.
+func (t *bTree) split(n *btreeNode, i int) {
+	child := n.children[i]
+	right := t.newNode(child.leaf())
+	right.items = append(right.items, child.items[btreeDegree:]...)
+	median := child.items[btreeDegree-1]
+	for j := btreeDegree - 1; j < len(child.items); j++ {
+		child.items[j] = nil
+	}
+	child.items = child.items[:btreeDegree-1]
+	if !child.leaf() {
+		right.children = append(right.children, child.children[btreeDegree:]...)
+		for j := btreeDegree; j < len(child.children); j++ {
+			child.children[j] = nil
+		}
+		child.children = child.children[:btreeDegree]
+	}
+	n.items = append(n.items, nil)
+	copy(n.items[i+1:], n.items[i:])
+	n.items[i] = median
+	n.children = append(n.children, nil)
+	copy(n.children[i+2:], n.children[i+1:])
+	n.children[i+1] = right
+}
+
+// insert split every fulled node on the way down,so the leaf always has room.
+func (t *bTree) insert(key []byte, value []byte, keyType byte, seq uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.root.items) == btreeMaxItems {
+		root := t.newNode(false)
+		root.children = append(root.children, t.root)
+		t.split(root, 0)
+		t.root = root
+	}
+	n := t.root
+	for {
+		i := n.search(key)
+		if i < len(n.items) && bytes.Equal(n.items[i].key, key) {
+			if n.items[i].seq < seq {
+				n.items[i] = newMemEntry(key, value, keyType, seq)
+				t.size += memEntrySize(key, value)
+			}
+			return
+		}
+		if n.leaf() {
+			n.items = append(n.items, nil)
+			copy(n.items[i+1:], n.items[i:])
+			n.items[i] = newMemEntry(key, value, keyType, seq)
+			t.size += memEntrySize(key, value)
+			t.keyNum++
+			return
+		}
+		if len(n.children[i].items) == btreeMaxItems {
+			t.split(n, i)
+			if cmp := bytes.Compare(key, n.items[i].key); cmp > 0 {
+				i++
+			} else if cmp == 0 {
+				continue
+			}
+		}
+		n = n.children[i]
+	}
+}
+
+func (t *bTree) find(key []byte) *findResult {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := t.root
+	for {
+		i := n.search(key)
+		if i < len(n.items) && bytes.Equal(n.items[i].key, key) {
+			return &findResult{e: n.items[i]}
+		}
+		if n.leaf() {
+			return nil
+		}
+		n = n.children[i]
+	}
+}
+
+// seek return the first key >= key,it is the entry found in a node or one of
+// the child before it.
+func (t *bTree) seek(key []byte) []byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var result []byte
+	n := t.root
+	for {
+		i := n.search(key)
+		if i < len(n.items) {
+			result = n.items[i].key
+			if bytes.Equal(result, key) {
+				return result
+			}
+		}
+		if n.leaf() {
+			return result
+		}
+		n = n.children[i]
+	}
+}
+
+func (t *bTree) export() *[]pairs {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	pairData := make([]pairs, 0, t.keyNum)
+	var walk func(n *btreeNode)
+	walk = func(n *btreeNode) {
+		for i, e := range n.items {
+			if !n.leaf() {
+				walk(n.children[i])
+			}
+			tmpEntry := new(pairs)
+			tmpEntry.setEntry(e.key, e.value, e.seq, e.keyType)
+			pairData = append(pairData, *tmpEntry)
+		}
+		if !n.leaf() {
+			walk(n.children[len(n.items)])
+		}
+	}
+	walk(t.root)
+	return &pairData
+}
+
+func (t *bTree) memoryUsage() int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.size
+}
+
+type hashLinkList struct {
+	mu              sync.RWMutex
+	buckets         []*hashNode
+	prefixExtractor PrefixExtractor
+	keyNum          int
+	size            int64
+}
+
+// hashNode is a node of the sorted list of one bucket.
+type hashNode struct {
+	entry *memEntry
+	next  *hashNode
+}
+
+func (lsm *LSMTree) initHashLinkList() *hashLinkList {
+	list := new(hashLinkList)
+	list.buckets = make([]*hashNode, hashBucketNum)
+	list.size = hashBucketNum * pointerSize
+	if lsm != nil {
+		list.prefixExtractor = lsm.prefixExtractor
+	}
+	return list
+}
+
+func (h *hashLinkList) bucket(key []byte) int {
+	prefix := key
+	if h.prefixExtractor != nil && h.prefixExtractor.InDomain(key) {
+		prefix = h.prefixExtractor.Transform(key)
+	}
+	return int(xxHash64(prefix, 0) % hashBucketNum)
+}
+
+func (h *hashLinkList) insert(key []byte, value []byte, keyType byte, seq uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	link := &h.buckets[h.bucket(key)]
+	for *link != nil && bytes.Compare((*link).entry.key, key) < 0 {
+		link = &(*link).next
+	}
+	if *link != nil && bytes.Equal((*link).entry.key, key) {
+		if (*link).entry.seq < seq {
+			(*link).entry = newMemEntry(key, value, keyType, seq)
+			h.size += memEntrySize(key, value)
+		}
+		return
+	}
+	*link = &hashNode{entry: newMemEntry(key, value, keyType, seq), next: *link}
+	h.size += hashNodeSize + memEntrySize(key, value)
+	h.keyNum++
+}
+
+func (h *hashLinkList) find(key []byte) *findResult {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for node := h.buckets[h.bucket(key)]; node != nil; node = node.next {
+		if cmp := bytes.Compare(node.entry.key, key); cmp == 0 {
+			return &findResult{e: node.entry}
+		} else if cmp > 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// seek walk every bucket,the keys are only sorted inside a bucket.
+func (h *hashLinkList) seek(key []byte) []byte {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var result []byte
+	for _, node := range h.buckets {
+		for ; node != nil; node = node.next {
+			if bytes.Compare(node.entry.key, key) >= 0 {
+				if result == nil || bytes.Compare(node.entry.key, result) < 0 {
+					result = node.entry.key
+				}
+				break
+			}
+		}
+	}
+	return result
+}
+
+// export sort the entries of all buckets,the order among buckets is lost by hashing.
+func (h *hashLinkList) export() *[]pairs {
+	h.mu.RLock()
+	entries := make([]*memEntry, 0, h.keyNum)
+	for _, node := range h.buckets {
+		for ; node != nil; node = node.next {
+			entries = append(entries, node.entry)
+		}
+	}
+	h.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	pairData := make([]pairs, len(entries))
+	for i, e := range entries {
+		pairData[i].setEntry(e.key, e.value, e.seq, e.keyType)
+	}
+	return &pairData
+}
+
+func (h *hashLinkList) memoryUsage() int64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.size
+}
+
+// vector keep every version of a key,sorting put the newest version of a key first.
+type vector struct {
+	mu      sync.RWMutex
+	entries []*memEntry
+	sorted  bool
+	size    int64
+}
+
+func (lsm *LSMTree) initVector() *vector {
+	v := new(vector)
+	v.sorted = true
+	return v
+}
+
+func (v *vector) insert(key []byte, value []byte, keyType byte, seq uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	e := newMemEntry(key, value, keyType, seq)
+	if n := len(v.entries); n > 0 && !v.less(v.entries[n-1], e) {
+		v.sorted = false
+	}
+	v.entries = append(v.entries, e)
+	v.size += pointerSize + memEntrySize(key, value)
+}
+
+func (v *vector) less(a, b *memEntry) bool {
+	if cmp := bytes.Compare(a.key, b.key); cmp != 0 {
+		return cmp < 0
+	}
+	return a.seq > b.seq
+}
+
+// sort must be called with v.mu held.
+func (v *vector) sort() {
+	if !v.sorted {
+		sort.Slice(v.entries, func(i, j int) bool {
+			return v.less(v.entries[i], v.entries[j])
+		})
+		v.sorted = true
+	}
+}
+
+// find sort an unsorted vector under the write lock first.
+func (v *vector) find(key []byte) *findResult {
+	v.mu.RLock()
+	if !v.sorted {
+		v.mu.RUnlock()
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		v.sort()
+	} else {
+		defer v.mu.RUnlock()
+	}
+	i := sort.Search(len(v.entries), func(i int) bool {
+		return bytes.Compare(v.entries[i].key, key) >= 0
+	})
+	if i < len(v.entries) && bytes.Equal(v.entries[i].key, key) {
+		return &findResult{e: v.entries[i]}
+	}
+	return nil
+}
+
+// seek sort an unsorted vector under the write lock first like find.
+func (v *vector) seek(key []byte) []byte {
+	v.mu.RLock()
+	if !v.sorted {
+		v.mu.RUnlock()
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		v.sort()
+	} else {
+		defer v.mu.RUnlock()
+	}
+	i := sort.Search(len(v.entries), func(i int) bool {
+		return bytes.Compare(v.entries[i].key, key) >= 0
+	})
+	if i < len(v.entries) {
+		return v.entries[i].key
+	}
+	return nil
+}
+
+// export return the newest version of every key.
+func (v *vector) export() *[]pairs {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.sort()
+	pairData := make([]pairs, 0, len(v.entries))
+	for i, e := range v.entries {
+		if i > 0 && bytes.Equal(v.entries[i-1].key, e.key) {
+			continue
+		}
+		tmpEntry := new(pairs)
+		tmpEntry.setEntry(e.key, e.value, e.seq, e.keyType)
+		pairData = append(pairData, *tmpEntry)
+	}
+	return &pairData
+}
+
+func (v *vector) memoryUsage() int64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.size
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func makeTestStrs() map[string]underStr {
+	lsmTree := &LSMTree{prefixExtractor: MakeFixedPrefixExtractor(2)}
+	return map[string]underStr{
+		"RBTree":       lsmTree.initRBTree(),
+		"BTree":        lsmTree.initBTree(),
+		"hashLinkList": lsmTree.initHashLinkList(),
+		"vector":       lsmTree.initVector(),
+	}
+}
+
+// TestMemTableRep compare every structure with a map keeping the newest write of a key.
+func TestMemTableRep(t *testing.T) {
+	for name, str := range makeTestStrs() {
+		rnd := rand.New(rand.NewSource(1))
+		newest := make(map[string]*memEntry)
+		for seq := uint64(1); seq <= 20000; seq++ {
+			key := []byte(strconv.Itoa(rnd.Intn(5000)))
+			value := []byte(strconv.FormatUint(seq, 10))
+			keyType := byte(typeValue)
+			if rnd.Intn(10) == 0 {
+				keyType, value = typeDeletion, nil
+			}
+			// an older write replayed after a newer one must be ignored
+			if seq%7 == 0 {
+				str.insert(key, []byte("old"), typeValue, 0)
+			}
+			str.insert(key, value, keyType, seq)
+			newest[string(key)] = &memEntry{key: key, value: value, keyType: keyType, seq: seq}
+		}
+		for i := 0; i < 5100; i++ {
+			key := []byte(strconv.Itoa(i))
+			want, ok := newest[string(key)]
+			result := str.find(key)
+			if !ok {
+				if result != nil {
+					t.Fatalf("%s find absent key %s", name, key)
+				}
+				continue
+			}
+			if result == nil {
+				t.Fatalf("%s does not find key %s", name, key)
+			}
+			e := result.memEntry()
+			if e.seq != want.seq || e.keyType != want.keyType || !bytes.Equal(e.value, want.value) {
+				t.Fatalf("%s find key %s seq %d,want %d", name, key, e.seq, want.seq)
+			}
+		}
+		data := *str.export()
+		if len(data) != len(newest) {
+			t.Fatalf("%s export %d entries,want %d", name, len(data), len(newest))
+		}
+		for i := range data {
+			if i > 0 && bytes.Compare(data[i-1].userKey(), data[i].userKey()) >= 0 {
+				t.Fatalf("%s export is not sorted", name)
+			}
+			seq, keyType := data[i].trailer()
+			want := newest[string(data[i].userKey())]
+			if seq != want.seq || keyType != want.keyType || !bytes.Equal(data[i].value, want.value) {
+				t.Fatalf("%s export key %s seq %d,want %d", name, data[i].userKey(), seq, want.seq)
+			}
+		}
+	}
+}
+
+func TestMemTableRepCopyKey(t *testing.T) {
+	for name, str := range makeTestStrs() {
+		key, value := []byte("key"), []byte("value")
+		str.insert(key, value, typeValue, 1)
+		key[0], value[0] = 'x', 'x'
+		result := str.find([]byte("key"))
+		if result == nil || !bytes.Equal(result.memEntry().value, []byte("value")) {
+			t.Fatalf("%s keep the buffer of the caller", name)
+		}
+	}
+}
+
+func TestMemTableTypes(t *testing.T) {
+	for _, memType := range []string{"BTree", "hashLinkList", "vector"} {
+		var lsmTree *LSMTree
+		lsmTree, err := lsmTree.initLSMTree(&Options{MemTableType: memType})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = lsmTree.open(t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+		putKeys(t, lsmTree, 0, 100)
+		if err = lsmTree.minorCompaction(); err != nil {
+			t.Fatal(err)
+		}
+		putKeys(t, lsmTree, 100, 200)
+		if err = lsmTree.RBDelete(&DeleteArgs{Key: testKey(150)}, new(DeleteReply)); err != nil {
+			t.Fatal(err)
+		}
+		checkFound(t, lsmTree, 50, true)
+		checkFound(t, lsmTree, 120, true)
+		checkFound(t, lsmTree, 150, false)
+		if err = lsmTree.minorCompaction(); err != nil {
+			t.Fatal(err)
+		}
+		checkFound(t, lsmTree, 120, true)
+		checkFound(t, lsmTree, 150, false)
+		if err = lsmTree.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// prefixKey return 16 keys for every prefix,like the few rows of one user.
+func prefixKey(i int) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(i/16)*0x9E3779B97F4A7C15)
+	binary.BigEndian.PutUint64(key[8:], uint64(i)*0x9E3779B97F4A7C15)
+	return key
+}
+
+func BenchmarkBTreeInsert(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkInsert(b, lsmTree.initBTree())
+}
+
+func BenchmarkHashLinkListInsert(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkInsert(b, lsmTree.initHashLinkList())
+}
+
+func BenchmarkVectorInsert(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkInsert(b, lsmTree.initVector())
+}
+
+func BenchmarkBTreeFind(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkFind(b, lsmTree.initBTree())
+}
+
+func BenchmarkHashLinkListFind(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkFind(b, lsmTree.initHashLinkList())
+}
+
+func BenchmarkVectorFind(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkFind(b, lsmTree.initVector())
+}
+
+func benchmarkPrefixFind(b *testing.B, str underStr) {
+	value := make([]byte, 100)
+	for i := 0; i < 100000; i++ {
+		str.insert(prefixKey(i), value, typeValue, uint64(i+1))
+	}
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		str.find(prefixKey(i % 100000))
+	}
+}
+
+func BenchmarkSkipListPrefixFind(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkPrefixFind(b, lsmTree.initSkipList())
+}
+
+func BenchmarkHashLinkListPrefixFind(b *testing.B) {
+	lsmTree := &LSMTree{prefixExtractor: MakeFixedPrefixExtractor(8)}
+	benchmarkPrefixFind(b, lsmTree.initHashLinkList())
+}
+
+// benchmarkBulkLoad insert a memory table worth of keys and export it as a flush do.
+// TestMemTableSeek compare seek of every structure with a search of the sorted keys.
+func TestMemTableSeek(t *testing.T) {
+	strs := makeTestStrs()
+	strs["skipList"] = new(LSMTree).initSkipList()
+	for name, str := range strs {
+		if key := str.seek([]byte("0")); key != nil {
+			t.Fatalf("%s seek %s in an empty table", name, key)
+		}
+		rnd := rand.New(rand.NewSource(1))
+		keys := make([]string, 0, 1000)
+		for i := 0; i < 1000; i++ {
+			key := strconv.Itoa(rnd.Intn(100000))
+			str.insert([]byte(key), nil, typeValue, uint64(i+1))
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for i := 0; i < 2000; i++ {
+			target := strconv.Itoa(rnd.Intn(110000))
+			j := sort.SearchStrings(keys, target)
+			key := str.seek([]byte(target))
+			if j == len(keys) && key != nil || j < len(keys) && string(key) != keys[j] {
+				t.Fatalf("%s seek %s return %s", name, target, key)
+			}
+		}
+	}
+}
+
+func benchmarkBulkLoad(b *testing.B, init func() underStr) {
+	value := make([]byte, 100)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		str := init()
+		for i := 0; i < 10000; i++ {
+			str.insert(benchKey(i), value, typeValue, uint64(i+1))
+		}
+		data := *str.export()
+		if !sort.SliceIsSorted(data, func(i, j int) bool {
+			return bytes.Compare(data[i].key, data[j].key) < 0
+		}) {
+			b.Fatal("Export is not sorted.")
+		}
+	}
+}
+
+func BenchmarkSkipListBulkLoad(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkBulkLoad(b, func() underStr { return lsmTree.initSkipList() })
+}
+
+func BenchmarkBTreeBulkLoad(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkBulkLoad(b, func() underStr { return lsmTree.initBTree() })
+}
+
+func BenchmarkVectorBulkLoad(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkBulkLoad(b, func() underStr { return lsmTree.initVector() })
+}
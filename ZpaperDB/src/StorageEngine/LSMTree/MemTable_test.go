@@ -1 +1,316 @@
 package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSkipList(t *testing.T) {
+	var lsmTree *LSMTree
+	list := lsmTree.initSkipList()
+	keys := rand.New(rand.NewSource(1)).Perm(1000)
+	for i, k := range keys {
+		key := []byte(strconv.Itoa(k))
+		list.insert(key, key, typeValue, uint64(i+1))
+	}
+	list.insert([]byte("7"), []byte("old"), typeValue, 1)
+	list.insert([]byte("8"), nil, typeDeletion, 5000)
+	if e := list.find([]byte("7")).memEntry(); !bytes.Equal(e.value, []byte("7")) {
+		t.Fatal("Older write replace the newer entry.")
+	}
+	if e := list.find([]byte("8")).memEntry(); e.keyType != typeDeletion || e.seq != 5000 {
+		t.Fatal("Newer write does not replace the entry.")
+	}
+	if list.find([]byte("1000")) != nil {
+		t.Fatal("Absent key is found.")
+	}
+	data := *list.export()
+	if len(data) != 1000 {
+		t.Fatalf("Export %d entries,want 1000", len(data))
+	}
+	if !sort.SliceIsSorted(data, func(i, j int) bool {
+		return bytes.Compare(data[i].userKey(), data[j].userKey()) < 0
+	}) {
+		t.Fatal("Export is not sorted.")
+	}
+	if list.memoryUsage() < 1000*(nodeSize+entrySize) {
+		t.Fatal("Memory usage does not count the nodes.")
+	}
+}
+
+func TestSkipListRandomHeight(t *testing.T) {
+	var lsmTree *LSMTree
+	list := lsmTree.initSkipList()
+	count := make(map[uint8]int)
+	for i := 0; i < 10000; i++ {
+		count[list.randomHeight()]++
+	}
+	// every level keep about 1/4 of the level below it
+	if count[1] < 7000 || count[1] > 8000 || count[2] < 1500 || count[2] > 2200 {
+		t.Fatal("Random height distribution error.", count)
+	}
+}
+
+func TestArenaMemoryUsage(t *testing.T) {
+	a := new(arena)
+	a.newNode(3)
+	a.newEntry([]byte("key"), make([]byte, 100), typeValue, 1)
+	a.copyBytes(make([]byte, bigValueSize+1))
+	want := nodeSize + 3*pointerSize + entrySize + 100 + bigValueSize + 1
+	if a.memoryUsage() != want {
+		t.Fatalf("Arena memory usage %d,want %d", a.memoryUsage(), want)
+	}
+}
+
+// TestSkipListConcurrent run readers during the inserts of one writer,
+// it is meant to be run with -race.
+func TestSkipListConcurrent(t *testing.T) {
+	var lsmTree *LSMTree
+	list := lsmTree.initSkipList()
+	const keyNum = 5000
+	done := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			lastSeq := make(map[int]uint64)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				k := rnd.Intn(keyNum)
+				result := list.find(benchKey(k))
+				if result != nil {
+					e := result.memEntry()
+					if binary.BigEndian.Uint64(e.value) != e.seq || e.seq < lastSeq[k] {
+						t.Error("Reader see a torn or older entry.")
+						return
+					}
+					lastSeq[k] = e.seq
+				}
+				if k%100 == 0 {
+					data := *list.export()
+					for i := 1; i < len(data); i++ {
+						if bytes.Compare(data[i-1].userKey(), data[i].userKey()) >= 0 {
+							t.Error("Export during insert is not sorted.")
+							return
+						}
+					}
+				}
+			}
+		}(int64(r))
+	}
+	rnd := rand.New(rand.NewSource(100))
+	for seq := uint64(1); seq <= keyNum*3; seq++ {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, seq)
+		list.insert(benchKey(rnd.Intn(keyNum)), value, typeValue, seq)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func benchKey(i int) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(i)*0x9E3779B97F4A7C15)
+	binary.BigEndian.PutUint64(key[8:], uint64(i))
+	return key
+}
+
+func benchmarkInsert(b *testing.B, str underStr) {
+	value := make([]byte, 100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		str.insert(benchKey(i), value, typeValue, uint64(i+1))
+	}
+}
+
+func benchmarkFind(b *testing.B, str underStr) {
+	value := make([]byte, 100)
+	for i := 0; i < 100000; i++ {
+		str.insert(benchKey(i), value, typeValue, uint64(i+1))
+	}
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		str.find(benchKey(i % 100000))
+	}
+}
+
+func BenchmarkSkipListInsert(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkInsert(b, lsmTree.initSkipList())
+}
+
+func BenchmarkRBTreeInsert(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkInsert(b, lsmTree.initRBTree())
+}
+
+func BenchmarkSkipListFind(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkFind(b, lsmTree.initSkipList())
+}
+
+func BenchmarkRBTreeFind(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkFind(b, lsmTree.initRBTree())
+}
+
+func BenchmarkSkipListConcurrentFind(b *testing.B) {
+	var lsmTree *LSMTree
+	list := lsmTree.initSkipList()
+	value := make([]byte, 100)
+	for i := 0; i < 100000; i++ {
+		list.insert(benchKey(i), value, typeValue, uint64(i+1))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			list.find(benchKey(i % 100000))
+			i++
+		}
+	})
+}
+
+func TestMemTableMemoryUsage(t *testing.T) {
+	var lsmTree *LSMTree
+	for _, memType := range []string{"skipList", "RBTree", "BTree", "hashLinkList", "vector"} {
+		lsmTree = &LSMTree{memType: memType}
+		mt := lsmTree.makeMemTable()
+		empty := mt.memoryUsage()
+		mt.add(typeValue, []byte("a"), make([]byte, 100), 1, 0)
+		size := mt.memoryUsage()
+		if size-empty < 101 || size-empty > 101+nodeSize+entrySize+skipListMaxHeight*pointerSize+rbNodeSize {
+			t.Fatalf("%s memory usage %d is not the keys,values and node overhead", memType, size)
+		}
+		mt.add(typeRangeDeletion, []byte("c"), []byte("d"), 3, 0)
+		if mt.memoryUsage() != size+rangeDelSize+2 {
+			t.Fatalf("%s memory usage does not count range tombstones", memType)
+		}
+	}
+}
+
+// checkIterator compare it with the sorted keys in both directions and seek
+// random targets.
+func checkIterator(t *testing.T, it IIterator, keys []string, rnd *rand.Rand) {
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if string(it.Key()) != keys[n] {
+			t.Fatalf("Iterator key %s,want %s", it.Key(), keys[n])
+		}
+		n++
+	}
+	if n != len(keys) {
+		t.Fatalf("Iterator return %d keys,want %d", n, len(keys))
+	}
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		n--
+		if string(it.Key()) != keys[n] {
+			t.Fatalf("Reverse iterator key %s,want %s", it.Key(), keys[n])
+		}
+	}
+	if n != 0 || it.Key() != nil || it.Value() != nil || it.Error() != nil {
+		t.Fatal("Reverse iteration error.")
+	}
+	it.Next()
+	it.Prev()
+	if it.Valid() {
+		t.Fatal("Next and Prev must not move an invalid iterator.")
+	}
+	for i := 0; i < 1000; i++ {
+		target := strconv.Itoa(rnd.Intn(4000))
+		j := sort.SearchStrings(keys, target)
+		it.Seek([]byte(target))
+		if it.Valid() != (j < len(keys)) || it.Valid() && string(it.Key()) != keys[j] {
+			t.Fatalf("Seek %s must move to the first key >= target.", target)
+		}
+		if j > 0 {
+			if !it.Valid() {
+				it.SeekToLast()
+			} else {
+				it.Prev()
+			}
+			if string(it.Key()) != keys[j-1] {
+				t.Fatalf("Prev after Seek %s error.", target)
+			}
+		}
+		if j < len(keys) && keys[j] == target {
+			j++
+		}
+		it.SeekForPrev([]byte(target))
+		if it.Valid() != (j > 0) || it.Valid() && string(it.Key()) != keys[j-1] {
+			t.Fatalf("SeekForPrev %s must move to the last key <= target.", target)
+		}
+	}
+}
+
+func TestMemTableIterator(t *testing.T) {
+	var lsmTree *LSMTree
+	for _, str := range []IContainer{lsmTree.initSkipList(), lsmTree.initRBTree()} {
+		it := str.NewIterator()
+		if it.SeekToFirst(); it.Valid() {
+			t.Fatal("Iterator of an empty table is valid.")
+		}
+		if it.SeekToLast(); it.Valid() {
+			t.Fatal("Iterator of an empty table is valid.")
+		}
+		rnd := rand.New(rand.NewSource(1))
+		keys := make([]string, 0, 1000)
+		for _, k := range rnd.Perm(3000)[:1000] {
+			key := strconv.Itoa(k)
+			keys = append(keys, key)
+			str.(underStr).insert([]byte(key), []byte(key), typeValue, uint64(k+1))
+		}
+		sort.Strings(keys)
+		checkIterator(t, it, keys, rnd)
+		it.Seek([]byte(keys[10]))
+		if !bytes.Equal(it.Value(), []byte(keys[10])) {
+			t.Fatal("Iterator value error.")
+		}
+		target := []byte(keys[500])
+		allocs := testing.AllocsPerRun(100, func() {
+			it.Seek(target)
+			it.Next()
+			it.Prev()
+		})
+		if allocs != 0 {
+			t.Fatalf("Iterator allocate %v times to move,want 0", allocs)
+		}
+	}
+}
+
+func benchmarkIterate(b *testing.B, str underStr) {
+	value := make([]byte, 100)
+	for i := 0; i < 100000; i++ {
+		str.insert(benchKey(i), value, typeValue, uint64(i+1))
+	}
+	it := str.(IContainer).NewIterator()
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if it.Next(); !it.Valid() {
+			it.SeekToFirst()
+		}
+	}
+}
+
+func BenchmarkSkipListIterate(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkIterate(b, lsmTree.initSkipList())
+}
+
+func BenchmarkRBTreeIterate(b *testing.B) {
+	var lsmTree *LSMTree
+	benchmarkIterate(b, lsmTree.initRBTree())
+}
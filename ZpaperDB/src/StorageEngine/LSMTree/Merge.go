@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// A Merge write an operand of typeMerge instead of a value,the operands are
+// applied on the older value of the key by the merge operator when the key is
+// read or compacted.The value of a typeMerge entry is a list of operands:
+// operand len(varint) | operand | operand len(varint) | operand ...
+// The memory table fold an operand into the entry of its key at once:onto a
+// value it is merged fully,onto other operands it is merged partially or
+// appended.The expiry of the base is checked against the time of the write
+// saved in its batch,so replaying the write ahead log fold the same.A merge onto a key written by PutWithTTL keep the expiry of the key,
+// the merged value expire with it.Once the key is expired it is no base,the
+// operands applied on it later start from no value and never expire.
+
+// MergeOperator combine the operands of Merge with the value of a key.
+type MergeOperator interface {
+	Name() string
+	// FullMerge apply operands,oldest first,on existingValue which is nil if the
+	// key has no value.
+	FullMerge(key, existingValue []byte, operands [][]byte) ([]byte, error)
+	// PartialMerge combine two operands into one,it return false if they can
+	// only be applied on a value.
+	PartialMerge(key, leftOperand, rightOperand []byte) ([]byte, bool)
+}
+
+var errNoMergeOperator = errors.New("merge: no merge operator")
+
+type uint64AddOperator struct{}
+
+type stringAppendOperator struct {
+	delimiter byte
+}
+
+// MakeUInt64AddOperator add operands to the value as little endian uint64,
+// a value or operand which is not 8 bytes is taken as 0.
+func MakeUInt64AddOperator() MergeOperator {
+	return uint64AddOperator{}
+}
+
+// MakeStringAppendOperator append operands to the value separated by delimiter.
+func MakeStringAppendOperator(delimiter byte) MergeOperator {
+	return stringAppendOperator{delimiter: delimiter}
+}
+
+func (uint64AddOperator) Name() string {
+	return "uint64add"
+}
+
+func decodeUint64(data []byte) uint64 {
+	if len(data) != 8 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(data)
+}
+
+func encodeUint64(n uint64) []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, n)
+	return data
+}
+
+func (uint64AddOperator) FullMerge(key, existingValue []byte, operands [][]byte) ([]byte, error) {
+	sum := decodeUint64(existingValue)
+	for _, operand := range operands {
+		sum += decodeUint64(operand)
+	}
+	return encodeUint64(sum), nil
+}
+
+func (uint64AddOperator) PartialMerge(key, leftOperand, rightOperand []byte) ([]byte, bool) {
+	return encodeUint64(decodeUint64(leftOperand) + decodeUint64(rightOperand)), true
+}
+
+func (stringAppendOperator) Name() string {
+	return "stringappend"
+}
+
+func (o stringAppendOperator) FullMerge(key, existingValue []byte, operands [][]byte) ([]byte, error) {
+	var value []byte
+	if existingValue != nil {
+		value = append(value, existingValue...)
+	}
+	for i, operand := range operands {
+		if existingValue != nil || i > 0 {
+			value = append(value, o.delimiter)
+		}
+		value = append(value, operand...)
+	}
+	return value, nil
+}
+
+func (o stringAppendOperator) PartialMerge(key, leftOperand, rightOperand []byte) ([]byte, bool) {
+	value := make([]byte, 0, len(leftOperand)+len(rightOperand)+1)
+	value = append(value, leftOperand...)
+	value = append(value, o.delimiter)
+	return append(value, rightOperand...), true
+}
+
+func encodeOperands(operands [][]byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	data := make([]byte, 0, 16)
+	for _, operand := range operands {
+		n := binary.PutUvarint(tmp[:], uint64(len(operand)))
+		data = append(data, tmp[:n]...)
+		data = append(data, operand...)
+	}
+	return data
+}
+
+func decodeOperands(data []byte) ([][]byte, error) {
+	operands := make([][]byte, 0, 1)
+	for len(data) > 0 {
+		operand, rest, ok := readLengthPrefixed(data)
+		if !ok {
+			return nil, errors.New("merge: bad operand list")
+		}
+		operands = append(operands, operand)
+		data = rest
+	}
+	return operands, nil
+}
+
+// appendOperand add operand after the operand list,it is merged into the last
+// operand if the operator can.
+func appendOperand(op MergeOperator, key, list, operand []byte) ([]byte, error) {
+	operands, err := decodeOperands(list)
+	if err != nil {
+		return nil, err
+	}
+	if last := len(operands) - 1; last >= 0 {
+		if combined, ok := op.PartialMerge(key, operands[last], operand); ok {
+			operands[last] = combined
+			return encodeOperands(operands), nil
+		}
+	}
+	return encodeOperands(append(operands, operand)), nil
+}
+
+// fullMerge apply the operand lists,given newest first,on base.
+func fullMerge(op MergeOperator, key, base []byte, lists [][]byte) ([]byte, error) {
+	if op == nil {
+		return nil, errNoMergeOperator
+	}
+	operands := make([][]byte, 0, len(lists))
+	for i := len(lists) - 1; i >= 0; i-- {
+		listOperands, err := decodeOperands(lists[i])
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, listOperands...)
+	}
+	return op.FullMerge(key, base, operands)
+}
+
+// combineOperands join the operand lists,given newest first,into one list.
+func combineOperands(op MergeOperator, key []byte, lists [][]byte) ([]byte, error) {
+	if op == nil {
+		return nil, errNoMergeOperator
+	}
+	combined := lists[len(lists)-1]
+	for i := len(lists) - 2; i >= 0; i-- {
+		operands, err := decodeOperands(lists[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, operand := range operands {
+			if combined, err = appendOperand(op, key, combined, operand); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return combined, nil
+}
+
+// mergeOnto apply the operand lists on an entry of another type,a deleted key
+// has no value and neither has a typeValueTTL entry expired at now.The result
+// keep the expiry of a live typeValueTTL entry.
+func mergeOnto(op MergeOperator, key, value []byte, keyType byte, now int64, lists [][]byte) ([]byte, byte, error) {
+	var base []byte
+	switch keyType {
+	case typeValue:
+		base = value
+	case typeValueTTL:
+		expireAt, ttlValue, ok := decodeTTLValue(value)
+		if !ok {
+			return nil, keyType, errors.New("merge: bad ttl value")
+		}
+		if expireAt <= now {
+			break
+		}
+		merged, err := fullMerge(op, key, ttlValue, lists)
+		if err != nil {
+			return nil, keyType, err
+		}
+		data := make([]byte, expirySize, expirySize+len(merged))
+		binary.LittleEndian.PutUint64(data, uint64(expireAt))
+		return append(data, merged...), typeValueTTL, nil
+	}
+	merged, err := fullMerge(op, key, base, lists)
+	return merged, typeValue, err
+}
+
+// foldMerges fold the versions of the key of versions[0],a typeMerge entry,
+// down to its base.Without a base the operands are combined into one typeMerge
+// entry,or applied on no value if there are no older versions below.A base in
+// a value log is read from values,a base expired at now is no value.
+func foldMerges(op MergeOperator, versions []pairs, rangeDels []rangeTombstone, bottommost bool, now int64, values *valueLog) (pairs, error) {
+	var result pairs
+	userKey := versions[0].userKey()
+	seq, _ := versions[0].trailer()
+	lists := make([][]byte, 0, 4)
+	for i := range versions {
+		if !bytes.Equal(versions[i].userKey(), userKey) {
+			break
+		}
+		versionSeq, keyType := versions[i].trailer()
+		value := versions[i].value
+		if coveredByRangeDel(rangeDels, userKey, versionSeq) {
+			value, keyType = nil, typeDeletion
+		}
+		if keyType == typeMerge {
+			lists = append(lists, value)
+			continue
+		}
+		if keyType == typeValuePointer {
+			var err error
+			if value, err = values.read(userKey, value); err != nil {
+				return result, err
+			}
+			keyType = typeValue
+		}
+		merged, keyType, err := mergeOnto(op, userKey, value, keyType, now, lists)
+		if err != nil {
+			return result, err
+		}
+		result.setEntry(userKey, merged, seq, keyType)
+		return result, nil
+	}
+	if !bottommost {
+		combined, err := combineOperands(op, userKey, lists)
+		if err != nil {
+			return result, err
+		}
+		result.setEntry(userKey, combined, seq, typeMerge)
+		return result, nil
+	}
+	merged, err := fullMerge(op, userKey, nil, lists)
+	if err != nil {
+		return result, err
+	}
+	result.setEntry(userKey, merged, seq, typeValue)
+	return result, nil
+}
+
+// addMerge fold a merge operand into the entry of key in the memory table,an
+// entry deleted by a newer range tombstone of the table or expired at now is no
+// base.
+func (mt *memTable) addMerge(key, operand []byte, seq uint64, now int64) error {
+	if mt.mergeOperator == nil {
+		return errNoMergeOperator
+	}
+	result := mt.str.find(key)
+	if result == nil {
+		mt.str.insert(key, encodeOperands([][]byte{operand}), typeMerge, seq)
+		return nil
+	}
+	e := result.memEntry()
+	value, keyType := e.value, e.keyType
+	if mt.rangeDelSeq(key) > e.seq {
+		value, keyType = nil, typeDeletion
+	}
+	if keyType == typeMerge {
+		list, err := appendOperand(mt.mergeOperator, key, value, operand)
+		if err != nil {
+			return err
+		}
+		mt.str.insert(key, list, typeMerge, seq)
+		return nil
+	}
+	merged, keyType, err := mergeOnto(mt.mergeOperator, key, value, keyType, now, [][]byte{encodeOperands([][]byte{operand})})
+	if err != nil {
+		return err
+	}
+	mt.str.insert(key, merged, keyType, seq)
+	return nil
+}
+
+// Merge write operand of key,it is applied on the value by Options.MergeOperator.
+func (lsm *LSMTree) Merge(key, operand []byte) error {
+	batch := new(WriteBatch)
+	batch.Merge(key, operand)
+	return lsm.write(batch)
+}
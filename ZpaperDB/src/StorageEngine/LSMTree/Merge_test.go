@@ -0,0 +1,406 @@
+package storage
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+)
+
+func makeMergeTestLSMTree(t *testing.T, op MergeOperator) *LSMTree {
+	var lsmTree *LSMTree
+	lsmTree, err := lsmTree.initLSMTree(&Options{MergeOperator: op})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lsmTree.open(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	return lsmTree
+}
+
+func addCounter(t *testing.T, lsmTree *LSMTree, key []byte, n uint64) {
+	if err := lsmTree.Merge(key, encodeUint64(n)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkCounter(t *testing.T, lsmTree *LSMTree, key []byte, want uint64) {
+	value, err := lsmTree.Get(key)
+	if err != nil {
+		t.Fatalf("counter %s: %v", key, err)
+	}
+	if len(value) != 8 || binary.LittleEndian.Uint64(value) != want {
+		t.Fatalf("counter %s = %v,want %d", key, value, want)
+	}
+}
+
+func checkString(t *testing.T, lsmTree *LSMTree, key []byte, want string) {
+	value, err := lsmTree.Get(key)
+	if err != nil {
+		t.Fatalf("key %s: %v", key, err)
+	}
+	if string(value) != want {
+		t.Fatalf("key %s = %q,want %q", key, value, want)
+	}
+}
+
+func TestMergeOperators(t *testing.T) {
+	add := MakeUInt64AddOperator()
+	value, err := add.FullMerge(nil, encodeUint64(5), [][]byte{encodeUint64(2), []byte("bad"), encodeUint64(3)})
+	if err != nil || decodeUint64(value) != 10 {
+		t.Fatal("uint64 add full merge error.", value, err)
+	}
+	if value, ok := add.PartialMerge(nil, encodeUint64(1), encodeUint64(2)); !ok || decodeUint64(value) != 3 {
+		t.Fatal("uint64 add partial merge error.")
+	}
+	appendOp := MakeStringAppendOperator(',')
+	if value, _ = appendOp.FullMerge(nil, nil, [][]byte{[]byte("a"), []byte("b")}); string(value) != "a,b" {
+		t.Fatalf("string append onto no value = %q", value)
+	}
+	if value, _ = appendOp.FullMerge(nil, []byte(""), [][]byte{[]byte("a")}); string(value) != ",a" {
+		t.Fatalf("string append onto empty value = %q", value)
+	}
+	list := encodeOperands([][]byte{[]byte("x"), nil, []byte("yz")})
+	operands, err := decodeOperands(list)
+	if err != nil || len(operands) != 3 || string(operands[2]) != "yz" || len(operands[1]) != 0 {
+		t.Fatal("operand list round trip error.", err)
+	}
+	if _, err = decodeOperands([]byte{5, 'a'}); err == nil {
+		t.Fatal("Broken operand list is decoded.")
+	}
+}
+
+func TestMergeCounter(t *testing.T) {
+	lsmTree := makeMergeTestLSMTree(t, MakeUInt64AddOperator())
+	key := []byte("counter")
+	addCounter(t, lsmTree, key, 1)
+	addCounter(t, lsmTree, key, 2)
+	checkCounter(t, lsmTree, key, 3)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	// operands in the memory table are merged with the ones of the SSTable
+	addCounter(t, lsmTree, key, 4)
+	checkCounter(t, lsmTree, key, 7)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	checkCounter(t, lsmTree, key, 7)
+	if err := lsmTree.RBAdd(&AddArgs{Key: key, Value: encodeUint64(100)}, new(AddReply)); err != nil {
+		t.Fatal(err)
+	}
+	addCounter(t, lsmTree, key, 1)
+	checkCounter(t, lsmTree, key, 101)
+	if err := lsmTree.RBDelete(&DeleteArgs{Key: key}, new(DeleteReply)); err != nil {
+		t.Fatal(err)
+	}
+	addCounter(t, lsmTree, key, 5)
+	checkCounter(t, lsmTree, key, 5)
+}
+
+func TestMergeStringAppend(t *testing.T) {
+	lsmTree := makeMergeTestLSMTree(t, MakeStringAppendOperator(','))
+	key := []byte("list")
+	if err := lsmTree.RBAdd(&AddArgs{Key: key, Value: []byte("a")}, new(AddReply)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	for _, operand := range []string{"b", "c"} {
+		if err := lsmTree.Merge(key, []byte(operand)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkString(t, lsmTree, key, "a,b,c")
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.Merge(key, []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	checkString(t, lsmTree, key, "a,b,c,d")
+	// a range tombstone newer than the value leave the operands without a base
+	if err := lsmTree.Merge([]byte("other"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.DeleteRange([]byte("a"), []byte("m")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.Merge(key, []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+	checkString(t, lsmTree, key, "e")
+	checkString(t, lsmTree, []byte("other"), "x")
+}
+
+func TestMergeCompaction(t *testing.T) {
+	lsmTree := makeMergeTestLSMTree(t, MakeUInt64AddOperator())
+	lsmTree.maxFileNum = 2
+	for i := 0; i < 100; i++ {
+		if err := lsmTree.RBAdd(&AddArgs{Key: testKey(i), Value: encodeUint64(uint64(i))}, new(AddReply)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 50; i < 150; i++ {
+		addCounter(t, lsmTree, testKey(i), 1000)
+	}
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 50; i < 150; i++ {
+		addCounter(t, lsmTree, testKey(i), 1)
+	}
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.maybeCompact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(lsmTree.levels[0]) != 0 || len(lsmTree.levels[1]) == 0 {
+		t.Fatal("Level0 is not compacted.")
+	}
+	for _, meta := range lsmTree.levels[1] {
+		data, err := meta.table.readAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range data {
+			if _, keyType := data[i].trailer(); keyType != typeValue {
+				t.Fatal("Merge operands are not folded at the bottommost level.")
+			}
+		}
+	}
+	for i := 0; i < 150; i++ {
+		want := uint64(i)
+		if i >= 100 {
+			want = 0
+		}
+		if i >= 50 {
+			want += 1001
+		}
+		checkCounter(t, lsmTree, testKey(i), want)
+	}
+	it := lsmTree.NewIterator()
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if n == 120 && decodeUint64(it.Value()) != 1001 {
+			t.Fatal("Iterator return an unmerged value.")
+		}
+		n++
+	}
+	if it.Error() != nil || n != 150 {
+		t.Fatalf("Iterator return %d keys,want 150", n)
+	}
+}
+
+func TestMergeNewestOperands(t *testing.T) {
+	op := MakeStringAppendOperator(',')
+	data := make([]pairs, 4)
+	data[0].setEntry([]byte("a"), encodeOperands([][]byte{[]byte("x")}), 3, typeMerge)
+	data[1].setEntry([]byte("a"), encodeOperands([][]byte{[]byte("y")}), 4, typeMerge)
+	data[2].setEntry([]byte("b"), encodeOperands([][]byte{[]byte("z")}), 5, typeMerge)
+	data[3].setEntry([]byte("b"), []byte("v"), 2, typeValue)
+	merged, err := mergeNewest(append([]pairs(nil), data...), nil, false, 0, op, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// operands without a base stay operands,there may be a base at a lower level
+	if seq, keyType := merged[0].trailer(); keyType != typeMerge || seq != 4 {
+		t.Fatal("Operands without a base are not combined.")
+	}
+	if operands, _ := decodeOperands(merged[0].value); len(operands) != 1 || string(operands[0]) != "x,y" {
+		t.Fatalf("Combined operands %q,want x,y", operands)
+	}
+	if _, keyType := merged[1].trailer(); keyType != typeValue || string(merged[1].value) != "v,z" {
+		t.Fatalf("Merged value %q,want v,z", merged[1].value)
+	}
+	merged, err = mergeNewest(append([]pairs(nil), data...), nil, true, 0, op, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, keyType := merged[0].trailer(); keyType != typeValue || string(merged[0].value) != "x,y" {
+		t.Fatalf("Merged value %q,want x,y", merged[0].value)
+	}
+	if _, err = mergeNewest(append([]pairs(nil), data...), nil, true, 0, nil, nil); err == nil {
+		t.Fatal("Merge operands are folded without a merge operator.")
+	}
+}
+
+func TestMergeTTL(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	var lsmTree *LSMTree
+	lsmTree, err := lsmTree.initLSMTree(&Options{Clock: clock, MergeOperator: MakeUInt64AddOperator()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lsmTree.open(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("counter")
+	if err = lsmTree.PutWithTTL(key, encodeUint64(1), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	addCounter(t, lsmTree, key, 1)
+	if err = lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	addCounter(t, lsmTree, key, 1)
+	checkCounter(t, lsmTree, key, 3)
+	// the value folded in the memory table expire with its base,the operand
+	// left above the expired base is applied on no value
+	clock.advance(time.Minute)
+	checkCounter(t, lsmTree, key, 1)
+	if err = lsmTree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkCounter(t, lsmTree, key, 1)
+}
+
+func TestMergeOntoExpiredTTL(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	var lsmTree *LSMTree
+	lsmTree, err := lsmTree.initLSMTree(&Options{Clock: clock, MergeOperator: MakeUInt64AddOperator()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lsmTree.open(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer lsmTree.Close()
+	// the expired base is in the memory table,in a SSTable below the operand
+	// and folded by a compaction
+	for i, key := range [][]byte{[]byte("memory"), []byte("table"), []byte("compaction")} {
+		if err = lsmTree.PutWithTTL(key, encodeUint64(1), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			if err = lsmTree.minorCompaction(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	clock.advance(2 * time.Minute)
+	for _, key := range [][]byte{[]byte("memory"), []byte("table"), []byte("compaction")} {
+		addCounter(t, lsmTree, key, 5)
+	}
+	if err = lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	checkCounter(t, lsmTree, []byte("memory"), 5)
+	checkCounter(t, lsmTree, []byte("table"), 5)
+	if err = lsmTree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkCounter(t, lsmTree, []byte("compaction"), 5)
+	// the result of a merge onto an expired base never expire
+	clock.advance(time.Hour)
+	checkCounter(t, lsmTree, []byte("memory"), 5)
+}
+
+func TestMergeConcurrent(t *testing.T) {
+	lsmTree, err := OpenLSMTree(t.TempDir(), &Options{MergeOperator: MakeUInt64AddOperator(), MaxMemTableSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				if err := lsmTree.Merge([]byte("counter"), encodeUint64(1)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	checkCounter(t, lsmTree, []byte("counter"), 4000)
+	if err = lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeWithoutOperator(t *testing.T) {
+	lsmTree := makeTestLSMTree(t)
+	batch := new(WriteBatch)
+	batch.Put(testKey(1), testKey(1))
+	batch.Merge(testKey(2), []byte("x"))
+	if err := lsmTree.Write(batch); err != errNoMergeOperator {
+		t.Fatal("Merge without a merge operator must fail.", err)
+	}
+	// the batch is rejected as a whole
+	checkFound(t, lsmTree, 1, false)
+	if lsmTree.seq != 0 {
+		t.Fatal("Rejected batch consume sequence numbers.")
+	}
+}
+
+func TestMergeReopen(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{MergeOperator: MakeUInt64AddOperator()}
+	lsmTree, err := OpenLSMTree(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("counter")
+	addCounter(t, lsmTree, key, 2)
+	if err = lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	addCounter(t, lsmTree, key, 3)
+	if err = lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenLSMTree(dir, nil); err == nil {
+		t.Fatal("Write ahead log with merges is replayed without a merge operator.")
+	}
+	lsmTree, err = OpenLSMTree(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmTree.Close()
+	checkCounter(t, lsmTree, key, 5)
+}
+
+func TestMergeTTLReopen(t *testing.T) {
+	dir := t.TempDir()
+	clock := &testClock{now: time.Unix(1000, 0)}
+	opts := &Options{Clock: clock, MergeOperator: MakeStringAppendOperator(',')}
+	lsmTree, err := OpenLSMTree(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("k")
+	if err = lsmTree.PutWithTTL(key, []byte("a"), 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err = lsmTree.Merge(key, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(20 * time.Second)
+	if _, err = lsmTree.Get(key); err != ErrNotFound {
+		t.Fatalf("Get of the expired merge = %v", err)
+	}
+	if err = lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the replay fold the merge against the time of its write,not of the replay
+	lsmTree, err = OpenLSMTree(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmTree.Close()
+	if value, err := lsmTree.Get(key); err != ErrNotFound {
+		t.Fatalf("Get after reopen = %q,%v", value, err)
+	}
+}
@@ -0,0 +1,328 @@
+package storage
+
+import (
+	"errors"
+	"ini"
+	"time"
+)
+
+// Options hold the settings of a LSMTree,the fields under a [section] comment
+// are read from that section of lsm.ini,the others are only set in code.A zero
+// field take the default value,if IniFile is set the keys present in the file
+// override the fields.
+type Options struct {
+	// [LSMTree]
+	// Cache is read from the cache key but ignored,there is no block cache and
+	// every read of a SSTable block go to the file.
+	Cache bool
+	// [MemTable]
+	MemTableType    string // skipList,RBTree,BTree,hashLinkList or vector
+	MaxMemTableSize int
+	// [SSTable]
+	MaxFileOfOneLevel    int
+	SnappyCompression    bool
+	BlockSize            int
+	BlockRestartInterval int
+	FilterFpp            float64
+	// [ValueLog]
+	// Values of at least ValueLogThreshold bytes are moved into value logs on
+	// flush,0 keep every value in the SSTables.The value logs whose garbage
+	// reach ValueLogGCRatio are collected after compactions,0 leave it to
+	// GarbageCollectValueLog.
+	ValueLogThreshold int
+	ValueLogGCRatio   float64
+
+	// CompactionStyle is leveled,universal or fifo,see CompactionPicker.
+	CompactionStyle string
+	// leveled: level1 may save MaxBytesForLevelBase,every next level
+	// LevelSizeMultiplier times more.
+	MaxBytesForLevelBase int64
+	LevelSizeMultiplier  int
+	// universal: runs within UniversalSizeRatio percent are merged,all runs are
+	// merged once the newer ones reach UniversalMaxSizeAmplificationPercent of the oldest.
+	UniversalSizeRatio                   int
+	UniversalMaxSizeAmplificationPercent int
+	// fifo: the oldest files are dropped beyond FIFOMaxTableFilesSize or FIFOTTL,
+	// a zero FIFOTTL keep files of any age.
+	FIFOMaxTableFilesSize int64
+	FIFOTTL               time.Duration
+
+	// [Background]
+	// Flushes run on MaxBackgroundFlushes workers and compactions on
+	// MaxBackgroundCompactions workers,a compaction worker run a queued flush
+	// first.A compaction larger than one output file is split into at most
+	// MaxSubcompactions key ranges compacted in parallel.
+	MaxBackgroundFlushes     int
+	MaxBackgroundCompactions int
+	MaxSubcompactions        int
+	// [RateLimiter]
+	// Flushes and compactions write SSTables at RateBytesPerSecond at most,0
+	// do not limit them.RateLimiterAutoTune raise the rate with the pending
+	// compaction bytes,see rateLimiter.
+	RateBytesPerSecond  int64
+	RateLimiterAutoTune bool
+
+	// Writes are delayed or stopped by the level0 file number or the
+	// estimated bytes compaction must rewrite.
+	Level0SlowdownWritesTrigger     int
+	Level0StopWritesTrigger         int
+	SoftPendingCompactionBytesLimit int64
+	HardPendingCompactionBytesLimit int64
+
+	// ReadOnly open take a shared lock of the directory and refuse writes.
+	ReadOnly bool
+	// Sync fsync the write ahead log before a write return,otherwise a crash
+	// of the machine may lose the last writes.
+	Sync bool
+	// FilterPolicy replace the bloom filter built from FilterFpp.
+	FilterPolicy    FilterPolicy
+	PrefixExtractor PrefixExtractor
+	// Clock decide whether the keys written by PutWithTTL are expired.
+	Clock Clock
+	// MergeOperator apply the operands written by Merge,Merge fail without it.
+	MergeOperator MergeOperator
+	// CompactionFilter may remove or change the values written by compactions.
+	CompactionFilter CompactionFilter
+	// EventListener is told of the flushes,compactions,file changes,write
+	// stalls and background errors of the database.
+	EventListener EventListener
+	IniFile       string
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		Cache:                true,
+		MemTableType:         "skipList",
+		MaxMemTableSize:      tableMaxSize,
+		Clock:                systemClock{},
+		MaxFileOfOneLevel:    10,
+		BlockSize:            blockSize,
+		BlockRestartInterval: restartInterval,
+		FilterFpp:            0.01,
+
+		CompactionStyle:                      "leveled",
+		MaxBytesForLevelBase:                 10 << 20,
+		LevelSizeMultiplier:                  10,
+		UniversalSizeRatio:                   1,
+		UniversalMaxSizeAmplificationPercent: 200,
+		FIFOMaxTableFilesSize:                1 << 30,
+
+		MaxBackgroundFlushes:     1,
+		MaxBackgroundCompactions: 2,
+		MaxSubcompactions:        1,
+
+		Level0SlowdownWritesTrigger:     20,
+		Level0StopWritesTrigger:         36,
+		SoftPendingCompactionBytesLimit: 64 << 30,
+		HardPendingCompactionBytesLimit: 256 << 30,
+	}
+}
+
+// resolve return a copy of opts with the ini file applied and the defaults filled in.
+func (opts *Options) resolve() (*Options, error) {
+	o := DefaultOptions()
+	if opts != nil {
+		*o = *opts
+	}
+	if o.IniFile != "" {
+		if err := o.loadIni(o.IniFile); err != nil {
+			return nil, err
+		}
+	}
+	def := DefaultOptions()
+	if o.Clock == nil {
+		o.Clock = def.Clock
+	}
+	if o.MemTableType == "" {
+		o.MemTableType = def.MemTableType
+	}
+	if o.MaxMemTableSize <= 0 {
+		o.MaxMemTableSize = def.MaxMemTableSize
+	}
+	if o.MaxFileOfOneLevel <= 0 {
+		o.MaxFileOfOneLevel = def.MaxFileOfOneLevel
+	}
+	if o.BlockSize <= 0 {
+		o.BlockSize = def.BlockSize
+	}
+	if o.BlockRestartInterval <= 0 {
+		o.BlockRestartInterval = def.BlockRestartInterval
+	}
+	if o.FilterFpp == 0 {
+		o.FilterFpp = def.FilterFpp
+	}
+	if o.Level0SlowdownWritesTrigger <= 0 {
+		o.Level0SlowdownWritesTrigger = def.Level0SlowdownWritesTrigger
+	}
+	if o.Level0StopWritesTrigger <= 0 {
+		o.Level0StopWritesTrigger = def.Level0StopWritesTrigger
+	}
+	if o.SoftPendingCompactionBytesLimit <= 0 {
+		o.SoftPendingCompactionBytesLimit = def.SoftPendingCompactionBytesLimit
+	}
+	if o.HardPendingCompactionBytesLimit <= 0 {
+		o.HardPendingCompactionBytesLimit = def.HardPendingCompactionBytesLimit
+	}
+	if o.CompactionStyle == "" {
+		o.CompactionStyle = def.CompactionStyle
+	}
+	if o.MaxBytesForLevelBase <= 0 {
+		o.MaxBytesForLevelBase = def.MaxBytesForLevelBase
+	}
+	if o.LevelSizeMultiplier <= 1 {
+		o.LevelSizeMultiplier = def.LevelSizeMultiplier
+	}
+	if o.UniversalSizeRatio <= 0 {
+		o.UniversalSizeRatio = def.UniversalSizeRatio
+	}
+	if o.UniversalMaxSizeAmplificationPercent <= 0 {
+		o.UniversalMaxSizeAmplificationPercent = def.UniversalMaxSizeAmplificationPercent
+	}
+	if o.FIFOMaxTableFilesSize <= 0 {
+		o.FIFOMaxTableFilesSize = def.FIFOMaxTableFilesSize
+	}
+	if o.MaxBackgroundFlushes <= 0 {
+		o.MaxBackgroundFlushes = def.MaxBackgroundFlushes
+	}
+	if o.MaxBackgroundCompactions <= 0 {
+		o.MaxBackgroundCompactions = def.MaxBackgroundCompactions
+	}
+	if o.MaxSubcompactions <= 0 {
+		o.MaxSubcompactions = def.MaxSubcompactions
+	}
+	if o.RateBytesPerSecond < 0 {
+		return nil, errors.New("options: negative rateBytesPerSecond")
+	}
+	if o.ValueLogThreshold < 0 || o.ValueLogGCRatio < 0 || o.ValueLogGCRatio > 1 {
+		return nil, errors.New("options: bad value log threshold or gc ratio")
+	}
+	if o.Level0StopWritesTrigger < o.Level0SlowdownWritesTrigger ||
+		o.HardPendingCompactionBytesLimit < o.SoftPendingCompactionBytesLimit {
+		return nil, errors.New("options: stop trigger must not be less than slowdown trigger")
+	}
+	switch o.MemTableType {
+	case "skipList", "RBTree", "BTree", "hashLinkList", "vector":
+	default:
+		return nil, errors.New("options: unknown memoryTableType " + o.MemTableType)
+	}
+	switch o.CompactionStyle {
+	case "leveled", "universal", "fifo":
+	default:
+		return nil, errors.New("options: unknown compactionStyle " + o.CompactionStyle)
+	}
+	return o, nil
+}
+
+// columnFamilyOptions resolve the options of a column family,a nil opts use db.
+// The options which belong to the whole database are taken from db.
+func (opts *Options) columnFamilyOptions(db *Options) (*Options, error) {
+	if opts == nil {
+		return db, nil
+	}
+	o, err := opts.resolve()
+	if err != nil {
+		return nil, err
+	}
+	o.ReadOnly = db.ReadOnly
+	o.Clock = db.Clock
+	o.MaxBackgroundFlushes = db.MaxBackgroundFlushes
+	o.MaxBackgroundCompactions = db.MaxBackgroundCompactions
+	o.RateBytesPerSecond = db.RateBytesPerSecond
+	o.RateLimiterAutoTune = db.RateLimiterAutoTune
+	o.EventListener = db.EventListener
+	o.Level0SlowdownWritesTrigger = db.Level0SlowdownWritesTrigger
+	o.Level0StopWritesTrigger = db.Level0StopWritesTrigger
+	o.SoftPendingCompactionBytesLimit = db.SoftPendingCompactionBytesLimit
+	o.HardPendingCompactionBytesLimit = db.HardPendingCompactionBytesLimit
+	return o, nil
+}
+
+func (opts *Options) loadIni(name string) error {
+	cfg, err := ini.Load(name)
+	if err != nil {
+		return err
+	}
+	section := cfg.Section("LSMTree")
+	if section.HasKey("cache") {
+		if opts.Cache, err = section.Key("cache").Bool(); err != nil {
+			return err
+		}
+	}
+	section = cfg.Section("MemTable")
+	if section.HasKey("memoryTableType") {
+		opts.MemTableType = section.Key("memoryTableType").String()
+	}
+	if section.HasKey("maxMemoryTableSize") {
+		if opts.MaxMemTableSize, err = section.Key("maxMemoryTableSize").Int(); err != nil {
+			return err
+		}
+	}
+	section = cfg.Section("SSTable")
+	if section.HasKey("maxFileOfOneLevel") {
+		if opts.MaxFileOfOneLevel, err = section.Key("maxFileOfOneLevel").Int(); err != nil {
+			return err
+		}
+	}
+	if section.HasKey("snappyCompression") {
+		if opts.SnappyCompression, err = section.Key("snappyCompression").Bool(); err != nil {
+			return err
+		}
+	}
+	if section.HasKey("blockSize") {
+		if opts.BlockSize, err = section.Key("blockSize").Int(); err != nil {
+			return err
+		}
+	}
+	if section.HasKey("blockRestartInterval") {
+		if opts.BlockRestartInterval, err = section.Key("blockRestartInterval").Int(); err != nil {
+			return err
+		}
+	}
+	if section.HasKey("filterFpp") {
+		if opts.FilterFpp, err = section.Key("filterFpp").Float64(); err != nil {
+			return err
+		}
+	}
+	if section.HasKey("compactionStyle") {
+		opts.CompactionStyle = section.Key("compactionStyle").String()
+	}
+	section = cfg.Section("Background")
+	if section.HasKey("maxBackgroundFlushes") {
+		if opts.MaxBackgroundFlushes, err = section.Key("maxBackgroundFlushes").Int(); err != nil {
+			return err
+		}
+	}
+	if section.HasKey("maxBackgroundCompactions") {
+		if opts.MaxBackgroundCompactions, err = section.Key("maxBackgroundCompactions").Int(); err != nil {
+			return err
+		}
+	}
+	if section.HasKey("maxSubcompactions") {
+		if opts.MaxSubcompactions, err = section.Key("maxSubcompactions").Int(); err != nil {
+			return err
+		}
+	}
+	section = cfg.Section("RateLimiter")
+	if section.HasKey("rateBytesPerSecond") {
+		if opts.RateBytesPerSecond, err = section.Key("rateBytesPerSecond").Int64(); err != nil {
+			return err
+		}
+	}
+	if section.HasKey("autoTune") {
+		if opts.RateLimiterAutoTune, err = section.Key("autoTune").Bool(); err != nil {
+			return err
+		}
+	}
+	section = cfg.Section("ValueLog")
+	if section.HasKey("valueLogThreshold") {
+		if opts.ValueLogThreshold, err = section.Key("valueLogThreshold").Int(); err != nil {
+			return err
+		}
+	}
+	if section.HasKey("valueLogGCRatio") {
+		if opts.ValueLogGCRatio, err = section.Key("valueLogGCRatio").Float64(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
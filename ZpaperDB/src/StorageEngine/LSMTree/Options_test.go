@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOptionsDefault(t *testing.T) {
+	var opts *Options
+	resolved, err := opts.resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *resolved != *DefaultOptions() {
+		t.Fatal("Nil options must resolve to the default options.")
+	}
+	_, err = (&Options{MemTableType: "hash"}).resolve()
+	if err == nil {
+		t.Fatal("Unknown memory table type is accepted.")
+	}
+}
+
+func TestOptionsIni(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "lsm.ini")
+	content := "[MemTable]\nmemoryTableType = RBTree\n\n[SSTable]\nblockSize = 8192\nfilterFpp = 0.05\n\n[Background]\nmaxSubcompactions = 4\n\n[RateLimiter]\nrateBytesPerSecond = 1048576\n"
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := (&Options{MaxFileOfOneLevel: 4, BlockSize: 1024, IniFile: name}).resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.MemTableType != "RBTree" || opts.BlockSize != 8192 || opts.FilterFpp != 0.05 || opts.MaxSubcompactions != 4 || opts.RateBytesPerSecond != 1<<20 {
+		t.Fatal("Ini keys must override the fields.")
+	}
+	if opts.MaxFileOfOneLevel != 4 || opts.BlockRestartInterval != restartInterval {
+		t.Fatal("Keys absent from the ini file must keep the fields or defaults.")
+	}
+	_, err = (&Options{IniFile: filepath.Join(t.TempDir(), "missing.ini")}).resolve()
+	if err == nil {
+		t.Fatal("Missing ini file is accepted.")
+	}
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// The rate limiter is a token bucket shared by the column families,every block
+// an SSTable write take its size in tokens first.Tokens refill at
+// Options.RateBytesPerSecond and the bucket hold refillPeriod of them at most,so
+// an idle limiter do not let a burst through.A write may take more tokens than
+// the bucket hold,the next writes wait until the debt is paid.Flushes have the
+// high priority:a compaction write wait while a flush is waiting.With
+// Options.RateLimiterAutoTune the rate is raised by the pending compaction bytes,
+// up to autoTuneMaxFactor times the configured rate once they reach
+// Options.SoftPendingCompactionBytesLimit,so compaction keep up before writes stall.
+
+const (
+	ioHigh = 0 // flush
+	ioLow  = 1 // compaction
+
+	refillPeriod      = 100 * time.Millisecond
+	autoTuneMaxFactor = 8
+)
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	baseRate  int64
+	rate      int64 // bytes per second
+	autoTune  bool
+	available int64
+	last      time.Time
+	waiting   [2]int
+	total     [2]int64 // bytes requested by priority
+	closing   <-chan struct{}
+}
+
+// makeRateLimiter return nil if bytesPerSecond is 0,a nil limiter never wait.
+func makeRateLimiter(bytesPerSecond int64, autoTune bool, closing <-chan struct{}) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		baseRate: bytesPerSecond,
+		rate:     bytesPerSecond,
+		autoTune: autoTune,
+		last:     time.Now(),
+		closing:  closing,
+	}
+}
+
+func (lim *rateLimiter) burst() int64 {
+	burst := lim.rate * int64(refillPeriod) / int64(time.Second)
+	if burst < 1 {
+		burst = 1
+	}
+	return burst
+}
+
+// refill must be called with lim.mu held.
+func (lim *rateLimiter) refill(now time.Time) {
+	elapsed := now.Sub(lim.last)
+	if elapsed <= 0 {
+		return
+	}
+	lim.last = now
+	lim.available += int64(float64(lim.rate) * elapsed.Seconds())
+	if burst := lim.burst(); lim.available > burst {
+		lim.available = burst
+	}
+}
+
+// request wait until n bytes of the priority may be written,it return at once
+// once the tree is closed so the writer can stop.
+func (lim *rateLimiter) request(n int, priority int) {
+	if lim == nil || n <= 0 {
+		return
+	}
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	lim.total[priority] += int64(n)
+	for {
+		lim.refill(time.Now())
+		if lim.available > 0 && (priority == ioHigh || lim.waiting[ioHigh] == 0) {
+			lim.available -= int64(n)
+			return
+		}
+		wait := refillPeriod / 10
+		if lim.available <= 0 {
+			wait = time.Duration(float64(-lim.available+1) / float64(lim.rate) * float64(time.Second))
+		}
+		lim.waiting[priority]++
+		lim.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-lim.closing:
+			timer.Stop()
+			lim.mu.Lock()
+			lim.waiting[priority]--
+			return
+		}
+		lim.mu.Lock()
+		lim.waiting[priority]--
+	}
+}
+
+// setPendingBytes raise the rate by the pending compaction bytes in auto tune mode.
+func (lim *rateLimiter) setPendingBytes(pending, soft int64) {
+	if lim == nil || !lim.autoTune {
+		return
+	}
+	factor := 1.0
+	if soft > 0 && pending > 0 {
+		factor += (autoTuneMaxFactor - 1) * float64(pending) / float64(soft)
+	}
+	if factor > autoTuneMaxFactor {
+		factor = autoTuneMaxFactor
+	}
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	lim.refill(time.Now())
+	lim.rate = int64(float64(lim.baseRate) * factor)
+}
+
+// bytesPerSecond return the current rate,0 if there is no limit.
+func (lim *rateLimiter) bytesPerSecond() int64 {
+	if lim == nil {
+		return 0
+	}
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return lim.rate
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if lim := makeRateLimiter(0, true, nil); lim != nil {
+		t.Fatal("Zero rate make a limiter.")
+	}
+	var lim *rateLimiter
+	lim.request(1<<20, ioLow)
+	lim = makeRateLimiter(100000, false, nil)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		lim.request(10000, ioLow)
+	}
+	// the last request wait for the debt of the previous ones
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("50000 bytes at 100000 bytes per second take %v", elapsed)
+	}
+	if lim.total[ioLow] != 50000 {
+		t.Fatalf("Limiter count %d bytes,want 50000", lim.total[ioLow])
+	}
+}
+
+func TestRateLimiterPriority(t *testing.T) {
+	closing := make(chan struct{})
+	lim := makeRateLimiter(10000, false, closing)
+	lim.request(5000, ioHigh)
+	order := make(chan int, 2)
+	go func() {
+		lim.request(100, ioLow)
+		order <- ioLow
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		lim.request(100, ioHigh)
+		order <- ioHigh
+	}()
+	if first := <-order; first != ioHigh {
+		t.Fatal("Compaction write go before the waiting flush.")
+	}
+	<-order
+	// a closed tree stop waiting at once
+	lim.request(100000, ioLow)
+	close(closing)
+	start := time.Now()
+	lim.request(100, ioLow)
+	if time.Since(start) > time.Second {
+		t.Fatal("Request wait after close.")
+	}
+}
+
+func TestRateLimiterAutoTune(t *testing.T) {
+	lim := makeRateLimiter(1000, true, nil)
+	lim.setPendingBytes(50, 100)
+	if rate := lim.bytesPerSecond(); rate != 4500 {
+		t.Fatalf("Rate %d at half the soft limit,want 4500", rate)
+	}
+	lim.setPendingBytes(1000, 100)
+	if rate := lim.bytesPerSecond(); rate != 1000*autoTuneMaxFactor {
+		t.Fatalf("Rate %d over the soft limit,want %d", rate, 1000*autoTuneMaxFactor)
+	}
+	lim.setPendingBytes(0, 100)
+	if rate := lim.bytesPerSecond(); rate != 1000 {
+		t.Fatalf("Rate %d without debt,want 1000", rate)
+	}
+	fixed := makeRateLimiter(1000, false, nil)
+	fixed.setPendingBytes(1000, 100)
+	if rate := fixed.bytesPerSecond(); rate != 1000 {
+		t.Fatal("Rate is tuned without auto tune.")
+	}
+}
+
+func TestRateLimitedFlush(t *testing.T) {
+	lsmTree := makeValueLogTestLSMTree(t, t.TempDir(), &Options{RateBytesPerSecond: 512 << 10})
+	defer lsmTree.Close()
+	putRange(t, lsmTree, 0, 256, 1024)
+	start := time.Now()
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("256KB flush at 512KB per second take %v", elapsed)
+	}
+	if size := lsmTree.levels[0][0].size; lsmTree.rateLimiter.total[ioHigh] != size {
+		t.Fatalf("Limiter count %d flushed bytes,want %d", lsmTree.rateLimiter.total[ioHigh], size)
+	}
+}
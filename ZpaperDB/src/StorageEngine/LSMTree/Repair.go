@@ -0,0 +1,479 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// RepairDB rebuild a database whose MANIFEST or files are damaged,so it can be
+// opened again.Every SSTable and write ahead log of the directory is read as
+// far as it can be,a file which can not be read fully is moved into lost/.
+// Reads search level0 by file order,not by sequence,so the old tables are not
+// kept:the salvaged entries of each column family are merged by sequence and
+// written into new SSTables holding the newest version of every key,and under
+// merge operands the base they apply on.The column families,the tables of each
+// family,the global sequences of ingested tables and the logs a family has
+// flushed are taken from the old MANIFEST if it can be read,the tables it does
+// not list are moved into lost/ too.Without it every table belong to the
+// default column family and a family only found in the logs is named after its
+// id.The new MANIFEST is written last,then the salvaged files are removed.
+
+const lostDirName = "lost"
+
+// RepairInfo tell what RepairDB salvaged.
+type RepairInfo struct {
+	Tables  int      // SSTables salvaged
+	Logs    int      // write ahead logs salvaged
+	Entries int      // entries written into the new SSTables
+	LastSeq uint64   // the last sequence of the repaired database
+	Lost    []string // the damaged or unknown files moved into lost/
+}
+
+type repairedTable struct {
+	family    uint32
+	globalSeq uint64
+}
+
+// loggedOperation is an operation of a write ahead log batch,added once the
+// whole batch is read.
+type loggedOperation struct {
+	family uint32
+	entry  pairs
+	del    *rangeTombstone
+}
+
+type repairer struct {
+	lsm             *LSMTree
+	old             *manifest // nil if the MANIFEST is missing or damaged
+	damagedManifest bool
+	tables          map[uint64]repairedTable // the tables of the old MANIFEST
+	logNums         map[uint32]uint64        // the logs each family of the old MANIFEST has flushed
+	data            map[uint32][]pairs
+	rangeDels       map[uint32][]rangeTombstone
+	salvaged        []string
+	lost            []string
+	info            RepairInfo
+}
+
+// RepairDB repair the database in dir,a nil opts use DefaultOptions.The new
+// SSTables of every column family are written with opts,no merge operator is
+// needed as the operands are not applied.
+func RepairDB(dir string, opts *Options) (RepairInfo, error) {
+	var lsm *LSMTree
+	lsm, err := lsm.initLSMTree(opts)
+	if err != nil {
+		return RepairInfo{}, err
+	}
+	defer lsm.Close()
+	if lsm.dbOpts.ReadOnly {
+		return RepairInfo{}, ErrReadOnly
+	}
+	lsm.dir = dir
+	lsm.values = makeValueLog(dir)
+	if lsm.lock, err = lockFile(filepath.Join(dir, lockFileName), false); err != nil {
+		return RepairInfo{}, err
+	}
+	r := &repairer{
+		lsm:       lsm,
+		tables:    make(map[uint64]repairedTable),
+		logNums:   make(map[uint32]uint64),
+		data:      make(map[uint32][]pairs),
+		rangeDels: make(map[uint32][]rangeTombstone),
+	}
+	if err = r.readManifest(); err != nil {
+		return RepairInfo{}, err
+	}
+	if err = r.salvageTables(); err != nil {
+		return RepairInfo{}, err
+	}
+	if err = r.salvageLogs(); err != nil {
+		return RepairInfo{}, err
+	}
+	if err = r.writeTables(); err != nil {
+		return RepairInfo{}, err
+	}
+	return r.info, r.removeFiles()
+}
+
+// readManifest take the column families from the old MANIFEST,a damaged one
+// is copied into lost/ before the new one is written.
+func (r *repairer) readManifest() error {
+	m, err := readManifest(r.lsm.dir)
+	if err != nil {
+		r.damagedManifest = true
+		return nil
+	}
+	if m == nil {
+		return nil
+	}
+	r.old = m
+	r.lsm.nextFileNum = m.nextFileNum
+	r.lsm.seq = m.lastSeq
+	r.lsm.nextFamilyID = m.nextFamilyID
+	r.addTables(0, m.logNum, m.files)
+	for _, f := range m.families {
+		if _, err = r.family(f.id, f.name); err != nil {
+			return err
+		}
+		r.addTables(f.id, f.logNum, f.files)
+	}
+	return nil
+}
+
+func (r *repairer) addTables(family uint32, logNum uint64, files []manifestFile) {
+	r.logNums[family] = logNum
+	for _, f := range files {
+		r.tables[f.fileNum] = repairedTable{family: family, globalSeq: f.globalSeq}
+	}
+}
+
+// family return the column family id,it is made with name if it does not
+// exist,an empty name is replaced by one made of the id.
+func (r *repairer) family(id uint32, name string) (*LSMTree, error) {
+	if family := r.lsm.families[id]; family != nil {
+		return family, nil
+	}
+	if name == "" {
+		name = "repaired" + strconv.FormatUint(uint64(id), 10)
+	}
+	opts, err := r.lsm.familyOpts[name].columnFamilyOptions(r.lsm.dbOpts)
+	if err != nil {
+		return nil, err
+	}
+	if id >= r.lsm.nextFamilyID {
+		r.lsm.nextFamilyID = id + 1
+	}
+	return r.lsm.initColumnFamily(id, name, opts)
+}
+
+// useFileNum keep the numbers of the new files above num.
+func (r *repairer) useFileNum(num uint64) {
+	if num >= r.lsm.nextFileNum {
+		r.lsm.nextFileNum = num + 1
+	}
+}
+
+func (r *repairer) salvageTables() error {
+	nums, err := numberedFiles(r.lsm.dir, "ssTable")
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		r.useFileNum(num)
+		name := r.lsm.tableFileName(num)
+		table, listed := r.tables[num]
+		if r.old != nil && !listed {
+			r.lost = append(r.lost, name)
+			continue
+		}
+		data, rangeDels, ok := readDamagedTable(name, table.globalSeq)
+		if len(data) > 0 || len(rangeDels) > 0 {
+			r.info.Tables++
+			for i := range data {
+				seq, _ := data[i].trailer()
+				r.lsm.seq = maxSeq(r.lsm.seq, seq)
+			}
+			for _, rangeDel := range rangeDels {
+				r.lsm.seq = maxSeq(r.lsm.seq, rangeDel.seq)
+			}
+			r.data[table.family] = append(r.data[table.family], data...)
+			r.rangeDels[table.family] = append(r.rangeDels[table.family], rangeDels...)
+		}
+		if ok {
+			r.salvaged = append(r.salvaged, name)
+		} else {
+			r.lost = append(r.lost, name)
+		}
+	}
+	return nil
+}
+
+// readDamagedTable return the entries of the blocks of the SSTable name which
+// can be read,ok is false if a part of it is damaged.
+func readDamagedTable(name string, globalSeq uint64) ([]pairs, []rangeTombstone, bool) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, false
+	}
+	defer file.Close()
+	t, err := openTable(file, nil, nil)
+	if err != nil {
+		return nil, nil, false
+	}
+	t.setGlobalSeq(globalSeq)
+	ok := true
+	var data []pairs
+	for i := range t.index {
+		keys, values, err := t.readBlock(t.index[i].value)
+		if err != nil {
+			ok = false
+			continue
+		}
+		for j := range keys {
+			if len(keys[j]) < 8 {
+				ok = false
+				continue
+			}
+			var p pairs
+			p.set(t.internalKey(keys[j]), values[j])
+			data = append(data, p)
+		}
+	}
+	return data, t.rangeDels, ok
+}
+
+func (r *repairer) salvageLogs() error {
+	nums, err := logFiles(r.lsm.dir)
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		r.useFileNum(num)
+		name := r.lsm.logFileName(num)
+		read, ok, err := r.readLog(name, num)
+		if err != nil {
+			return err
+		}
+		if read {
+			r.info.Logs++
+		}
+		if ok {
+			r.salvaged = append(r.salvaged, name)
+		} else {
+			r.lost = append(r.lost, name)
+		}
+	}
+	nums, err = numberedFiles(r.lsm.dir, "vlog")
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		r.useFileNum(num)
+	}
+	return nil
+}
+
+// readLog add the batches of the log num up to the first damaged one,read is
+// true if a batch is added and ok is false if the log is damaged.
+func (r *repairer) readLog(name string, num uint64) (read bool, ok bool, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return false, false, nil
+	}
+	defer file.Close()
+	reader := makeLogReader(file)
+	for {
+		record, err := reader.readRecord()
+		if err == io.EOF {
+			return read, true, nil
+		}
+		if err != nil {
+			return read, false, nil
+		}
+		batch, err := decodeWriteBatch(record)
+		if err != nil {
+			return read, false, nil
+		}
+		var ops []loggedOperation
+		err = batch.iterate(func(family uint32, keyType byte, key, value []byte, seq uint64) error {
+			if r.old != nil {
+				// a family missing from the MANIFEST is dropped
+				logNum, known := r.logNums[family]
+				if !known || num < logNum {
+					return nil
+				}
+			}
+			op := loggedOperation{family: family}
+			switch keyType {
+			case typeRangeDeletion:
+				op.del = &rangeTombstone{start: key, end: value, seq: seq}
+			case typeMerge:
+				op.entry.setEntry(key, encodeOperands([][]byte{value}), seq, keyType)
+			default:
+				op.entry.setEntry(key, value, seq, keyType)
+			}
+			ops = append(ops, op)
+			return nil
+		})
+		if err != nil {
+			return read, false, nil
+		}
+		for _, op := range ops {
+			if _, err = r.family(op.family, ""); err != nil {
+				return read, false, err
+			}
+			if op.del != nil {
+				r.rangeDels[op.family] = append(r.rangeDels[op.family], *op.del)
+			} else {
+				r.data[op.family] = append(r.data[op.family], op.entry)
+			}
+		}
+		if batch.count > 0 {
+			r.lsm.seq = maxSeq(r.lsm.seq, batch.seq+uint64(batch.count)-1)
+		}
+		read = true
+	}
+}
+
+// newestVersions sort data by user key and return the newest version of every
+// key which no newer range tombstone cover,merge operands are combined into one
+// entry and their base is returned in bases.The same version may be read from
+// several tables.
+func newestVersions(data []pairs, rangeDels []rangeTombstone) ([]pairs, []pairs) {
+	sort.SliceStable(data, func(i, j int) bool {
+		result := bytes.Compare(data[i].userKey(), data[j].userKey())
+		if result != 0 {
+			return result < 0
+		}
+		seqI, _ := data[i].trailer()
+		seqJ, _ := data[j].trailer()
+		return seqI > seqJ
+	})
+	newest := make([]pairs, 0, len(data))
+	var bases []pairs
+	for i := 0; i < len(data); {
+		userKey := data[i].userKey()
+		j := i
+		for j < len(data) && bytes.Equal(data[j].userKey(), userKey) {
+			j++
+		}
+		versions := data[i:j]
+		i = j
+		var lists [][]byte
+		var mergeSeq uint64
+		for k := range versions {
+			seq, keyType := versions[k].trailer()
+			if k > 0 {
+				if prevSeq, _ := versions[k-1].trailer(); seq == prevSeq {
+					continue
+				}
+			}
+			if coveredByRangeDel(rangeDels, userKey, seq) {
+				break
+			}
+			if keyType != typeMerge {
+				if lists == nil {
+					newest = append(newest, versions[k])
+				} else {
+					bases = append(bases, versions[k])
+				}
+				break
+			}
+			if lists == nil {
+				mergeSeq = seq
+			}
+			lists = append(lists, versions[k].value)
+		}
+		if lists != nil {
+			// an operand list is oldest first
+			var combined []byte
+			for k := len(lists) - 1; k >= 0; k-- {
+				combined = append(combined, lists[k]...)
+			}
+			var p pairs
+			p.setEntry(userKey, combined, mergeSeq, typeMerge)
+			newest = append(newest, p)
+		}
+	}
+	return newest, bases
+}
+
+// writeTables write the newest versions of each column family into its last
+// level and the bases of its merge operands under them,with the fifo style
+// both go to level0.
+func (r *repairer) writeTables() error {
+	families := r.lsm.columnFamilies()
+	outputs := make([][2][]*fileMeta, len(families))
+	removeOutputs := func() {
+		for i, family := range families {
+			family.removeOutputs(outputs[i][0])
+			family.removeOutputs(outputs[i][1])
+		}
+	}
+	for i, family := range families {
+		id := family.family.id
+		newest, bases := newestVersions(r.data[id], r.rangeDels[id])
+		r.info.Entries += len(newest) + len(bases)
+		var err error
+		// the bases are written first,they are the older level0 files
+		if outputs[i][1], err = family.writeCompactionOutput(bases, nil); err != nil {
+			removeOutputs()
+			return err
+		}
+		if outputs[i][0], err = family.writeCompactionOutput(newest, r.rangeDels[id]); err != nil {
+			removeOutputs()
+			return err
+		}
+	}
+	r.lsm.mu.Lock()
+	defer r.lsm.mu.Unlock()
+	for i, family := range families {
+		level, baseLevel := maxLevel-1, maxLevel-1
+		if len(outputs[i][1]) > 0 {
+			level = maxLevel - 2
+		}
+		if family.opts.CompactionStyle == "fifo" {
+			level, baseLevel = 0, 0
+		}
+		family.levels[baseLevel] = append(family.levels[baseLevel], outputs[i][1]...)
+		family.levels[level] = append(family.levels[level], outputs[i][0]...)
+		// no log is needed,the next open start a new one
+		family.table.logNum = r.lsm.nextFileNum
+	}
+	r.info.LastSeq = r.lsm.seq
+	if err := r.keepDamagedManifest(); err != nil {
+		removeOutputs()
+		return err
+	}
+	if err := r.lsm.saveManifest(); err != nil {
+		for _, family := range families {
+			for level := range family.levels {
+				family.levels[level] = nil
+			}
+		}
+		removeOutputs()
+		return err
+	}
+	return nil
+}
+
+// keepDamagedManifest copy a damaged MANIFEST into lost/ before it is replaced.
+func (r *repairer) keepDamagedManifest() error {
+	if !r.damagedManifest {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(r.lsm.dir, lostDirName), 0755); err != nil {
+		return err
+	}
+	if err := copyFile(filepath.Join(r.lsm.dir, manifestName), filepath.Join(r.lsm.dir, lostDirName, manifestName)); err != nil {
+		return err
+	}
+	r.info.Lost = append(r.info.Lost, manifestName)
+	return nil
+}
+
+// removeFiles move the damaged files into lost/ and remove the salvaged ones.
+func (r *repairer) removeFiles() error {
+	if len(r.lost) > 0 {
+		lostDir := filepath.Join(r.lsm.dir, lostDirName)
+		if err := os.MkdirAll(lostDir, 0755); err != nil {
+			return err
+		}
+		for _, name := range r.lost {
+			if err := os.Rename(name, filepath.Join(lostDir, filepath.Base(name))); err != nil {
+				return err
+			}
+			r.info.Lost = append(r.info.Lost, filepath.Base(name))
+		}
+	}
+	for _, name := range r.salvaged {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
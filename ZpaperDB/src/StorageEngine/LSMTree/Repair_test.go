@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func putValues(t *testing.T, lsmTree *LSMTree, from, to int, gen string) {
+	batch := new(WriteBatch)
+	for i := from; i < to; i++ {
+		batch.Put(testKey(i), append([]byte(gen), testKey(i)...))
+	}
+	if err := lsmTree.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairDBWithoutManifest(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree := makeValueLogTestLSMTree(t, dir, nil)
+	putValues(t, lsmTree, 0, 100, "a")
+	if err := lsmTree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	putValues(t, lsmTree, 0, 50, "b")
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.DeleteRange(testKey(10), testKey(20)); err != nil {
+		t.Fatal(err)
+	}
+	putValues(t, lsmTree, 40, 60, "c")
+	if err := lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestName), []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLSMTree(dir, nil); err == nil {
+		t.Fatal("Damaged MANIFEST is opened.")
+	}
+	info, err := RepairDB(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Tables != 2 || info.Logs == 0 || len(info.Lost) != 1 || info.Lost[0] != manifestName {
+		t.Fatalf("Repair %+v,want 2 tables,the logs and the MANIFEST lost", info)
+	}
+	if _, err = os.Stat(filepath.Join(dir, lostDirName, manifestName)); err != nil {
+		t.Fatal("Damaged MANIFEST is not kept.", err)
+	}
+	lsmTree = makeValueLogTestLSMTree(t, dir, nil)
+	defer lsmTree.Close()
+	if lsmTree.seq != info.LastSeq {
+		t.Fatalf("Sequence %d after repair,want %d", lsmTree.seq, info.LastSeq)
+	}
+	for i := 0; i < 100; i++ {
+		switch {
+		case i >= 10 && i < 20:
+			checkFound(t, lsmTree, i, false)
+		case i >= 40 && i < 60:
+			checkValue(t, lsmTree, i, "c")
+		case i < 50:
+			checkValue(t, lsmTree, i, "b")
+		default:
+			checkValue(t, lsmTree, i, "a")
+		}
+	}
+	// a write after the repair is the newest
+	putValues(t, lsmTree, 0, 1, "d")
+	checkValue(t, lsmTree, 0, "d")
+}
+
+func TestRepairDBDamagedTable(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{MergeOperator: MakeStringAppendOperator(',')}
+	lsmTree := makeValueLogTestLSMTree(t, dir, opts)
+	cf, err := lsmTree.CreateColumnFamily("other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeysCF(t, lsmTree, cf, 0, 10)
+	if err = lsmTree.Put(&WriteArgs{Key: []byte("counter"), Value: []byte("a")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = lsmTree.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = lsmTree.Merge([]byte("counter"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	putValues(t, lsmTree, 0, 1000, "a")
+	if err = lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	damaged := lsmTree.tableFileName(lsmTree.levels[0][0].fileNum)
+	if err = lsmTree.Merge([]byte("counter"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err = lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// break the first data block of the level0 table
+	file, err := os.OpenFile(damaged, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.WriteAt([]byte("broken"), 16); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	info, err := RepairDB(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Lost) != 1 || info.Lost[0] != filepath.Base(damaged) {
+		t.Fatalf("Lost files %v,want %s", info.Lost, filepath.Base(damaged))
+	}
+	if _, err = os.Stat(filepath.Join(dir, lostDirName, filepath.Base(damaged))); err != nil {
+		t.Fatal("Damaged table is not moved into lost.", err)
+	}
+	lsmTree = makeValueLogTestLSMTree(t, dir, opts)
+	defer lsmTree.Close()
+	cf = lsmTree.ColumnFamily("other")
+	if cf == nil {
+		t.Fatal("Column family is lost.")
+	}
+	checkFoundCF(t, lsmTree, cf, 5, true)
+	checkFound(t, lsmTree, 5, false)
+	// the keys of the other blocks are salvaged
+	checkValue(t, lsmTree, 999, "a")
+	checkString(t, lsmTree, []byte("counter"), "a,c")
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+)
+
+// SSTWriter write a standalone SSTable for IngestExternalFile.The keys are added
+// in increasing order and kept in memory until Finish build the table with a
+// TableBuilder,so a large bulk load should be split over several writers.The
+// entries are saved with sequence 0,the ingestion give them their sequence.The
+// table use the block,compression and filter options of opts.
+type SSTWriter struct {
+	path         string
+	opts         *Options
+	filterPolicy FilterPolicy
+	data         []pairs
+	rangeDels    []rangeTombstone
+	last         []byte
+	finished     bool
+}
+
+// MakeSSTWriter return a writer of the SSTable path,a nil opts use DefaultOptions.
+func MakeSSTWriter(path string, opts *Options) (*SSTWriter, error) {
+	o, err := opts.resolve()
+	if err != nil {
+		return nil, err
+	}
+	w := &SSTWriter{path: path, opts: o, filterPolicy: o.FilterPolicy}
+	if w.filterPolicy == nil {
+		if w.filterPolicy, err = MakeBloomFilterPolicy(o.FilterFpp); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *SSTWriter) Put(key, value []byte) error {
+	return w.add(typeValue, key, value)
+}
+
+func (w *SSTWriter) Merge(key, operand []byte) error {
+	return w.add(typeMerge, key, operand)
+}
+
+func (w *SSTWriter) Delete(key []byte) error {
+	return w.add(typeDeletion, key, nil)
+}
+
+// DeleteRange delete every key in [start,end) older than the table,the range
+// may be added in any order with the keys.
+func (w *SSTWriter) DeleteRange(start, end []byte) error {
+	if w.finished {
+		return errors.New("sst writer: finished")
+	}
+	if bytes.Compare(start, end) >= 0 {
+		return errors.New("delete range: start must be less than end")
+	}
+	w.rangeDels = append(w.rangeDels, rangeTombstone{
+		start: append([]byte(nil), start...),
+		end:   append([]byte(nil), end...),
+	})
+	return nil
+}
+
+func (w *SSTWriter) add(keyType byte, key, value []byte) error {
+	if w.finished {
+		return errors.New("sst writer: finished")
+	}
+	if w.last != nil && bytes.Compare(key, w.last) <= 0 {
+		return errors.New("sst writer: keys must be added in increasing order")
+	}
+	var p pairs
+	p.setEntry(key, append([]byte(nil), value...), 0, keyType)
+	w.data = append(w.data, p)
+	w.last = p.userKey()
+	return nil
+}
+
+// Finish write the table,a writer without entries write nothing and fail.
+func (w *SSTWriter) Finish() error {
+	if w.finished {
+		return errors.New("sst writer: finished")
+	}
+	if len(w.data) == 0 && len(w.rangeDels) == 0 {
+		return errors.New("sst writer: no entries")
+	}
+	w.finished = true
+	file, err := os.Create(w.path)
+	if err != nil {
+		return err
+	}
+	tb := &TableBuilder{
+		data:            &w.data,
+		rangeDels:       w.rangeDels,
+		ssTableFile:     file,
+		blockSize:       uint32(w.opts.BlockSize),
+		restartInterval: w.opts.BlockRestartInterval,
+		filterPolicy:    w.filterPolicy,
+		prefixExtractor: w.opts.PrefixExtractor,
+	}
+	if w.opts.SnappyCompression {
+		tb.snappy = 0x1
+	}
+	err = tb.minorCompress()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(w.path)
+	}
+	w.data, w.rangeDels = nil, nil
+	return err
+}
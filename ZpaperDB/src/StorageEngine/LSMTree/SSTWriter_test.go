@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSSTWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "external.sst")
+	w, err := MakeSSTWriter(path, &Options{SnappyCompression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Finish(); err == nil {
+		t.Fatal("Empty table is written.")
+	}
+	for i := 0; i < 100; i++ {
+		if err = w.Put(testKey(i), testKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Put(testKey(50), nil); err == nil {
+		t.Fatal("Key out of order is accepted.")
+	}
+	if err = w.Delete(testKey(100)); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.DeleteRange(testKey(0), testKey(10)); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Put(testKey(200), nil); err == nil {
+		t.Fatal("Finished writer accept keys.")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	table, err := openTable(file, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := table.readAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 101 || len(table.rangeDels) != 1 {
+		t.Fatalf("Table hold %d entries and %d range tombstones,want 101 and 1", len(data), len(table.rangeDels))
+	}
+	for i := range data {
+		if seq, _ := data[i].trailer(); seq != 0 {
+			t.Fatalf("Entry %d has sequence %d,want 0", i, seq)
+		}
+	}
+	// the global sequence replace the sequence of every entry
+	table.setGlobalSeq(7)
+	p, err := table.get(testKey(5))
+	if err != nil || p == nil {
+		t.Fatal("Key is not found.", err)
+	}
+	if seq, keyType := p.trailer(); seq != 7 || keyType != typeValue {
+		t.Fatalf("Entry has sequence %d type %d,want 7 and value", seq, keyType)
+	}
+	if table.rangeDelSeq(testKey(5)) != 7 {
+		t.Fatal("Range tombstone does not get the global sequence.")
+	}
+}
@@ -3,27 +3,48 @@ package storage
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"hash/crc32"
-	"ini"
-	"log"
 	"os"
 	"reflect"
-	"strconv"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // SSTable include data block,meta block\meta index block,index block\footer,
 // the footer including meta index handle,index handle and padding,magic number.
+// Every block end with a trailer: block type(1 byte) and crc32 checksum(4 bytes).
 // data block
 
+// The key of a data block entry is an internal key: user key | sequence<<8 | keyType(8 bytes),
+// a table save at most one version of a user key.Range tombstones are saved in the
+// meta block named rangeDelBlockName.
+
+const (
+	blockSize         = 4096
+	restartInterval   = 16
+	blockTrailerSize  = 5
+	footerSize        = 48
+	tableMagicNumber  = uint64(0xdb4775248b80fb57)
+	maxFileSize       = 2097152 // compaction output file max size = 2MB
+	rangeDelBlockName = "zpaperdb.RangeDel"
+)
+
 type TableBuilder struct {
-	rw          *sync.RWMutex
-	data        *[]pairs
-	ssTableFile *os.File
-	snappy      byte
-	fpp         float32
-	filterBase  byte
+	rw              *sync.RWMutex
+	data            *[]pairs
+	rangeDels       []rangeTombstone
+	ssTableFile     *os.File
+	offset          uint32
+	blockSize       uint32
+	restartInterval int
+	snappy          byte
+	filterPolicy    FilterPolicy
+	prefixExtractor PrefixExtractor
+	rateLimiter     *rateLimiter
+	priority        int // ioHigh or ioLow
 }
 
 type block struct {
@@ -42,13 +63,13 @@ type indexBlock struct {
 	checksum     uint32
 }
 
+// metaBlock save one filter,the range tombstones or the value logs the table point
+// to,its name is the key of the meta index block.
 type metaBlock struct {
-	filterData []filter
-	offset     []uint32
-	filterSize uint32
-	filterBase byte
-	blockType  byte
-	checkSum   uint32
+	name      string
+	data      []byte
+	blockType byte
+	checkSum  uint32
 }
 
 type pairs struct {
@@ -72,11 +93,42 @@ func (p *pairs) set(key []byte, value []byte) {
 	p.valueLen = uint32(len(value))
 }
 
+// setEntry save the internal key of key as the pair's key.
+func (p *pairs) setEntry(key []byte, value []byte, seq uint64, keyType byte) {
+	p.set(makeInternalKey(key, seq, keyType), value)
+}
+
+func (p *pairs) userKey() []byte {
+	return userKeyOf(p.key)
+}
+
+func (p *pairs) trailer() (uint64, byte) {
+	if len(p.key) < 8 {
+		return 0, typeValue
+	}
+	tag := binary.LittleEndian.Uint64(p.key[len(p.key)-8:])
+	return tag >> 8, byte(tag)
+}
+
+func makeInternalKey(userKey []byte, seq uint64, keyType byte) []byte {
+	key := make([]byte, len(userKey)+8)
+	copy(key, userKey)
+	binary.LittleEndian.PutUint64(key[len(userKey):], seq<<8|uint64(keyType))
+	return key
+}
+
+func userKeyOf(key []byte) []byte {
+	if len(key) < 8 {
+		return key
+	}
+	return key[:len(key)-8]
+}
+
 type footer struct {
 	metaIndexHandle BlockHandler
 	indexHandle     BlockHandler
 	padding         []byte
-	magicNum        []byte
+	magicNum        uint64
 }
 
 type BlockHandler struct {
@@ -84,134 +136,366 @@ type BlockHandler struct {
 	size   uint32
 }
 
-type SSTable struct {
-	dataBlockSet   []block
-	metaBlockSet   []metaBlock
-	metaIndexBlock indexBlock
-	indexBlock     indexBlock
-	footer         footer
+// fileMeta describe a SSTable of a level,smallest and largest are user keys
+// and cover the range tombstones of the table too.
+type fileMeta struct {
+	fileNum   uint64
+	size      int64
+	smallest  []byte
+	largest   []byte
+	createdAt int64 // unix nano
+	table     *tableReader
+	// refs count the reads which pinned the table,the level hold no reference.
+	// removeTables take it below zero once,whoever does it last call obsolete.
+	refs     int32
+	obsolete func()
+}
+
+// ref pin the table for a read,it must be called with lsm.mu held while meta
+// is in a level.
+func (meta *fileMeta) ref() {
+	atomic.AddInt32(&meta.refs, 1)
 }
 
+// unref release a read,the last read of a removed table close and delete it.
+func (meta *fileMeta) unref() {
+	if atomic.AddInt32(&meta.refs, -1) == -1 {
+		meta.obsolete()
+	}
+}
+
+// compaction merge inputFile[i],files of level inputLevel[i],into new files of
+// outputLevel.Tombstones are dropped only when no older file may save an older
+// version of their keys.The compact pointer of curLevel move past inputFile[0]
+// unless curLevel is -1.A deletion compaction remove its inputs and write nothing.
 type compaction struct {
-	curLevel   int
-	maxFileNum int
-	inputFile  [][]*os.File
-}
-
-func (lsm *LSMTree) BeginCompaction() {
-	var snappy byte
-	var left, right uint8
-	cfg, _ := ini.Load("lsm.ini")
-	maxNum, _ := cfg.Section("SSTable").Key("maxFileOfOneLevel").Int()
-	tmpSnappy, _ := cfg.Section("SSTable").Key("snappyCompression").Bool()
-	if tmpSnappy == true {
-		snappy = 0x1
-	} else {
-		snappy = 0x0
-	}
-	fpp, _ := cfg.Section("SSTable").Key("filterFpp").Float64()
-	cp := new(compaction)
-	cp.maxFileNum = maxNum
-	cp.inputFile = make([][]*os.File, 20)
-	for i := 0; i < 20; i++ {
-		right = lsm.levelNum[i]
-		cp.inputFile[i] = make([]*os.File, 10)
-		cp.inputFile[i] = lsm.ssTableFile[left:right]
-		left = right
-	}
-	go lsm.checkMemTableSize()
-	go func() {
-		for {
-			<-lsm.table.fulled
-			lsm.mu.Lock()
-			lsm.levelNum[0]++
-			tb := new(TableBuilder)
-			tb.data = lsm.table.str.export()
-			tb.snappy = snappy
-			tb.fpp = float32(fpp)
-			tb.filterBase = 12
-			lsm.table.str = lsm.initSkipList()
-			lsm.table.size = 0
+	curLevel    int
+	outputLevel int
+	maxFileNum  int
+	inputLevel  []int
+	inputFile   [][]*fileMeta
+	bottommost  bool
+	deletion    bool
+}
+
+// minorCompaction turn the memory table into an immutable one with a new write
+// ahead log,write it into a level0 SSTable,then remove the write ahead logs no
+// column family need.If the last flush failed,the immutable table is flushed again.
+func (lsm *LSMTree) minorCompaction() error {
+	defer lsm.deliverEvents()
+	lsm.bgMu.RLock()
+	defer lsm.bgMu.RUnlock()
+	lsm.flushMu.Lock()
+	defer lsm.flushMu.Unlock()
+	lsm.mu.Lock()
+	if err := lsm.checkWritable(); err != nil {
+		lsm.mu.Unlock()
+		return err
+	}
+	if lsm.dropped {
+		lsm.mu.Unlock()
+		return nil
+	}
+	if lsm.imm == nil {
+		if err := lsm.rotateMemTable(); err != nil {
 			lsm.mu.Unlock()
-			tb.ssTableFile, _ = os.Create("./data/level0/ssTable" + strconv.Itoa(lsm.ssTableNum))
-			cp.inputFile[0] = append(cp.inputFile[0], tb.ssTableFile)
-			err := tb.minorCompress()
-			if err != nil {
-				log.Fatalln(err)
-			}
-			time.Sleep(10 * time.Second)
-		}
-	}()
-	go func() {
-		for {
-			for index, value := range lsm.levelNum {
-				if value >= uint8(maxNum) {
-					cp.curLevel = index
-					cp.majorCompress()
-				}
-			}
-			time.Sleep(1 * time.Minute)
+			return err
+		}
+	}
+	imm := lsm.imm
+	fileNum := lsm.newFileNum()
+	lsm.mu.Unlock()
+	imm.rwMu.RLock()
+	rangeDels := imm.rangeDels
+	imm.rwMu.RUnlock()
+	info := FlushInfo{ColumnFamily: lsm.family.name, FileNum: fileNum}
+	lsm.notify(func(listener EventListener) {
+		listener.OnFlushBegin(info)
+	})
+	start := time.Now()
+	meta, err := lsm.flushTable(fileNum, *imm.str.export(), rangeDels)
+	if err == nil {
+		lsm.mu.Lock()
+		if meta != nil {
+			level0 := make([]*fileMeta, 0, len(lsm.levels[0])+1)
+			lsm.levels[0] = append(append(level0, lsm.levels[0]...), meta)
+			lsm.installValueLogs(meta)
+			lsm.recordFlush(meta)
+		}
+		lsm.imm = nil
+		lsm.versionChanged()
+		lsm.scheduler.scheduleCompaction(lsm)
+		err = lsm.saveManifest()
+		lsm.mu.Unlock()
+	}
+	if meta != nil {
+		info.Size = meta.size
+		if err == nil {
+			lsm.notifyTablesCreated([]*fileMeta{meta}, 0, ReasonFlush)
+		}
+	} else if err == nil {
+		info.FileNum = 0
+	}
+	info.Duration, info.Err = time.Since(start), err
+	lsm.notify(func(listener EventListener) {
+		listener.OnFlushEnd(info)
+	})
+	if err != nil {
+		return err
+	}
+	if err = lsm.removeObsoleteLogs(); err != nil {
+		return err
+	}
+	return lsm.removeObsoleteValueLogs()
+}
+
+// rotateMemTable turn the memory table into the immutable table with a new write
+// ahead log,it must be called with lsm.mu held and lsm.imm nil.The empty memory
+// tables of the other column families move to the new log too,so they do not
+// keep the old logs.
+func (lsm *LSMTree) rotateMemTable() error {
+	newLog, err := lsm.newLogWriter()
+	if err != nil {
+		return err
+	}
+	lsm.writeAheadLog.close()
+	lsm.writeAheadLog = newLog
+	lsm.imm = lsm.table
+	lsm.table = lsm.makeMemTable()
+	lsm.table.logNum = newLog.num
+	for _, family := range lsm.families {
+		if family.table.entries == 0 {
+			family.table.logNum = newLog.num
+		}
+	}
+	return nil
+}
+
+// maybeRotate rotate a fulled memory table and queue its flush,
+// it must be called with lsm.mu held.
+func (lsm *LSMTree) maybeRotate() error {
+	if !lsm.table.fulled || lsm.imm != nil {
+		return nil
+	}
+	if err := lsm.rotateMemTable(); err != nil {
+		return err
+	}
+	lsm.scheduler.scheduleFlush(lsm)
+	return nil
+}
+
+func (lsm *LSMTree) newTableBuilder(file *os.File, data *[]pairs, rangeDels []rangeTombstone, priority int) *TableBuilder {
+	tb := new(TableBuilder)
+	tb.data = data
+	tb.rangeDels = rangeDels
+	tb.ssTableFile = file
+	tb.snappy = lsm.snappy
+	tb.blockSize = uint32(lsm.opts.BlockSize)
+	tb.restartInterval = lsm.opts.BlockRestartInterval
+	tb.filterPolicy = lsm.filterPolicy
+	tb.prefixExtractor = lsm.prefixExtractor
+	tb.rateLimiter = lsm.rateLimiter
+	tb.priority = priority
+	return tb
+}
+
+// writeTable write the sorted pairs and range tombstones into the SSTable fileNum
+// at the I/O priority,nothing is written if both are empty.
+func (lsm *LSMTree) writeTable(fileNum uint64, data []pairs, rangeDels []rangeTombstone, priority int) (*fileMeta, error) {
+	if len(data) == 0 && len(rangeDels) == 0 {
+		return nil, nil
+	}
+	file, err := os.Create(lsm.tableFileName(fileNum))
+	if err != nil {
+		return nil, err
+	}
+	tb := lsm.newTableBuilder(file, &data, rangeDels, priority)
+	err = tb.minorCompress()
+	if err == nil {
+		meta := &fileMeta{fileNum: fileNum, size: int64(tb.offset), createdAt: lsm.now()}
+		meta.smallest, meta.largest = tb.keyRange()
+		meta.table, err = openTable(file, lsm.filterPolicy, lsm.prefixExtractor)
+		if err == nil {
+			return meta, nil
+		}
+	}
+	file.Close()
+	os.Remove(lsm.tableFileName(fileNum))
+	return nil, err
+}
+
+// maybeCompact run compactions until every level is under its limit,then
+// collect the value logs if Options.ValueLogGCRatio is set.A compaction into
+// level0 hold the flushes back,so its outputs stay the newest level0 files.
+func (lsm *LSMTree) maybeCompact() error {
+	lsm.bgMu.RLock()
+	defer lsm.bgMu.RUnlock()
+	lsm.compactMu.Lock()
+	defer lsm.compactMu.Unlock()
+	lsm.mu.Lock()
+	err, dropped := lsm.checkWritable(), lsm.dropped
+	lsm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if dropped {
+		return nil
+	}
+	for cp := lsm.pickCompaction(); cp != nil; cp = lsm.pickCompaction() {
+		var err error
+		if cp.outputLevel == 0 {
+			err = lsm.compactLevel0()
+		} else {
+			err = lsm.majorCompress(cp)
 		}
-	}()
+		if err != nil {
+			return err
+		}
+	}
+	if lsm.opts.ValueLogGCRatio > 0 {
+		return lsm.collectValueLogs(lsm.opts.ValueLogGCRatio)
+	}
+	return nil
+}
+
+// compactLevel0 pick again with the flushes held back and run the compaction.
+func (lsm *LSMTree) compactLevel0() error {
+	lsm.flushMu.Lock()
+	defer lsm.flushMu.Unlock()
+	cp := lsm.pickCompaction()
+	if cp == nil {
+		return nil
+	}
+	return lsm.majorCompress(cp)
+}
+
+func totalFileSize(files []*fileMeta) int64 {
+	var size int64
+	for _, meta := range files {
+		size += meta.size
+	}
+	return size
+}
+
+// pickCompaction ask the compaction picker of the column family.
+func (lsm *LSMTree) pickCompaction() *compaction {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	return lsm.picker.pickCompaction(lsm.currentVersion())
+}
+
+func keyRangeOf(files []*fileMeta) ([]byte, []byte) {
+	var smallest, largest []byte
+	for i, meta := range files {
+		if i == 0 || bytes.Compare(meta.smallest, smallest) < 0 {
+			smallest = meta.smallest
+		}
+		if i == 0 || bytes.Compare(meta.largest, largest) > 0 {
+			largest = meta.largest
+		}
+	}
+	return smallest, largest
+}
+
+func overlappingFiles(files []*fileMeta, smallest, largest []byte) []*fileMeta {
+	result := make([]*fileMeta, 0, len(files))
+	for _, meta := range files {
+		if bytes.Compare(meta.largest, smallest) < 0 || bytes.Compare(meta.smallest, largest) > 0 {
+			continue
+		}
+		result = append(result, meta)
+	}
+	return result
 }
 
 func (tb *TableBuilder) minorCompress() error {
-	var i, j, k int32
 	data := *tb.data
-	offset := *tb.segmentKV()
 	dataBlockSet := make([]*block, 0, 1024)
-	for offset[i] != 0 {
-		dataBlockSet = append(dataBlockSet, tb.buildDataBlock(data[j:offset[i]+1]))
-		j = offset[i] + 1
-		k++
+	if len(data) > 0 {
+		var start int32
+		for _, end := range *tb.segmentKV() {
+			dataBlockSet = append(dataBlockSet, tb.buildDataBlock(data[start:end+1]))
+			start = end + 1
+			if int(end) == len(data)-1 {
+				break
+			}
+		}
+	}
+	dataHandles := make([]BlockHandler, len(dataBlockSet))
+	for i, dataBlock := range dataBlockSet {
+		handle, err := tb.writeBlock(dataBlock.encode())
+		if err != nil {
+			return err
+		}
+		dataHandles[i] = handle
 	}
-	dataBlockNum := len(dataBlockSet)
-	dataBlockSize := uint32(dataBlockNum * 4096)
 	metaBlockSet := tb.buildMetaBlock(dataBlockSet)
-	metaBlockNum := len(metaBlockSet)
-	metaBlockSize := uint32(metaBlockNum * 4096)
-	metaIndexBlock := tb.buildMetaIndexBlock(metaBlockSet, uint32(len(dataBlockSet)*4096))
-	dataIndexBlock := tb.buildIndexBlock(dataBlockSet)
-	footerBlock := tb.buildFooter(BlockHandler{
-		offset: dataBlockSize + metaBlockSize,
-		size:   4096,
-	}, BlockHandler{
-		offset: dataBlockSize + metaBlockSize + 4096,
-		size:   4096,
-	})
-	var num int
-	ssTable := new(SSTable)
-	ssTable.dataBlockSet = make([]block, dataBlockNum)
-	ssTable.metaBlockSet = make([]metaBlock, metaBlockNum)
-	for num = 0; num < dataBlockNum; num++ {
-		ssTable.dataBlockSet[num] = *dataBlockSet[num]
-	}
-	for num = 0; num < metaBlockNum; num++ {
-		ssTable.metaBlockSet[num] = *metaBlockSet[num]
-	}
-	ssTable.metaIndexBlock = *metaIndexBlock
-	ssTable.indexBlock = *dataIndexBlock
-	ssTable.footer = *footerBlock
-	err := binary.Write(tb.ssTableFile, binary.LittleEndian, ssTable)
+	metaHandles := make([]BlockHandler, len(metaBlockSet))
+	for i, meta := range metaBlockSet {
+		handle, err := tb.writeBlock(meta.encode())
+		if err != nil {
+			return err
+		}
+		metaHandles[i] = handle
+	}
+	metaIndexHandle, err := tb.writeBlock(tb.buildMetaIndexBlock(metaBlockSet, metaHandles).encode())
 	if err != nil {
 		return err
 	}
-	return nil
+	indexHandle, err := tb.writeBlock(tb.buildIndexBlock(dataBlockSet, dataHandles).encode())
+	if err != nil {
+		return err
+	}
+	_, err = tb.writeBlock(tb.buildFooter(metaIndexHandle, indexHandle).encode())
+	if err != nil {
+		return err
+	}
+	return tb.ssTableFile.Sync()
+}
+
+func (tb *TableBuilder) writeBlock(data []byte) (BlockHandler, error) {
+	tb.rateLimiter.request(len(data), tb.priority)
+	n, err := tb.ssTableFile.Write(data)
+	if err != nil {
+		return BlockHandler{}, err
+	}
+	handle := BlockHandler{offset: tb.offset, size: uint32(n)}
+	tb.offset += uint32(n)
+	return handle, nil
+}
+
+// keyRange return the smallest and largest user key of the pairs and range tombstones.
+func (tb *TableBuilder) keyRange() ([]byte, []byte) {
+	var smallest, largest []byte
+	data := *tb.data
+	if len(data) > 0 {
+		smallest, largest = data[0].userKey(), data[len(data)-1].userKey()
+	}
+	for i, rangeDel := range tb.rangeDels {
+		if (len(data) == 0 && i == 0) || bytes.Compare(rangeDel.start, smallest) < 0 {
+			smallest = rangeDel.start
+		}
+		if (len(data) == 0 && i == 0) || bytes.Compare(rangeDel.end, largest) > 0 {
+			largest = rangeDel.end
+		}
+	}
+	return smallest, largest
 }
 
 func (tb *TableBuilder) segmentKV() *[]int32 {
 	var j, sign int
 	var size uint32 = 9 //
-	indexSet := make([]int32, 256, 1024)
 	data := *tb.data
 	pairNum := len(*tb.data)
+	indexSet := make([]int32, pairNum+1)
+	maxSize, interval := tb.blockOptions()
 	for i := 0; i < pairNum; i++ {
 		size += data[i].keyLen + data[i].valueLen + 8
 		sign++
-		if sign%16 == 0 {
+		if sign%interval == 0 {
 			size += 4
 		}
-		if size > 4096 {
+		if size > maxSize && sign > 1 {
 			i--
 			indexSet[j] = int32(i)
 			j++
@@ -225,8 +509,320 @@ func (tb *TableBuilder) segmentKV() *[]int32 {
 	return &indexSet
 }
 
-func (cp *compaction) majorCompress() {
+// majorCompress merge the input files into new SSTables of the output level,
+// only the newest version of every key is kept.Entries covered by a newer range
+// tombstone are dropped,tombstones themselves are dropped at the bottommost level.
+// The key range is split into subcompactions compacted in parallel,see
+// subcompactionBounds.It must be called with lsm.compactMu held.
+func (lsm *LSMTree) majorCompress(cp *compaction) error {
+	defer lsm.deliverEvents()
+	info := lsm.compactionInfo(cp)
+	lsm.notify(func(listener EventListener) {
+		listener.OnCompactionBegin(info)
+	})
+	start := time.Now()
+	outputs, err := lsm.compactFiles(cp)
+	if err == nil {
+		err = lsm.finishCompaction(cp, outputs)
+	}
+	info.Duration, info.Err = time.Since(start), err
+	if err == nil {
+		lsm.recordCompaction(cp, outputs, info.Duration)
+		for _, meta := range outputs {
+			info.OutputFiles = append(info.OutputFiles, meta.fileNum)
+		}
+		info.BytesWritten = totalFileSize(outputs)
+	}
+	lsm.notify(func(listener EventListener) {
+		listener.OnCompactionEnd(info)
+	})
+	return err
+}
+
+// compactFiles write the output files of cp,a deletion compaction write nothing.
+func (lsm *LSMTree) compactFiles(cp *compaction) ([]*fileMeta, error) {
+	if cp.deletion {
+		return nil, nil
+	}
+	data := make([]pairs, 0, 1024)
+	rangeDels := make([]rangeTombstone, 0)
+	for _, files := range cp.inputFile {
+		for _, meta := range files {
+			tablePairs, err := meta.table.readAll()
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, tablePairs...)
+			rangeDels = append(rangeDels, meta.table.rangeDels...)
+		}
+	}
+	bounds := lsm.subcompactionBounds(cp)
+	if len(bounds) == 0 {
+		return lsm.subcompact(cp, data, rangeDels)
+	}
+	parts := make([][]pairs, len(bounds)+1)
+	for i := range data {
+		n := sort.Search(len(bounds), func(j int) bool {
+			return bytes.Compare(data[i].userKey(), bounds[j]) < 0
+		})
+		parts[n] = append(parts[n], data[i])
+	}
+	results := make([][]*fileMeta, len(parts))
+	errs := make([]error, len(parts))
+	var wg sync.WaitGroup
+	for i := range parts {
+		var lower, upper []byte
+		if i > 0 {
+			lower = bounds[i-1]
+		}
+		if i < len(bounds) {
+			upper = bounds[i]
+		}
+		wg.Add(1)
+		go func(i int, rangeDels []rangeTombstone) {
+			defer wg.Done()
+			results[i], errs[i] = lsm.subcompact(cp, parts[i], rangeDels)
+		}(i, clipRangeDels(rangeDels, lower, upper))
+	}
+	wg.Wait()
+	var outputs []*fileMeta
+	for i := range results {
+		outputs = append(outputs, results[i]...)
+	}
+	for _, err := range errs {
+		if err != nil {
+			lsm.removeOutputs(outputs)
+			return nil, err
+		}
+	}
+	return outputs, nil
+}
+
+// subcompact merge the entries and range tombstones of one key range of cp into
+// output files.
+func (lsm *LSMTree) subcompact(cp *compaction, data []pairs, rangeDels []rangeTombstone) ([]*fileMeta, error) {
+	merged, err := mergeNewest(data, rangeDels, cp.bottommost, lsm.now(), lsm.opts.MergeOperator, lsm.values)
+	if err != nil {
+		return nil, err
+	}
+	if merged, err = lsm.filterEntries(cp, merged); err != nil {
+		return nil, err
+	}
+	if cp.bottommost {
+		rangeDels = nil
+	}
+	return lsm.writeCompactionOutput(merged, rangeDels)
+}
 
+// subcompactionBounds split a compaction larger than maxFileSize into at most
+// Options.MaxSubcompactions key ranges of about the same input size,the bounds
+// are the smallest keys of input files.
+func (lsm *LSMTree) subcompactionBounds(cp *compaction) [][]byte {
+	var files []*fileMeta
+	for _, inputs := range cp.inputFile {
+		files = append(files, inputs...)
+	}
+	total := totalFileSize(files)
+	n := int((total + maxFileSize - 1) / maxFileSize)
+	if n > lsm.opts.MaxSubcompactions {
+		n = lsm.opts.MaxSubcompactions
+	}
+	if n <= 1 {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return bytes.Compare(files[i].smallest, files[j].smallest) < 0
+	})
+	var bounds [][]byte
+	var size int64
+	for _, meta := range files {
+		if size >= total*int64(len(bounds)+1)/int64(n) && len(bounds)+1 < n &&
+			bytes.Compare(meta.smallest, files[0].smallest) > 0 &&
+			(len(bounds) == 0 || bytes.Compare(meta.smallest, bounds[len(bounds)-1]) > 0) {
+			bounds = append(bounds, meta.smallest)
+		}
+		size += meta.size
+	}
+	return bounds
+}
+
+func (lsm *LSMTree) removeOutputs(outputs []*fileMeta) {
+	for _, output := range outputs {
+		output.table.close()
+		os.Remove(lsm.tableFileName(output.fileNum))
+	}
+}
+
+// finishCompaction install the outputs and remove the input files.
+func (lsm *LSMTree) finishCompaction(cp *compaction, outputs []*fileMeta) error {
+	if err := lsm.installCompaction(cp, outputs); err != nil {
+		return err
+	}
+	lsm.notifyTablesCreated(outputs, cp.outputLevel, ReasonCompaction)
+	for i, files := range cp.inputFile {
+		lsm.removeTables(files, cp.inputLevel[i], ReasonCompaction)
+	}
+	return lsm.removeObsoleteValueLogs()
+}
+
+// mergeNewest sort data by user key and keep the newest version of every key,
+// versions covered by a newer range tombstone are dropped and so are the
+// tombstones if dropDeletion is set.An entry expired at now is dropped too if
+// dropDeletion is set,otherwise it is kept as a tombstone.The merge operands
+// of a key are folded into its older version,as there are no versions below
+// once deletions may be dropped,the operands without one are applied on no value.
+// A version in values is read only if operands are folded into it.
+func mergeNewest(data []pairs, rangeDels []rangeTombstone, dropDeletion bool, now int64, mergeOperator MergeOperator, values *valueLog) ([]pairs, error) {
+	sort.SliceStable(data, func(i, j int) bool {
+		result := bytes.Compare(data[i].userKey(), data[j].userKey())
+		if result != 0 {
+			return result < 0
+		}
+		seqI, _ := data[i].trailer()
+		seqJ, _ := data[j].trailer()
+		return seqI > seqJ
+	})
+	merged := make([]pairs, 0, len(data))
+	var lastKey []byte
+	for i := range data {
+		userKey := data[i].userKey()
+		if i > 0 && bytes.Equal(userKey, lastKey) {
+			continue
+		}
+		lastKey = userKey
+		seq, keyType := data[i].trailer()
+		if coveredByRangeDel(rangeDels, userKey, seq) {
+			continue
+		}
+		entry := data[i]
+		if keyType == typeMerge {
+			var err error
+			if entry, err = foldMerges(mergeOperator, data[i:], rangeDels, dropDeletion, now, values); err != nil {
+				return nil, err
+			}
+			_, keyType = entry.trailer()
+		}
+		if keyType == typeValueTTL && expired(entry.value, now) {
+			if dropDeletion {
+				continue
+			}
+			tombstone := new(pairs)
+			tombstone.setEntry(userKey, nil, seq, typeDeletion)
+			merged = append(merged, *tombstone)
+			continue
+		}
+		if keyType == typeDeletion && dropDeletion {
+			continue
+		}
+		merged = append(merged, entry)
+	}
+	return merged, nil
+}
+
+func coveredByRangeDel(rangeDels []rangeTombstone, key []byte, seq uint64) bool {
+	for i := range rangeDels {
+		if rangeDels[i].seq > seq && rangeDels[i].covers(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCompactionOutput split data into files of about maxFileSize,range tombstones
+// are cut at the file boundaries so that every file only cover its own key range.
+// It return ErrClosed before the next file once the tree is closed.
+func (lsm *LSMTree) writeCompactionOutput(data []pairs, rangeDels []rangeTombstone) ([]*fileMeta, error) {
+	bounds := []int{0}
+	var size int
+	for i := range data {
+		size += len(data[i].key) + len(data[i].value) + 8
+		if size > maxFileSize && i+1 < len(data) {
+			bounds = append(bounds, i+1)
+			size = 0
+		}
+	}
+	bounds = append(bounds, len(data))
+	outputs := make([]*fileMeta, 0, len(bounds)-1)
+	for i := 0; i+1 < len(bounds); i++ {
+		var lower, upper []byte
+		if i > 0 {
+			lower = data[bounds[i]].userKey()
+		}
+		if i+2 < len(bounds) {
+			upper = data[bounds[i+1]].userKey()
+		}
+		lsm.mu.Lock()
+		closed := lsm.closed
+		fileNum := lsm.newFileNum()
+		lsm.mu.Unlock()
+		var meta *fileMeta
+		err := ErrClosed
+		if !closed {
+			meta, err = lsm.writeTable(fileNum, data[bounds[i]:bounds[i+1]], clipRangeDels(rangeDels, lower, upper), ioLow)
+		}
+		if err != nil {
+			lsm.removeOutputs(outputs)
+			return nil, err
+		}
+		if meta != nil {
+			outputs = append(outputs, meta)
+		}
+	}
+	return outputs, nil
+}
+
+// clipRangeDels cut the tombstones to [lower,upper),nil means unbounded.
+func clipRangeDels(rangeDels []rangeTombstone, lower, upper []byte) []rangeTombstone {
+	var result []rangeTombstone
+	for _, rangeDel := range rangeDels {
+		if lower != nil && bytes.Compare(rangeDel.start, lower) < 0 {
+			rangeDel.start = lower
+		}
+		if upper != nil && bytes.Compare(rangeDel.end, upper) > 0 {
+			rangeDel.end = upper
+		}
+		if bytes.Compare(rangeDel.start, rangeDel.end) < 0 {
+			result = append(result, rangeDel)
+		}
+	}
+	return result
+}
+
+// installCompaction replace the input files with the output files and save the
+// MANIFEST.The outputs of level0 are the newest files of level0.
+func (lsm *LSMTree) installCompaction(cp *compaction, outputs []*fileMeta) error {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	removed := make(map[uint64]bool)
+	for _, files := range cp.inputFile {
+		for _, meta := range files {
+			removed[meta.fileNum] = true
+		}
+	}
+	for _, level := range append([]int{cp.outputLevel}, cp.inputLevel...) {
+		kept := make([]*fileMeta, 0, len(lsm.levels[level])+len(outputs))
+		for _, meta := range lsm.levels[level] {
+			if !removed[meta.fileNum] {
+				kept = append(kept, meta)
+			}
+		}
+		if level == cp.outputLevel {
+			kept = append(kept, outputs...)
+			outputs = nil
+			if level > 0 {
+				sort.Slice(kept, func(i, j int) bool {
+					return bytes.Compare(kept[i].smallest, kept[j].smallest) < 0
+				})
+			}
+		}
+		lsm.levels[level] = kept
+	}
+	if cp.curLevel >= 0 {
+		_, largest := keyRangeOf(cp.inputFile[0])
+		lsm.compactPointer[cp.curLevel] = largest
+	}
+	lsm.versionChanged()
+	return lsm.saveManifest()
 }
 
 func (b *BlockHandler) set(offset uint32, size uint32) {
@@ -238,130 +834,303 @@ func (b *BlockHandler) get() (uint32, uint32) {
 	return b.offset, b.size
 }
 
+func (b *BlockHandler) encode() []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint32(data, b.offset)
+	binary.LittleEndian.PutUint32(data[4:], b.size)
+	return data
+}
+
+func decodeBlockHandler(data []byte) (BlockHandler, error) {
+	if len(data) != 8 {
+		return BlockHandler{}, errors.New("sstable: bad block handle")
+	}
+	return BlockHandler{
+		offset: binary.LittleEndian.Uint32(data),
+		size:   binary.LittleEndian.Uint32(data[4:]),
+	}, nil
+}
+
+// blockOptions return the block size and restart interval,zero means the default.
+func (tb *TableBuilder) blockOptions() (uint32, int) {
+	maxSize, interval := tb.blockSize, tb.restartInterval
+	if maxSize == 0 {
+		maxSize = blockSize
+	}
+	if interval == 0 {
+		interval = restartInterval
+	}
+	return maxSize, interval
+}
+
 func (tb *TableBuilder) buildDataBlock(pair []pairs) *block {
-	var j, k = 0, 1
 	var offset uint32
 	pairNum := len(pair)
+	_, interval := tb.blockOptions()
 	newBlock := new(block)
 	newBlock.keyValueSet = make([]pairs, pairNum)
-	newBlock.restartPoint = make([]int32, pairNum/16+1)
-	newBlock.restartNum = uint32(pairNum/16 + 1)
+	newBlock.restartNum = uint32((pairNum + interval - 1) / interval)
+	newBlock.restartPoint = make([]int32, newBlock.restartNum)
 	newBlock.blockType = tb.snappy
 	for i := 0; i < pairNum; i++ {
+		if i%interval == 0 {
+			newBlock.restartPoint[i/interval] = int32(offset)
+		}
 		newBlock.keyValueSet[i] = pair[i]
 		offset += pair[i].keyLen + pair[i].valueLen + 8
-		j++
-		if j == 16 {
-			newBlock.restartPoint[k] = int32(offset)
-			k++
-			j = 0
-		}
 	}
 	return newBlock
 }
 
+// buildMetaBlock build one filter of user keys for the whole table,a prefix filter
+// if the builder has a prefix extractor,the range tombstone block and the block
+// of the value logs the table point to.
 func (tb *TableBuilder) buildMetaBlock(dataBlock []*block) []*metaBlock {
-	var k int
-	var filterSize, curBlockSize uint32 = 0, 10
-	filterSet := make([]filter, 0, 200)
-	offsetSet := make([]uint32, 0, 200)
-	offsetSet = append(offsetSet, 0)
-	blockSet := make([]*metaBlock, 0, 200)
-	for i := 0; i < len(dataBlock)-1; i++ {
-		pairNum := int64(len(dataBlock[i].keyValueSet))
-		newFilter, _ := MakeBloomFilter(0.01, pairNum)
-		for j := 0; j < int(pairNum); j++ {
-			newFilter.Add(dataBlock[i].keyValueSet[j].key)
-		}
-		filterSet = append(filterSet, filter{
-			keyNum:    uint32(newFilter.ElementNum),
-			bitMap:    newFilter.ByteArray,
-			bitMapLen: uint32(newFilter.BitArrayLen),
-			hashNum:   int32(newFilter.HashNum),
+	blockSet := make([]*metaBlock, 0, 4)
+	if tb.filterPolicy != nil {
+		blockSet = append(blockSet, tb.buildFilterBlock(dataBlock)...)
+	}
+	if len(tb.rangeDels) > 0 {
+		keys := make([][]byte, len(tb.rangeDels))
+		values := make([][]byte, len(tb.rangeDels))
+		for i, rangeDel := range tb.rangeDels {
+			keys[i] = makeInternalKey(rangeDel.start, rangeDel.seq, typeRangeDeletion)
+			values[i] = rangeDel.end
+		}
+		blockSet = append(blockSet, &metaBlock{
+			name: rangeDelBlockName,
+			data: encodeBlockContent(keys, values, nil),
 		})
-		filterSize += filterSet[k].getSize()
-		curBlockSize = filterSize + 4
-		k++
-		offsetSet = append(offsetSet, filterSize)
-		if curBlockSize > 4096 {
-			newMetaBlock := new(metaBlock)
-			newMetaBlock.filterData = filterSet[:k-1]
-			newMetaBlock.offset = offsetSet[:k-1]
-			newMetaBlock.filterSize = filterSize - filterSet[k-1].getSize() - filterSet[k-2].getSize()
-			newMetaBlock.filterBase = 0x12
-			blockSet = append(blockSet, newMetaBlock)
-			i--
-			filterSize = 0
-			curBlockSize = 10
-			offsetSet = offsetSet[:1]
-			filterSet = filterSet[0:0]
-			k = 0
+	}
+	if refs := valueLogRefs(*tb.data); len(refs) > 0 {
+		blockSet = append(blockSet, &metaBlock{
+			name: valueLogBlockName,
+			data: encodeValueLogRefs(refs),
+		})
+	}
+	return blockSet
+}
+
+func (tb *TableBuilder) buildFilterBlock(dataBlock []*block) []*metaBlock {
+	blockSet := make([]*metaBlock, 0, 2)
+	keys := make([][]byte, 0, len(dataBlock)*256)
+	for i := 0; i < len(dataBlock); i++ {
+		for j := 0; j < len(dataBlock[i].keyValueSet); j++ {
+			keys = append(keys, dataBlock[i].keyValueSet[j].userKey())
 		}
 	}
 	blockSet = append(blockSet, &metaBlock{
-		filterData: filterSet[:],
-		offset:     offsetSet[:],
-		filterSize: filterSize,
-		filterBase: 0x12,
-		blockType:  0,
-		checkSum:   0,
+		name: fullFilterName(tb.filterPolicy),
+		data: tb.filterPolicy.CreateFilter(keys),
 	})
+	if tb.prefixExtractor != nil {
+		prefixes := make([][]byte, 0, len(keys))
+		for _, key := range keys {
+			if !tb.prefixExtractor.InDomain(key) {
+				continue
+			}
+			prefix := tb.prefixExtractor.Transform(key)
+			if len(prefixes) > 0 && bytes.Equal(prefixes[len(prefixes)-1], prefix) {
+				continue
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		blockSet = append(blockSet, &metaBlock{
+			name: prefixFilterName(tb.filterPolicy, tb.prefixExtractor),
+			data: tb.filterPolicy.CreateFilter(prefixes),
+		})
+	}
 	return blockSet
 }
 
-func (tb *TableBuilder) buildMetaIndexBlock(metaBlock []*metaBlock, startOffset uint32) *indexBlock {
-	var j, k = 0, 1
-	key := binaryData("BloomFilter.zpaperdb")
+func fullFilterName(policy FilterPolicy) string {
+	return "fullfilter." + policy.Name()
+}
+
+func prefixFilterName(policy FilterPolicy, extractor PrefixExtractor) string {
+	return "prefixfilter." + policy.Name() + ":" + extractor.Name()
+}
+
+func (tb *TableBuilder) buildMetaIndexBlock(metaBlock []*metaBlock, handles []BlockHandler) *indexBlock {
 	metaIndexBlock := new(indexBlock)
 	metaIndexBlock.keyValueSet = make([]indexPairs, len(metaBlock))
-	metaIndexBlock.restartPoint = make([]int32, len(metaBlock)/16+1)
 	for i := 0; i < len(metaBlock); i++ {
-		metaIndexBlock.keyValueSet[i].key = key
-		metaIndexBlock.keyValueSet[i].keyLen = 20
-		tmpHandle := new(BlockHandler)
-		tmpHandle.set(startOffset+uint32(i*4096), 4096)
-		j++
-		if j == 16 {
-			metaIndexBlock.restartPoint[k] = int32(i * 4096)
-			k++
-			j = 0
-		}
-		metaIndexBlock.keyValueSet[i].value = *tmpHandle
+		metaIndexBlock.keyValueSet[i].key = []byte(metaBlock[i].name)
+		metaIndexBlock.keyValueSet[i].keyLen = uint32(len(metaBlock[i].name))
+		metaIndexBlock.keyValueSet[i].value = handles[i]
 		metaIndexBlock.keyValueSet[i].valueLen = 8
 	}
+	metaIndexBlock.setRestartPoint()
 	return metaIndexBlock
 }
 
-func (tb *TableBuilder) buildIndexBlock(dataBlock []*block) *indexBlock {
-	var j, k = 0, 1
+// buildIndexBlock use the first key of every data block as its index key.
+func (tb *TableBuilder) buildIndexBlock(dataBlock []*block, handles []BlockHandler) *indexBlock {
 	tmpIndexBlock := new(indexBlock)
 	tmpIndexBlock.keyValueSet = make([]indexPairs, len(dataBlock))
 	for i := 0; i < len(dataBlock); i++ {
 		tmpIndexBlock.keyValueSet[i].key = dataBlock[i].keyValueSet[0].key
 		tmpIndexBlock.keyValueSet[i].keyLen = dataBlock[i].keyValueSet[0].keyLen
-		tmpHandle := new(BlockHandler)
-		tmpHandle.set(uint32(i*4096), 4096)
-		j++
-		if j == 16 {
-			tmpIndexBlock.restartPoint[k] = int32(i * 4096)
-			k++
-			j = 0
-		}
 		tmpIndexBlock.keyValueSet[i].valueLen = 8
-		tmpIndexBlock.keyValueSet[i].value = *tmpHandle
+		tmpIndexBlock.keyValueSet[i].value = handles[i]
 	}
+	tmpIndexBlock.setRestartPoint()
 	return tmpIndexBlock
 }
 
+func (ib *indexBlock) setRestartPoint() {
+	var offset uint32
+	ib.restartNum = uint32((len(ib.keyValueSet) + restartInterval - 1) / restartInterval)
+	ib.restartPoint = make([]int32, ib.restartNum)
+	for i := 0; i < len(ib.keyValueSet); i++ {
+		if i%restartInterval == 0 {
+			ib.restartPoint[i/restartInterval] = int32(offset)
+		}
+		offset += ib.keyValueSet[i].keyLen + ib.keyValueSet[i].valueLen + 8
+	}
+}
+
 func (tb *TableBuilder) buildFooter(metaIndex, index BlockHandler) *footer {
 	tmpFooter := new(footer)
 	tmpFooter.indexHandle = index
 	tmpFooter.metaIndexHandle = metaIndex
 	tmpFooter.padding = make([]byte, 24)
-	tmpFooter.magicNum = binaryData("db4775248b80fb57")
+	tmpFooter.magicNum = tableMagicNumber
 	return tmpFooter
 }
 
+// block layout: entries | restart points | restart num | block type | checksum,
+// entry layout: key len | value len | key | value.
+func encodeBlock(keys, values [][]byte, restartPoint []int32, blockType byte) []byte {
+	return appendBlockTrailer(encodeBlockContent(keys, values, restartPoint), blockType)
+}
+
+func encodeBlockContent(keys, values [][]byte, restartPoint []int32) []byte {
+	size := blockTrailerSize + 4 + 4*len(restartPoint)
+	for i := range keys {
+		size += 8 + len(keys[i]) + len(values[i])
+	}
+	data := make([]byte, 0, size)
+	var tmp [4]byte
+	for i := range keys {
+		binary.LittleEndian.PutUint32(tmp[:], uint32(len(keys[i])))
+		data = append(data, tmp[:]...)
+		binary.LittleEndian.PutUint32(tmp[:], uint32(len(values[i])))
+		data = append(data, tmp[:]...)
+		data = append(data, keys[i]...)
+		data = append(data, values[i]...)
+	}
+	for _, point := range restartPoint {
+		binary.LittleEndian.PutUint32(tmp[:], uint32(point))
+		data = append(data, tmp[:]...)
+	}
+	binary.LittleEndian.PutUint32(tmp[:], uint32(len(restartPoint)))
+	return append(data, tmp[:]...)
+}
+
+func appendBlockTrailer(data []byte, blockType byte) []byte {
+	var tmp [4]byte
+	data = append(data, blockType)
+	binary.LittleEndian.PutUint32(tmp[:], getCRC32(data))
+	return append(data, tmp[:]...)
+}
+
+func (b *block) encode() []byte {
+	keys := make([][]byte, len(b.keyValueSet))
+	values := make([][]byte, len(b.keyValueSet))
+	for i := range b.keyValueSet {
+		keys[i] = b.keyValueSet[i].key
+		values[i] = b.keyValueSet[i].value
+	}
+	data := encodeBlock(keys, values, b.restartPoint, b.blockType)
+	b.checksum = binary.LittleEndian.Uint32(data[len(data)-4:])
+	return data
+}
+
+func (ib *indexBlock) encode() []byte {
+	keys := make([][]byte, len(ib.keyValueSet))
+	values := make([][]byte, len(ib.keyValueSet))
+	for i := range ib.keyValueSet {
+		keys[i] = ib.keyValueSet[i].key
+		values[i] = ib.keyValueSet[i].value.encode()
+	}
+	data := encodeBlock(keys, values, ib.restartPoint, ib.blockType)
+	ib.checksum = binary.LittleEndian.Uint32(data[len(data)-4:])
+	return data
+}
+
+func (m *metaBlock) encode() []byte {
+	data := appendBlockTrailer(append([]byte(nil), m.data...), m.blockType)
+	m.checkSum = binary.LittleEndian.Uint32(data[len(data)-4:])
+	return data
+}
+
+func (f *footer) encode() []byte {
+	data := make([]byte, 0, footerSize)
+	data = append(data, f.metaIndexHandle.encode()...)
+	data = append(data, f.indexHandle.encode()...)
+	data = append(data, f.padding...)
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], f.magicNum)
+	return append(data, tmp[:]...)
+}
+
+func decodeFooter(data []byte) (*footer, error) {
+	if len(data) != footerSize {
+		return nil, errors.New("sstable: bad footer size")
+	}
+	f := new(footer)
+	f.magicNum = binary.LittleEndian.Uint64(data[40:])
+	if f.magicNum != tableMagicNumber {
+		return nil, errors.New("sstable: bad magic number")
+	}
+	f.metaIndexHandle, _ = decodeBlockHandler(data[:8])
+	f.indexHandle, _ = decodeBlockHandler(data[8:16])
+	f.padding = data[16:40]
+	return f, nil
+}
+
+// checkBlockTrailer verify the checksum,return the block content and block type.
+func checkBlockTrailer(data []byte) ([]byte, byte, error) {
+	if len(data) < blockTrailerSize {
+		return nil, 0, errors.New("sstable: block too short")
+	}
+	body := data[:len(data)-4]
+	if getCRC32(body) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, 0, errors.New("sstable: block checksum mismatch")
+	}
+	return body[:len(body)-1], body[len(body)-1], nil
+}
+
+// decodeBlockContent split the content of a block into keys and values.
+func decodeBlockContent(body []byte) ([][]byte, [][]byte, error) {
+	if len(body) < 4 {
+		return nil, nil, errors.New("sstable: block too short")
+	}
+	restartNum := int(binary.LittleEndian.Uint32(body[len(body)-4:]))
+	limit := len(body) - 4 - 4*restartNum
+	if limit < 0 {
+		return nil, nil, errors.New("sstable: bad restart number")
+	}
+	keys := make([][]byte, 0, restartNum*restartInterval)
+	values := make([][]byte, 0, restartNum*restartInterval)
+	for p := 0; p < limit; {
+		if p+8 > limit {
+			return nil, nil, errors.New("sstable: bad block entry")
+		}
+		keyLen := int(binary.LittleEndian.Uint32(body[p:]))
+		valueLen := int(binary.LittleEndian.Uint32(body[p+4:]))
+		p += 8
+		if keyLen < 0 || valueLen < 0 || p+keyLen+valueLen > limit {
+			return nil, nil, errors.New("sstable: bad block entry")
+		}
+		keys = append(keys, body[p:p+keyLen])
+		values = append(values, body[p+keyLen:p+keyLen+valueLen])
+		p += keyLen + valueLen
+	}
+	return keys, values, nil
+}
+
 func binaryData(data interface{}) []byte {
 	buf := new(bytes.Buffer)
 	sign, typeValue := checkKVType(data)
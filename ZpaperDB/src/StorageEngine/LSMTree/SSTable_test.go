@@ -3,6 +3,7 @@ package storage
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -46,7 +47,7 @@ func TestBuildMetaBlock(t *testing.T) {
 	tmpPairs := make([]pairs, 4000)
 	for i = 0; i < 4000; i++ {
 		tmp := binaryData(i)
-		tmpPairs[i].set(tmp, tmp)
+		tmpPairs[i].setEntry(tmp, tmp, uint64(i), typeValue)
 	}
 	tb := new(TableBuilder)
 	tb.data = &tmpPairs
@@ -58,15 +59,26 @@ func TestBuildMetaBlock(t *testing.T) {
 		l++
 	}
 	dataBlockSet = append(dataBlockSet, tb.buildDataBlock(tmpPairs[j:]))
+	tb.filterPolicy, _ = MakeBloomFilterPolicy(0.01)
 	metaBlockSet := tb.buildMetaBlock(dataBlockSet)
-	if len(metaBlockSet) != 2 {
-		t.Error("Meta block num error,want 2.")
+	if len(metaBlockSet) != 1 {
+		t.Error("Meta block num error,want 1.")
 	}
-	for k := 0; k < len(metaBlockSet); k++ {
-		if int(metaBlockSet[k].filterSize)+4*len(metaBlockSet[k].offset)+10 > 4096 {
-			t.Error("Meta block size error,want < 4096")
+	for i = 0; i < 4000; i++ {
+		if !tb.filterPolicy.KeyMayMatch(tmpPairs[i].userKey(), metaBlockSet[0].data) {
+			t.Fatal("Full filter lose key", i)
 		}
 	}
+	tb.prefixExtractor = MakeFixedPrefixExtractor(2)
+	metaBlockSet = tb.buildMetaBlock(dataBlockSet)
+	if len(metaBlockSet) != 2 || metaBlockSet[1].name != "prefixfilter.zpaperdb.BuiltinBloomFilter:zpaperdb.FixedPrefix.2" {
+		t.Error("Prefix filter meta block error.")
+	}
+	tb.rangeDels = []rangeTombstone{{start: binaryData(int32(1)), end: binaryData(int32(9)), seq: 5000}}
+	metaBlockSet = tb.buildMetaBlock(dataBlockSet)
+	if len(metaBlockSet) != 3 || metaBlockSet[2].name != rangeDelBlockName {
+		t.Error("Range tombstone meta block error.")
+	}
 }
 
 func TestBuildSSTable(t *testing.T) {
@@ -74,17 +86,16 @@ func TestBuildSSTable(t *testing.T) {
 	tmpPairs := make([]pairs, 10000)
 	for i = 0; i < 10000; i++ {
 		tmp := binaryData(i)
-		tmpPairs[i].set(tmp, tmp)
+		tmpPairs[i].setEntry(tmp, tmp, uint64(i), typeValue)
 	}
 	tb := new(TableBuilder)
 	tb.data = &tmpPairs
-	tb.filterBase = 12
 	tb.snappy = 0x0
-	tb.fpp = 0.01
-	tb.ssTableFile, _ = os.Create("./data/test")
+	tb.filterPolicy, _ = MakeBloomFilterPolicy(0.01)
+	tb.ssTableFile, _ = os.Create(filepath.Join(t.TempDir(), "test"))
 	err := tb.minorCompress()
 	if err != nil {
-		fmt.Println(err)
+		t.Fatal(err)
 	}
 }
 
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// The background work of every column family run on two worker pools shared by
+// the database.The flush pool only run flushes,a compaction worker run a queued
+// flush before any compaction,so a fulled memory table never wait behind the
+// compaction backlog.A column family is queued once per kind of work and run
+// one compaction at a time,a large compaction is split into subcompactions run
+// in parallel instead.Every family is queued for compaction every
+// compactionInterval too,so a FIFO TTL expire without writes.Close stop the
+// workers after their running job,a compaction stop before its next output file.
+
+const compactionInterval = time.Minute
+
+type scheduler struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	flushes     []*LSMTree
+	compactions []*LSMTree
+	queued      map[*LSMTree]bool // queued for compaction
+	flushQueued map[*LSMTree]bool
+	compacting  map[*LSMTree]bool
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+func makeScheduler() *scheduler {
+	s := &scheduler{
+		queued:      make(map[*LSMTree]bool),
+		flushQueued: make(map[*LSMTree]bool),
+		compacting:  make(map[*LSMTree]bool),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// scheduleFlush queue the flush of the immutable table of family.
+func (s *scheduler) scheduleFlush(family *LSMTree) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.flushQueued[family] {
+		return
+	}
+	s.flushQueued[family] = true
+	s.flushes = append(s.flushes, family)
+	s.cond.Broadcast()
+}
+
+// scheduleCompaction queue family to compact its levels,a family being compacted
+// is compacted again once the running compaction finish.
+func (s *scheduler) scheduleCompaction(family *LSMTree) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.queued[family] {
+		return
+	}
+	s.queued[family] = true
+	s.compactions = append(s.compactions, family)
+	s.cond.Broadcast()
+}
+
+// pendingFlushes return the number of queued flushes.
+func (s *scheduler) pendingFlushes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.flushes)
+}
+
+// next wait for a job of the pool,flush report whether it is a flush.It return
+// nil once the scheduler is closed.
+func (s *scheduler) next(compactionPool bool) (family *LSMTree, flush bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed {
+		if len(s.flushes) > 0 {
+			family, s.flushes = s.flushes[0], s.flushes[1:]
+			delete(s.flushQueued, family)
+			return family, true
+		}
+		if compactionPool {
+			for i, queued := range s.compactions {
+				if s.compacting[queued] {
+					continue
+				}
+				s.compactions = append(s.compactions[:i:i], s.compactions[i+1:]...)
+				delete(s.queued, queued)
+				s.compacting[queued] = true
+				return queued, false
+			}
+		}
+		s.cond.Wait()
+	}
+	return nil, false
+}
+
+func (s *scheduler) compactionDone(family *LSMTree) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.compacting, family)
+	s.cond.Broadcast()
+}
+
+// start run the worker pools and the compaction timer of lsm.
+func (s *scheduler) start(lsm *LSMTree, flushes, compactions int) {
+	for i := 0; i < flushes+compactions; i++ {
+		s.wg.Add(1)
+		go s.work(i >= flushes)
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(compactionInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lsm.closing:
+				return
+			case <-ticker.C:
+			}
+			lsm.mu.Lock()
+			lsm.maybeScheduleCompaction()
+			lsm.mu.Unlock()
+		}
+	}()
+}
+
+func (s *scheduler) work(compactionPool bool) {
+	defer s.wg.Done()
+	for {
+		family, flush := s.next(compactionPool)
+		if family == nil {
+			return
+		}
+		var err error
+		reason := ReasonFlush
+		if flush {
+			err = family.flushImmutable()
+		} else {
+			reason = ReasonCompaction
+			err = family.maybeCompact()
+			s.compactionDone(family)
+		}
+		if err != nil {
+			family.mu.Lock()
+			family.setBackgroundError(err, reason)
+			family.mu.Unlock()
+			family.deliverEvents()
+		}
+	}
+}
+
+// close stop the workers and wait for their running jobs.
+func (s *scheduler) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// BeginCompaction start the background flush and compaction workers.
+func (lsm *LSMTree) BeginCompaction() {
+	lsm.scheduler.start(lsm, lsm.dbOpts.MaxBackgroundFlushes, lsm.dbOpts.MaxBackgroundCompactions)
+	lsm.mu.Lock()
+	lsm.maybeScheduleCompaction()
+	lsm.mu.Unlock()
+}
+
+// flushImmutable flush the immutable table of the column family if it has one.
+func (lsm *LSMTree) flushImmutable() error {
+	lsm.mu.Lock()
+	hasImm := lsm.imm != nil
+	lsm.mu.Unlock()
+	if !hasImm {
+		return nil
+	}
+	return lsm.minorCompaction()
+}
+
+// maybeScheduleCompaction queue every column family for compaction,it must be
+// called with lsm.mu held.
+func (lsm *LSMTree) maybeScheduleCompaction() {
+	for _, family := range lsm.families {
+		lsm.scheduler.scheduleCompaction(family)
+	}
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	s := makeScheduler()
+	a, b := new(LSMTree), new(LSMTree)
+	s.scheduleCompaction(a)
+	s.scheduleCompaction(a)
+	s.scheduleFlush(b)
+	// a compaction worker take the flush first
+	if family, flush := s.next(true); family != b || !flush {
+		t.Fatal("Queued flush does not run before the compaction.")
+	}
+	if family, flush := s.next(true); family != a || flush {
+		t.Fatal("Queued compaction does not run.")
+	}
+	if len(s.compactions) != 0 {
+		t.Fatal("Family is queued twice for compaction.")
+	}
+	// a family being compacted is left queued until its compaction finish
+	s.scheduleCompaction(a)
+	s.scheduleCompaction(b)
+	if family, _ := s.next(true); family != b {
+		t.Fatal("Family being compacted is compacted twice at once.")
+	}
+	s.compactionDone(a)
+	if family, _ := s.next(true); family != a {
+		t.Fatal("Family is not compacted again after its compaction.")
+	}
+	// the flush pool never run a compaction
+	s.scheduleCompaction(new(LSMTree))
+	done := make(chan *LSMTree)
+	go func() {
+		family, _ := s.next(false)
+		done <- family
+	}()
+	select {
+	case <-done:
+		t.Fatal("Flush worker run a compaction.")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.close()
+	if family := <-done; family != nil {
+		t.Fatal("Closed scheduler return a job.")
+	}
+}
+
+// putRange write keys [from,to) with values of size bytes.
+func putRange(t *testing.T, lsmTree *LSMTree, from, to, size int) {
+	for i := from; i < to; i++ {
+		batch := new(WriteBatch)
+		batch.Put(testKey(i), bytes.Repeat(testKey(i), size/len(testKey(i))))
+		if err := lsmTree.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSubcompactions(t *testing.T) {
+	lsmTree := makeValueLogTestLSMTree(t, t.TempDir(), &Options{MaxFileOfOneLevel: 4, MaxSubcompactions: 4})
+	defer lsmTree.Close()
+	// 4 overlapping level0 files of 1MB
+	for k := 0; k < 4; k++ {
+		putRange(t, lsmTree, k*500, k*500+1000, 1050)
+		if err := lsmTree.minorCompaction(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cp := lsmTree.pickCompaction()
+	if cp == nil {
+		t.Fatal("No compaction is picked.")
+	}
+	bounds := lsmTree.subcompactionBounds(cp)
+	if len(bounds) < 1 || len(bounds) > 3 {
+		t.Fatalf("%d subcompaction bounds,want 1 to 3", len(bounds))
+	}
+	if err := lsmTree.majorCompress(cp); err != nil {
+		t.Fatal(err)
+	}
+	files := lsmTree.levels[1]
+	if len(lsmTree.levels[0]) != 0 || len(files) < 2 {
+		t.Fatal("Level0 is not compacted into level1.")
+	}
+	for i := 1; i < len(files); i++ {
+		if bytes.Compare(files[i-1].largest, files[i].smallest) >= 0 {
+			t.Fatalf("Level1 files %d and %d overlap", files[i-1].fileNum, files[i].fileNum)
+		}
+	}
+	for i := 0; i < 2500; i += 37 {
+		value, err := lsmTree.Get(testKey(i))
+		if err != nil || !bytes.HasPrefix(value, testKey(i)) {
+			t.Fatalf("key %d value %q %v", i, value, err)
+		}
+	}
+	// the whole compaction run as one range without MaxSubcompactions
+	lsmTree.opts.MaxSubcompactions = 1
+	if bounds = lsmTree.subcompactionBounds(cp); len(bounds) != 0 {
+		t.Fatal("Compaction is split with one subcompaction.")
+	}
+}
+
+func TestCompactionCancel(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree := makeValueLogTestLSMTree(t, dir, &Options{MaxFileOfOneLevel: 2})
+	putKeys(t, lsmTree, 0, 100)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, lsmTree, 50, 150)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	cp := lsmTree.pickCompaction()
+	entries, _ := os.ReadDir(dir)
+	lsmTree.mu.Lock()
+	lsmTree.closed = true
+	lsmTree.mu.Unlock()
+	if err := lsmTree.majorCompress(cp); err != ErrClosed {
+		t.Fatal("Compaction is not stopped by Close.", err)
+	}
+	if after, _ := os.ReadDir(dir); len(after) != len(entries) || len(lsmTree.levels[0]) != 2 {
+		t.Fatal("Stopped compaction leave files or remove its inputs.")
+	}
+	lsmTree.mu.Lock()
+	lsmTree.closed = false
+	lsmTree.mu.Unlock()
+	if err := lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsmTree = makeValueLogTestLSMTree(t, dir, nil)
+	defer lsmTree.Close()
+	checkFound(t, lsmTree, 120, true)
+}
+
+func TestBackgroundWorkers(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{
+		MaxMemTableSize:          8192,
+		MaxFileOfOneLevel:        2,
+		MaxBackgroundFlushes:     2,
+		MaxBackgroundCompactions: 2,
+		MaxSubcompactions:        2,
+	}
+	lsmTree, err := OpenLSMTree(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := lsmTree.CreateColumnFamily("other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, lsmTree, 0, 3000)
+	putKeysCF(t, lsmTree, cf, 0, 3000)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lsmTree.mu.Lock()
+		compacted := true
+		for _, family := range lsmTree.families {
+			compacted = compacted && family.imm == nil && len(family.levels[0]) < 2 && len(family.levels[1]) > 0
+		}
+		lsmTree.mu.Unlock()
+		if compacted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Column families are not flushed and compacted in background.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Close stop the workers while writes keep them busy
+	putKeys(t, lsmTree, 3000, 4000)
+	if err = lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsmTree, err = OpenColumnFamilies(dir, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmTree.Close()
+	for i := 0; i < 4000; i += 41 {
+		checkFound(t, lsmTree, i, true)
+	}
+	cf = lsmTree.ColumnFamily("other")
+	for i := 0; i < 3000; i += 41 {
+		checkFoundCF(t, lsmTree, cf, i, true)
+	}
+}
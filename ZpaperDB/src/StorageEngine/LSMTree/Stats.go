@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Every column family count its flushes,compactions and reads.The flush and
+// compaction counters are guarded by lsm.mu,the read counters are atomic as
+// Get do not hold lsm.mu while it search the SSTables.Stats return a snapshot
+// of them and GetProperty format them as named properties:
+// zpaperdb.num-files-at-level<N>: the file number of level N
+// zpaperdb.stats: a table of the levels and the counters
+// zpaperdb.sstables: the files of every level with their sizes and key ranges
+// zpaperdb.approximate-memory-usage: the bytes of the memory tables
+
+const (
+	propertyNumFilesAtLevel = "zpaperdb.num-files-at-level"
+	propertyStats           = "zpaperdb.stats"
+	propertySSTables        = "zpaperdb.sstables"
+	propertyMemoryUsage     = "zpaperdb.approximate-memory-usage"
+)
+
+// LevelStats count the compactions whose output is the level,the flushes are
+// counted in level0.
+type LevelStats struct {
+	Files          int
+	Bytes          int64
+	Compactions    int
+	BytesRead      int64
+	BytesWritten   int64
+	CompactionTime time.Duration
+}
+
+type Stats struct {
+	Levels             []LevelStats
+	MemTableBytes      int64 // the memory table and the immutable one
+	ImmutableMemTables int
+	// UserBytesWritten is the key and value bytes written into the column family.
+	UserBytesWritten       int64
+	Flushes                int
+	BytesFlushed           int64
+	Compactions            int
+	CompactionTime         time.Duration
+	CompactionBytesRead    int64
+	CompactionBytesWritten int64
+	// WriteAmplification is the SSTable bytes written by flushes and compactions
+	// per user byte.ReadAmplification is the sorted runs a Get may search:every
+	// level0 file and every other non empty level.
+	WriteAmplification float64
+	ReadAmplification  int
+	Gets               int64
+	TablesRead         int64 // SSTables searched after the filters
+	// FilterUseful is the SSTable lookups a filter skipped,FilterFalsePositives
+	// the ones it let through which do not find the key.
+	FilterChecks         int64
+	FilterUseful         int64
+	FilterFalsePositives int64
+	// database wide
+	WALBytes   int64
+	WriteStall WriteStallStats
+}
+
+type familyStats struct {
+	levels       [maxLevel]LevelStats
+	userBytes    int64
+	flushes      int
+	bytesFlushed int64
+}
+
+type readStats struct {
+	gets                 int64
+	tablesRead           int64
+	filterChecks         int64
+	filterUseful         int64
+	filterFalsePositives int64
+}
+
+// recordFlush must be called with lsm.mu held once meta is in level0.
+func (lsm *LSMTree) recordFlush(meta *fileMeta) {
+	lsm.stats.flushes++
+	lsm.stats.bytesFlushed += meta.size
+	lsm.stats.levels[0].BytesWritten += meta.size
+}
+
+func (lsm *LSMTree) recordCompaction(cp *compaction, outputs []*fileMeta, elapsed time.Duration) {
+	var read int64
+	for _, files := range cp.inputFile {
+		read += totalFileSize(files)
+	}
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	level := &lsm.stats.levels[cp.outputLevel]
+	level.Compactions++
+	level.BytesRead += read
+	level.BytesWritten += totalFileSize(outputs)
+	level.CompactionTime += elapsed
+}
+
+// searchTable search key in the SSTable after its filters.
+func (lsm *LSMTree) searchTable(t *tableReader, key []byte) (*pairs, error) {
+	filtered := t.fullFilterPolicy != nil || t.prefixPolicy != nil
+	if filtered {
+		atomic.AddInt64(&lsm.reads.filterChecks, 1)
+	}
+	if !t.mayContain(key) {
+		atomic.AddInt64(&lsm.reads.filterUseful, 1)
+		return nil, nil
+	}
+	atomic.AddInt64(&lsm.reads.tablesRead, 1)
+	pair, err := t.find(key)
+	if err == nil && pair == nil && filtered {
+		atomic.AddInt64(&lsm.reads.filterFalsePositives, 1)
+	}
+	return pair, err
+}
+
+// memoryUsage must be called with lsm.mu held.
+func (lsm *LSMTree) memoryUsage() int64 {
+	size := lsm.table.memoryUsage()
+	if lsm.imm != nil {
+		size += lsm.imm.memoryUsage()
+	}
+	return size
+}
+
+// Stats return the counters of the column family,WALBytes and WriteStall are
+// the database's.
+func (lsm *LSMTree) Stats() Stats {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	s := Stats{
+		Levels:           make([]LevelStats, maxLevel),
+		MemTableBytes:    lsm.memoryUsage(),
+		UserBytesWritten: lsm.stats.userBytes,
+		Flushes:          lsm.stats.flushes,
+		BytesFlushed:     lsm.stats.bytesFlushed,
+		WALBytes:         lsm.walBytes,
+		WriteStall: WriteStallStats{
+			State:         stallStateName(lsm.stall.state),
+			DelayedWrites: lsm.stall.delayedWrites,
+			StoppedWrites: lsm.stall.stoppedWrites,
+			DelayedTime:   lsm.stall.delayedTime,
+			StoppedTime:   lsm.stall.stoppedTime,
+		},
+		Gets:                 atomic.LoadInt64(&lsm.reads.gets),
+		TablesRead:           atomic.LoadInt64(&lsm.reads.tablesRead),
+		FilterChecks:         atomic.LoadInt64(&lsm.reads.filterChecks),
+		FilterUseful:         atomic.LoadInt64(&lsm.reads.filterUseful),
+		FilterFalsePositives: atomic.LoadInt64(&lsm.reads.filterFalsePositives),
+	}
+	if lsm.imm != nil {
+		s.ImmutableMemTables = 1
+	}
+	copy(s.Levels, lsm.stats.levels[:])
+	var written int64
+	for level, files := range lsm.levels {
+		s.Levels[level].Files = len(files)
+		s.Levels[level].Bytes = totalFileSize(files)
+		s.Compactions += s.Levels[level].Compactions
+		s.CompactionTime += s.Levels[level].CompactionTime
+		s.CompactionBytesRead += s.Levels[level].BytesRead
+		written += s.Levels[level].BytesWritten
+		if level == 0 {
+			s.ReadAmplification += len(files)
+		} else if len(files) > 0 {
+			s.ReadAmplification++
+		}
+	}
+	s.CompactionBytesWritten = written - s.BytesFlushed
+	if s.UserBytesWritten > 0 {
+		s.WriteAmplification = float64(written) / float64(s.UserBytesWritten)
+	}
+	return s
+}
+
+// StatsCF return the counters of the column family like Stats.
+func (lsm *LSMTree) StatsCF(cf *ColumnFamilyHandle) (Stats, error) {
+	family, err := lsm.columnFamily(cf)
+	if err != nil {
+		return Stats{}, err
+	}
+	return family.Stats(), nil
+}
+
+// GetProperty return the property name of the column family.
+func (lsm *LSMTree) GetProperty(name string) (string, error) {
+	switch {
+	case strings.HasPrefix(name, propertyNumFilesAtLevel):
+		level, err := strconv.Atoi(name[len(propertyNumFilesAtLevel):])
+		if err != nil || level < 0 || level >= maxLevel {
+			break
+		}
+		lsm.mu.Lock()
+		defer lsm.mu.Unlock()
+		return strconv.Itoa(len(lsm.levels[level])), nil
+	case name == propertyStats:
+		return formatStats(lsm.Stats()), nil
+	case name == propertySSTables:
+		return lsm.formatSSTables(), nil
+	case name == propertyMemoryUsage:
+		lsm.mu.Lock()
+		defer lsm.mu.Unlock()
+		return strconv.FormatInt(lsm.memoryUsage(), 10), nil
+	}
+	return "", errors.New("zpaperdb: unknown property " + name)
+}
+
+// GetPropertyCF return the property name of the column family like GetProperty.
+func (lsm *LSMTree) GetPropertyCF(cf *ColumnFamilyHandle, name string) (string, error) {
+	family, err := lsm.columnFamily(cf)
+	if err != nil {
+		return "", err
+	}
+	return family.GetProperty(name)
+}
+
+func formatStats(s Stats) string {
+	const mb = 1 << 20
+	var b strings.Builder
+	b.WriteString("                         Compactions\n")
+	b.WriteString("Level  Files  Size(MB)  Count  Time(sec)  Read(MB)  Write(MB)\n")
+	b.WriteString("--------------------------------------------------------------\n")
+	for level, l := range s.Levels {
+		if l.Files == 0 && l.Compactions == 0 && l.BytesWritten == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "%5d %6d %9.2f %6d %10.3f %9.2f %10.2f\n", level, l.Files, float64(l.Bytes)/mb,
+			l.Compactions, l.CompactionTime.Seconds(), float64(l.BytesRead)/mb, float64(l.BytesWritten)/mb)
+	}
+	fmt.Fprintf(&b, "memory tables: %d bytes,%d immutable\n", s.MemTableBytes, s.ImmutableMemTables)
+	fmt.Fprintf(&b, "writes: %d user bytes,%d WAL bytes,%d flushes of %d bytes\n",
+		s.UserBytesWritten, s.WALBytes, s.Flushes, s.BytesFlushed)
+	fmt.Fprintf(&b, "compactions: %d,%.3f sec,%d bytes read,%d bytes written\n",
+		s.Compactions, s.CompactionTime.Seconds(), s.CompactionBytesRead, s.CompactionBytesWritten)
+	fmt.Fprintf(&b, "amplification: write %.2f,read %d\n", s.WriteAmplification, s.ReadAmplification)
+	fmt.Fprintf(&b, "reads: %d gets,%d tables read\n", s.Gets, s.TablesRead)
+	fmt.Fprintf(&b, "filters: %d checks,%d useful,%d false positives\n",
+		s.FilterChecks, s.FilterUseful, s.FilterFalsePositives)
+	fmt.Fprintf(&b, "write stall: %s,%d delayed,%d stopped\n",
+		s.WriteStall.State, s.WriteStall.DelayedWrites, s.WriteStall.StoppedWrites)
+	return b.String()
+}
+
+func (lsm *LSMTree) formatSSTables() string {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	var b strings.Builder
+	for level, files := range lsm.levels {
+		fmt.Fprintf(&b, "--- level %d ---\n", level)
+		for _, meta := range files {
+			fmt.Fprintf(&b, " %d:%d[%q .. %q]\n", meta.fileNum, meta.size, meta.smallest, meta.largest)
+		}
+	}
+	return b.String()
+}
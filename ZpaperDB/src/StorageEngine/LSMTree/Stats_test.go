@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	lsmTree := makeValueLogTestLSMTree(t, t.TempDir(), &Options{MaxFileOfOneLevel: 2})
+	defer lsmTree.Close()
+	putKeys(t, lsmTree, 0, 100)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, lsmTree, 100, 200)
+	flushAndCompact(t, lsmTree)
+	checkFound(t, lsmTree, 50, true)
+	if _, err := lsmTree.Get(append(testKey(50), 'x')); err != ErrNotFound {
+		t.Fatal("Absent key is found.", err)
+	}
+	s := lsmTree.Stats()
+	// every key and value is 7 bytes
+	if s.UserBytesWritten != 200*14 || s.WALBytes <= s.UserBytesWritten {
+		t.Fatalf("User bytes %d and WAL bytes %d,want 2800 and more", s.UserBytesWritten, s.WALBytes)
+	}
+	if s.Flushes != 2 || s.Levels[0].BytesWritten != s.BytesFlushed || s.Levels[0].Files != 0 {
+		t.Fatal("Flushes are not counted in level0.", s.Levels[0])
+	}
+	level1 := s.Levels[1]
+	if s.Compactions != 1 || level1.Compactions != 1 || level1.BytesRead != s.BytesFlushed ||
+		level1.BytesWritten != level1.Bytes || s.CompactionBytesWritten != level1.BytesWritten {
+		t.Fatal("Compaction into level1 is not counted.", level1)
+	}
+	want := float64(s.BytesFlushed+level1.BytesWritten) / float64(s.UserBytesWritten)
+	if s.WriteAmplification != want || s.ReadAmplification != 1 {
+		t.Fatalf("Amplification write %f read %d,want %f and 1", s.WriteAmplification, s.ReadAmplification, want)
+	}
+	if s.Gets != 2 || s.FilterChecks != 2 || s.FilterUseful+s.FilterFalsePositives != 1 || s.TablesRead != 2-s.FilterUseful {
+		t.Fatalf("Reads are not counted: %+v", s)
+	}
+}
+
+func TestGetProperty(t *testing.T) {
+	lsmTree := makeValueLogTestLSMTree(t, t.TempDir(), nil)
+	defer lsmTree.Close()
+	putKeys(t, lsmTree, 0, 100)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, lsmTree, 100, 110)
+	if value, err := lsmTree.GetProperty("zpaperdb.num-files-at-level0"); err != nil || value != "1" {
+		t.Fatalf("Level0 has %q files,want 1 %v", value, err)
+	}
+	if value, _ := lsmTree.GetProperty("zpaperdb.num-files-at-level6"); value != "0" {
+		t.Fatalf("Level6 has %q files,want 0", value)
+	}
+	value, err := lsmTree.GetProperty("zpaperdb.sstables")
+	meta := lsmTree.levels[0][0]
+	if err != nil || !strings.Contains(value, "--- level 0 ---\n "+strconv.FormatUint(meta.fileNum, 10)+":") {
+		t.Fatalf("SSTables property %q miss the level0 file", value)
+	}
+	if value, err = lsmTree.GetProperty("zpaperdb.stats"); err != nil || !strings.Contains(value, "amplification") {
+		t.Fatalf("Stats property %q", value)
+	}
+	value, err = lsmTree.GetProperty("zpaperdb.approximate-memory-usage")
+	if size, _ := strconv.ParseInt(value, 10, 64); err != nil || size != lsmTree.table.memoryUsage() {
+		t.Fatalf("Memory usage %q,want %d", value, lsmTree.table.memoryUsage())
+	}
+	for _, name := range []string{"zpaperdb.num-files-at-level7", "zpaperdb.num-files-at-levelx", "leveldb.stats"} {
+		if _, err = lsmTree.GetProperty(name); err == nil {
+			t.Fatalf("Unknown property %s is accepted.", name)
+		}
+	}
+}
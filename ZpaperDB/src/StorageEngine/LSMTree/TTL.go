@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// An entry written by PutWithTTL is of typeValueTTL,its value is prefixed by the
+// expiry time:
+// expiry unix nano(8 bytes) | value
+// Reads treat an expired entry as absent.Compaction drop it at the bottommost
+// level and turn it into a tombstone at the other levels,so it keep shadowing
+// the older versions below.
+
+const expirySize = 8
+
+// Clock give the time to the TTL checks,tests replace it to move time forward.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func encodeTTLValue(value []byte, expireAt time.Time) []byte {
+	data := make([]byte, expirySize+len(value))
+	binary.LittleEndian.PutUint64(data, uint64(expireAt.UnixNano()))
+	copy(data[expirySize:], value)
+	return data
+}
+
+// decodeTTLValue return the expiry unix nano and the value of a typeValueTTL entry.
+func decodeTTLValue(data []byte) (int64, []byte, bool) {
+	if len(data) < expirySize {
+		return 0, nil, false
+	}
+	return int64(binary.LittleEndian.Uint64(data)), data[expirySize:], true
+}
+
+// expired report whether a typeValueTTL entry is expired at now,a broken
+// entry is treated as expired.
+func expired(data []byte, now int64) bool {
+	expireAt, _, ok := decodeTTLValue(data)
+	return !ok || expireAt <= now
+}
+
+func (lsm *LSMTree) now() int64 {
+	return lsm.opts.Clock.Now().UnixNano()
+}
+
+// PutWithTTL write key which is visible for ttl from now on.
+func (lsm *LSMTree) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("ttl: must be positive")
+	}
+	batch := new(WriteBatch)
+	batch.PutWithExpiry(key, value, lsm.opts.Clock.Now().Add(ttl))
+	return lsm.write(batch)
+}
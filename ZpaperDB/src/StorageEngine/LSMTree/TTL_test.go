@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func makeTTLTestLSMTree(t *testing.T, clock Clock) *LSMTree {
+	var lsmTree *LSMTree
+	lsmTree, err := lsmTree.initLSMTree(&Options{Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lsmTree.open(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	return lsmTree
+}
+
+func TestTTLGet(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	lsmTree := makeTTLTestLSMTree(t, clock)
+	if err := lsmTree.PutWithTTL(testKey(1), testKey(1), 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	args := &AddArgs{Key: testKey(2), Value: testKey(2), TTL: 20 * time.Second}
+	if err := lsmTree.RBAdd(args, new(AddReply)); err != nil || args.KeyType != typeValueTTL {
+		t.Fatal("RBAdd with TTL must write a typeValueTTL entry.", err)
+	}
+	putKeys(t, lsmTree, 3, 4)
+	if err := lsmTree.PutWithTTL(testKey(4), nil, 0); err == nil {
+		t.Fatal("PutWithTTL accept ttl 0.")
+	}
+	checkFound(t, lsmTree, 1, true)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	checkFound(t, lsmTree, 1, true)
+	clock.advance(10 * time.Second)
+	checkFound(t, lsmTree, 1, false)
+	checkFound(t, lsmTree, 2, true)
+	clock.advance(10 * time.Second)
+	checkFound(t, lsmTree, 2, false)
+	checkFound(t, lsmTree, 3, true)
+	// a new write of an expired key is visible again
+	if err := lsmTree.PutWithTTL(testKey(1), testKey(1), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkFound(t, lsmTree, 1, true)
+}
+
+func TestTTLIterator(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	lsmTree := makeTTLTestLSMTree(t, clock)
+	putKeys(t, lsmTree, 0, 10)
+	for i := 5; i < 15; i++ {
+		if err := lsmTree.PutWithTTL(testKey(i), testKey(i), time.Duration(i)*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// keys 5 to 10 are expired
+	clock.advance(10 * time.Second)
+	it := lsmTree.NewIterator()
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		want := n
+		if n >= 5 {
+			want = n + 6
+		}
+		if !bytes.Equal(it.Key(), testKey(want)) || !bytes.Equal(it.Value(), testKey(want)) {
+			t.Fatalf("Iterator key %s value %s,want %s", it.Key(), it.Value(), testKey(want))
+		}
+		n++
+	}
+	if n != 9 {
+		t.Fatalf("Iterator return %d keys,want 9", n)
+	}
+}
+
+func TestTTLCompaction(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	lsmTree := makeTTLTestLSMTree(t, clock)
+	lsmTree.maxFileNum = 2
+	putKeys(t, lsmTree, 0, 100)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 50; i < 150; i++ {
+		if err := lsmTree.PutWithTTL(testKey(i), testKey(i), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(time.Minute)
+	if err := lsmTree.maybeCompact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(lsmTree.levels[0]) != 0 || len(lsmTree.levels[1]) == 0 {
+		t.Fatal("Level0 is not compacted.")
+	}
+	var num int
+	for _, meta := range lsmTree.levels[1] {
+		data, err := meta.table.readAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		num += len(data)
+	}
+	if num != 50 {
+		t.Fatalf("Compaction keep %d entries,want 50", num)
+	}
+	checkFound(t, lsmTree, 10, true)
+	checkFound(t, lsmTree, 60, false)
+	checkFound(t, lsmTree, 120, false)
+}
+
+func TestMergeNewestExpired(t *testing.T) {
+	now := time.Unix(1000, 0)
+	data := make([]pairs, 3)
+	data[0].setEntry([]byte("a"), []byte("old"), 1, typeValue)
+	data[1].setEntry([]byte("a"), encodeTTLValue([]byte("new"), now), 2, typeValueTTL)
+	data[2].setEntry([]byte("b"), encodeTTLValue([]byte("live"), now.Add(time.Second)), 3, typeValueTTL)
+	merged, err := mergeNewest(append([]pairs(nil), data...), nil, false, now.UnixNano(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != 2 {
+		t.Fatalf("Merge keep %d entries,want 2", len(merged))
+	}
+	// the expired entry must keep shadowing the older version of a lower level
+	if seq, keyType := merged[0].trailer(); keyType != typeDeletion || seq != 2 {
+		t.Fatal("Expired entry is not turned into a tombstone.")
+	}
+	if _, keyType := merged[1].trailer(); keyType != typeValueTTL {
+		t.Fatal("Live entry lose its expiry.")
+	}
+	merged, err = mergeNewest(append([]pairs(nil), data...), nil, true, now.UnixNano(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != 1 || !bytes.Equal(merged[0].userKey(), []byte("b")) {
+		t.Fatal("Expired entry is not dropped at the bottommost level.")
+	}
+}
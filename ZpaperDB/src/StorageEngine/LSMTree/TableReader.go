@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+)
+
+// tableReader open a SSTable written by TableBuilder.It load the footer,the index
+// block and the filters recorded in the meta index block.The name of each filter
+// decide which policy decode it, a filter built by an unknown policy is ignored.
+type tableReader struct {
+	file             *os.File
+	size             int64
+	footer           *footer
+	index            []indexPairs
+	prefixExtractor  PrefixExtractor
+	fullFilterPolicy FilterPolicy
+	fullFilter       []byte
+	prefixPolicy     FilterPolicy
+	prefixFilter     []byte
+	rangeDels        []rangeTombstone
+	valueLogs        map[uint64]int64 // bytes pointed to in each value log
+	globalSeq        uint64           // the sequence of every entry of an ingested table
+}
+
+func openTable(file *os.File, policy FilterPolicy, extractor PrefixExtractor) (*tableReader, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	t := new(tableReader)
+	t.file = file
+	t.size = info.Size()
+	t.prefixExtractor = extractor
+	if t.size < footerSize {
+		return nil, errors.New("sstable: file too short")
+	}
+	footerData := make([]byte, footerSize)
+	if _, err = file.ReadAt(footerData, t.size-footerSize); err != nil {
+		return nil, err
+	}
+	if t.footer, err = decodeFooter(footerData); err != nil {
+		return nil, err
+	}
+	keys, values, err := t.readBlock(t.footer.indexHandle)
+	if err != nil {
+		return nil, err
+	}
+	t.index = make([]indexPairs, len(keys))
+	for i := range keys {
+		handle, err := decodeBlockHandler(values[i])
+		if err != nil {
+			return nil, err
+		}
+		t.index[i] = indexPairs{keyLen: uint32(len(keys[i])), valueLen: 8, key: keys[i], value: handle}
+	}
+	if err = t.readMetaIndex(policy); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *tableReader) readMetaIndex(policy FilterPolicy) error {
+	keys, values, err := t.readBlock(t.footer.metaIndexHandle)
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		name := string(keys[i])
+		var filterPolicy FilterPolicy
+		var prefix bool
+		switch {
+		case name == rangeDelBlockName:
+			if err = t.readRangeDels(values[i]); err != nil {
+				return err
+			}
+			continue
+		case name == valueLogBlockName:
+			handle, err := decodeBlockHandler(values[i])
+			if err != nil {
+				return err
+			}
+			content, err := t.readRawBlock(handle)
+			if err != nil {
+				return err
+			}
+			if t.valueLogs, err = decodeValueLogRefs(content); err != nil {
+				return err
+			}
+			continue
+		case strings.HasPrefix(name, "fullfilter."):
+			filterPolicy = pickFilterPolicy(strings.TrimPrefix(name, "fullfilter."), policy)
+		case strings.HasPrefix(name, "prefixfilter."):
+			sep := strings.LastIndex(name, ":")
+			if sep < 0 || t.prefixExtractor == nil || name[sep+1:] != t.prefixExtractor.Name() {
+				continue
+			}
+			filterPolicy = pickFilterPolicy(name[len("prefixfilter."):sep], policy)
+			prefix = true
+		}
+		if filterPolicy == nil {
+			continue
+		}
+		handle, err := decodeBlockHandler(values[i])
+		if err != nil {
+			return err
+		}
+		data, err := t.readRawBlock(handle)
+		if err != nil {
+			return err
+		}
+		if prefix {
+			t.prefixPolicy, t.prefixFilter = filterPolicy, data
+		} else {
+			t.fullFilterPolicy, t.fullFilter = filterPolicy, data
+		}
+	}
+	return nil
+}
+
+func (t *tableReader) readRangeDels(handleData []byte) error {
+	handle, err := decodeBlockHandler(handleData)
+	if err != nil {
+		return err
+	}
+	keys, values, err := t.readBlock(handle)
+	if err != nil {
+		return err
+	}
+	t.rangeDels = make([]rangeTombstone, len(keys))
+	for i := range keys {
+		tmpPair := pairs{key: keys[i]}
+		t.rangeDels[i].start = tmpPair.userKey()
+		t.rangeDels[i].end = values[i]
+		t.rangeDels[i].seq, _ = tmpPair.trailer()
+	}
+	return nil
+}
+
+// pickFilterPolicy return the policy which can decode the filter named name,
+// the reader's own policy is preferred to the builtin ones.
+func pickFilterPolicy(name string, policy FilterPolicy) FilterPolicy {
+	if policy != nil && policy.Name() == name {
+		return policy
+	}
+	if name == (&bloomFilterPolicy{}).Name() {
+		return &bloomFilterPolicy{}
+	}
+	return nil
+}
+
+// readRawBlock read a block and check its trailer,return the block content.
+func (t *tableReader) readRawBlock(handle BlockHandler) ([]byte, error) {
+	if handle.size < blockTrailerSize || int64(handle.offset)+int64(handle.size) > t.size {
+		return nil, errors.New("sstable: bad block handle")
+	}
+	data := make([]byte, handle.size)
+	if _, err := t.file.ReadAt(data, int64(handle.offset)); err != nil {
+		return nil, err
+	}
+	content, _, err := checkBlockTrailer(data)
+	return content, err
+}
+
+func (t *tableReader) readBlock(handle BlockHandler) ([][]byte, [][]byte, error) {
+	content, err := t.readRawBlock(handle)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decodeBlockContent(content)
+}
+
+// keyMayMatch return false only if the full filter is sure key is not in the table.
+func (t *tableReader) keyMayMatch(key []byte) bool {
+	if t.fullFilterPolicy == nil {
+		return true
+	}
+	return t.fullFilterPolicy.KeyMayMatch(key, t.fullFilter)
+}
+
+// prefixMayMatch return false only if no key in the table has the prefix of key.
+func (t *tableReader) prefixMayMatch(key []byte) bool {
+	if t.prefixPolicy == nil || !t.prefixExtractor.InDomain(key) {
+		return true
+	}
+	return t.prefixPolicy.KeyMayMatch(t.prefixExtractor.Transform(key), t.prefixFilter)
+}
+
+// get return the entry of key,or nil if the table has no entry of key.
+func (t *tableReader) get(key []byte) (*pairs, error) {
+	if !t.mayContain(key) {
+		return nil, nil
+	}
+	return t.find(key)
+}
+
+// mayContain return false only if the filters are sure key is not in the table.
+func (t *tableReader) mayContain(key []byte) bool {
+	return t.keyMayMatch(key) && t.prefixMayMatch(key)
+}
+
+// find search the block of key without the filters.
+func (t *tableReader) find(key []byte) (*pairs, error) {
+	// the key can only be in the last block whose first key <= key
+	i := sort.Search(len(t.index), func(i int) bool {
+		return bytes.Compare(userKeyOf(t.index[i].key), key) > 0
+	}) - 1
+	if i < 0 {
+		return nil, nil
+	}
+	keys, values, err := t.readBlock(t.index[i].value)
+	if err != nil {
+		return nil, err
+	}
+	j := sort.Search(len(keys), func(j int) bool {
+		return bytes.Compare(userKeyOf(keys[j]), key) >= 0
+	})
+	if j == len(keys) || !bytes.Equal(userKeyOf(keys[j]), key) {
+		return nil, nil
+	}
+	result := new(pairs)
+	result.set(t.internalKey(keys[j]), values[j])
+	return result, nil
+}
+
+// readAll return every entry of the table in order.
+func (t *tableReader) readAll() ([]pairs, error) {
+	result := make([]pairs, 0, len(t.index)*64)
+	for i := range t.index {
+		keys, values, err := t.readBlock(t.index[i].value)
+		if err != nil {
+			return nil, err
+		}
+		for j := range keys {
+			tmpPair := pairs{}
+			tmpPair.set(t.internalKey(keys[j]), values[j])
+			result = append(result, tmpPair)
+		}
+	}
+	return result, nil
+}
+
+// rangeDelSeq return the sequence of the newest range tombstone which cover key.
+func (t *tableReader) rangeDelSeq(key []byte) uint64 {
+	var seq uint64
+	for i := range t.rangeDels {
+		if t.rangeDels[i].seq > seq && t.rangeDels[i].covers(key) {
+			seq = t.rangeDels[i].seq
+		}
+	}
+	return seq
+}
+
+// setGlobalSeq give every entry and range tombstone of an ingested table the
+// sequence seq,the table itself save them with sequence 0.
+func (t *tableReader) setGlobalSeq(seq uint64) {
+	if seq == 0 {
+		return
+	}
+	t.globalSeq = seq
+	for i := range t.rangeDels {
+		t.rangeDels[i].seq = seq
+	}
+}
+
+func (t *tableReader) internalKey(key []byte) []byte {
+	if t.globalSeq == 0 {
+		return key
+	}
+	p := pairs{key: key}
+	_, keyType := p.trailer()
+	return makeInternalKey(p.userKey(), t.globalSeq, keyType)
+}
+
+func (t *tableReader) close() error {
+	return t.file.Close()
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func buildTestTable(t *testing.T, num int, extractor PrefixExtractor) string {
+	tmpPairs := make([]pairs, num)
+	for i := 0; i < num; i++ {
+		tmp := []byte("key" + strconv.Itoa(100000+i))
+		tmpPairs[i].setEntry(tmp, tmp, uint64(i+1), typeValue)
+	}
+	path := filepath.Join(t.TempDir(), "ssTable")
+	tb := new(TableBuilder)
+	tb.data = &tmpPairs
+	tb.filterPolicy, _ = MakeBloomFilterPolicy(0.01)
+	tb.prefixExtractor = extractor
+	tb.ssTableFile, _ = os.Create(path)
+	if err := tb.minorCompress(); err != nil {
+		t.Fatal(err)
+	}
+	tb.ssTableFile.Close()
+	return path
+}
+
+func TestOpenTable(t *testing.T) {
+	path := buildTestTable(t, 5000, nil)
+	file, _ := os.Open(path)
+	reader, err := openTable(file, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.close()
+	if len(reader.index) < 2 {
+		t.Fatal("Index block entry num error.")
+	}
+	if reader.fullFilterPolicy == nil {
+		t.Fatal("Full filter is not picked by its name.")
+	}
+	falseNum := 0
+	for i := 0; i < 5000; i++ {
+		if !reader.keyMayMatch([]byte("key" + strconv.Itoa(100000+i))) {
+			t.Fatal("Full filter lose key", i)
+		}
+		if reader.keyMayMatch([]byte("nokey" + strconv.Itoa(i))) {
+			falseNum++
+		}
+	}
+	if falseNum > 150 {
+		t.Error("Full filter false positive too much:", falseNum)
+	}
+}
+
+func TestOpenTablePrefixFilter(t *testing.T) {
+	path := buildTestTable(t, 300, MakeFixedPrefixExtractor(6))
+	file, _ := os.Open(path)
+	reader, err := openTable(file, nil, MakeFixedPrefixExtractor(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.close()
+	if !reader.prefixMayMatch([]byte("key100zzz")) {
+		t.Error("Prefix filter lose prefix key100.")
+	}
+	if reader.prefixMayMatch([]byte("abc999")) {
+		t.Error("Prefix filter match absent prefix.")
+	}
+	file, _ = os.Open(path)
+	other, err := openTable(file, nil, MakeFixedPrefixExtractor(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.close()
+	if other.prefixPolicy != nil {
+		t.Error("Prefix filter of another extractor must be ignored.")
+	}
+}
+
+func TestOpenTableCorruption(t *testing.T) {
+	path := buildTestTable(t, 100, nil)
+	data, _ := os.ReadFile(path)
+	data[10] ^= 0xFF
+	os.WriteFile(path, data, 0644)
+	file, _ := os.Open(path)
+	defer file.Close()
+	reader, err := openTable(file, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = reader.readBlock(reader.index[0].value); err == nil {
+		t.Error("Block checksum mismatch is not found.")
+	}
+}
@@ -0,0 +1,526 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Values of at least Options.ValueLogThreshold bytes are separated from their
+// keys when a memory table is flushed,the way WiscKey do.They are appended to a
+// new value log and the SSTable save an entry of typeValuePointer instead,so
+// compaction only rewrite the small pointers.
+// record layout: checksum(4 bytes) | key len(varint) | key | value
+// pointer layout: file number(8 bytes) | offset(8 bytes) | record size(4 bytes)
+// Every SSTable save the bytes it point to in each value log in the meta block
+// named valueLogBlockName.A value log no SSTable point to is removed.A value log
+// whose garbage reach the discard ratio is collected:the SSTables which point to
+// it are rewritten at their level with its live values moved into a new value
+// log.Level0 tables are ordered by file number and are never rewritten,a value
+// log they point to is collected once level0 is compacted.
+
+const (
+	valuePointerSize  = 20
+	valueLogBlockName = "zpaperdb.ValueLogs"
+)
+
+var errNoValueLog = errors.New("vlog: no value log")
+
+type valuePointer struct {
+	fileNum uint64
+	offset  int64
+	size    uint32
+}
+
+func (p valuePointer) encode() []byte {
+	data := make([]byte, valuePointerSize)
+	binary.LittleEndian.PutUint64(data, p.fileNum)
+	binary.LittleEndian.PutUint64(data[8:], uint64(p.offset))
+	binary.LittleEndian.PutUint32(data[16:], p.size)
+	return data
+}
+
+func decodeValuePointer(data []byte) (valuePointer, error) {
+	if len(data) != valuePointerSize {
+		return valuePointer{}, errors.New("vlog: bad value pointer")
+	}
+	return valuePointer{
+		fileNum: binary.LittleEndian.Uint64(data),
+		offset:  int64(binary.LittleEndian.Uint64(data[8:])),
+		size:    binary.LittleEndian.Uint32(data[16:]),
+	}, nil
+}
+
+// valueLog is shared by the column families,it keep the value logs open for reads.
+type valueLog struct {
+	mu    sync.Mutex
+	dir   string
+	files map[uint64]*os.File
+}
+
+type valueLogWriter struct {
+	num    uint64
+	file   *os.File
+	buf    *bufio.Writer
+	offset int64
+}
+
+func makeValueLog(dir string) *valueLog {
+	return &valueLog{dir: dir, files: make(map[uint64]*os.File)}
+}
+
+func (vl *valueLog) fileName(num uint64) string {
+	return filepath.Join(vl.dir, "vlog"+strconv.FormatUint(num, 10))
+}
+
+func (vl *valueLog) open(num uint64) (*os.File, error) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	if file := vl.files[num]; file != nil {
+		return file, nil
+	}
+	file, err := os.Open(vl.fileName(num))
+	if err != nil {
+		return nil, err
+	}
+	vl.files[num] = file
+	return file, nil
+}
+
+// read return the value the pointer data of key point to.
+func (vl *valueLog) read(key, data []byte) ([]byte, error) {
+	if vl == nil {
+		return nil, errNoValueLog
+	}
+	p, err := decodeValuePointer(data)
+	if err != nil {
+		return nil, err
+	}
+	file, err := vl.open(p.fileNum)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, p.size)
+	if _, err = file.ReadAt(record, p.offset); err != nil {
+		return nil, err
+	}
+	return decodeValueRecord(key, record)
+}
+
+func encodeValueRecord(key, value []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(key)))
+	record := make([]byte, 4, 4+n+len(key)+len(value))
+	record = append(record, tmp[:n]...)
+	record = append(record, key...)
+	record = append(record, value...)
+	binary.LittleEndian.PutUint32(record, getCRC32(record[4:]))
+	return record
+}
+
+func decodeValueRecord(key, record []byte) ([]byte, error) {
+	if len(record) < 4 || getCRC32(record[4:]) != binary.LittleEndian.Uint32(record) {
+		return nil, errors.New("vlog: record checksum mismatch")
+	}
+	recordKey, value, ok := readLengthPrefixed(record[4:])
+	if !ok || !bytes.Equal(recordKey, key) {
+		return nil, errors.New("vlog: record of another key")
+	}
+	return value, nil
+}
+
+func (vl *valueLog) create(num uint64) (*valueLogWriter, error) {
+	file, err := os.Create(vl.fileName(num))
+	if err != nil {
+		return nil, err
+	}
+	return &valueLogWriter{num: num, file: file, buf: bufio.NewWriter(file)}, nil
+}
+
+// add append the value of key and return its pointer.
+func (w *valueLogWriter) add(key, value []byte) ([]byte, error) {
+	record := encodeValueRecord(key, value)
+	if _, err := w.buf.Write(record); err != nil {
+		return nil, err
+	}
+	p := valuePointer{fileNum: w.num, offset: w.offset, size: uint32(len(record))}
+	w.offset += int64(len(record))
+	return p.encode(), nil
+}
+
+// sync make the values added durable before a SSTable point to them.
+func (w *valueLogWriter) sync() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+func (w *valueLogWriter) close() error {
+	err := w.sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (vl *valueLog) remove(num uint64) error {
+	vl.mu.Lock()
+	if file := vl.files[num]; file != nil {
+		file.Close()
+		delete(vl.files, num)
+	}
+	vl.mu.Unlock()
+	return os.Remove(vl.fileName(num))
+}
+
+func (vl *valueLog) close() {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	for num, file := range vl.files {
+		file.Close()
+		delete(vl.files, num)
+	}
+}
+
+// valueLogRefs return the bytes data point to in each value log.
+func valueLogRefs(data []pairs) map[uint64]int64 {
+	var refs map[uint64]int64
+	for i := range data {
+		if _, keyType := data[i].trailer(); keyType != typeValuePointer {
+			continue
+		}
+		p, err := decodeValuePointer(data[i].value)
+		if err != nil {
+			continue
+		}
+		if refs == nil {
+			refs = make(map[uint64]int64)
+		}
+		refs[p.fileNum] += int64(p.size)
+	}
+	return refs
+}
+
+func encodeValueLogRefs(refs map[uint64]int64) []byte {
+	nums := make([]uint64, 0, len(refs))
+	for num := range refs {
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	keys := make([][]byte, len(nums))
+	values := make([][]byte, len(nums))
+	for i, num := range nums {
+		keys[i] = encodeUint64(num)
+		values[i] = encodeUint64(uint64(refs[num]))
+	}
+	return encodeBlockContent(keys, values, nil)
+}
+
+func decodeValueLogRefs(content []byte) (map[uint64]int64, error) {
+	keys, values, err := decodeBlockContent(content)
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[uint64]int64, len(keys))
+	for i := range keys {
+		if len(keys[i]) != 8 || len(values[i]) != 8 {
+			return nil, errors.New("vlog: bad value log block")
+		}
+		refs[decodeUint64(keys[i])] = int64(decodeUint64(values[i]))
+	}
+	return refs, nil
+}
+
+// separateValues move the values of at least ValueLogThreshold bytes out of data
+// into a new value log,it return data with their pointers and the value log
+// number,0 if nothing is moved.
+func (lsm *LSMTree) separateValues(data []pairs) ([]pairs, uint64, error) {
+	threshold := lsm.opts.ValueLogThreshold
+	if threshold <= 0 {
+		return data, 0, nil
+	}
+	var w *valueLogWriter
+	var separated []pairs
+	for i := range data {
+		seq, keyType := data[i].trailer()
+		if keyType != typeValue || len(data[i].value) < threshold {
+			continue
+		}
+		if w == nil {
+			num := lsm.newValueLogNum()
+			var err error
+			if w, err = lsm.values.create(num); err != nil {
+				lsm.discardValueLog(num)
+				return nil, 0, err
+			}
+			separated = append([]pairs(nil), data...)
+		}
+		pointer, err := w.add(data[i].userKey(), data[i].value)
+		if err != nil {
+			w.close()
+			lsm.discardValueLog(w.num)
+			return nil, 0, err
+		}
+		separated[i].setEntry(data[i].userKey(), pointer, seq, typeValuePointer)
+	}
+	if w == nil {
+		return data, 0, nil
+	}
+	if err := w.close(); err != nil {
+		lsm.discardValueLog(w.num)
+		return nil, 0, err
+	}
+	return separated, w.num, nil
+}
+
+// flushTable write a memory table into the level0 SSTable fileNum with its large
+// values separated.
+func (lsm *LSMTree) flushTable(fileNum uint64, data []pairs, rangeDels []rangeTombstone) (*fileMeta, error) {
+	data, valueLogNum, err := lsm.separateValues(data)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := lsm.writeTable(fileNum, data, rangeDels, ioHigh)
+	if err != nil && valueLogNum != 0 {
+		lsm.discardValueLog(valueLogNum)
+	}
+	return meta, err
+}
+
+// newValueLogNum return the number of a new value log,which is pending until an
+// installed SSTable point to it.
+func (lsm *LSMTree) newValueLogNum() uint64 {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	num := lsm.newFileNum()
+	lsm.pendingValueLogs[num] = true
+	return num
+}
+
+// installValueLogs must be called with lsm.mu held once meta is in a level,the
+// value logs it point to are no longer pending.
+func (lsm *LSMTree) installValueLogs(meta *fileMeta) {
+	for num := range meta.table.valueLogs {
+		delete(lsm.pendingValueLogs, num)
+	}
+}
+
+// discardValueLog remove a pending value log which is not used.
+func (lsm *LSMTree) discardValueLog(num uint64) {
+	lsm.values.remove(num)
+	lsm.mu.Lock()
+	delete(lsm.pendingValueLogs, num)
+	lsm.mu.Unlock()
+}
+
+// liveValueLogs return the bytes the SSTables of every column family point to
+// in each value log,it must be called with lsm.mu held.
+func (lsm *LSMTree) liveValueLogs() map[uint64]int64 {
+	live := make(map[uint64]int64)
+	for _, family := range lsm.families {
+		for _, files := range family.levels {
+			for _, meta := range files {
+				for num, size := range meta.table.valueLogs {
+					live[num] += size
+				}
+			}
+		}
+	}
+	return live
+}
+
+// removeObsoleteValueLogs remove the value logs no SSTable point to,the pending
+// ones and those created after the check are kept for the flushes running meanwhile.
+// The value logs of removed tables which reads still use are kept too.
+func (lsm *LSMTree) removeObsoleteValueLogs() error {
+	lsm.mu.Lock()
+	live := lsm.liveValueLogs()
+	for meta := range lsm.removedTables {
+		for num, size := range meta.table.valueLogs {
+			live[num] += size
+		}
+	}
+	pending := make(map[uint64]bool, len(lsm.pendingValueLogs))
+	for num := range lsm.pendingValueLogs {
+		pending[num] = true
+	}
+	nextFileNum := lsm.nextFileNum
+	lsm.mu.Unlock()
+	nums, err := numberedFiles(lsm.dir, "vlog")
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		if _, ok := live[num]; ok || pending[num] || num >= nextFileNum {
+			continue
+		}
+		if err = lsm.values.remove(num); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GarbageCollectValueLog collect the value logs of every column family whose
+// garbage is at least discardRatio of their size.
+func (lsm *LSMTree) GarbageCollectValueLog(discardRatio float64) error {
+	if discardRatio <= 0 || discardRatio > 1 {
+		return errors.New("vlog: discard ratio must be in (0,1]")
+	}
+	lsm.bgMu.RLock()
+	defer lsm.bgMu.RUnlock()
+	lsm.mu.Lock()
+	if err := lsm.checkWritable(); err != nil {
+		lsm.mu.Unlock()
+		return err
+	}
+	families := lsm.columnFamilies()
+	lsm.mu.Unlock()
+	for _, family := range families {
+		family.compactMu.Lock()
+		err := family.collectValueLogs(discardRatio)
+		family.compactMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectValueLogs rewrite the SSTables of the column family which point to a
+// value log whose garbage reach discardRatio,it must be called with lsm.compactMu held.
+func (lsm *LSMTree) collectValueLogs(discardRatio float64) error {
+	defer lsm.deliverEvents()
+	lsm.mu.Lock()
+	if err := lsm.checkWritable(); err != nil {
+		lsm.mu.Unlock()
+		return err
+	}
+	if lsm.dropped {
+		lsm.mu.Unlock()
+		return nil
+	}
+	live := lsm.liveValueLogs()
+	pinned := make(map[uint64]bool)
+	for _, family := range lsm.families {
+		for _, meta := range family.levels[0] {
+			for num := range meta.table.valueLogs {
+				pinned[num] = true
+			}
+		}
+	}
+	levels := make([][]*fileMeta, len(lsm.levels))
+	copy(levels, lsm.levels)
+	lsm.mu.Unlock()
+	victims := make(map[uint64]bool)
+	for num, size := range live {
+		if pinned[num] {
+			continue
+		}
+		info, err := os.Stat(lsm.values.fileName(num))
+		if err != nil {
+			return err
+		}
+		if info.Size() > 0 && 1-float64(size)/float64(info.Size()) >= discardRatio {
+			victims[num] = true
+		}
+	}
+	if len(victims) == 0 {
+		return nil
+	}
+	var w *valueLogWriter
+	defer func() {
+		if w != nil {
+			w.close()
+			lsm.mu.Lock()
+			delete(lsm.pendingValueLogs, w.num)
+			lsm.mu.Unlock()
+		}
+	}()
+	for level := 1; level < len(levels); level++ {
+		for _, meta := range levels[level] {
+			pointToVictim := false
+			for num := range meta.table.valueLogs {
+				pointToVictim = pointToVictim || victims[num]
+			}
+			if !pointToVictim {
+				continue
+			}
+			data, err := meta.table.readAll()
+			if err != nil {
+				return err
+			}
+			for i := range data {
+				seq, keyType := data[i].trailer()
+				if keyType != typeValuePointer {
+					continue
+				}
+				p, err := decodeValuePointer(data[i].value)
+				if err != nil {
+					return err
+				}
+				if !victims[p.fileNum] {
+					continue
+				}
+				userKey := data[i].userKey()
+				value, err := lsm.values.read(userKey, data[i].value)
+				if err != nil {
+					return err
+				}
+				if w == nil {
+					num := lsm.newValueLogNum()
+					if w, err = lsm.values.create(num); err != nil {
+						lsm.discardValueLog(num)
+						return err
+					}
+				}
+				pointer, err := w.add(userKey, value)
+				if err != nil {
+					return err
+				}
+				data[i].setEntry(userKey, pointer, seq, typeValuePointer)
+			}
+			if w != nil {
+				if err = w.sync(); err != nil {
+					return err
+				}
+			}
+			outputs, err := lsm.writeCompactionOutput(data, meta.table.rangeDels)
+			if err != nil {
+				return err
+			}
+			if err = lsm.replaceFile(level, meta, outputs); err != nil {
+				return err
+			}
+			lsm.notifyTablesCreated(outputs, level, ReasonValueLogGC)
+			lsm.removeTables([]*fileMeta{meta}, level, ReasonValueLogGC)
+		}
+	}
+	return lsm.removeObsoleteValueLogs()
+}
+
+// replaceFile install outputs instead of the file old of level and save the MANIFEST.
+func (lsm *LSMTree) replaceFile(level int, old *fileMeta, outputs []*fileMeta) error {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	files := make([]*fileMeta, 0, len(lsm.levels[level])+len(outputs))
+	for _, meta := range lsm.levels[level] {
+		if meta != old {
+			files = append(files, meta)
+		}
+	}
+	files = append(files, outputs...)
+	sort.Slice(files, func(i, j int) bool {
+		return bytes.Compare(files[i].smallest, files[j].smallest) < 0
+	})
+	lsm.levels[level] = files
+	lsm.versionChanged()
+	return lsm.saveManifest()
+}
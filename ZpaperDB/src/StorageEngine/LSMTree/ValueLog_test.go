@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func makeValueLogTestLSMTree(t *testing.T, dir string, opts *Options) *LSMTree {
+	var lsmTree *LSMTree
+	lsmTree, err := lsmTree.initLSMTree(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lsmTree.open(dir); err != nil {
+		t.Fatal(err)
+	}
+	return lsmTree
+}
+
+func largeValue(i int, gen string) []byte {
+	return bytes.Repeat(append([]byte(gen), testKey(i)...), 16)
+}
+
+func putLargeValues(t *testing.T, lsmTree *LSMTree, from, to int, gen string) {
+	for i := from; i < to; i++ {
+		batch := new(WriteBatch)
+		batch.Put(testKey(i), largeValue(i, gen))
+		if err := lsmTree.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkLargeValues(t *testing.T, lsmTree *LSMTree, from, to int, gen string) {
+	for i := from; i < to; i++ {
+		value, err := lsmTree.Get(testKey(i))
+		if err != nil || !bytes.Equal(value, largeValue(i, gen)) {
+			t.Fatalf("key %d value %q,want generation %s %v", i, value, gen, err)
+		}
+	}
+}
+
+func flushAndCompact(t *testing.T, lsmTree *LSMTree) {
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.maybeCompact(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func valueLogNums(t *testing.T, lsmTree *LSMTree) []uint64 {
+	nums, err := numberedFiles(lsmTree.dir, "vlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nums
+}
+
+func TestValueLogSeparation(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree := makeValueLogTestLSMTree(t, dir, &Options{ValueLogThreshold: 64})
+	putLargeValues(t, lsmTree, 0, 20, "a")
+	putKeys(t, lsmTree, 100, 110)
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if nums := valueLogNums(t, lsmTree); len(nums) != 1 {
+		t.Fatalf("Value logs %v after flush,want one", nums)
+	}
+	data, err := lsmTree.levels[0][0].table.readAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pointers := 0
+	for i := range data {
+		if _, keyType := data[i].trailer(); keyType == typeValuePointer {
+			pointers++
+		}
+	}
+	if pointers != 20 {
+		t.Fatalf("SSTable save %d value pointers,want 20", pointers)
+	}
+	checkLargeValues(t, lsmTree, 0, 20, "a")
+	checkFound(t, lsmTree, 105, true)
+	it := lsmTree.NewIterator()
+	it.Seek(testKey(3))
+	if !it.Valid() || !bytes.Equal(it.Value(), largeValue(3, "a")) {
+		t.Fatal("Iterator does not read the value log.", it.Error())
+	}
+	if err = lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsmTree = makeValueLogTestLSMTree(t, dir, nil)
+	defer lsmTree.Close()
+	checkLargeValues(t, lsmTree, 0, 20, "a")
+}
+
+func TestValueLogGC(t *testing.T) {
+	lsmTree := makeValueLogTestLSMTree(t, t.TempDir(), &Options{ValueLogThreshold: 64, MaxFileOfOneLevel: 1})
+	putLargeValues(t, lsmTree, 0, 40, "a")
+	flushAndCompact(t, lsmTree)
+	putLargeValues(t, lsmTree, 0, 20, "b")
+	flushAndCompact(t, lsmTree)
+	if len(lsmTree.levels[0]) != 0 || len(valueLogNums(t, lsmTree)) != 2 {
+		t.Fatal("Overwritten values are not compacted into level1.")
+	}
+	// the first value log is half garbage
+	if err := lsmTree.GarbageCollectValueLog(0.6); err != nil {
+		t.Fatal(err)
+	}
+	first := valueLogNums(t, lsmTree)[0]
+	if err := lsmTree.GarbageCollectValueLog(0.4); err != nil {
+		t.Fatal(err)
+	}
+	nums := valueLogNums(t, lsmTree)
+	if len(nums) != 2 || nums[0] == first {
+		t.Fatalf("Value logs %v after gc,the first one %d must be collected", nums, first)
+	}
+	checkLargeValues(t, lsmTree, 0, 20, "b")
+	checkLargeValues(t, lsmTree, 20, 40, "a")
+	// a value log no SSTable point to is removed
+	batch := new(WriteBatch)
+	batch.DeleteRange(testKey(0), testKey(20))
+	if err := lsmTree.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	flushAndCompact(t, lsmTree)
+	if nums = valueLogNums(t, lsmTree); len(nums) != 1 {
+		t.Fatalf("Value logs %v,the deleted values must be removed", nums)
+	}
+	checkLargeValues(t, lsmTree, 20, 40, "a")
+	checkFound(t, lsmTree, 5, false)
+}
+
+func TestValueLogMerge(t *testing.T) {
+	lsmTree := makeValueLogTestLSMTree(t, t.TempDir(), &Options{
+		ValueLogThreshold: 64,
+		MaxFileOfOneLevel: 1,
+		MergeOperator:     MakeStringAppendOperator(','),
+	})
+	putLargeValues(t, lsmTree, 0, 1, "a")
+	if err := lsmTree.minorCompaction(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmTree.Merge(testKey(0), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	want := string(largeValue(0, "a")) + ",x"
+	checkString(t, lsmTree, testKey(0), want)
+	flushAndCompact(t, lsmTree)
+	checkString(t, lsmTree, testKey(0), want)
+}
+
+func TestValueRecordCorruption(t *testing.T) {
+	record := encodeValueRecord([]byte("k"), []byte("value"))
+	if value, err := decodeValueRecord([]byte("k"), record); err != nil || string(value) != "value" {
+		t.Fatal("Value record round trip failed.", err)
+	}
+	if _, err := decodeValueRecord([]byte("other"), record); err == nil {
+		t.Fatal("Value record of another key is accepted.")
+	}
+	record[len(record)-1] ^= 0xff
+	if _, err := decodeValueRecord([]byte("k"), record); err == nil {
+		t.Fatal("Corrupted value record is accepted.")
+	}
+	if _, err := decodeValuePointer(make([]byte, 8)); err == nil {
+		t.Fatal("Short value pointer is accepted.")
+	}
+}
@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// Every write of LSMTree is a batch,the batch is appended to the write ahead log
+// as one record before it is inserted into the memory table.
+// record layout: checksum(4 bytes) | length(4 bytes) | batch
+// batch layout: sequence(8 bytes) | count(4 bytes) | time(8 bytes) | operations
+// operation layout: keyType(1 byte) | key len(varint) | key | value len(varint) | value
+// An operation of a column family other than the default one set familyFlag in
+// its keyType and save the family id(varint) after it.
+// time is the UnixNano of the write,a merge is folded in the memory table
+// against it so the replay of the log give the same value as the write.
+
+const (
+	logHeaderSize   = 8
+	batchHeaderSize = 20
+	familyFlag      = 0x80
+)
+
+// WriteBatch apply several operations atomically,its zero value is an empty batch.
+type WriteBatch struct {
+	seq   uint64
+	count uint32
+	time  int64 // set by LSMTree.write
+	data  []byte
+}
+
+var errRecordChecksum = errors.New("wal: record checksum mismatch")
+
+type logWriter struct {
+	file *os.File
+	num  uint64
+	sync bool  // fsync after every record
+	size int64 // end of the last record written whole
+}
+
+type logReader struct {
+	reader    *bufio.Reader
+	remaining int64 // bytes of the file not read yet
+	err       error
+}
+
+func (b *WriteBatch) Put(key, value []byte) {
+	b.add(typeValue, key, value)
+}
+
+func (b *WriteBatch) PutCF(cf *ColumnFamilyHandle, key, value []byte) {
+	b.addFamily(cf.id, typeValue, key, value)
+}
+
+// PutWithExpiry write key which is visible until expireAt.
+func (b *WriteBatch) PutWithExpiry(key, value []byte, expireAt time.Time) {
+	b.add(typeValueTTL, key, encodeTTLValue(value, expireAt))
+}
+
+// Merge write operand of key,it is applied on the value by the merge operator.
+func (b *WriteBatch) Merge(key, operand []byte) {
+	b.add(typeMerge, key, operand)
+}
+
+func (b *WriteBatch) MergeCF(cf *ColumnFamilyHandle, key, operand []byte) {
+	b.addFamily(cf.id, typeMerge, key, operand)
+}
+
+func (b *WriteBatch) Delete(key []byte) {
+	b.add(typeDeletion, key, nil)
+}
+
+func (b *WriteBatch) DeleteCF(cf *ColumnFamilyHandle, key []byte) {
+	b.addFamily(cf.id, typeDeletion, key, nil)
+}
+
+// DeleteRange delete every key in [start,end),start is saved as key and end as value.
+func (b *WriteBatch) DeleteRange(start, end []byte) {
+	b.add(typeRangeDeletion, start, end)
+}
+
+func (b *WriteBatch) DeleteRangeCF(cf *ColumnFamilyHandle, start, end []byte) {
+	b.addFamily(cf.id, typeRangeDeletion, start, end)
+}
+
+func (b *WriteBatch) Count() int {
+	return int(b.count)
+}
+
+func (b *WriteBatch) Reset() {
+	b.seq = 0
+	b.count = 0
+	b.time = 0
+	b.data = b.data[:0]
+}
+
+func (b *WriteBatch) add(keyType byte, key, value []byte) {
+	b.addFamily(0, keyType, key, value)
+}
+
+func (b *WriteBatch) addFamily(id uint32, keyType byte, key, value []byte) {
+	var tmp [binary.MaxVarintLen64]byte
+	if id == 0 {
+		b.data = append(b.data, keyType)
+	} else {
+		b.data = append(b.data, keyType|familyFlag)
+		n := binary.PutUvarint(tmp[:], uint64(id))
+		b.data = append(b.data, tmp[:n]...)
+	}
+	n := binary.PutUvarint(tmp[:], uint64(len(key)))
+	b.data = append(b.data, tmp[:n]...)
+	b.data = append(b.data, key...)
+	n = binary.PutUvarint(tmp[:], uint64(len(value)))
+	b.data = append(b.data, tmp[:n]...)
+	b.data = append(b.data, value...)
+	b.count++
+}
+
+func (b *WriteBatch) encode() []byte {
+	data := make([]byte, batchHeaderSize, batchHeaderSize+len(b.data))
+	binary.LittleEndian.PutUint64(data, b.seq)
+	binary.LittleEndian.PutUint32(data[8:], b.count)
+	binary.LittleEndian.PutUint64(data[12:], uint64(b.time))
+	return append(data, b.data...)
+}
+
+func decodeWriteBatch(data []byte) (*WriteBatch, error) {
+	if len(data) < batchHeaderSize {
+		return nil, errors.New("wal: batch too short")
+	}
+	b := new(WriteBatch)
+	b.seq = binary.LittleEndian.Uint64(data)
+	b.count = binary.LittleEndian.Uint32(data[8:])
+	b.time = int64(binary.LittleEndian.Uint64(data[12:]))
+	b.data = data[batchHeaderSize:]
+	return b, nil
+}
+
+// iterate call fn with the column family of every operation of the batch and
+// its sequence number.
+func (b *WriteBatch) iterate(fn func(family uint32, keyType byte, key, value []byte, seq uint64) error) error {
+	data := b.data
+	seq := b.seq
+	var num uint32
+	for len(data) > 0 {
+		keyType := data[0]
+		data = data[1:]
+		var family uint32
+		if keyType&familyFlag != 0 {
+			id, n := binary.Uvarint(data)
+			if n <= 0 || id > math.MaxUint32 {
+				return errors.New("wal: bad column family")
+			}
+			keyType &^= familyFlag
+			family = uint32(id)
+			data = data[n:]
+		}
+		key, rest, ok := readLengthPrefixed(data)
+		if !ok {
+			return errors.New("wal: bad batch operation")
+		}
+		value, rest, ok := readLengthPrefixed(rest)
+		if !ok {
+			return errors.New("wal: bad batch operation")
+		}
+		if err := fn(family, keyType, key, value, seq); err != nil {
+			return err
+		}
+		data = rest
+		seq++
+		num++
+	}
+	if num != b.count {
+		return errors.New("wal: batch count mismatch")
+	}
+	return nil
+}
+
+func readLengthPrefixed(data []byte) ([]byte, []byte, bool) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < length {
+		return nil, nil, false
+	}
+	return data[n : n+int(length)], data[n+int(length):], true
+}
+
+// insertInto insert every operation into the memory table tables return for its
+// column family,the operation is skipped if it return nil.A merge is folded
+// against the time of the batch.
+func (b *WriteBatch) insertInto(tables func(family uint32) *memTable) error {
+	return b.iterate(func(family uint32, keyType byte, key, value []byte, seq uint64) error {
+		mt := tables(family)
+		if mt == nil {
+			return nil
+		}
+		return mt.add(keyType, key, value, seq, b.time)
+	})
+}
+
+func (lsm *LSMTree) newLogWriter() (*logWriter, error) {
+	num := lsm.newFileNum()
+	file, err := os.Create(lsm.logFileName(num))
+	if err != nil {
+		return nil, err
+	}
+	info := lsm.walInfo(num)
+	lsm.queueEvent(func(listener EventListener) {
+		listener.OnWALCreated(info)
+	})
+	return &logWriter{file: file, num: num, sync: lsm.dbOpts.Sync}, nil
+}
+
+func (w *logWriter) addRecord(data []byte) error {
+	record := make([]byte, logHeaderSize, logHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(record, getCRC32(data))
+	binary.LittleEndian.PutUint32(record[4:], uint32(len(data)))
+	if _, err := w.file.Write(append(record, data...)); err != nil {
+		return err
+	}
+	if w.sync {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+	}
+	w.size += int64(len(record) + len(data))
+	return nil
+}
+
+func (w *logWriter) close() error {
+	return w.file.Close()
+}
+
+// makeLogReader read the records of file from its start.
+func makeLogReader(file *os.File) *logReader {
+	r := &logReader{reader: bufio.NewReader(file)}
+	info, err := file.Stat()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	r.remaining = info.Size()
+	return r
+}
+
+// readRecord return io.EOF at the end of the log,a record cut short by a crash
+// at the tail is treated as the end of the log too.A record whose checksum
+// mismatch return errRecordChecksum.
+func (r *logReader) readRecord() ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	header := make([]byte, logHeaderSize)
+	_, err := io.ReadFull(r.reader, header)
+	if err == io.ErrUnexpectedEOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.remaining -= logHeaderSize
+	// a length beyond the file is a torn or damaged header,it is not allocated
+	length := int64(binary.LittleEndian.Uint32(header[4:]))
+	if length > r.remaining {
+		return nil, io.EOF
+	}
+	r.remaining -= length
+	data := make([]byte, length)
+	_, err = io.ReadFull(r.reader, data)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if getCRC32(data) != binary.LittleEndian.Uint32(header) {
+		return nil, errRecordChecksum
+	}
+	return data, nil
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	batch := new(WriteBatch)
+	batch.Put([]byte("a"), []byte("1"))
+	batch.Delete([]byte("b"))
+	batch.DeleteRange([]byte("c"), []byte("d"))
+	batch.MergeCF(&ColumnFamilyHandle{id: 300}, []byte("e"), []byte("2"))
+	batch.seq = 10
+	decoded, err := decodeWriteBatch(batch.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantType := []byte{typeValue, typeDeletion, typeRangeDeletion, typeMerge}
+	wantFamily := []uint32{0, 0, 0, 300}
+	var num int
+	err = decoded.iterate(func(family uint32, keyType byte, key, value []byte, seq uint64) error {
+		if keyType != wantType[num] || family != wantFamily[num] || seq != uint64(10+num) {
+			t.Error("Batch operation error.")
+		}
+		num++
+		return nil
+	})
+	if err != nil || num != 4 {
+		t.Fatal("Batch iterate error.", err)
+	}
+}
+
+func TestLogRecord(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "WAL1")
+	file, _ := os.Create(name)
+	writer := &logWriter{file: file, num: 1}
+	records := [][]byte{[]byte("first"), bytes.Repeat([]byte("x"), 10000), {}}
+	for _, record := range records {
+		if err := writer.addRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.file.Write([]byte{1, 2, 3})
+	writer.close()
+	file, _ = os.Open(name)
+	defer file.Close()
+	reader := makeLogReader(file)
+	for _, record := range records {
+		data, err := reader.readRecord()
+		if err != nil || !bytes.Equal(data, record) {
+			t.Fatal("Log record error.", err)
+		}
+	}
+	if _, err := reader.readRecord(); err != io.EOF {
+		t.Fatal("Torn record at the tail must be io.EOF.", err)
+	}
+}
+
+func TestLogRecordLength(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "WAL1")
+	file, _ := os.Create(name)
+	writer := &logWriter{file: file, num: 1}
+	if err := writer.addRecord([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	// a damaged header claiming about 4GB
+	writer.file.Write([]byte{0, 0, 0, 0, 0xf0, 0xff, 0xff, 0xff, 1, 2, 3})
+	writer.close()
+	file, _ = os.Open(name)
+	defer file.Close()
+	reader := makeLogReader(file)
+	if data, err := reader.readRecord(); err != nil || string(data) != "first" {
+		t.Fatal("Log record error.", err)
+	}
+	if _, err := reader.readRecord(); err != io.EOF {
+		t.Fatal("Record longer than the file must be io.EOF.", err)
+	}
+}
+
+func TestTornLogReopen(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		damage  func(data []byte) []byte
+		lastKey int // the last key recovered,-1 if the open fail
+	}{
+		{"truncated", func(data []byte) []byte { return data[:len(data)-3] }, 8},
+		{"last record damaged", func(data []byte) []byte { data[len(data)-1] ^= 0xff; return data }, 8},
+		{"first record damaged", func(data []byte) []byte { data[logHeaderSize] ^= 0xff; return data }, -1},
+	} {
+		dir := t.TempDir()
+		lsmTree, err := OpenLSMTree(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		putKeys(t, lsmTree, 0, 10)
+		name := lsmTree.logFileName(lsmTree.writeAheadLog.num)
+		if err = lsmTree.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(name, c.damage(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		lsmTree, err = OpenLSMTree(dir, nil)
+		if c.lastKey < 0 {
+			if err == nil {
+				lsmTree.Close()
+				t.Fatalf("%s: log is replayed.", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		checkFound(t, lsmTree, c.lastKey, true)
+		checkFound(t, lsmTree, c.lastKey+1, false)
+		lsmTree.Close()
+	}
+}
+
+func TestSyncWrite(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree, err := OpenLSMTree(dir, &Options{Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lsmTree.writeAheadLog.sync {
+		t.Fatal("Write ahead log is not synced with Options.Sync.")
+	}
+	putKeys(t, lsmTree, 0, 10)
+	if err = lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsmTree, err = OpenLSMTree(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmTree.Close()
+	for i := 0; i < 10; i++ {
+		checkFound(t, lsmTree, i, true)
+	}
+}
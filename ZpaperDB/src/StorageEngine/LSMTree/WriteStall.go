@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"time"
+)
+
+// Writes are delayed when level0 has Level0SlowdownWritesTrigger files or the
+// pending compaction bytes reach the soft limit,every write sleep slowdownDelay
+// once.Writes are stopped until compaction catch up when level0 has
+// Level0StopWritesTrigger files or the pending bytes reach the hard limit.
+
+const (
+	slowdownDelay = time.Millisecond
+
+	stallNormal  = 0
+	stallDelayed = 1
+	stallStopped = 2
+)
+
+type WriteStallStats struct {
+	State         string // normal,delayed or stopped
+	DelayedWrites uint64
+	StoppedWrites uint64
+	DelayedTime   time.Duration
+	StoppedTime   time.Duration
+}
+
+type writeStall struct {
+	state         int
+	delayedWrites uint64
+	stoppedWrites uint64
+	delayedTime   time.Duration
+	stoppedTime   time.Duration
+}
+
+func stallStateName(state int) string {
+	switch state {
+	case stallDelayed:
+		return "delayed"
+	case stallStopped:
+		return "stopped"
+	}
+	return "normal"
+}
+
+// pendingCompactionBytes estimate the bytes compaction must rewrite to catch up
+// by the compaction picker,it must be called with lsm.mu held.
+func (lsm *LSMTree) pendingCompactionBytes() int64 {
+	return lsm.picker.pendingCompactionBytes(lsm.currentVersion())
+}
+
+// stallCondition must be called with lsm.mu held,the column family in the
+// worst state decide it.
+func (lsm *LSMTree) stallCondition() int {
+	state := stallNormal
+	for _, family := range lsm.families {
+		if familyState := family.familyStallCondition(); familyState > state {
+			state = familyState
+		}
+	}
+	return state
+}
+
+func (lsm *LSMTree) familyStallCondition() int {
+	v := lsm.currentVersion()
+	level0 := lsm.picker.stallFileNum(v)
+	pending := lsm.picker.pendingCompactionBytes(v)
+	if level0 >= lsm.opts.Level0StopWritesTrigger || pending >= lsm.opts.HardPendingCompactionBytesLimit {
+		return stallStopped
+	}
+	if level0 >= lsm.opts.Level0SlowdownWritesTrigger || pending >= lsm.opts.SoftPendingCompactionBytesLimit {
+		return stallDelayed
+	}
+	return stallNormal
+}
+
+// makeRoomForWrite delay or block the write by the stall condition and wait for
+// the flush of the immutable table if a memory table is fulled.It must be
+// called with lsm.mu held and may release it while waiting.
+func (lsm *LSMTree) makeRoomForWrite() error {
+	delayed, stopped := false, false
+	for {
+		if err := lsm.checkWritable(); err != nil {
+			return err
+		}
+		state := lsm.stallCondition()
+		lsm.setStallState(state)
+		switch {
+		case len(lsm.events) > 0:
+			// the listeners hear of the stall before the write wait
+			lsm.mu.Unlock()
+			lsm.deliverEvents()
+			lsm.mu.Lock()
+		case state == stallStopped || lsm.waitingFlush():
+			if !stopped {
+				lsm.stall.stoppedWrites++
+				stopped = true
+			}
+			lsm.maybeScheduleCompaction()
+			start := time.Now()
+			lsm.bgCond.Wait()
+			lsm.stall.stoppedTime += time.Since(start)
+		case state == stallDelayed && !delayed:
+			lsm.stall.delayedWrites++
+			lsm.maybeScheduleCompaction()
+			lsm.mu.Unlock()
+			time.Sleep(slowdownDelay)
+			lsm.mu.Lock()
+			lsm.stall.delayedTime += slowdownDelay
+			delayed = true
+		default:
+			for _, family := range lsm.families {
+				if err := family.maybeRotate(); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// waitingFlush report whether a column family has a fulled memory table while
+// its immutable table is not flushed yet,it must be called with lsm.mu held.
+func (lsm *LSMTree) waitingFlush() bool {
+	for _, family := range lsm.families {
+		if family.table.fulled && family.imm != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// versionChanged must be called with lsm.mu held after the files of the levels
+// change,it refresh the stall state and the auto tuned rate limit and wake the
+// stopped writes.
+func (lsm *LSMTree) versionChanged() {
+	lsm.setStallState(lsm.stallCondition())
+	if lsm.rateLimiter != nil {
+		var pending int64
+		for _, family := range lsm.families {
+			pending += family.pendingCompactionBytes()
+		}
+		lsm.rateLimiter.setPendingBytes(pending, lsm.dbOpts.SoftPendingCompactionBytesLimit)
+	}
+	lsm.bgCond.Broadcast()
+}
+
+func (lsm *LSMTree) WriteStallStats() WriteStallStats {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	return WriteStallStats{
+		State:         stallStateName(lsm.stall.state),
+		DelayedWrites: lsm.stall.delayedWrites,
+		StoppedWrites: lsm.stall.stoppedWrites,
+		DelayedTime:   lsm.stall.delayedTime,
+		StoppedTime:   lsm.stall.stoppedTime,
+	}
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func makeStallTestLSMTree(t *testing.T) *LSMTree {
+	var lsmTree *LSMTree
+	lsmTree, err := lsmTree.initLSMTree(&Options{
+		MaxFileOfOneLevel:           100,
+		Level0SlowdownWritesTrigger: 2,
+		Level0StopWritesTrigger:     3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lsmTree.open(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	return lsmTree
+}
+
+func TestWriteSlowdown(t *testing.T) {
+	lsmTree := makeStallTestLSMTree(t)
+	for i := 0; i < 2; i++ {
+		putKeys(t, lsmTree, i*10, i*10+10)
+		if err := lsmTree.minorCompaction(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putKeys(t, lsmTree, 100, 110)
+	stats := lsmTree.WriteStallStats()
+	if stats.State != "delayed" || stats.DelayedWrites != 10 || stats.DelayedTime < 10*slowdownDelay {
+		t.Fatalf("Write stall stats error: %+v", stats)
+	}
+	if stats.StoppedWrites != 0 {
+		t.Fatal("Writes are stopped under the stop trigger.")
+	}
+}
+
+func TestWriteStop(t *testing.T) {
+	lsmTree := makeStallTestLSMTree(t)
+	for i := 0; i < 3; i++ {
+		putKeys(t, lsmTree, i*10, i*10+10)
+		if err := lsmTree.minorCompaction(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan error)
+	go func() {
+		done <- lsmTree.RBAdd(&AddArgs{Key: testKey(100), Value: testKey(100)}, new(AddReply))
+	}()
+	select {
+	case <-done:
+		t.Fatal("Write is not stopped at the stop trigger.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if stats := lsmTree.WriteStallStats(); stats.State != "stopped" {
+		t.Fatal("Write stall state error.", stats.State)
+	}
+	lsmTree.mu.Lock()
+	lsmTree.maxFileNum = 3
+	lsmTree.mu.Unlock()
+	if err := lsmTree.maybeCompact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	stats := lsmTree.WriteStallStats()
+	if stats.State != "normal" || stats.StoppedWrites == 0 || stats.StoppedTime < 50*time.Millisecond {
+		t.Fatalf("Write stall stats error: %+v", stats)
+	}
+	checkFound(t, lsmTree, 100, true)
+}
+
+func TestWriteStopClose(t *testing.T) {
+	lsmTree := makeStallTestLSMTree(t)
+	for i := 0; i < 3; i++ {
+		putKeys(t, lsmTree, i*10, i*10+10)
+		if err := lsmTree.minorCompaction(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan error)
+	go func() {
+		done <- lsmTree.RBAdd(&AddArgs{Key: testKey(100), Value: testKey(100)}, new(AddReply))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	lsmTree.Close()
+	if err := <-done; err != ErrClosed {
+		t.Fatal("Stopped write must return ErrClosed after Close.", err)
+	}
+}
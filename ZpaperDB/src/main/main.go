@@ -1,8 +1,494 @@
 package main
 
-import "fmt"
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	btree "src/StorageEngine/B+Tree"
+	"src/zpaperdb"
+)
+
+const usage = `usage: zpaperdb <command> [arguments]
+
+A path is the directory of a LSMTree database or a B+Tree data file,a file is
+taken for a B+Tree one if its first page decode as a B+Tree node,its keys are
+one byte.Writing a B+Tree file is out of scope:put,delete and compact only take
+a LSMTree database,the B+Tree Insert does not keep the keys it is given yet.
+
+commands:
+  get [-cf name] <path> <key>                   print the value of key
+  put [-cf name] <dir> <key> <value>            write key
+  delete [-cf name] <dir> <key>                 delete key
+  scan [-cf name] [-from key] [-to key] [-limit n] <path>
+                                                print the keys in [from,to)
+  dump-sst <file>                               print the footer,index,filters and entries of a SSTable
+  dump-wal <file>                               print the operations of a write ahead log
+  manifest <dir>                                print the levels and the key ranges of the files
+  compact [-cf name] <dir>                      compact every SSTable of the column family
+  stats [-cf name] <path>                       print the levels and the counters
+  verify <path>                                 check every block and record checksum
+  repair <dir>                                  rebuild the database in dir after its MANIFEST or files are damaged
+`
+
+// errUsage is returned for a wrong number of arguments,the usage is printed.
+var errUsage = errors.New("wrong number of arguments")
 
 func main() {
-	fmt.Println(1)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "get":
+		err = get(args)
+	case "put":
+		err = put(args)
+	case "delete":
+		err = del(args)
+	case "scan":
+		err = scan(args)
+	case "dump-sst":
+		err = dumpSST(args)
+	case "dump-wal":
+		err = dumpWAL(args)
+	case "manifest":
+		err = manifest(args)
+	case "compact":
+		err = compact(args)
+	case "stats":
+		err = stats(args)
+	case "verify":
+		err = verify(args)
+	case "repair":
+		err = repair(args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err == errUsage {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "zpaperdb:", err)
+		os.Exit(1)
+	}
+}
+
+// parse parse the flags of the command name and check it is left with n
+// arguments,otherwise it print the usage and return errUsage.
+func parse(flags *flag.FlagSet, args []string, n int, names string) ([]string, error) {
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: zpaperdb %s [flags] %s\n", flags.Name(), names)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() != n {
+		flags.Usage()
+		return nil, errUsage
+	}
+	return flags.Args(), nil
+}
+
+// isBTreeDataFile return true if path is a file whose first page is a B+Tree
+// node,a LSMTree database is a directory.
+func isBTreeDataFile(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if info.IsDir() {
+		return false, nil
+	}
+	return btree.IsDataFile(path)
+}
+
+func openDB(dir string, readOnly bool) (*zpaperdb.DB, error) {
+	opts := zpaperdb.DefaultOptions()
+	opts.ReadOnly = readOnly
+	return zpaperdb.Open(dir, opts)
+}
+
+// columnFamily return the default column family if name is empty.
+func columnFamily(db *zpaperdb.DB, name string) (*zpaperdb.ColumnFamilyHandle, error) {
+	if name == "" {
+		return db.DefaultColumnFamily(), nil
+	}
+	cf := db.ColumnFamily(name)
+	if cf == nil {
+		return nil, zpaperdb.ErrColumnFamilyNotFound
+	}
+	return cf, nil
+}
+
+// printable return b as a string if it is printable text,otherwise in hex.
+func printable(b []byte) string {
+	if utf8.Valid(b) && strings.IndexFunc(string(b), func(r rune) bool { return !unicode.IsPrint(r) }) < 0 {
+		return string(b)
+	}
+	return "0x" + hex.EncodeToString(b)
+}
+
+func btreeKey(key string) (byte, error) {
+	if len(key) != 1 {
+		return 0, errors.New("a B+Tree key is one byte")
+	}
+	return key[0], nil
+}
+
+func get(args []string) error {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	cfName := flags.String("cf", "", "column family")
+	args, err := parse(flags, args, 2, "<path> <key>")
+	if err != nil {
+		return err
+	}
+	isBTree, err := isBTreeDataFile(args[0])
+	if err != nil {
+		return err
+	}
+	if isBTree {
+		key, err := btreeKey(args[1])
+		if err != nil {
+			return err
+		}
+		pages, err := btree.ReadDataPages(args[0])
+		if err != nil {
+			return err
+		}
+		for _, page := range pages {
+			if i := bytes.IndexByte(page.Keys, key); i >= 0 {
+				fmt.Println(page.Values[i])
+				return nil
+			}
+		}
+		return errors.New("get: " + args[1] + " is not found")
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	cf, err := columnFamily(db, *cfName)
+	if err != nil {
+		return err
+	}
+	value, err := db.GetCF(cf, []byte(args[1]))
+	if err == zpaperdb.ErrNotFound {
+		return errors.New("get: " + args[1] + " is not found")
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(printable(value))
+	return nil
+}
+
+// writeDB open the database dir for a write.Writing a B+Tree file is not
+// supported,its Insert overwrite the keys of a page instead of adding them.
+func writeDB(command, dir string, cfName string, fn func(db *zpaperdb.DB, cf *zpaperdb.ColumnFamilyHandle) error) error {
+	if isBTree, err := isBTreeDataFile(dir); err == nil && isBTree {
+		return errors.New(command + ": writing a B+Tree data file is not supported,it is read only")
+	}
+	db, err := openDB(dir, false)
+	if err != nil {
+		return err
+	}
+	cf, err := columnFamily(db, cfName)
+	if err == nil {
+		err = fn(db, cf)
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func put(args []string) error {
+	flags := flag.NewFlagSet("put", flag.ExitOnError)
+	cfName := flags.String("cf", "", "column family")
+	args, err := parse(flags, args, 3, "<dir> <key> <value>")
+	if err != nil {
+		return err
+	}
+	return writeDB("put", args[0], *cfName, func(db *zpaperdb.DB, cf *zpaperdb.ColumnFamilyHandle) error {
+		return db.PutCF(cf, []byte(args[1]), []byte(args[2]))
+	})
+}
+
+func del(args []string) error {
+	flags := flag.NewFlagSet("delete", flag.ExitOnError)
+	cfName := flags.String("cf", "", "column family")
+	args, err := parse(flags, args, 2, "<dir> <key>")
+	if err != nil {
+		return err
+	}
+	return writeDB("delete", args[0], *cfName, func(db *zpaperdb.DB, cf *zpaperdb.ColumnFamilyHandle) error {
+		return db.DeleteCF(cf, []byte(args[1]))
+	})
+}
+
+func compact(args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	cfName := flags.String("cf", "", "column family")
+	args, err := parse(flags, args, 1, "<dir>")
+	if err != nil {
+		return err
+	}
+	return writeDB("compact", args[0], *cfName, func(db *zpaperdb.DB, cf *zpaperdb.ColumnFamilyHandle) error {
+		return db.CompactRangeCF(cf, nil, nil)
+	})
+}
+
+func scan(args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	cfName := flags.String("cf", "", "column family")
+	from := flags.String("from", "", "first key,the first key of the path if empty")
+	to := flags.String("to", "", "end key which is not printed,unbounded if empty")
+	limit := flags.Int("limit", 0, "most keys printed,unlimited if 0")
+	args, err := parse(flags, args, 1, "<path>")
+	if err != nil {
+		return err
+	}
+	n := 0
+	// print return false once the key is out of the range or the limit is reached
+	print := func(key []byte, value string) bool {
+		if *to != "" && string(key) >= *to || *limit > 0 && n >= *limit {
+			return false
+		}
+		fmt.Printf("%s: %s\n", printable(key), value)
+		n++
+		return true
+	}
+	isBTree, err := isBTreeDataFile(args[0])
+	if err != nil {
+		return err
+	}
+	if isBTree {
+		pages, err := btree.ReadDataPages(args[0])
+		if err != nil {
+			return err
+		}
+		for _, page := range pages {
+			for i, key := range page.Keys {
+				if string(key) < *from {
+					continue
+				}
+				if !print([]byte{key}, page.Values[i]) {
+					return nil
+				}
+			}
+		}
+		return nil
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	cf, err := columnFamily(db, *cfName)
+	if err != nil {
+		return err
+	}
+	it := db.NewIteratorCF(cf)
+	defer it.Close()
+	if *from != "" {
+		it.Seek([]byte(*from))
+	} else {
+		it.SeekToFirst()
+	}
+	for ; it.Valid() && print(it.Key(), printable(it.Value())); it.Next() {
+	}
+	return it.Error()
+}
+
+func printEntry(e zpaperdb.DumpEntry) error {
+	switch e.Type {
+	case "deletion":
+		fmt.Printf("seq %d %s %s\n", e.Seq, e.Type, printable(e.Key))
+	case "range deletion":
+		fmt.Printf("seq %d %s [%s,%s)\n", e.Seq, e.Type, printable(e.Key), printable(e.Value))
+	default:
+		fmt.Printf("seq %d %s %s: %s\n", e.Seq, e.Type, printable(e.Key), printable(e.Value))
+	}
+	return nil
+}
+
+func dumpSST(args []string) error {
+	if len(args) != 1 {
+		return errors.New("dump-sst: take one SSTable")
+	}
+	dump, err := zpaperdb.DumpTable(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d bytes\n", filepath.Base(args[0]), dump.Size)
+	fmt.Printf("footer: meta index at %d,%d bytes;index at %d,%d bytes\n",
+		dump.MetaIndex.Offset, dump.MetaIndex.Size, dump.Index.Offset, dump.Index.Size)
+	fmt.Printf("index: %d data blocks\n", len(dump.DataBlocks))
+	for _, block := range dump.DataBlocks {
+		fmt.Printf("  at %d,%d bytes,first key %s\n", block.Offset, block.Size, printable([]byte(block.Name)))
+	}
+	fmt.Printf("meta blocks: %d\n", len(dump.MetaBlocks))
+	for _, block := range dump.MetaBlocks {
+		fmt.Printf("  %s at %d,%d bytes\n", block.Name, block.Offset, block.Size)
+	}
+	fmt.Println("entries:")
+	return zpaperdb.ScanTable(args[0], printEntry)
+}
+
+func dumpWAL(args []string) error {
+	if len(args) != 1 {
+		return errors.New("dump-wal: take one write ahead log")
+	}
+	return zpaperdb.ScanLog(args[0], func(e zpaperdb.DumpEntry) error {
+		fmt.Printf("cf %d ", e.ColumnFamily)
+		return printEntry(e)
+	})
+}
+
+func manifest(args []string) error {
+	if len(args) != 1 {
+		return errors.New("manifest: take one directory")
+	}
+	m, err := zpaperdb.DumpManifest(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("next file %d,last sequence %d,next column family %d\n", m.NextFileNum, m.LastSeq, m.NextFamilyID)
+	for _, family := range m.ColumnFamilies {
+		fmt.Printf("column family %s(%d),logs before WAL%d are flushed\n", family.Name, family.ID, family.LogNum)
+		for _, f := range family.Files {
+			fmt.Printf("  level %d ssTable%d: %d bytes [%s,%s]", f.Level, f.FileNum, f.Size, printable(f.Smallest), printable(f.Largest))
+			if f.GlobalSeq != 0 {
+				fmt.Printf(" global sequence %d", f.GlobalSeq)
+			}
+			fmt.Println()
+		}
+	}
+	return nil
+}
+
+func stats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	cfName := flags.String("cf", "", "column family")
+	args, err := parse(flags, args, 1, "<path>")
+	if err != nil {
+		return err
+	}
+	isBTree, err := isBTreeDataFile(args[0])
+	if err != nil {
+		return err
+	}
+	if isBTree {
+		pages, err := btree.ReadDataPages(args[0])
+		if err != nil {
+			return err
+		}
+		keys := 0
+		for _, page := range pages {
+			keys += len(page.Keys)
+		}
+		fmt.Printf("B+Tree data file: %d data pages,%d keys\n", len(pages), keys)
+		return nil
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	cf, err := columnFamily(db, *cfName)
+	if err != nil {
+		return err
+	}
+	value, err := db.GetPropertyCF(cf, "zpaperdb.stats")
+	if err != nil {
+		return err
+	}
+	fmt.Print(value)
+	return nil
+}
+
+func verify(args []string) error {
+	if len(args) != 1 {
+		return errors.New("verify: take one path")
+	}
+	info, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		// a single file of the database is checked by its name
+		name := filepath.Base(args[0])
+		switch {
+		case strings.HasPrefix(name, "ssTable"):
+			err = zpaperdb.VerifyTable(args[0])
+		case strings.HasPrefix(name, "WAL") || name == "MANIFEST":
+			err = zpaperdb.VerifyLog(args[0])
+		default:
+			isBTree, err := isBTreeDataFile(args[0])
+			if err != nil {
+				return err
+			}
+			if !isBTree {
+				return errors.New("verify: " + name + " is not a SSTable,write ahead log,MANIFEST or B+Tree data file")
+			}
+			// the B+Tree pages have no checksum,they are checked by decoding
+			pages, err := btree.ReadDataPages(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s: %d data pages decoded\n", name, len(pages))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(name + ": ok")
+		return nil
+	}
+	results, err := zpaperdb.VerifyDB(args[0])
+	if err != nil {
+		return err
+	}
+	damaged := 0
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Printf("%s: %v\n", r.File, r.Err)
+			damaged++
+		} else {
+			fmt.Println(r.File + ": ok")
+		}
+	}
+	if damaged != 0 {
+		return errors.New("verify: " + strconv.Itoa(damaged) + " damaged files")
+	}
+	return nil
+}
 
+func repair(args []string) error {
+	if len(args) != 1 {
+		return errors.New("repair: take one directory")
+	}
+	info, err := zpaperdb.RepairDB(args[0], nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("salvaged %d tables and %d logs,%d entries,last sequence %d\n", info.Tables, info.Logs, info.Entries, info.LastSeq)
+	for _, name := range info.Lost {
+		fmt.Println("moved into lost:", name)
+	}
+	return nil
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"src/zpaperdb"
+)
+
+// capture return what fn print to the standard output.
+func capture(t *testing.T, fn func() error) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- data
+	}()
+	stdout := os.Stdout
+	os.Stdout = w
+	err = fn()
+	os.Stdout = stdout
+	w.Close()
+	data := <-out
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct {
+		args   []string
+		n      int
+		cf     string
+		want   []string
+		errUse bool
+	}{
+		{args: []string{"dir", "key"}, n: 2, want: []string{"dir", "key"}},
+		{args: []string{"-cf", "users", "dir", "key"}, n: 2, cf: "users", want: []string{"dir", "key"}},
+		{args: []string{"-cf=users", "dir"}, n: 1, cf: "users", want: []string{"dir"}},
+		{args: []string{"dir"}, n: 2, errUse: true},
+		{args: []string{"dir", "key", "value"}, n: 2, errUse: true},
+		{args: []string{"-cf", "users"}, n: 1, errUse: true},
+	} {
+		flags := flag.NewFlagSet("get", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		cfName := flags.String("cf", "", "column family")
+		args, err := parse(flags, c.args, c.n, "<path> <key>")
+		if c.errUse {
+			if err != errUsage {
+				t.Fatalf("parse %v = %v,want errUsage", c.args, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(args, c.want) || *cfName != c.cf {
+			t.Fatalf("parse %v = %v,cf %q,%v", c.args, args, *cfName, err)
+		}
+	}
+}
+
+func TestCommandOutput(t *testing.T) {
+	dir := t.TempDir()
+	db, err := zpaperdb.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("b"), []byte("2"))
+	db.Delete([]byte("b"))
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	glob := func(pattern string) []string {
+		names, _ := filepath.Glob(filepath.Join(dir, pattern))
+		if len(names) != 1 {
+			t.Fatalf("%d files match %s,want 1", len(names), pattern)
+		}
+		return names
+	}
+	// the cases run in order on the same database,args is evaluated before fn
+	for _, c := range []struct {
+		name string
+		fn   func(args []string) error
+		args func() []string
+		want []string
+	}{
+		{"dump-wal", dumpWAL, func() []string { return glob("WAL*") }, []string{
+			"cf 0 seq 1 value a: 1\n", "cf 0 seq 2 value b: 2\n", "cf 0 seq 3 deletion b\n"}},
+		{"compact", compact, func() []string { return []string{dir} }, nil},
+		{"dump-sst", dumpSST, func() []string { return glob("ssTable*") }, []string{
+			"index: 1 data blocks\n", "fullfilter.zpaperdb.BuiltinBloomFilter", "entries:\nseq 1 value a: 1\n"}},
+		{"manifest", manifest, func() []string { return []string{dir} }, []string{
+			"last sequence 3", "column family default(0)", "level 1 ssTable", "[a,a]"}},
+		{"get", get, func() []string { return []string{dir, "a"} }, []string{"1\n"}},
+		{"scan", scan, func() []string { return []string{dir} }, []string{"a: 1\n"}},
+		{"verify", verify, func() []string { return []string{dir} }, []string{": ok\n"}},
+		{"repair", repair, func() []string { return []string{dir} }, []string{
+			"salvaged 1 tables and 0 logs,1 entries,last sequence 3\n"}},
+	} {
+		args := c.args()
+		out := capture(t, func() error { return c.fn(args) })
+		for _, want := range c.want {
+			if !strings.Contains(out, want) {
+				t.Fatalf("%s print %q,want %q in it", c.name, out, want)
+			}
+		}
+	}
+}
+
+func TestWrongArgumentNumber(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		fn   func(args []string) error
+		args []string
+	}{
+		{"get", get, []string{"dir"}},
+		{"put", put, []string{"dir", "key"}},
+		{"scan", scan, nil},
+		{"dump-sst", dumpSST, nil},
+		{"repair", repair, []string{"a", "b"}},
+	} {
+		if err := c.fn(c.args); err == nil {
+			t.Fatalf("%s %v is accepted.", c.name, c.args)
+		}
+	}
+}
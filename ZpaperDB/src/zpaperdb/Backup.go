@@ -0,0 +1,48 @@
+package zpaperdb
+
+import (
+	storage "src/StorageEngine/LSMTree"
+)
+
+type BackupInfo = storage.BackupInfo
+
+// BackupEngine keep incremental backups of DBs in a directory,a backup copy
+// only the SSTables the earlier backups do not have.
+type BackupEngine struct {
+	be *storage.BackupEngine
+}
+
+func OpenBackupEngine(dir string) (*BackupEngine, error) {
+	be, err := storage.OpenBackupEngine(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &BackupEngine{be: be}, nil
+}
+
+// CreateNewBackup back up db while it keep taking writes.
+func (be *BackupEngine) CreateNewBackup(db *DB) (BackupInfo, error) {
+	return be.be.CreateNewBackup(db.lsm)
+}
+
+func (be *BackupEngine) GetBackupInfo() ([]BackupInfo, error) {
+	return be.be.GetBackupInfo()
+}
+
+// RestoreDBFromBackup write the DB of the backup id into dir,which must not hold a DB.
+func (be *BackupEngine) RestoreDBFromBackup(id uint32, dir string) error {
+	return be.be.RestoreDBFromBackup(id, dir)
+}
+
+func (be *BackupEngine) RestoreDBFromLatestBackup(dir string) error {
+	return be.be.RestoreDBFromLatestBackup(dir)
+}
+
+func (be *BackupEngine) DeleteBackup(id uint32) error {
+	return be.be.DeleteBackup(id)
+}
+
+// PurgeOldBackups delete the oldest backups until keep are left.
+func (be *BackupEngine) PurgeOldBackups(keep int) error {
+	return be.be.PurgeOldBackups(keep)
+}
@@ -0,0 +1,43 @@
+package zpaperdb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupEngine(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	be, err := OpenBackupEngine(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := be.CreateNewBackup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "restored")
+	if err = be.RestoreDBFromBackup(info.ID, dir); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if value, err := restored.Get([]byte("a")); err != nil || string(value) != "1" {
+		t.Fatalf("Restored value %q %v", value, err)
+	}
+	if _, err = restored.Get([]byte("b")); err != ErrNotFound {
+		t.Fatal("Write after the backup is restored.", err)
+	}
+}
@@ -0,0 +1,307 @@
+// Package zpaperdb is the public interface of the ZpaperDB LSMTree storage engine.
+//
+//	db, err := zpaperdb.Open("data", nil)
+//	err = db.Put([]byte("key"), []byte("value"))
+//	value, err := db.Get([]byte("key"))
+//	err = db.Close()
+package zpaperdb
+
+import (
+	storage "src/StorageEngine/LSMTree"
+	"time"
+)
+
+// Options hold the settings of the database and the keys of lsm.ini,see
+// storage.Options.
+type Options = storage.Options
+
+// WriteBatch apply several Put,Merge,Delete and DeleteRange atomically,the
+// operations may span column families.
+type WriteBatch = storage.WriteBatch
+
+type WriteStallStats = storage.WriteStallStats
+
+// Stats count the flushes,compactions and reads of a column family,see storage.Stats.
+type Stats = storage.Stats
+
+type LevelStats = storage.LevelStats
+
+// Clock decide whether the keys written by PutWithTTL are expired,see Options.Clock.
+type Clock = storage.Clock
+
+// MergeOperator apply the operands written by Merge,see Options.MergeOperator.
+type MergeOperator = storage.MergeOperator
+
+// CompactionFilter may remove or change values during compaction,see
+// Options.CompactionFilter.
+type CompactionFilter = storage.CompactionFilter
+
+type CompactionDecision = storage.CompactionDecision
+
+const (
+	CompactionKeep   = storage.CompactionKeep
+	CompactionRemove = storage.CompactionRemove
+	CompactionChange = storage.CompactionChange
+)
+
+// EventListener is told of the background jobs,file changes and write stalls,
+// see Options.EventListener.Embed NopEventListener to implement some callbacks.
+type EventListener = storage.EventListener
+
+type NopEventListener = storage.NopEventListener
+
+type (
+	FlushInfo           = storage.FlushInfo
+	CompactionInfo      = storage.CompactionInfo
+	TableFileInfo       = storage.TableFileInfo
+	WALInfo             = storage.WALInfo
+	WriteStallInfo      = storage.WriteStallInfo
+	BackgroundErrorInfo = storage.BackgroundErrorInfo
+)
+
+const (
+	ReasonFlush            = storage.ReasonFlush
+	ReasonCompaction       = storage.ReasonCompaction
+	ReasonValueLogGC       = storage.ReasonValueLogGC
+	ReasonDropColumnFamily = storage.ReasonDropColumnFamily
+	ReasonWriteAheadLog    = storage.ReasonWriteAheadLog
+	ReasonIngest           = storage.ReasonIngest
+)
+
+// ColumnFamilyHandle name a column family,every family is a keyspace of its own
+// memory tables,SSTables and options sharing the write ahead log of the DB.
+type ColumnFamilyHandle = storage.ColumnFamilyHandle
+
+// SSTWriter write a SSTable from keys in increasing order for IngestExternalFile.
+type SSTWriter = storage.SSTWriter
+
+// MakeSSTWriter return a writer of the SSTable path,a nil opts use DefaultOptions.
+func MakeSSTWriter(path string, opts *Options) (*SSTWriter, error) {
+	return storage.MakeSSTWriter(path, opts)
+}
+
+// Iterator iterate a snapshot of the visible keys in order,Close it to release
+// the SSTables it pinned.
+type Iterator = storage.DBIterator
+
+var (
+	ErrNotFound = storage.ErrNotFound
+	ErrClosed   = storage.ErrClosed
+	ErrLocked   = storage.ErrLocked
+	ErrReadOnly = storage.ErrReadOnly
+
+	ErrColumnFamilyNotFound = storage.ErrColumnFamilyNotFound
+)
+
+const DefaultColumnFamilyName = storage.DefaultColumnFamilyName
+
+type DB struct {
+	lsm *storage.LSMTree
+}
+
+func DefaultOptions() *Options {
+	return storage.DefaultOptions()
+}
+
+// UInt64AddOperator add little endian uint64 operands to the value,like a counter.
+func UInt64AddOperator() MergeOperator {
+	return storage.MakeUInt64AddOperator()
+}
+
+// StringAppendOperator append operands to the value separated by delimiter.
+func StringAppendOperator(delimiter byte) MergeOperator {
+	return storage.MakeStringAppendOperator(delimiter)
+}
+
+// Open open the database saved in dir,a new one is created if dir is empty.
+// A nil opts use DefaultOptions.The directory is locked until Close,Open return
+// ErrLocked if another handle hold it.
+func Open(dir string, opts *Options) (*DB, error) {
+	lsm, err := storage.OpenLSMTree(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{lsm: lsm}, nil
+}
+
+// OpenColumnFamilies open dir like Open,familyOpts give the options of the
+// column families saved in dir by name,a family missing from it use opts.
+func OpenColumnFamilies(dir string, opts *Options, familyOpts map[string]*Options) (*DB, error) {
+	lsm, err := storage.OpenColumnFamilies(dir, opts, familyOpts)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{lsm: lsm}, nil
+}
+
+// RepairInfo tell what RepairDB salvaged.
+type RepairInfo = storage.RepairInfo
+
+// RepairDB rebuild the DB in dir after its MANIFEST or files are damaged,the
+// files which can not be read fully are moved into dir/lost.The DB must be
+// closed.
+func RepairDB(dir string, opts *Options) (RepairInfo, error) {
+	return storage.RepairDB(dir, opts)
+}
+
+func (db *DB) Put(key, value []byte) error {
+	batch := new(WriteBatch)
+	batch.Put(key, value)
+	return db.lsm.Write(batch)
+}
+
+// PutWithTTL write key which is visible for ttl,Get return ErrNotFound after it
+// is expired.
+func (db *DB) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return db.lsm.PutWithTTL(key, value, ttl)
+}
+
+// Get return ErrNotFound if key is absent,deleted or expired.
+func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.lsm.Get(key)
+}
+
+// Merge write operand of key without reading it,Options.MergeOperator apply it
+// on the value when the key is read.
+func (db *DB) Merge(key, operand []byte) error {
+	return db.lsm.Merge(key, operand)
+}
+
+func (db *DB) Delete(key []byte) error {
+	batch := new(WriteBatch)
+	batch.Delete(key)
+	return db.lsm.Write(batch)
+}
+
+// DeleteRange delete every key in [start,end).
+func (db *DB) DeleteRange(start, end []byte) error {
+	return db.lsm.DeleteRange(start, end)
+}
+
+func (db *DB) Write(batch *WriteBatch) error {
+	return db.lsm.Write(batch)
+}
+
+func (db *DB) NewIterator() *Iterator {
+	return db.lsm.NewIterator()
+}
+
+func (db *DB) Close() error {
+	return db.lsm.Close()
+}
+
+// GarbageCollectValueLog move the live values out of the value logs whose
+// garbage is at least discardRatio of their size and remove them,see
+// Options.ValueLogThreshold.
+func (db *DB) GarbageCollectValueLog(discardRatio float64) error {
+	return db.lsm.GarbageCollectValueLog(discardRatio)
+}
+
+// CompactRange compact every SSTable overlapping [start,end] and return once
+// it is done,nil start or end means unbounded.
+func (db *DB) CompactRange(start, end []byte) error {
+	return db.lsm.CompactRange(start, end)
+}
+
+// Checkpoint write a copy of the DB which open as a DB of its own into dir,the
+// SSTables are hard linked.
+func (db *DB) Checkpoint(dir string) error {
+	return db.lsm.Checkpoint(dir)
+}
+
+// IngestExternalFile add the SSTables of SSTWriter to the DB without writing
+// their keys again,their keys are newer than every write before.
+func (db *DB) IngestExternalFile(paths []string) error {
+	return db.lsm.IngestExternalFile(paths)
+}
+
+func (db *DB) IngestExternalFileCF(cf *ColumnFamilyHandle, paths []string) error {
+	return db.lsm.IngestExternalFileCF(cf, paths)
+}
+
+// CreateColumnFamily create the column family name,a nil opts use the options
+// of the DB.
+func (db *DB) CreateColumnFamily(name string, opts *Options) (*ColumnFamilyHandle, error) {
+	return db.lsm.CreateColumnFamily(name, opts)
+}
+
+// DropColumnFamily remove the column family and all its keys,the default one
+// can not be dropped.
+func (db *DB) DropColumnFamily(cf *ColumnFamilyHandle) error {
+	return db.lsm.DropColumnFamily(cf)
+}
+
+func (db *DB) ListColumnFamilies() []string {
+	return db.lsm.ListColumnFamilies()
+}
+
+// ColumnFamily return the handle of the column family name,nil if there is none.
+func (db *DB) ColumnFamily(name string) *ColumnFamilyHandle {
+	return db.lsm.ColumnFamily(name)
+}
+
+func (db *DB) DefaultColumnFamily() *ColumnFamilyHandle {
+	return db.lsm.DefaultColumnFamily()
+}
+
+func (db *DB) PutCF(cf *ColumnFamilyHandle, key, value []byte) error {
+	return db.lsm.PutCF(cf, key, value)
+}
+
+// GetCF return ErrNotFound if key is absent,deleted or expired in the column family.
+func (db *DB) GetCF(cf *ColumnFamilyHandle, key []byte) ([]byte, error) {
+	return db.lsm.GetCF(cf, key)
+}
+
+func (db *DB) DeleteCF(cf *ColumnFamilyHandle, key []byte) error {
+	return db.lsm.DeleteCF(cf, key)
+}
+
+func (db *DB) MergeCF(cf *ColumnFamilyHandle, key, operand []byte) error {
+	return db.lsm.MergeCF(cf, key, operand)
+}
+
+func (db *DB) CompactRangeCF(cf *ColumnFamilyHandle, start, end []byte) error {
+	return db.lsm.CompactRangeCF(cf, start, end)
+}
+
+func (db *DB) NewIteratorCF(cf *ColumnFamilyHandle) *Iterator {
+	return db.lsm.NewIteratorCF(cf)
+}
+
+// Stats return the counters of the default column family and the database.
+func (db *DB) Stats() Stats {
+	return db.lsm.Stats()
+}
+
+func (db *DB) StatsCF(cf *ColumnFamilyHandle) (Stats, error) {
+	return db.lsm.StatsCF(cf)
+}
+
+// GetProperty return a property of the default column family:
+// zpaperdb.num-files-at-level<N>,zpaperdb.stats,zpaperdb.sstables or
+// zpaperdb.approximate-memory-usage.
+func (db *DB) GetProperty(name string) (string, error) {
+	return db.lsm.GetProperty(name)
+}
+
+func (db *DB) GetPropertyCF(cf *ColumnFamilyHandle, name string) (string, error) {
+	return db.lsm.GetPropertyCF(cf, name)
+}
+
+// WriteStallStats report whether writes are delayed or stopped by compaction debt.
+func (db *DB) WriteStallStats() WriteStallStats {
+	return db.lsm.WriteStallStats()
+}
+
+// BackgroundError return the error of a failed flush,compaction or write ahead
+// log write which stopped the writes,nil if the DB is writable.
+func (db *DB) BackgroundError() error {
+	return db.lsm.BackgroundError()
+}
+
+// Resume let the writes go on after a recoverable background error,like a fulled
+// disk,once its cause is fixed.
+func (db *DB) Resume() error {
+	return db.lsm.Resume()
+}
@@ -0,0 +1,395 @@
+package zpaperdb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDB(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, &Options{MemTableType: "skipList"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	batch := new(WriteBatch)
+	batch.Put([]byte("b"), []byte("2"))
+	batch.Put([]byte("c"), []byte("3"))
+	batch.Delete([]byte("a"))
+	if err = db.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Get([]byte("a")); err != ErrNotFound {
+		t.Fatal("Deleted key is found.")
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]byte("d"), nil); err != ErrClosed {
+		t.Fatal("Put after Close must return ErrClosed.", err)
+	}
+	db, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	value, err := db.Get([]byte("c"))
+	if err != nil || !bytes.Equal(value, []byte("3")) {
+		t.Fatal("Value is lost after reopen.", err)
+	}
+	it := db.NewIterator()
+	defer it.Close()
+	var keys []string
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	if len(keys) != 2 || keys[0] != "b" || keys[1] != "c" {
+		t.Fatal("Iterator keys error.", keys)
+	}
+}
+
+type fixedClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fixedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fixedClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestPutWithTTL(t *testing.T) {
+	clock := &fixedClock{now: time.Unix(1000, 0)}
+	db, err := Open(t.TempDir(), &Options{Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.PutWithTTL([]byte("a"), []byte("1"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get([]byte("a")); err != nil || !bytes.Equal(value, []byte("1")) {
+		t.Fatal("Key is not visible before it expire.", err)
+	}
+	clock.advance(time.Hour)
+	if _, err = db.Get([]byte("a")); err != ErrNotFound {
+		t.Fatal("Expired key is found.")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{MergeOperator: StringAppendOperator(',')})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	for _, operand := range []string{"2", "3"} {
+		if err = db.Merge([]byte("a"), []byte(operand)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if value, err := db.Get([]byte("a")); err != nil || string(value) != "1,2,3" {
+		t.Fatalf("Merged value %q,want 1,2,3 %v", value, err)
+	}
+}
+
+func TestColumnFamilies(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := db.CreateColumnFamily("metadata", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := new(WriteBatch)
+	batch.Put([]byte("blob1"), []byte("data"))
+	batch.PutCF(meta, []byte("blob1"), []byte("size=4"))
+	if err = db.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenColumnFamilies(dir, nil, map[string]*Options{"metadata": {MemTableType: "RBTree"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	meta = db.ColumnFamily("metadata")
+	if meta == nil {
+		t.Fatal("Column family is not recovered.", db.ListColumnFamilies())
+	}
+	if value, err := db.GetCF(meta, []byte("blob1")); err != nil || string(value) != "size=4" {
+		t.Fatal("Column family value error.", err)
+	}
+	if value, err := db.Get([]byte("blob1")); err != nil || string(value) != "data" {
+		t.Fatal("Default column family value error.", err)
+	}
+	if err = db.DropColumnFamily(meta); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.GetCF(meta, []byte("blob1")); err != ErrColumnFamilyNotFound {
+		t.Fatal("Dropped column family is read.")
+	}
+}
+
+func TestValueLog(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{ValueLogThreshold: 16}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := []byte("a value larger than the value log threshold")
+	if err = db.Put([]byte("large"), value); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the reopen flush the recovered memory table into a value log
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got, err := db.Get([]byte("large")); err != nil || string(got) != string(value) {
+		t.Fatalf("Separated value %q,want %q %v", got, value, err)
+	}
+	if err = db.GarbageCollectValueLog(0.5); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.GarbageCollectValueLog(0); err == nil {
+		t.Fatal("Zero discard ratio is accepted.")
+	}
+}
+
+type prefixFilter struct{}
+
+func (prefixFilter) Name() string {
+	return "prefix"
+}
+
+func (prefixFilter) Filter(level int, key, value []byte) (CompactionDecision, []byte) {
+	if bytes.HasPrefix(key, []byte("tmp/")) {
+		return CompactionRemove, nil
+	}
+	return CompactionKeep, nil
+}
+
+func TestCompactRange(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{CompactionFilter: prefixFilter{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"a", "tmp/b", "tmp/c"} {
+		if err = db.Put([]byte(key), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Get([]byte("tmp/b")); err != ErrNotFound {
+		t.Fatal("Filtered key is found.", err)
+	}
+	if _, err = db.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if stats := db.Stats(); stats.UserBytesWritten != 2 || stats.MemTableBytes == 0 {
+		t.Fatalf("Stats %+v do not count the write", stats)
+	}
+	cf, err := db.CreateColumnFamily("other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.GetPropertyCF(cf, "zpaperdb.num-files-at-level0"); err != nil || value != "0" {
+		t.Fatalf("New column family has %q level0 files %v", value, err)
+	}
+}
+
+type flushCounter struct {
+	NopEventListener
+	mu      sync.Mutex
+	flushes []FlushInfo
+}
+
+func (c *flushCounter) OnFlushEnd(info FlushInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushes = append(c.flushes, info)
+}
+
+func TestEventListener(t *testing.T) {
+	listener := new(flushCounter)
+	db, err := Open(t.TempDir(), &Options{EventListener: listener})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	if len(listener.flushes) != 1 || listener.flushes[0].ColumnFamily != DefaultColumnFamilyName || listener.flushes[0].Size == 0 {
+		t.Fatalf("Listener hear of flushes %+v", listener.flushes)
+	}
+}
+
+func TestResume(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Resume(); err != nil || db.BackgroundError() != nil {
+		t.Fatal("Writable DB has a background error.", err)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir() + "/checkpoint"
+	if err = db.Checkpoint(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkpoint.Close()
+	if value, err := checkpoint.Get([]byte("a")); err != nil || string(value) != "1" {
+		t.Fatalf("Checkpoint value %q %v", value, err)
+	}
+}
+
+func TestIngestExternalFile(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Put([]byte("b"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	path := t.TempDir() + "/external.sst"
+	w, err := MakeSSTWriter(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err = w.Put([]byte(key), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.IngestExternalFile([]string{path}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != "new" {
+			t.Fatalf("key %s value %q %v", key, value, err)
+		}
+	}
+}
+
+func TestRepairDB(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(dir, "MANIFEST")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = RepairDB(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get([]byte("a")); err != nil || string(value) != "1" {
+		t.Fatalf("Repaired value %q %v", value, err)
+	}
+}
+
+func TestVerifyDB(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := DumpManifest(dir)
+	if err != nil || len(m.ColumnFamilies[0].Files) != 1 {
+		t.Fatalf("MANIFEST %+v %v,want 1 file", m, err)
+	}
+	results, err := VerifyDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("Intact file %s fail the check: %v", r.File, r.Err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package zpaperdb
+
+import (
+	storage "src/StorageEngine/LSMTree"
+)
+
+// The dump functions read the files of a closed DB for tools,see storage.DumpTable.
+
+type (
+	DumpBlock    = storage.DumpBlock
+	TableDump    = storage.TableDump
+	DumpEntry    = storage.DumpEntry
+	ManifestDump = storage.ManifestDump
+	FamilyDump   = storage.FamilyDump
+	FileDump     = storage.FileDump
+	VerifyResult = storage.VerifyResult
+)
+
+// DumpTable return the footer,index and meta blocks of the SSTable path.
+func DumpTable(path string) (*TableDump, error) {
+	return storage.DumpTable(path)
+}
+
+// ScanTable call fn with every entry of the SSTable path,then with its range
+// tombstones.
+func ScanTable(path string, fn func(DumpEntry) error) error {
+	return storage.ScanTable(path, fn)
+}
+
+// ScanLog call fn with every operation of the write ahead log path.
+func ScanLog(path string, fn func(DumpEntry) error) error {
+	return storage.ScanLog(path, fn)
+}
+
+func DumpManifest(dir string) (*ManifestDump, error) {
+	return storage.DumpManifest(dir)
+}
+
+// VerifyDB check the block and record checksums of every file of the DB in dir.
+func VerifyDB(dir string) ([]VerifyResult, error) {
+	return storage.VerifyDB(dir)
+}
+
+// VerifyTable check every block of the SSTable path and the values it keep in
+// the value logs beside it.
+func VerifyTable(path string) error {
+	return storage.VerifyTable(path)
+}
+
+// VerifyLog check every record of the write ahead log or MANIFEST path.
+func VerifyLog(path string) error {
+	return storage.VerifyLog(path)
+}